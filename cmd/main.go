@@ -13,9 +13,13 @@ import (
 
 	"github.com/absmach/mproxy"
 	"github.com/absmach/mproxy/examples/simple"
+	"github.com/absmach/mproxy/pkg/coap"
 	"github.com/absmach/mproxy/pkg/http"
 	"github.com/absmach/mproxy/pkg/mqtt"
 	"github.com/absmach/mproxy/pkg/mqtt/websocket"
+	"github.com/absmach/mproxy/pkg/mqttsn"
+	"github.com/absmach/mproxy/pkg/mux"
+	"github.com/absmach/mproxy/pkg/schema"
 	"github.com/absmach/mproxy/pkg/session"
 	"github.com/caarlos0/env/v11"
 	"github.com/joho/godotenv"
@@ -31,6 +35,14 @@ const (
 	mqttWSWithTLS    = "MPROXY_MQTT_WS_WITH_TLS_"
 	mqttWSWithmTLS   = "MPROXY_MQTT_WS_WITH_MTLS_"
 
+	mqttSN = "MPROXY_MQTT_SN_"
+
+	coapWithoutDTLS = "MPROXY_COAP_"
+	coapTCP         = "MPROXY_COAP_TCP_WITHOUT_TLS_"
+	coapTLS         = "MPROXY_COAP_TCP_WITH_TLS_"
+
+	shared = "MPROXY_MUX_"
+
 	httpWithoutTLS = "MPROXY_HTTP_WITHOUT_TLS_"
 	httpWithTLS    = "MPROXY_HTTP_WITH_TLS_"
 	httpWithmTLS   = "MPROXY_HTTP_WITH_MTLS_"
@@ -45,7 +57,7 @@ func main() {
 	})
 	logger := slog.New(logHandler)
 
-	handler := simple.New(logger)
+	var handler session.Handler = simple.New(logger)
 
 	var interceptor session.Interceptor
 
@@ -55,6 +67,24 @@ func main() {
 		panic(err)
 	}
 
+	// Deadline of the handler hooks of all the proxies
+	handlerConfig, err := session.NewHandlerConfig(env.Options{Prefix: "MPROXY_"})
+	if err != nil {
+		panic(err)
+	}
+	handler = session.WithTimeout(handler, handlerConfig.Timeout)
+
+	// Payload schema validation of the MQTT proxies
+	schemaConfig, err := schema.NewConfig(env.Options{Prefix: "MPROXY_"})
+	if err != nil {
+		panic(err)
+	}
+	if schemaConfig.File != "" {
+		if interceptor, err = schema.Load(schemaConfig); err != nil {
+			panic(err)
+		}
+	}
+
 	// mProxy server Configuration for MQTT without TLS
 	mqttConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWithoutTLS})
 	if err != nil {
@@ -96,9 +126,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	wsOptions, err := websocket.NewConfig(env.Options{Prefix: mqttWSWithoutTLS})
+	if err != nil {
+		panic(err)
+	}
 
 	// mProxy server for MQTT over Websocket without TLS
-	wsProxy := websocket.New(wsConfig, handler, interceptor, logger)
+	wsProxy := websocket.New(wsConfig, wsOptions, handler, interceptor, logger)
 	g.Go(func() error {
 		return wsProxy.Listen(ctx)
 	})
@@ -108,9 +142,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	wsTLSOptions, err := websocket.NewConfig(env.Options{Prefix: mqttWSWithTLS})
+	if err != nil {
+		panic(err)
+	}
 
 	// mProxy server for MQTT over Websocket with TLS
-	wsTLSProxy := websocket.New(wsTLSConfig, handler, interceptor, logger)
+	wsTLSProxy := websocket.New(wsTLSConfig, wsTLSOptions, handler, interceptor, logger)
 	g.Go(func() error {
 		return wsTLSProxy.Listen(ctx)
 	})
@@ -120,21 +158,93 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	wsMTLSOptions, err := websocket.NewConfig(env.Options{Prefix: mqttWSWithmTLS})
+	if err != nil {
+		panic(err)
+	}
 
 	// mProxy server for MQTT over Websocket with mTLS
-	wsMTLSProxy := websocket.New(wsMTLSConfig, handler, interceptor, logger)
+	wsMTLSProxy := websocket.New(wsMTLSConfig, wsMTLSOptions, handler, interceptor, logger)
 	g.Go(func() error {
 		return wsMTLSProxy.Listen(ctx)
 	})
 
+	// mProxy gateway Configuration for MQTT-SN
+	snConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttSN})
+	if err != nil {
+		panic(err)
+	}
+	snGatewayConfig, err := mqttsn.NewConfig(env.Options{Prefix: mqttSN})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy gateway for MQTT-SN
+	snProxy := mqttsn.New(snConfig, snGatewayConfig, handler, interceptor, logger)
+	g.Go(func() error {
+		return snProxy.Listen(ctx)
+	})
+
+	// mProxy server Configuration for CoAP
+	coapConfig, err := mproxy.NewConfig(env.Options{Prefix: coapWithoutDTLS})
+	if err != nil {
+		panic(err)
+	}
+	coapOptions, err := coap.NewConfig(env.Options{Prefix: coapWithoutDTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for CoAP
+	coapProxy := coap.New(coapConfig, coapOptions, handler, logger)
+	g.Go(func() error {
+		return coapProxy.Listen(ctx)
+	})
+
+	// mProxy server Configuration for CoAP over TCP without TLS
+	coapTCPConfig, err := mproxy.NewConfig(env.Options{Prefix: coapTCP})
+	if err != nil {
+		panic(err)
+	}
+	coapTCPOptions, err := coap.NewConfig(env.Options{Prefix: coapTCP})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for CoAP over TCP without TLS
+	coapTCPProxy := coap.NewTCP(coapTCPConfig, coapTCPOptions, handler, logger)
+	g.Go(func() error {
+		return coapTCPProxy.Listen(ctx)
+	})
+
+	// mProxy server Configuration for CoAP over TLS
+	coapTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: coapTLS})
+	if err != nil {
+		panic(err)
+	}
+	coapTLSOptions, err := coap.NewConfig(env.Options{Prefix: coapTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for CoAP over TLS
+	coapTLSProxy := coap.NewTCP(coapTLSConfig, coapTLSOptions, handler, logger)
+	g.Go(func() error {
+		return coapTLSProxy.Listen(ctx)
+	})
+
 	// mProxy server Configuration for HTTP without TLS
 	httpConfig, err := mproxy.NewConfig(env.Options{Prefix: httpWithoutTLS})
 	if err != nil {
 		panic(err)
 	}
+	httpOptions, err := http.NewConfig(env.Options{Prefix: httpWithoutTLS})
+	if err != nil {
+		panic(err)
+	}
 
 	// mProxy server for HTTP without TLS
-	httpProxy, err := http.NewProxy(httpConfig, handler, logger)
+	httpProxy, err := http.NewProxy(httpConfig, httpOptions, handler, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -147,9 +257,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	httpTLSOptions, err := http.NewConfig(env.Options{Prefix: httpWithTLS})
+	if err != nil {
+		panic(err)
+	}
 
 	// mProxy server for HTTP with TLS
-	httpTLSProxy, err := http.NewProxy(httpTLSConfig, handler, logger)
+	httpTLSProxy, err := http.NewProxy(httpTLSConfig, httpTLSOptions, handler, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -162,9 +276,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	httpMTLSOptions, err := http.NewConfig(env.Options{Prefix: httpWithmTLS})
+	if err != nil {
+		panic(err)
+	}
 
 	// mProxy server for HTTP with mTLS
-	httpMTLSProxy, err := http.NewProxy(httpMTLSConfig, handler, logger)
+	httpMTLSProxy, err := http.NewProxy(httpMTLSConfig, httpMTLSOptions, handler, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -172,6 +290,27 @@ func main() {
 		return httpMTLSProxy.Listen(ctx)
 	})
 
+	// mProxy shared server Configuration for MQTT, MQTT over Websocket and HTTP on a single port
+	muxConfig, err := mproxy.NewConfig(env.Options{Prefix: shared})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy shared server routing to the proxies without TLS, its TLS is terminated by the shared server
+	muxServer := mux.New(muxConfig, logger)
+	g.Go(func() error {
+		return muxServer.Listen(ctx)
+	})
+	g.Go(func() error {
+		return mqttProxy.Serve(ctx, muxServer.MQTT())
+	})
+	g.Go(func() error {
+		return wsProxy.Serve(ctx, muxServer.WebSocket())
+	})
+	g.Go(func() error {
+		return httpProxy.Serve(ctx, muxServer.HTTP())
+	})
+
 	g.Go(func() error {
 		return StopSignalHandler(ctx, cancel, logger)
 	})
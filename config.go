@@ -5,16 +5,39 @@ package mproxy
 
 import (
 	"crypto/tls"
+	"errors"
+	"net/netip"
 
+	"github.com/absmach/mproxy/pkg/jwt"
+	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/upstream"
 	"github.com/caarlos0/env/v11"
 )
 
+var errTrustedProxy = errors.New("invalid trusted proxy")
+
 type Config struct {
-	Address    string `env:"ADDRESS"     envDefault:""`
-	PathPrefix string `env:"PATH_PREFIX" envDefault:"/"`
-	Target     string `env:"TARGET"      envDefault:""`
-	TLSConfig  *tls.Config
+	Address        string   `env:"ADDRESS"         envDefault:""`
+	PathPrefix     string   `env:"PATH_PREFIX"     envDefault:"/"`
+	Target         string   `env:"TARGET"          envDefault:""`
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envDefault:""`
+	TLSConfig      *tls.Config
+	// TLSJobs holds the background jobs of TLSConfig, such as the reloading
+	// of its certificates, which the proxies start with their listener.
+	TLSJobs *mptls.Jobs
+	// TargetTLSConfig is used to dial the target over TLS. It is configured
+	// by the same variables as TLSConfig prefixed with TARGET_.
+	TargetTLSConfig *tls.Config
+	// Upstream holds the fallback targets of the MQTT proxies.
+	Upstream upstream.Config
+	// MQTT holds the options of the proxied MQTT connections.
+	MQTT session.Config
+	// JWT verifies the tokens of the HTTP and WebSocket clients before the
+	// handler is called. It is nil unless JWT_JWKS_URL is set.
+	JWT *jwt.Verifier
+	// trustedProxies is parsed from TrustedProxies.
+	trustedProxies []netip.Prefix
 }
 
 func NewConfig(opts env.Options) (Config, error) {
@@ -23,14 +46,47 @@ func NewConfig(opts env.Options) (Config, error) {
 		return Config{}, err
 	}
 
+	trusted, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return Config{}, err
+	}
+	c.trustedProxies = trusted
+
 	cfg, err := mptls.NewConfig(opts)
 	if err != nil {
 		return Config{}, err
 	}
 
-	c.TLSConfig, err = mptls.Load(&cfg)
+	c.TLSConfig, c.TLSJobs, err = mptls.Load(&cfg)
+	if err != nil {
+		return Config{}, err
+	}
+
+	targetOpts := opts
+	targetOpts.Prefix += "TARGET_"
+	targetCfg, err := mptls.NewClientConfig(targetOpts)
+	if err != nil {
+		return Config{}, err
+	}
+	c.TargetTLSConfig, err = mptls.LoadClient(&targetCfg)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.Upstream, err = upstream.NewConfig(opts)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.MQTT, err = session.NewConfig(opts)
+	if err != nil {
+		return Config{}, err
+	}
+
+	jwtCfg, err := jwt.NewConfig(opts)
 	if err != nil {
 		return Config{}, err
 	}
+	c.JWT = jwt.New(jwtCfg)
 	return c, nil
 }
@@ -75,8 +75,15 @@ func (h *Handler) logAction(ctx context.Context, action string, topics *[]string
 	args := []interface{}{
 		slog.Group("session", slog.String("id", s.ID), slog.String("username", s.Username)),
 	}
-	if s.Cert.Subject.CommonName != "" {
-		args = append(args, slog.Group("cert", slog.String("cn", s.Cert.Subject.CommonName)))
+	if s.Identity.Fingerprint != "" {
+		args = append(args, slog.Group("cert",
+			slog.String("cn", s.Identity.CommonName),
+			slog.String("serial", s.Identity.SerialNumber),
+			slog.String("fingerprint", s.Identity.Fingerprint),
+		))
+	}
+	if s.JA4 != "" {
+		args = append(args, slog.Group("tls", slog.String("ja3", s.JA3), slog.String("ja4", s.JA4)))
 	}
 	if topics != nil {
 		args = append(args, slog.Any("topics", *topics))
@@ -0,0 +1,92 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies returns the prefixes of the trusted proxies, given as
+// CIDRs or as IP addresses.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", errTrustedProxy, p)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errTrustedProxy, p)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientIP returns the IP address of the client of an HTTP request. When the
+// request comes from a trusted proxy, the client is the last address of the
+// X-Forwarded-For headers which isn't a trusted proxy, or the X-Real-IP
+// header without X-Forwarded-For. Otherwise it is the remote address.
+func (c Config) ClientIP(r *http.Request) string {
+	remote := remoteHost(r)
+	if !c.trusted(remote) {
+		return remote
+	}
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(h, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(ip))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(forwarded[i]); err != nil {
+			// A malformed address can't be told from a forged one.
+			return remote
+		}
+		if !c.trusted(forwarded[i]) || i == 0 {
+			return forwarded[i]
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		if _, err := netip.ParseAddr(ip); err == nil {
+			return ip
+		}
+	}
+	return remote
+}
+
+// TrustedProxy reports whether an HTTP request comes from a trusted proxy.
+func (c Config) TrustedProxy(r *http.Request) bool {
+	return c.trusted(remoteHost(r))
+}
+
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (c Config) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range c.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -10,8 +10,15 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/joho/godotenv v1.5.1
-	golang.org/x/crypto v0.22.0
-	golang.org/x/sync v0.7.0
+	github.com/miekg/pkcs11 v1.1.2
+	github.com/pion/dtls/v3 v3.0.4
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.30.0
+	golang.org/x/sync v0.8.0
 )
 
-require golang.org/x/net v0.24.0 // indirect
+require (
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/transport/v3 v3.0.7 // indirect
+	golang.org/x/text v0.19.0 // indirect
+)
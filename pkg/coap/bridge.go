@@ -0,0 +1,426 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/upstream"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Codes of the responses of the bridge.
+const (
+	Changed          byte = 0x44
+	Content          byte = 0x45
+	BadRequest       byte = 0x80
+	MethodNotAllowed byte = 0x85
+)
+
+// bridgeTimeout is the timeout of the connection of a bridge to the broker.
+const bridgeTimeout = 10 * time.Second
+
+var (
+	errBroker     = errors.New("MQTT broker refused the CoAP bridge")
+	errBrokerAuth = errors.New("MQTT broker refused the credentials of the CoAP client")
+	errClosed     = errors.New("CoAP relay closed")
+)
+
+// bridge is the MQTT 3.1.1 session of a client, to which its requests on the
+// bridged paths are translated.
+type bridge struct {
+	conn net.Conn
+	once sync.Once
+
+	mu sync.Mutex
+	// msgID is the message ID of the last packet sent to the broker.
+	msgID uint16
+	// pending holds the requests awaiting the acknowledgement of their packet
+	// by the broker, by message ID.
+	pending map[uint16]Message
+	// seq is the Observe value of the last notification.
+	seq uint32
+}
+
+// bridged reports whether the requests on a path are translated to MQTT.
+func (p *Proxy) bridged(path string) bool {
+	for _, prefix := range p.coap.MQTTPaths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// bridgeable reports whether a request on a bridged path has an MQTT
+// translation: the writes are publishes, and the observations subscriptions.
+func bridgeable(m Message) bool {
+	switch m.Code {
+	case PUT, POST:
+		return true
+	case GET:
+		_, ok := m.Observe()
+		return ok
+	default:
+		return false
+	}
+}
+
+// bridge translates an authorized request on a bridged path to MQTT. The
+// topic is the path without its leading slash. The requests are answered once
+// the broker acknowledges their packet, after an empty acknowledgement of the
+// confirmable requests.
+func (p *Proxy) bridge(ctx context.Context, c *client, m Message) {
+	b, err := p.bridgeOf(ctx, c)
+	if err != nil {
+		code := ServiceUnavailable
+		if errors.Is(err, errBrokerAuth) {
+			code = Unauthorized
+		}
+		c.reject(m, code)
+		p.logger.Error("Failed to bridge CoAP request to MQTT", slog.String("remote", c.addr.String()), slog.String("target", p.coap.MQTTTarget), slog.Any("error", err))
+		return
+	}
+	topic := strings.TrimPrefix(m.Path(), "/")
+	wait := func() *Message {
+		c.ack(m)
+		m.Type = NonConfirmable
+		return &m
+	}
+
+	switch m.Code {
+	case PUT, POST:
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			c.reject(m, BadRequest)
+			return
+		}
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.TopicName, publish.Payload, publish.Qos = topic, m.Payload, p.coap.MQTTQoS
+		// PUT replaces the state of the resource, which the broker retains.
+		publish.Retain = m.Code == PUT
+		if publish.Qos == 0 {
+			err = b.send(publish, nil)
+			if err == nil {
+				c.respond(m, Message{Code: Changed})
+			}
+			break
+		}
+		err = b.send(publish, wait())
+	case GET:
+		if !validFilter(topic) {
+			if obs := c.observations.remove(m.Token); obs != nil {
+				p.unsubscribe(obs)
+			}
+			c.reject(m, BadRequest)
+			return
+		}
+		if observe, _ := m.Observe(); observe == observeDeregister {
+			if c.observations.subscribed(topic) {
+				c.respond(m, Message{Code: Content})
+				return
+			}
+			unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+			unsubscribe.Topics = []string{topic}
+			err = b.send(unsubscribe, wait())
+			break
+		}
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.Topics, subscribe.Qoss = []string{topic}, []byte{p.coap.MQTTQoS}
+		err = b.send(subscribe, wait())
+	}
+	if err != nil {
+		if m.Code == GET {
+			if obs := c.observations.remove(m.Token); obs != nil {
+				p.unsubscribe(obs)
+			}
+		}
+		c.reject(m, ServiceUnavailable)
+		p.logger.Warn(fmt.Sprintf("Failed to bridge CoAP request of %s to MQTT: %s", c.addr, err))
+	}
+}
+
+// unbridge unsubscribes the topic of an observation ended by the client, if
+// no other observation of the client shares it.
+func (p *Proxy) unbridge(c *client, obs *observation) {
+	topic := obs.topic()
+	c.bmu.Lock()
+	b := c.bridge
+	c.bmu.Unlock()
+	if b == nil || c.observations.subscribed(topic) {
+		return
+	}
+	unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	unsubscribe.Topics = []string{topic}
+	if err := b.send(unsubscribe, nil); err != nil {
+		p.logger.Warn(fmt.Sprintf("Failed to unsubscribe MQTT topic %s of %s: %s", topic, c.addr, err))
+	}
+}
+
+// bridgeOf returns the bridge of a client, connecting it to the broker with
+// the credentials of the session of the request if needed.
+func (p *Proxy) bridgeOf(ctx context.Context, c *client) (*bridge, error) {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	select {
+	case <-c.done:
+		return nil, errClosed
+	default:
+	}
+	if c.bridge != nil {
+		return c.bridge, nil
+	}
+	conn, err := p.dialBroker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion = "MQTT", 4
+	// The broker assigns the client ID of the clean session.
+	connect.CleanSession = true
+	if s, ok := session.FromContext(ctx); ok {
+		if s.Username != "" || len(s.Password) > 0 {
+			connect.UsernameFlag, connect.Username = true, s.Username
+		}
+		if len(s.Password) > 0 {
+			connect.PasswordFlag, connect.Password = true, s.Password
+		}
+	}
+	if err := handshake(conn, connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.bridge = &bridge{conn: conn, pending: make(map[uint16]Message)}
+	go p.bridgeDownlink(c, c.bridge)
+	return c.bridge, nil
+}
+
+// dialBroker connects to the broker, over TLS if the target TLS configuration
+// is set or the scheme of the broker requires it.
+func (p *Proxy) dialBroker(ctx context.Context) (net.Conn, error) {
+	address, secure := upstream.SplitScheme(p.coap.MQTTTarget)
+	config := p.config.TargetTLSConfig
+	if config == nil && secure {
+		config = &tls.Config{}
+	}
+	dialer := net.Dialer{Timeout: bridgeTimeout}
+	if config != nil {
+		d := tls.Dialer{NetDialer: &dialer, Config: config}
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// handshake sends the CONNECT of a bridge and reads the CONNACK of the broker.
+func handshake(conn net.Conn, connect *packets.ConnectPacket) error {
+	if err := conn.SetDeadline(time.Now().Add(bridgeTimeout)); err != nil {
+		return err
+	}
+	if err := connect.Write(conn); err != nil {
+		return err
+	}
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+	connack, ok := pkt.(*packets.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("%w: unexpected %s", errBroker, pkt)
+	}
+	switch connack.ReturnCode {
+	case packets.Accepted:
+	case packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedNotAuthorised:
+		return errBrokerAuth
+	default:
+		return fmt.Errorf("%w: %s", errBroker, packets.ConnackReturnCodes[connack.ReturnCode])
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// bridgeDownlink translates the packets of the broker until the bridge is
+// closed. The publishes are notified to the observations whose topic filter
+// matches them. If the broker is lost, the pending requests and the
+// observations of the bridge are ended with 5.03 Service Unavailable.
+func (p *Proxy) bridgeDownlink(c *client, b *bridge) {
+	for {
+		pkt, err := packets.ReadPacket(b.conn)
+		if err != nil {
+			break
+		}
+		c.touch()
+		switch pkt := pkt.(type) {
+		case *packets.PublishPacket:
+			if pkt.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = pkt.MessageID
+				if err := b.send(puback, nil); err != nil {
+					p.logger.Warn(fmt.Sprintf("Failed to acknowledge MQTT publish of %s: %s", c.addr, err))
+				}
+			}
+			c.observations.matching(pkt.TopicName, func(obs *observation) {
+				n := Message{Type: NonConfirmable, Code: Content, MessageID: c.nextMID(), Token: obs.token, Payload: pkt.Payload}
+				n.Options = []Option{observeOption(b.next())}
+				obs.mid, obs.notify = n.MessageID, true
+				_, _ = c.pc.WriteTo(n.Encode(), c.addr)
+			})
+		case *packets.PubackPacket:
+			if req, ok := b.done(pkt.MessageID); ok {
+				c.respond(req, Message{Code: Changed})
+			}
+		case *packets.SubackPacket:
+			req, ok := b.done(pkt.MessageID)
+			if !ok {
+				continue
+			}
+			if len(pkt.ReturnCodes) == 0 || pkt.ReturnCodes[0] > 2 {
+				if obs := c.observations.remove(req.Token); obs != nil {
+					p.unsubscribe(obs)
+				}
+				c.respond(req, Message{Code: Forbidden})
+				continue
+			}
+			c.respond(req, Message{Code: Content, Options: []Option{observeOption(b.next())}})
+		case *packets.UnsubackPacket:
+			if req, ok := b.done(pkt.MessageID); ok {
+				c.respond(req, Message{Code: Content})
+			}
+		}
+	}
+
+	b.close()
+	c.bmu.Lock()
+	if c.bridge == b {
+		c.bridge = nil
+	}
+	c.bmu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	p.logger.Warn(fmt.Sprintf("MQTT broker %s of the CoAP bridge of %s lost", p.coap.MQTTTarget, c.addr))
+	for _, req := range b.drain() {
+		c.respond(req, Message{Code: ServiceUnavailable})
+	}
+	for _, obs := range c.observations.drainFunc(func(obs *observation) bool { return obs.bridged }) {
+		m := Message{Type: NonConfirmable, Code: ServiceUnavailable, MessageID: c.nextMID(), Token: obs.token}
+		_, _ = c.pc.WriteTo(m.Encode(), c.addr)
+		p.unsubscribe(obs)
+	}
+}
+
+// send writes a packet to the broker. The publishes with a QoS, and the
+// subscriptions, get the next message ID, and the request is pending until
+// the broker acknowledges them.
+func (b *bridge) send(pkt packets.ControlPacket, req *Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var id uint16
+	switch pkt := pkt.(type) {
+	case *packets.PublishPacket:
+		if pkt.Qos > 0 {
+			id = b.nextID()
+			pkt.MessageID = id
+		}
+	case *packets.SubscribePacket:
+		id = b.nextID()
+		pkt.MessageID = id
+	case *packets.UnsubscribePacket:
+		id = b.nextID()
+		pkt.MessageID = id
+	}
+	if req != nil && id != 0 {
+		b.pending[id] = *req
+	}
+	if err := pkt.Write(b.conn); err != nil {
+		delete(b.pending, id)
+		return err
+	}
+	return nil
+}
+
+func (b *bridge) nextID() uint16 {
+	if b.msgID++; b.msgID == 0 {
+		b.msgID++
+	}
+	return b.msgID
+}
+
+// next returns the Observe value of the next notification.
+func (b *bridge) next() uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Observe values are 24-bit sequence numbers.
+	b.seq = (b.seq + 1) & 0xFFFFFF
+	return b.seq
+}
+
+// done returns the request acknowledged by a packet of the broker.
+func (b *bridge) done(id uint16) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	req, ok := b.pending[id]
+	delete(b.pending, id)
+	return req, ok
+}
+
+// drain removes and returns the pending requests.
+func (b *bridge) drain() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	reqs := make([]Message, 0, len(b.pending))
+	for _, req := range b.pending {
+		reqs = append(reqs, req)
+	}
+	clear(b.pending)
+	return reqs
+}
+
+// close disconnects the bridge from the broker.
+func (b *bridge) close() {
+	b.once.Do(func() {
+		b.mu.Lock()
+		_ = b.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = packets.NewControlPacket(packets.Disconnect).Write(b.conn)
+		b.mu.Unlock()
+		b.conn.Close()
+	})
+}
+
+// validFilter reports whether a topic is a valid MQTT topic filter, whose
+// wildcards are whole levels and # is the last level.
+func validFilter(topic string) bool {
+	if topic == "" {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch {
+		case level == "+":
+		case level == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+// observeOption returns the Observe option of a value.
+func observeOption(v uint32) Option {
+	return Option{Number: OptionObserve, Value: bytes.TrimLeft(binary.BigEndian.AppendUint32(nil, v), "\x00")}
+}
@@ -0,0 +1,444 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/dtls"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/caarlos0/env/v11"
+)
+
+// maxMessageSize is the maximum size of a CoAP message carried by a UDP
+// datagram.
+const maxMessageSize = 0xFFFF
+
+// queueSize is the number of requests of a client queued while the previous
+// ones are authorized.
+const queueSize = 64
+
+var errQoS = errors.New("invalid CoAP MQTT bridge QoS, it must be 0 or 1")
+
+// Config holds the options of the CoAP proxy.
+type Config struct {
+	AuthQuery      string        `env:"COAP_AUTH_QUERY"      envDefault:"auth"`
+	IdleTimeout    time.Duration `env:"COAP_IDLE_TIMEOUT"    envDefault:"5m"`
+	ObserveTimeout time.Duration `env:"COAP_OBSERVE_TIMEOUT" envDefault:"24h"`
+	MQTTPaths      []string      `env:"COAP_MQTT_PATHS"      envDefault:""`
+	MQTTTarget     string        `env:"COAP_MQTT_TARGET"     envDefault:"localhost:1883"`
+	MQTTQoS        uint8         `env:"COAP_MQTT_QOS"        envDefault:"0"`
+
+	// DTLS holds the DTLS options of the listener.
+	DTLS dtls.Config
+}
+
+// NewConfig parses the CoAP proxy options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	if c.MQTTQoS > 1 {
+		return Config{}, errQoS
+	}
+	var err error
+	if c.DTLS, err = dtls.NewConfig(opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Proxy is the CoAP proxy. Each CoAP client, identified by its UDP address,
+// is relayed to the target from its own UDP socket, so the responses and the
+// notifications of the target reach the client that requested them. The
+// requests on the bridged paths are translated to MQTT instead, in an MQTT
+// session of the client with the broker.
+type Proxy struct {
+	config  mproxy.Config
+	coap    Config
+	handler session.Handler
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// New returns a new CoAP proxy.
+func New(config mproxy.Config, coap Config, handler session.Handler, logger *slog.Logger) *Proxy {
+	return &Proxy{
+		config:  config,
+		coap:    coap,
+		handler: handler,
+		logger:  logger,
+		clients: make(map[string]*client),
+	}
+}
+
+// Listen of the server, this will block.
+func (p *Proxy) Listen(ctx context.Context) error {
+	p.config.TLSJobs.Start(ctx)
+	config, err := dtls.Load(p.coap.DTLS, p.config.TLSConfig)
+	if err != nil {
+		return err
+	}
+	var pc net.PacketConn
+	status := "without DTLS"
+	if config != nil {
+		pc, err = dtls.ListenPacket(p.config.Address, p.coap.DTLS, config, p.logger)
+		status = "with DTLS"
+	} else {
+		pc, err = net.ListenPacket("udp", p.config.Address)
+	}
+	if err != nil {
+		return err
+	}
+	p.logger.Info(fmt.Sprintf("CoAP proxy server started at %s %s", p.config.Address, status))
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				p.logger.Info(fmt.Sprintf("CoAP proxy server at %s exiting...", p.config.Address))
+				return nil
+			}
+			return err
+		}
+		p.receive(ctx, pc, addr, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// receive queues a message to the relay of its client, started by the first
+// message of the client.
+func (p *Proxy) receive(ctx context.Context, pc net.PacketConn, addr net.Addr, msg []byte) {
+	p.mu.Lock()
+	c, ok := p.clients[addr.String()]
+	if !ok {
+		target, err := net.Dial("udp", strings.TrimPrefix(p.config.Target, "coap://"))
+		if err != nil {
+			p.mu.Unlock()
+			p.logger.Error("Cannot connect to CoAP server " + p.config.Target + " due to: " + err.Error())
+			return
+		}
+		// The context of the relay is canceled once it is closed.
+		cctx, cancel := context.WithCancel(ctx)
+		c = &client{
+			pc:     pc,
+			addr:   addr,
+			target: target,
+			in:     make(chan []byte, queueSize),
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		if dc, ok := pc.(*dtls.PacketConn); ok {
+			c.closed = dc.Done(addr)
+		}
+		c.touch()
+		p.clients[addr.String()] = c
+		go p.serve(cctx, c)
+	}
+	p.mu.Unlock()
+	select {
+	case c.in <- msg:
+	default:
+		p.logger.Warn(fmt.Sprintf("Dropped CoAP message of %s, its relay is busy", addr))
+	}
+}
+
+// serve relays the messages of a client until it has been idle for the idle
+// timeout, or for the observe timeout while it observes resources.
+func (p *Proxy) serve(ctx context.Context, c *client) {
+	defer p.remove(c)
+	go p.downlink(c)
+
+	for {
+		select {
+		case msg := <-c.in:
+			c.touch()
+			m, err := Decode(msg)
+			if err != nil {
+				p.logger.Debug(fmt.Sprintf("Invalid CoAP message from %s: %s", c.addr, err))
+				continue
+			}
+			if m.IsRequest() {
+				bridged := p.bridged(m.Path())
+				if bridged && !bridgeable(m) {
+					c.reject(m, MethodNotAllowed)
+					continue
+				}
+				rctx, code, err := p.authorize(ctx, c, &m, bridged)
+				if err != nil {
+					c.reject(m, code)
+					p.logger.Error("Failed to authorize CoAP request", slog.String("remote", c.addr.String()), slog.String("path", m.Path()), slog.Any("error", err))
+					continue
+				}
+				if bridged {
+					p.bridge(rctx, c, m)
+					continue
+				}
+				msg = m.Encode()
+			}
+			if m.Type == Reset {
+				if obs := c.observations.reset(m.MessageID); obs != nil {
+					p.unsubscribe(obs)
+					if obs.bridged {
+						p.unbridge(c, obs)
+						continue
+					}
+				}
+			}
+			if _, err := c.target.Write(msg); err != nil {
+				p.logger.Warn(fmt.Sprintf("Failed to relay CoAP message of %s: %s", c.addr, err))
+			}
+		case <-c.done:
+			return
+		case <-c.closed:
+			p.endObservations(c, false)
+			c.close()
+			return
+		case <-ctx.Done():
+			p.endObservations(c, false)
+			c.close()
+			return
+		}
+	}
+}
+
+// authorize authorizes a request of a client with the handler, and returns
+// the context of its session or the response code of its rejection. The reads
+// and the observations are authorized as subscriptions to their path, and the
+// other requests as publishes to their path. The handler may modify the path
+// and the payload.
+func (p *Proxy) authorize(ctx context.Context, c *client, m *Message, bridged bool) (context.Context, byte, error) {
+	var s session.Session
+	if host, _, err := net.SplitHostPort(c.addr.String()); err == nil {
+		s.RemoteIP = host
+	}
+	if pc, ok := c.pc.(*dtls.PacketConn); ok {
+		peer, err := pc.Peer(c.addr)
+		if err != nil {
+			return nil, Unauthorized, err
+		}
+		s.Username = peer.PSKIdentity
+		if len(peer.Certificates) > 0 {
+			s.Cert = *peer.Certificates[0]
+			s.Identity = session.NewIdentity(s.Cert)
+			s.MTLS = true
+		}
+	}
+	return p.authorizeSession(ctx, s, &c.observations, m, bridged)
+}
+
+// authorizeSession authorizes a request in the session of its client, whose
+// password is the authentication query parameter of the request, and tracks
+// the observations it registers.
+func (p *Proxy) authorizeSession(ctx context.Context, s session.Session, obs *observations, m *Message, bridged bool) (context.Context, byte, error) {
+	query := m.Query()
+	m.RemoveQuery(p.coap.AuthQuery)
+	s.Password = []byte(query.Get(p.coap.AuthQuery))
+	s.Query = query
+	ctx = session.NewContext(ctx, &s)
+	if err := p.handler.AuthConnect(ctx); err != nil {
+		return nil, Unauthorized, err
+	}
+
+	path := m.Path()
+	if m.Code != GET && m.Code != FETCH {
+		payload := m.Payload
+		if err := p.handler.AuthPublish(ctx, &path, &payload); err != nil {
+			return nil, Forbidden, err
+		}
+		m.SetPath(path)
+		m.Payload = payload
+		if err := p.handler.Publish(ctx, &path, &payload); err != nil {
+			return nil, Forbidden, err
+		}
+		return ctx, 0, nil
+	}
+
+	topics := []string{path}
+	observe, ok := m.Observe()
+	if ok && observe == observeDeregister {
+		obs.remove(m.Token)
+		if err := p.handler.Unsubscribe(ctx, &topics); err != nil {
+			return nil, Forbidden, err
+		}
+		return ctx, 0, nil
+	}
+	if err := p.handler.AuthSubscribe(ctx, &topics); err != nil {
+		return nil, Forbidden, err
+	}
+	if len(topics) > 0 {
+		m.SetPath(topics[0])
+	}
+	if ok && observe == observeRegister {
+		if err := p.handler.Subscribe(ctx, &topics); err != nil {
+			return nil, Forbidden, err
+		}
+		obs.add(&observation{
+			ctx:     ctx,
+			token:   slices.Clone(m.Token),
+			path:    m.Path(),
+			topics:  topics,
+			bridged: bridged,
+		})
+	}
+	return ctx, 0, nil
+}
+
+// unsubscribe tells the handler that an observation ended, which may be once
+// the relay of the client is closed.
+func (p *Proxy) unsubscribe(obs *observation) {
+	if err := p.handler.Unsubscribe(context.WithoutCancel(obs.ctx), &obs.topics); err != nil {
+		p.logger.Warn("Failed to unsubscribe CoAP observation of " + obs.path + ": " + err.Error())
+	}
+}
+
+// endObservations ends the observations of a client whose relay is closed.
+// The observations are canceled with the target if the client is gone, and
+// with the client, by an error notification, if the target is lost. The
+// bridged observations end with the MQTT session of the client.
+func (p *Proxy) endObservations(c *client, targetLost bool) {
+	for _, obs := range c.observations.drain() {
+		if targetLost {
+			m := Message{Type: NonConfirmable, Code: ServiceUnavailable, MessageID: c.nextMID(), Token: obs.token}
+			_, _ = c.pc.WriteTo(m.Encode(), c.addr)
+		} else if !obs.bridged {
+			m := Message{Type: NonConfirmable, Code: GET, MessageID: c.nextMID(), Token: obs.token}
+			m.SetPath(obs.path)
+			m.Options = append(m.Options, Option{Number: OptionObserve, Value: []byte{observeDeregister}})
+			_, _ = c.target.Write(m.Encode())
+		}
+		p.unsubscribe(obs)
+	}
+}
+
+func (p *Proxy) remove(c *client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[c.addr.String()] == c {
+		delete(p.clients, c.addr.String())
+	}
+}
+
+// client is the relay of a CoAP client to the target.
+type client struct {
+	pc     net.PacketConn
+	addr   net.Addr
+	target net.Conn
+	in     chan []byte
+	done   chan struct{}
+	once   sync.Once
+	cancel context.CancelFunc
+	// closed is closed once the DTLS session of the client ends.
+	closed <-chan struct{}
+	// last is the time of the last message of the client or the target, in
+	// nanoseconds since the Unix epoch.
+	last atomic.Int64
+	// mid is the message ID of the last message sent by the proxy itself.
+	mid          atomic.Uint32
+	observations observations
+
+	bmu sync.Mutex
+	// bridge is the MQTT session of the requests on the bridged paths.
+	bridge *bridge
+}
+
+func (c *client) nextMID() uint16 {
+	return uint16(c.mid.Add(1))
+}
+
+func (c *client) touch() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+// close ends the relay of the client.
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.cancel()
+		c.target.Close()
+		c.bmu.Lock()
+		defer c.bmu.Unlock()
+		if c.bridge != nil {
+			c.bridge.close()
+		}
+	})
+}
+
+// downlink relays the messages of the target to the client until the relay
+// is idle for the timeout or the target is lost.
+func (p *Proxy) downlink(c *client) {
+	defer c.close()
+	buf := make([]byte, maxMessageSize)
+	for {
+		if err := c.target.SetReadDeadline(time.Now().Add(p.coap.IdleTimeout)); err != nil {
+			return
+		}
+		n, err := c.target.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				p.endObservations(c, true)
+				return
+			}
+			timeout := p.coap.IdleTimeout
+			if c.observations.active() {
+				timeout = max(timeout, p.coap.ObserveTimeout)
+			}
+			if time.Since(time.Unix(0, c.last.Load())) < timeout {
+				continue
+			}
+			p.endObservations(c, false)
+			return
+		}
+		c.touch()
+		if m, err := Decode(buf[:n]); err == nil {
+			if obs := c.observations.notified(m); obs != nil {
+				p.unsubscribe(obs)
+			}
+		}
+		// Lost datagrams are retransmitted by the client or the target.
+		_, _ = c.pc.WriteTo(buf[:n], c.addr)
+	}
+}
+
+// reject answers a request with an error response.
+func (c *client) reject(req Message, code byte) {
+	c.respond(req, Message{Code: code})
+}
+
+// respond answers a request, piggybacked on the acknowledgement of the
+// confirmable requests.
+func (c *client) respond(req Message, resp Message) {
+	resp.Type, resp.MessageID, resp.Token = Acknowledgement, req.MessageID, req.Token
+	if req.Type != Confirmable {
+		resp.Type, resp.MessageID = NonConfirmable, c.nextMID()
+	}
+	_, _ = c.pc.WriteTo(resp.Encode(), c.addr)
+}
+
+// ack acknowledges a confirmable request, whose response is sent later.
+func (c *client) ack(req Message) {
+	if req.Type != Confirmable {
+		return
+	}
+	resp := Message{Type: Acknowledgement, Code: Empty, MessageID: req.MessageID}
+	_, _ = c.pc.WriteTo(resp.Encode(), c.addr)
+}
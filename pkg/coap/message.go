@@ -0,0 +1,326 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package coap implements a CoAP proxy, which relays the requests of the CoAP
+// clients over UDP to the target CoAP server once the handler authorizes them.
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Message types.
+const (
+	Confirmable     byte = 0
+	NonConfirmable  byte = 1
+	Acknowledgement byte = 2
+	Reset           byte = 3
+)
+
+// Codes of the requests, and of the responses of the proxy.
+const (
+	Empty        byte = 0x00
+	GET          byte = 0x01
+	POST         byte = 0x02
+	PUT          byte = 0x03
+	DELETE       byte = 0x04
+	FETCH        byte = 0x05
+	Unauthorized byte = 0x81
+	Forbidden    byte = 0x83
+)
+
+// Codes of the signaling messages of CoAP over TCP.
+const (
+	CSM     byte = 0xE1
+	Ping    byte = 0xE2
+	Pong    byte = 0xE3
+	Release byte = 0xE4
+	Abort   byte = 0xE5
+)
+
+// Option numbers.
+const (
+	OptionObserve  uint16 = 6
+	OptionURIPath  uint16 = 11
+	OptionURIQuery uint16 = 15
+)
+
+// Observe values of the GET requests.
+const (
+	observeRegister   = 0
+	observeDeregister = 1
+)
+
+// payloadMarker separates the options from the payload.
+const payloadMarker = 0xFF
+
+var (
+	errMessage  = errors.New("malformed CoAP message")
+	errTooLarge = errors.New("CoAP message too large")
+)
+
+// Option is an option of a CoAP message.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message is a CoAP message.
+type Message struct {
+	Type      byte
+	Code      byte
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Decode returns the CoAP message of a datagram.
+func Decode(b []byte) (Message, error) {
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return Message{}, errMessage
+	}
+	tkl := int(b[0] & 0x0F)
+	if tkl > 8 || len(b) < 4+tkl {
+		return Message{}, errMessage
+	}
+	m := Message{
+		Type:      b[0] >> 4 & 0x03,
+		Code:      b[1],
+		MessageID: binary.BigEndian.Uint16(b[2:]),
+		Token:     b[4 : 4+tkl],
+	}
+	if err := m.decodeOptions(b[4+tkl:]); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// ReadTCP reads a CoAP message framed over TCP, as specified by RFC 8323,
+// whose options and payload are at most maxSize bytes long. The messages over
+// TCP have neither a type nor a message ID.
+func ReadTCP(r io.Reader, maxSize int) (Message, error) {
+	var h [1]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return Message{}, err
+	}
+	tkl := int(h[0] & 0x0F)
+	if tkl > 8 {
+		return Message{}, errMessage
+	}
+	length := int(h[0] >> 4)
+	if length >= 13 {
+		ext := make([]byte, 1<<(length-13))
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return Message{}, err
+		}
+		switch length {
+		case 13:
+			length = int(ext[0]) + 13
+		case 14:
+			length = int(binary.BigEndian.Uint16(ext)) + 269
+		default:
+			n := uint64(binary.BigEndian.Uint32(ext)) + 65805
+			if n > uint64(maxSize) {
+				return Message{}, errTooLarge
+			}
+			length = int(n)
+		}
+	}
+	if length > maxSize {
+		return Message{}, errTooLarge
+	}
+	b := make([]byte, 1+tkl+length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return Message{}, err
+	}
+	m := Message{Code: b[0], Token: b[1 : 1+tkl]}
+	if err := m.decodeOptions(b[1+tkl:]); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// decodeOptions decodes the options and the payload of a message.
+func (m *Message) decodeOptions(b []byte) error {
+	var number int
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return errMessage
+			}
+			m.Payload = b[1:]
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		var ok bool
+		if delta, b, ok = extended(delta, b[1:]); !ok {
+			return errMessage
+		}
+		if length, b, ok = extended(length, b); !ok || len(b) < length {
+			return errMessage
+		}
+		if number += delta; number > 0xFFFF {
+			return errMessage
+		}
+		m.Options = append(m.Options, Option{Number: uint16(number), Value: b[:length]})
+		b = b[length:]
+	}
+	return nil
+}
+
+// extended returns the value of an option delta or length nibble, followed by
+// its extended bytes in b.
+func extended(v int, b []byte) (int, []byte, bool) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], true
+	case 15:
+		return 0, nil, false
+	}
+	return v, b, true
+}
+
+// Encode returns the datagram of the message.
+func (m Message) Encode() []byte {
+	b := []byte{1<<6 | m.Type<<4 | byte(len(m.Token)), m.Code}
+	b = binary.BigEndian.AppendUint16(b, m.MessageID)
+	b = append(b, m.Token...)
+	return m.appendOptions(b)
+}
+
+// EncodeTCP returns the TCP frame of the message, as specified by RFC 8323.
+func (m Message) EncodeTCP() []byte {
+	body := m.appendOptions(nil)
+	var b []byte
+	switch n := len(body); {
+	case n < 13:
+		b = []byte{byte(n) << 4}
+	case n < 269:
+		b = []byte{13 << 4, byte(n - 13)}
+	case n < 65805:
+		b = binary.BigEndian.AppendUint16([]byte{14 << 4}, uint16(n-269))
+	default:
+		b = binary.BigEndian.AppendUint32([]byte{15 << 4}, uint32(n-65805))
+	}
+	b[0] |= byte(len(m.Token))
+	b = append(b, m.Code)
+	b = append(b, m.Token...)
+	return append(b, body...)
+}
+
+// appendOptions appends the options and the payload of the message to b.
+func (m Message) appendOptions(b []byte) []byte {
+	options := slices.Clone(m.Options)
+	slices.SortStableFunc(options, func(a, b Option) int {
+		return int(a.Number) - int(b.Number)
+	})
+	var number uint16
+	for _, o := range options {
+		delta, deltaExt := nibble(int(o.Number - number))
+		length, lengthExt := nibble(len(o.Value))
+		b = append(b, delta<<4|length)
+		b = append(b, deltaExt...)
+		b = append(b, lengthExt...)
+		b = append(b, o.Value...)
+		number = o.Number
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.Payload...)
+	}
+	return b
+}
+
+// nibble returns the nibble and the extended bytes of an option delta or
+// length.
+func nibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, binary.BigEndian.AppendUint16(nil, uint16(v-269))
+	}
+}
+
+// IsRequest reports whether the message is a request.
+func (m Message) IsRequest() bool {
+	return m.Code >= GET && m.Code < 0x20
+}
+
+// Path returns the path of the Uri-Path options, such as /sensors/temp.
+func (m Message) Path() string {
+	var segments []string
+	for _, o := range m.Options {
+		if o.Number == OptionURIPath {
+			segments = append(segments, string(o.Value))
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// SetPath replaces the Uri-Path options with the segments of a path.
+func (m *Message) SetPath(path string) {
+	m.remove(func(o Option) bool {
+		return o.Number == OptionURIPath
+	})
+	if path = strings.Trim(path, "/"); path == "" {
+		return
+	}
+	for _, segment := range strings.Split(path, "/") {
+		m.Options = append(m.Options, Option{Number: OptionURIPath, Value: []byte(segment)})
+	}
+}
+
+// Query returns the parameters of the Uri-Query options.
+func (m Message) Query() url.Values {
+	query := make(url.Values)
+	for _, o := range m.Options {
+		if o.Number == OptionURIQuery {
+			key, value, _ := strings.Cut(string(o.Value), "=")
+			query.Add(key, value)
+		}
+	}
+	return query
+}
+
+// RemoveQuery removes the Uri-Query options of a parameter.
+func (m *Message) RemoveQuery(key string) {
+	m.remove(func(o Option) bool {
+		k, _, _ := strings.Cut(string(o.Value), "=")
+		return o.Number == OptionURIQuery && k == key
+	})
+}
+
+// Observe returns the value of the Observe option, if the message has one.
+func (m Message) Observe() (uint32, bool) {
+	for _, o := range m.Options {
+		if o.Number == OptionObserve && len(o.Value) <= 3 {
+			var v uint32
+			for _, b := range o.Value {
+				v = v<<8 | uint32(b)
+			}
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (m *Message) remove(match func(Option) bool) {
+	m.Options = slices.DeleteFunc(slices.Clone(m.Options), match)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+// ServiceUnavailable is the code of the notifications ending the observations
+// of a client whose target is lost.
+const ServiceUnavailable byte = 0xA3
+
+// observation is a resource observed by a client, whose authorization context
+// is kept to unsubscribe it once the observation ends.
+type observation struct {
+	ctx    context.Context
+	token  []byte
+	path   string
+	topics []string
+	// mid is the message ID of the last notification of the target, which
+	// the client resets to cancel the observation.
+	mid    uint16
+	notify bool
+	// bridged reports whether the observation is an MQTT subscription of the
+	// bridge rather than an observation of the target.
+	bridged bool
+}
+
+// topic returns the MQTT topic filter of a bridged observation.
+func (obs *observation) topic() string {
+	return strings.TrimPrefix(obs.path, "/")
+}
+
+// observations holds the observations of a client by token.
+type observations struct {
+	mu sync.Mutex
+	m  map[string]*observation
+}
+
+func (o *observations) add(obs *observation) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.m == nil {
+		o.m = make(map[string]*observation)
+	}
+	o.m[string(obs.token)] = obs
+}
+
+func (o *observations) remove(token []byte) *observation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	obs, ok := o.m[string(token)]
+	if !ok {
+		return nil
+	}
+	delete(o.m, string(token))
+	return obs
+}
+
+// active reports whether the client observes any resource.
+func (o *observations) active() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.m) > 0
+}
+
+// subscribed reports whether a bridged observation has a topic filter.
+func (o *observations) subscribed(topic string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, obs := range o.m {
+		if obs.bridged && obs.topic() == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// matching calls fn with the bridged observations whose topic filter matches
+// a topic.
+func (o *observations) matching(topic string, fn func(*observation)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, obs := range o.m {
+		if obs.bridged && session.Matches(obs.topic(), topic) {
+			fn(obs)
+		}
+	}
+}
+
+// notified records a message of the target, and returns the observation it
+// ends: a response without the Observe option, such as an error, ends the
+// observation of its token.
+func (o *observations) notified(m Message) *observation {
+	if m.Code == Empty {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	obs, ok := o.m[string(m.Token)]
+	if !ok || obs.bridged {
+		return nil
+	}
+	if _, observe := m.Observe(); observe && m.Code < 0x80 {
+		obs.mid, obs.notify = m.MessageID, true
+		return nil
+	}
+	delete(o.m, string(m.Token))
+	return obs
+}
+
+// reset returns the observation canceled by a reset of the client to one of
+// its notifications.
+func (o *observations) reset(mid uint16) *observation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for token, obs := range o.m {
+		if obs.notify && obs.mid == mid {
+			delete(o.m, token)
+			return obs
+		}
+	}
+	return nil
+}
+
+// drain removes and returns all the observations.
+func (o *observations) drain() []*observation {
+	return o.drainFunc(func(*observation) bool { return true })
+}
+
+// drainFunc removes and returns the observations matched by a function.
+func (o *observations) drainFunc(match func(*observation) bool) []*observation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var all []*observation
+	for token, obs := range o.m {
+		if match(obs) {
+			all = append(all, obs)
+			delete(o.m, token)
+		}
+	}
+	return all
+}
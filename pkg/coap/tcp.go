@@ -0,0 +1,231 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/session"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxFrameSize is the maximum size of the options and the payload of a CoAP
+// message over TCP, which may carry the large blocks of BERT transfers.
+const maxFrameSize = 1 << 20
+
+// alpn is the application protocol of CoAP over TLS.
+const alpn = "coap"
+
+// TCPProxy is the CoAP over TCP and TLS proxy, as specified by RFC 8323, for
+// the devices whose networks block UDP. Each connection of a client is relayed
+// to the target over its own connection, and its requests are authorized like
+// those of the CoAP proxy over UDP. The requests are not bridged to MQTT.
+type TCPProxy struct {
+	proxy  *Proxy
+	dialer net.Dialer
+}
+
+// NewTCP returns a new CoAP over TCP proxy. The target is a host:port address
+// or a URI such as coaps+tcp://host:5684, whose coaps+tcp scheme requires TLS.
+func NewTCP(config mproxy.Config, coap Config, handler session.Handler, logger *slog.Logger) *TCPProxy {
+	return &TCPProxy{proxy: New(config, coap, handler, logger)}
+}
+
+// Listen of the server, this will block.
+func (p *TCPProxy) Listen(ctx context.Context) error {
+	config, logger := p.proxy.config, p.proxy.logger
+	l, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+
+	if config.TLSConfig != nil {
+		config.TLSJobs.Start(ctx)
+		l = mptls.NewListener(l, mptls.WithNextProtos(config.TLSConfig, alpn))
+	}
+	status := mptls.SecurityStatus(config.TLSConfig)
+	logger.Info(fmt.Sprintf("CoAP over TCP proxy server started at %s with %s", config.Address, status))
+	if err := p.Serve(ctx, l); err != nil {
+		logger.Info(fmt.Sprintf("CoAP over TCP proxy server at %s with %s exiting with errors", config.Address, status), slog.String("error", err.Error()))
+	} else {
+		logger.Info(fmt.Sprintf("CoAP over TCP proxy server at %s with %s exiting...", config.Address, status))
+	}
+	return nil
+}
+
+// Serve proxies the connections accepted by l until ctx is done. The
+// connections of l are expected to be already secured, if needed.
+func (p *TCPProxy) Serve(ctx context.Context, l net.Listener) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				p.proxy.logger.Warn("Accept error " + err.Error())
+				continue
+			}
+			go p.handle(ctx, conn)
+		}
+	})
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return l.Close()
+	})
+	return g.Wait()
+}
+
+// handle relays a connection of a client until either side closes its
+// connection, which ends the observations of the client.
+func (p *TCPProxy) handle(ctx context.Context, inbound net.Conn) {
+	logger := p.proxy.logger
+	defer p.close(inbound)
+	clientCert, err := mptls.ClientCert(inbound)
+	if err != nil {
+		logger.Error("Failed to get client certificate: " + err.Error())
+		return
+	}
+
+	s := session.Session{Cert: clientCert, Identity: session.NewIdentity(clientCert), MTLS: len(clientCert.Raw) > 0}
+	if host, _, err := net.SplitHostPort(inbound.RemoteAddr().String()); err == nil {
+		s.RemoteIP = host
+	}
+	if fp, ok := mptls.ClientFingerprint(inbound); ok {
+		s.JA3, s.JA4 = fp.JA3Hash, fp.JA4
+	}
+
+	outbound, err := p.dial(ctx)
+	if err != nil {
+		logger.Error("Cannot connect to CoAP server " + p.proxy.config.Target + " due to: " + err.Error())
+		return
+	}
+	defer p.close(outbound)
+
+	// The hooks of the requests are canceled once either side is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		obs observations
+		// mu serializes the writes to the client, which receives the
+		// messages of the target and the rejections of the proxy.
+		mu sync.Mutex
+	)
+	write := func(m Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := inbound.Write(m.EncodeTCP())
+		return err
+	}
+	defer func() {
+		// The target ends the observations of the closed connection.
+		for _, o := range obs.drain() {
+			p.proxy.unsubscribe(o)
+		}
+	}()
+
+	go func() {
+		defer inbound.Close()
+		defer cancel()
+		for {
+			m, err := ReadTCP(outbound, maxFrameSize)
+			if err != nil {
+				p.closed("target", err)
+				return
+			}
+			if o := obs.notified(m); o != nil {
+				p.proxy.unsubscribe(o)
+			}
+			if err := write(m); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The client is read one request ahead of the authorization, so its close
+	// is noticed while the hooks of the previous request are pending.
+	requests := make(chan Message)
+	go func() {
+		defer close(requests)
+		for {
+			m, err := ReadTCP(inbound, maxFrameSize)
+			if err != nil {
+				p.closed("client", err)
+				cancel()
+				return
+			}
+			select {
+			case requests <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for m := range requests {
+		if m.IsRequest() {
+			if code, err := p.authorize(ctx, s, &obs, &m); err != nil {
+				logger.Error("Failed to authorize CoAP request", slog.String("remote", inbound.RemoteAddr().String()), slog.String("path", m.Path()), slog.Any("error", err))
+				if err := write(Message{Code: code, Token: m.Token}); err != nil {
+					return
+				}
+				continue
+			}
+		}
+		if _, err := outbound.Write(m.EncodeTCP()); err != nil {
+			return
+		}
+	}
+}
+
+func (p *TCPProxy) authorize(ctx context.Context, s session.Session, obs *observations, m *Message) (byte, error) {
+	_, code, err := p.proxy.authorizeSession(ctx, s, obs, m, false)
+	return code, err
+}
+
+// closed logs the end of a connection, unless it was closed cleanly.
+func (p *TCPProxy) closed(side string, err error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	p.proxy.logger.Warn(fmt.Sprintf("CoAP over TCP %s connection ended: %s", side, err))
+}
+
+// dial connects to the target, over TLS if the target TLS configuration is
+// set or the scheme of the target requires it.
+func (p *TCPProxy) dial(ctx context.Context) (net.Conn, error) {
+	address, config := p.proxy.config.Target, p.proxy.config.TargetTLSConfig
+	if scheme, addr, ok := strings.Cut(address, "://"); ok {
+		address = addr
+		if config == nil && strings.EqualFold(scheme, "coaps+tcp") {
+			config = &tls.Config{}
+		}
+	}
+	if config != nil {
+		config = config.Clone()
+		config.NextProtos = []string{alpn}
+		d := tls.Dialer{NetDialer: &p.dialer, Config: config}
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return p.dialer.DialContext(ctx, "tcp", address)
+}
+
+func (p *TCPProxy) close(conn net.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		p.proxy.logger.Warn(fmt.Sprintf("Error closing connection %s", err.Error()))
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dtls terminates the DTLS 1.2 sessions of the UDP listeners, whose
+// clients authenticate with a pre-shared key or an X.509 certificate.
+package dtls
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	piondtls "github.com/pion/dtls/v3"
+)
+
+var (
+	errPSK        = errors.New("invalid DTLS pre-shared key")
+	errUnknownPSK = errors.New("unknown DTLS PSK identity")
+	errClientAuth = errors.New("DTLS client has neither a certificate nor a pre-shared key")
+)
+
+// Cipher suites of the clients with certificates and with pre-shared keys,
+// including the AES-128-CCM-8 suites mandated by CoAP for constrained devices.
+var (
+	certCipherSuites = []piondtls.CipherSuiteID{
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		piondtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		piondtls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+	}
+	pskCipherSuites = []piondtls.CipherSuiteID{
+		piondtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+		piondtls.TLS_PSK_WITH_AES_128_CCM,
+		piondtls.TLS_PSK_WITH_AES_128_CCM_8,
+	}
+)
+
+// PSKFunc returns the pre-shared key of the identity of a client.
+type PSKFunc func(identity []byte) ([]byte, error)
+
+// Config holds the DTLS options of a UDP listener.
+type Config struct {
+	PSKKeys          []string      `env:"DTLS_PSK_KEYS"          envDefault:""`
+	PSKIdentityHint  string        `env:"DTLS_PSK_IDENTITY_HINT" envDefault:""`
+	HandshakeTimeout time.Duration `env:"DTLS_HANDSHAKE_TIMEOUT" envDefault:"30s"`
+
+	// PSK looks up the pre-shared keys of the clients. NewConfig sets it to
+	// the lookup of PSKKeys, and it may be replaced to look the keys up
+	// elsewhere, such as in a device registry.
+	PSK PSKFunc
+}
+
+// NewConfig parses the DTLS options from the environment. The pre-shared
+// keys are given as identity:key, where the key is encoded in hexadecimal.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	if len(c.PSKKeys) == 0 {
+		return c, nil
+	}
+	keys := make(map[string][]byte, len(c.PSKKeys))
+	for i, k := range c.PSKKeys {
+		// The entries are not quoted in the errors since they hold the keys.
+		identity, key, ok := strings.Cut(k, ":")
+		if !ok || identity == "" {
+			return Config{}, fmt.Errorf("%w at position %d", errPSK, i+1)
+		}
+		b, err := hex.DecodeString(key)
+		if err != nil || len(b) == 0 {
+			return Config{}, fmt.Errorf("%w at position %d", errPSK, i+1)
+		}
+		keys[identity] = b
+	}
+	c.PSK = func(identity []byte) ([]byte, error) {
+		key, ok := keys[string(identity)]
+		if !ok {
+			return nil, errUnknownPSK
+		}
+		return key, nil
+	}
+	return c, nil
+}
+
+// Load returns the DTLS configuration of a listener, or nil if the listener
+// has neither pre-shared keys nor a TLS configuration. The certificates and
+// the client verification of the TLS configuration, including the
+// verifications of CERT_VERIFICATION_METHODS, apply to the DTLS clients.
+func Load(c Config, tlsConfig *tls.Config) (*piondtls.Config, error) {
+	if c.PSK == nil && tlsConfig == nil {
+		return nil, nil
+	}
+	config := &piondtls.Config{
+		PSK:                  piondtls.PSKCallback(c.PSK),
+		ExtendedMasterSecret: piondtls.RequireExtendedMasterSecret,
+	}
+	if c.PSK != nil {
+		config.CipherSuites = pskCipherSuites
+		if c.PSKIdentityHint != "" {
+			config.PSKIdentityHint = []byte(c.PSKIdentityHint)
+		}
+	}
+	if tlsConfig == nil {
+		return config, nil
+	}
+	config.CipherSuites = append(slices.Clone(certCipherSuites), config.CipherSuites...)
+	config.Certificates = tlsConfig.Certificates
+	if tlsConfig.GetCertificate != nil {
+		getCertificate := tlsConfig.GetCertificate
+		config.GetCertificate = func(hello *piondtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getCertificate(&tls.ClientHelloInfo{ServerName: hello.ServerName})
+		}
+	}
+	config.ClientCAs = tlsConfig.ClientCAs
+	config.RootCAs = tlsConfig.RootCAs
+	config.VerifyPeerCertificate = tlsConfig.VerifyPeerCertificate
+	switch tlsConfig.ClientAuth {
+	case tls.RequestClientCert:
+		config.ClientAuth = piondtls.RequestClientCert
+	case tls.RequireAnyClientCert:
+		config.ClientAuth = piondtls.RequireAnyClientCert
+	case tls.VerifyClientCertIfGiven:
+		config.ClientAuth = piondtls.VerifyClientCertIfGiven
+	case tls.RequireAndVerifyClientCert:
+		config.ClientAuth = piondtls.RequireAndVerifyClientCert
+	}
+	if c.PSK != nil && config.ClientAuth != piondtls.NoClientCert {
+		// The clients authenticated with a pre-shared key have no
+		// certificate, so the certificates are only verified if given, and
+		// the clients required to have one must have a pre-shared key instead.
+		required := config.ClientAuth == piondtls.RequireAnyClientCert || config.ClientAuth == piondtls.RequireAndVerifyClientCert
+		config.ClientAuth = piondtls.VerifyClientCertIfGiven
+		if tlsConfig.ClientCAs == nil {
+			config.ClientAuth = piondtls.RequestClientCert
+		}
+		if required {
+			config.VerifyConnection = func(state *piondtls.State) error {
+				if len(state.PeerCertificates) == 0 && len(state.IdentityHint) == 0 {
+					return errClientAuth
+				}
+				return nil
+			}
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,236 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package dtls
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	piondtls "github.com/pion/dtls/v3"
+)
+
+// maxRecordSize is the maximum size of the data of a DTLS record.
+const maxRecordSize = 0xFFFF
+
+var (
+	errDeadline = errors.New("deadlines are not supported by the DTLS packet connection")
+	errPeer     = errors.New("no DTLS session with the peer")
+)
+
+// Peer is the identity of a DTLS client, authenticated with a pre-shared
+// key or with a certificate.
+type Peer struct {
+	// PSKIdentity is the identity of the pre-shared key of the client.
+	PSKIdentity string
+	// Certificates is the certificate chain of the client.
+	Certificates []*x509.Certificate
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// PacketConn is a net.PacketConn over the DTLS sessions of the clients of a
+// listener, so the UDP proxies serve them as plain UDP clients. Each datagram
+// read from a client is the data of one of its records, and the datagrams
+// written to a client are sent in its session.
+type PacketConn struct {
+	l                net.Listener
+	handshakeTimeout time.Duration
+	logger           *slog.Logger
+	in               chan datagram
+	done             chan struct{}
+	once             sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*dtlsSession
+}
+
+// dtlsSession is the DTLS session of a client, whose done channel is closed
+// once it ends.
+type dtlsSession struct {
+	conn *piondtls.Conn
+	done chan struct{}
+}
+
+// ListenPacket listens on a UDP address and terminates the DTLS sessions of
+// the clients with the configuration.
+func ListenPacket(address string, c Config, config *piondtls.Config, logger *slog.Logger) (*PacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	l, err := piondtls.Listen("udp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	pc := &PacketConn{
+		l:                l,
+		handshakeTimeout: c.HandshakeTimeout,
+		logger:           logger,
+		in:               make(chan datagram),
+		done:             make(chan struct{}),
+		sessions:         make(map[string]*dtlsSession),
+	}
+	go pc.accept()
+	return pc, nil
+}
+
+func (pc *PacketConn) accept() {
+	for {
+		conn, err := pc.l.Accept()
+		if err != nil {
+			select {
+			case <-pc.done:
+				return
+			default:
+			}
+			pc.logger.Warn("Failed to accept DTLS client: " + err.Error())
+			continue
+		}
+		go pc.serve(conn.(*piondtls.Conn))
+	}
+}
+
+// serve completes the handshake of a client and reads its datagrams until
+// its session ends.
+func (pc *PacketConn) serve(conn *piondtls.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), pc.handshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		pc.logger.Debug("DTLS handshake with " + conn.RemoteAddr().String() + " failed: " + err.Error())
+		return
+	}
+
+	addr := conn.RemoteAddr()
+	s := &dtlsSession{conn: conn, done: make(chan struct{})}
+	pc.mu.Lock()
+	if prev, ok := pc.sessions[addr.String()]; ok {
+		prev.conn.Close()
+	}
+	pc.sessions[addr.String()] = s
+	pc.mu.Unlock()
+	defer pc.remove(s)
+
+	buf := make([]byte, maxRecordSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case pc.in <- datagram{b: append([]byte(nil), buf[:n]...), addr: addr}:
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+func (pc *PacketConn) remove(s *dtlsSession) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	close(s.done)
+	if pc.sessions[s.conn.RemoteAddr().String()] == s {
+		delete(pc.sessions, s.conn.RemoteAddr().String())
+	}
+}
+
+func (pc *PacketConn) conn(addr net.Addr) (*piondtls.Conn, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	s, ok := pc.sessions[addr.String()]
+	if !ok {
+		return nil, false
+	}
+	return s.conn, true
+}
+
+// Done returns a channel closed once the DTLS session of the client of an
+// address ends, or nil if the client has no session.
+func (pc *PacketConn) Done(addr net.Addr) <-chan struct{} {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	s, ok := pc.sessions[addr.String()]
+	if !ok {
+		return nil
+	}
+	return s.done
+}
+
+// Peer returns the identity of the client of an address.
+func (pc *PacketConn) Peer(addr net.Addr) (Peer, error) {
+	conn, ok := pc.conn(addr)
+	if !ok {
+		return Peer{}, errPeer
+	}
+	state, ok := conn.ConnectionState()
+	if !ok {
+		return Peer{}, errPeer
+	}
+	p := Peer{PSKIdentity: string(state.IdentityHint)}
+	for _, raw := range state.PeerCertificates {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return Peer{}, err
+		}
+		p.Certificates = append(p.Certificates, cert)
+	}
+	return p, nil
+}
+
+func (pc *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-pc.in:
+		return copy(b, d.b), d.addr, nil
+	case <-pc.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (pc *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn, ok := pc.conn(addr)
+	if !ok {
+		return 0, errPeer
+	}
+	return conn.Write(b)
+}
+
+// Close stops the listener and ends the sessions of the clients.
+func (pc *PacketConn) Close() error {
+	var err error
+	pc.once.Do(func() {
+		close(pc.done)
+		err = pc.l.Close()
+		pc.mu.Lock()
+		defer pc.mu.Unlock()
+		for _, s := range pc.sessions {
+			s.conn.Close()
+		}
+	})
+	return err
+}
+
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.l.Addr()
+}
+
+func (pc *PacketConn) SetDeadline(time.Time) error {
+	return errDeadline
+}
+
+func (pc *PacketConn) SetReadDeadline(time.Time) error {
+	return errDeadline
+}
+
+func (pc *PacketConn) SetWriteDeadline(time.Time) error {
+	return errDeadline
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable returned when the circuit breaker of the target is open.
+var ErrUnavailable = errors.New("target unavailable")
+
+// breaker is the circuit breaker of a target. It opens after a number of
+// consecutive failures and fails the requests fast until the timeout, after
+// which a single request probes the target to close it again.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	timeout   time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a request may be sent to the target.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a request allowed by the breaker.
+func (b *breaker) done(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	if b.failures++; b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.timeout)
+	}
+}
+
+// release ends a request allowed by the breaker without an outcome.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// targetTransport sends the requests to a target through its circuit breaker,
+// and sends the idempotent requests again after the failures of the target.
+type targetTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+	breaker *breaker
+}
+
+func newTransport(next http.RoundTripper, c Config) http.RoundTripper {
+	if c.Retries <= 0 && c.BreakerFailures <= 0 {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &targetTransport{next: next, retries: c.Retries, backoff: c.RetryBackoff}
+	if c.BreakerFailures > 0 {
+		t.breaker = &breaker{threshold: c.BreakerFailures, timeout: c.BreakerTimeout}
+	}
+	return t
+}
+
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := 0
+	if retryable(req) {
+		retries = t.retries
+	}
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		if t.breaker != nil && !t.breaker.allow() {
+			return nil, ErrUnavailable
+		}
+		resp, err := t.next.RoundTrip(req)
+		ok := err == nil && !failed(resp.StatusCode)
+		switch {
+		case t.breaker == nil:
+		case req.Context().Err() != nil:
+			// Requests canceled by the clients don't tell the target health.
+			t.breaker.release()
+		default:
+			t.breaker.done(ok)
+		}
+		if ok || attempt >= retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// retryable reports whether a request is idempotent and its body, if any,
+// can be sent again.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// failed reports whether a response status denotes a failure of the target.
+func failed(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
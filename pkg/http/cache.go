@@ -0,0 +1,331 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a cached response, stored for the values of the request
+// headers listed by its Vary header.
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	vary    map[string]string
+	stored  time.Time
+	expires time.Time
+	elem    *list.Element
+}
+
+// fresh reports whether the entry can be served without revalidation.
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// matches reports whether the entry was stored for the headers of a request.
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// write serves the entry, or its headers only if the client already has it.
+func (e *cacheEntry) write(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	for name, values := range e.header {
+		h[name] = values
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	if etag := e.header.Get("ETag"); etag != "" && matchETag(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// cache is the in-memory cache of the GET responses of the targets, bounded by
+// the total size of the bodies and evicting the least recently used entries.
+type cache struct {
+	mu      sync.Mutex
+	maxSize int64
+	maxTTL  time.Duration
+	size    int64
+	entries map[string]*cacheEntry
+	lru     *list.List
+}
+
+func newCache(maxSize int64, maxTTL time.Duration) *cache {
+	return &cache{
+		maxSize: maxSize,
+		maxTTL:  maxTTL,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+func (c *cache) get(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !e.matches(r) {
+		return nil
+	}
+	c.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (c *cache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[e.key]; ok {
+		c.remove(old)
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = e
+	c.size += int64(len(e.body))
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// refresh updates an entry revalidated by the target with the headers of the
+// 304 response, and returns it. The entry is dropped if it may no longer be
+// stored.
+func (c *cache) refresh(e *cacheEntry, header http.Header, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	updated := *e
+	updated.header = e.header.Clone()
+	for name, values := range header {
+		updated.header[name] = values
+	}
+	ttl, ok := c.freshness(updated.status, updated.header, r)
+	if cur, ok := c.entries[e.key]; ok {
+		c.remove(cur)
+	}
+	now := time.Now()
+	updated.stored, updated.expires = now, now.Add(ttl)
+	if !ok {
+		return &updated
+	}
+	updated.elem = c.lru.PushFront(&updated)
+	c.entries[updated.key] = &updated
+	c.size += int64(len(updated.body))
+	return &updated
+}
+
+// remove must be called with the lock held.
+func (c *cache) remove(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// freshness returns how long a response may be served from the cache, and
+// whether it may be stored at all. Being a cache shared by the clients, only
+// the responses explicitly allowed to be shared are stored, and a response
+// without freshness is stored only to be revalidated by its ETag.
+func (c *cache) freshness(status int, header http.Header, r *http.Request) (time.Duration, bool) {
+	if status != http.StatusOK || header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return 0, false
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return 0, false
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return 0, false
+	}
+	var ttl time.Duration
+	switch {
+	case cc.has("no-cache"):
+	case cc.has("s-maxage"):
+		ttl = cc.seconds("s-maxage")
+	case cc.has("max-age"):
+		ttl = cc.seconds("max-age")
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	ttl = min(ttl, c.maxTTL)
+	if ttl <= 0 && header.Get("ETag") == "" {
+		return 0, false
+	}
+	return max(ttl, 0), true
+}
+
+// serveCached serves a GET request from the cache while it's fresh, and
+// otherwise proxies it to the target, revalidating the stale entry with its
+// ETag, and stores the response.
+func (p Proxy) serveCached(w http.ResponseWriter, r *http.Request, rp *httputil.ReverseProxy) {
+	cc := parseCacheControl(r.Header)
+	if cc.has("no-store") {
+		rp.ServeHTTP(w, r)
+		return
+	}
+	key := r.Host + r.URL.RequestURI()
+	e := p.cache.get(key, r)
+	if e != nil && e.fresh(time.Now()) && !cc.has("no-cache") {
+		e.write(w, r)
+		return
+	}
+	cw := &cacheWriter{ResponseWriter: w, limit: p.cache.maxSize, cache: p.cache, r: r}
+	if e != nil && e.header.Get("ETag") != "" && r.Header.Get("If-None-Match") == "" {
+		// The 304 of the target is answered with the stored response.
+		r.Header.Set("If-None-Match", e.header.Get("ETag"))
+		cw.header = make(http.Header)
+	}
+	rp.ServeHTTP(cw, r)
+	switch {
+	case cw.status == http.StatusNotModified && cw.header != nil:
+		r.Header.Del("If-None-Match")
+		p.cache.refresh(e, cw.header, r).write(w, r)
+	case cw.store && !cw.overflow:
+		now := time.Now()
+		header := w.Header().Clone()
+		vary := make(map[string]string)
+		for _, v := range header.Values("Vary") {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					vary[name] = r.Header.Get(name)
+				}
+			}
+		}
+		p.cache.put(&cacheEntry{
+			key:     key,
+			status:  cw.status,
+			header:  header,
+			body:    cw.body.Bytes(),
+			vary:    vary,
+			stored:  now,
+			expires: now.Add(cw.ttl),
+		})
+	}
+}
+
+// cacheWriter passes a response to the client while it keeps its body, up to
+// the size of the cache, if the response may be stored. The 304 responses to
+// the revalidations of the cache are held back, with their headers.
+type cacheWriter struct {
+	http.ResponseWriter
+	cache    *cache
+	r        *http.Request
+	limit    int64
+	header   http.Header
+	status   int
+	store    bool
+	ttl      time.Duration
+	overflow bool
+	body     bytes.Buffer
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	if cw.header != nil {
+		return cw.header
+	}
+	return cw.ResponseWriter.Header()
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		// Informational responses are followed by the final one.
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if cw.header != nil {
+		if status == http.StatusNotModified {
+			return
+		}
+		h := cw.ResponseWriter.Header()
+		for name, values := range cw.header {
+			h[name] = values
+		}
+		cw.header = nil
+	}
+	cw.ttl, cw.store = cw.cache.freshness(status, cw.ResponseWriter.Header(), cw.r)
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.header != nil {
+		return len(b), nil
+	}
+	if cw.store && !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush the streamed responses.
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// cacheControl holds the directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) time.Duration {
+	s, err := strconv.Atoi(cc[directive])
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+// matchETag reports whether an If-None-Match header matches an ETag, with
+// the weak comparison.
+func matchETag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"errors"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	errRoute  = errors.New("invalid HTTP route")
+	errHeader = errors.New("invalid HTTP header")
+)
+
+// Config holds the HTTP options of the proxy.
+type Config struct {
+	MaxBody               int64         `env:"HTTP_MAX_BODY"                envDefault:"0"`
+	MaxBufferedBody       int64         `env:"HTTP_MAX_BUFFERED_BODY"       envDefault:"0"`
+	FlushInterval         time.Duration `env:"HTTP_FLUSH_INTERVAL"          envDefault:"0"`
+	HTTP2                 bool          `env:"HTTP_H2"                      envDefault:"false"`
+	TargetH2C             bool          `env:"HTTP_TARGET_H2C"              envDefault:"false"`
+	Routes                []string      `env:"HTTP_ROUTES"                  envDefault:""`
+	RequestHeaders        []string      `env:"HTTP_REQUEST_HEADERS"         envDefault:""`
+	RemoveRequestHeaders  []string      `env:"HTTP_REMOVE_REQUEST_HEADERS"  envDefault:""`
+	RemoveResponseHeaders []string      `env:"HTTP_REMOVE_RESPONSE_HEADERS" envDefault:""`
+	ForwardedHeaders      bool          `env:"HTTP_FORWARDED_HEADERS"       envDefault:"false"`
+	Retries               int           `env:"HTTP_RETRIES"                 envDefault:"0"`
+	RetryBackoff          time.Duration `env:"HTTP_RETRY_BACKOFF"           envDefault:"100ms"`
+	BreakerFailures       int           `env:"HTTP_BREAKER_FAILURES"        envDefault:"0"`
+	BreakerTimeout        time.Duration `env:"HTTP_BREAKER_TIMEOUT"         envDefault:"30s"`
+	SSEIdleTimeout        time.Duration `env:"HTTP_SSE_IDLE_TIMEOUT"        envDefault:"0"`
+	CacheSize             int64         `env:"HTTP_CACHE_SIZE"              envDefault:"0"`
+	CacheTTL              time.Duration `env:"HTTP_CACHE_TTL"               envDefault:"5m"`
+
+	// rules is parsed from Routes.
+	rules []rule
+	// headers is parsed from RequestHeaders.
+	headers []header
+}
+
+// NewConfig parses the HTTP options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	rules, err := parseRules(c.Routes)
+	if err != nil {
+		return Config{}, err
+	}
+	c.rules = rules
+	headers, err := parseHeaders(c.RequestHeaders)
+	if err != nil {
+		return Config{}, err
+	}
+	c.headers = headers
+	return c, nil
+}
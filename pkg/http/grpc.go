@@ -0,0 +1,93 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+const grpcContentType = "application/grpc"
+
+// gRPC status codes of the calls rejected by the proxy.
+const (
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// isGRPC reports whether a request is a gRPC call, which is served over
+// HTTP/2 and excludes gRPC-Web.
+func isGRPC(r *http.Request) bool {
+	if r.ProtoMajor != 2 {
+		return false
+	}
+	ct := r.Header.Get("Content-Type")
+	return ct == grpcContentType || strings.HasPrefix(ct, grpcContentType+"+") || strings.HasPrefix(ct, grpcContentType+";")
+}
+
+// serveGRPC proxies a gRPC call once the client and the method are authorized.
+func (p Proxy) serveGRPC(ctx context.Context, w http.ResponseWriter, r *http.Request, s *session.Session) {
+	if err := p.session.AuthConnect(ctx); err != nil {
+		grpcError(w, grpcUnauthenticated, err)
+		p.logger.Error("Failed to authorize connect", slog.String("remote", s.RemoteIP), slog.Any("error", err))
+		return
+	}
+	if err := p.authGRPC(ctx, r); err != nil {
+		grpcError(w, grpcPermissionDenied, err)
+		p.logger.Error("Failed to authorize gRPC method", slog.String("remote", s.RemoteIP), slog.String("method", r.URL.Path), slog.Any("error", err))
+		return
+	}
+	p.rewriteRequest(r, s)
+	p.upstream(r).ServeHTTP(w, r)
+}
+
+// authGRPC authorizes a gRPC call by its method, given as
+// /package.Service/Method, with the handler. Handlers which don't implement
+// session.GRPCHandler authorize it as a publish of the method, without payload
+// since the messages of the call are streamed.
+func (p Proxy) authGRPC(ctx context.Context, r *http.Request) error {
+	method := r.URL.Path
+	if h, ok := p.session.(session.GRPCHandler); ok {
+		return h.AuthGRPC(ctx, method)
+	}
+	var payload []byte
+	return p.session.Publish(ctx, &method, &payload)
+}
+
+// grpcError rejects a gRPC call with a trailers-only response.
+func grpcError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(err.Error()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcCode returns the gRPC status code of an HTTP error.
+func grpcCode(statusCode int, err error) int {
+	switch {
+	case errors.Is(err, ErrMissingAuthentication), statusCode == http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case statusCode == http.StatusForbidden:
+		return grpcPermissionDenied
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return grpcResourceExhausted
+	case statusCode == http.StatusBadGateway, statusCode == http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case statusCode == http.StatusBadRequest:
+		return grpcInvalidArgument
+	default:
+		return grpcUnknown
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+// header is a request header set by the proxy, whose value is a template.
+type header struct {
+	name  string
+	value string
+}
+
+// forwardingHeaders are the headers set by the proxy with the forwarding
+// headers, which are dropped from the requests of untrusted clients.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip", "Forwarded"}
+
+// parseHeaders returns the headers given as name:value.
+func parseHeaders(headers []string) ([]header, error) {
+	parsed := make([]header, 0, len(headers))
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%w: %s", errHeader, h)
+		}
+		parsed = append(parsed, header{name: textproto.CanonicalMIMEHeaderKey(name), value: strings.TrimSpace(value)})
+	}
+	return parsed, nil
+}
+
+// rewriteRequest applies the header rules to a request authorized by the
+// handler. Headers whose value is empty once expanded are removed, so the
+// clients can't set the headers injected by the proxy.
+func (p Proxy) rewriteRequest(r *http.Request, s *session.Session) {
+	if p.http.ForwardedHeaders {
+		if !p.config.TrustedProxy(r) {
+			for _, h := range forwardingHeaders {
+				r.Header.Del(h)
+			}
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		r.Header.Set("X-Real-Ip", s.RemoteIP)
+	}
+	for _, name := range p.http.RemoveRequestHeaders {
+		r.Header.Del(name)
+	}
+	if len(p.http.headers) == 0 {
+		return
+	}
+	expand := strings.NewReplacer("%u", s.Username, "%n", s.Cert.Subject.CommonName, "%i", s.RemoteIP, "%%", "%")
+	for _, h := range p.http.headers {
+		if v := expand.Replace(h.value); v != "" {
+			r.Header.Set(h.name, v)
+			continue
+		}
+		r.Header.Del(h.name)
+	}
+}
+
+// rewriteResponse removes the configured headers from the responses, and
+// prepares the streams of server-sent events.
+func (p Proxy) rewriteResponse(resp *http.Response) error {
+	for _, name := range p.http.RemoveResponseHeaders {
+		resp.Header.Del(name)
+	}
+	if isEventStream(resp) {
+		p.streamEvents(resp)
+	}
+	return nil
+}
@@ -19,15 +19,25 @@ import (
 	"strings"
 
 	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/jwt"
 	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
 const contentType = "application/json"
 
-// ErrMissingAuthentication returned when no basic or Authorization header is set.
-var ErrMissingAuthentication = errors.New("missing authorization")
+var (
+	// ErrMissingAuthentication returned when no basic or Authorization header is set.
+	ErrMissingAuthentication = errors.New("missing authorization")
+	// ErrBodyTooLarge returned when the request body exceeds the maximum size.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// connKey is the context key of the client connection of a request.
+type connKey struct{}
 
 func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Metrics and health endpoints are served directly.
@@ -41,51 +51,160 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.http.MaxBody > 0 {
+		if r.ContentLength > p.http.MaxBody {
+			encodeError(w, r, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+			return
+		}
+		// Bodies without length are cut once they exceed the limit.
+		r.Body = http.MaxBytesReader(w, r.Body, p.http.MaxBody)
+	}
+
+	conn, _ := r.Context().Value(connKey{}).(net.Conn)
+	if state, ok := mptls.ConnState(conn); ok && r.TLS == nil {
+		// The TLS connections routed by a shared listener are wrapped.
+		r.TLS = &state
+	}
+	mtls := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	claims, err := p.verifyJWT(r)
+	if err != nil {
+		encodeError(w, r, http.StatusUnauthorized, err)
+		p.logger.Error("Failed to verify JWT", slog.String("remote", p.config.ClientIP(r)), slog.Any("error", err))
+		return
+	}
 	username, password, ok := r.BasicAuth()
 	switch {
 	case ok:
 		break
 	case r.Header.Get("Authorization") != "":
 		password = r.Header.Get("Authorization")
+	case mtls:
+		// Clients authenticated with a certificate are left to the handler.
+	case claims != nil:
+		// The token of the query parameters was verified.
 	default:
-		encodeError(w, http.StatusBadGateway, ErrMissingAuthentication)
+		encodeError(w, r, http.StatusBadGateway, ErrMissingAuthentication)
 		return
 	}
 
 	s := &session.Session{
 		Password: []byte(password),
 		Username: username,
+		RemoteIP: p.config.ClientIP(r),
+		Claims:   claims,
+	}
+	if mtls {
+		s.Cert = *r.TLS.PeerCertificates[0]
+		s.Identity = session.NewIdentity(s.Cert)
+		s.MTLS = true
+	}
+	if fp, ok := mptls.ClientFingerprint(conn); ok {
+		s.JA3, s.JA4 = fp.JA3Hash, fp.JA4
 	}
 	ctx := session.NewContext(r.Context(), s)
-	payload, err := io.ReadAll(r.Body)
-	if err != nil {
-		encodeError(w, http.StatusBadRequest, err)
-		p.logger.Error("Failed to read body", slog.Any("error", err))
+	if isGRPC(r) {
+		// The messages of the gRPC calls are streamed to the target.
+		p.serveGRPC(ctx, w, r, s)
 		return
 	}
-	if err := r.Body.Close(); err != nil {
-		encodeError(w, http.StatusInternalServerError, err)
-		p.logger.Error("Failed to close body", slog.Any("error", err))
+	payload, err := p.body(r)
+	if err != nil {
+		if tooLarge(err) {
+			encodeError(w, r, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+			return
+		}
+		encodeError(w, r, http.StatusBadRequest, err)
+		p.logger.Error("Failed to read body", slog.Any("error", err))
 		return
 	}
-
-	// r.Body is reset to ensure it can be safely copied by httputil.ReverseProxy.
-	// no close method is required since NopClose Close() always returns nill.
-	r.Body = io.NopCloser(bytes.NewBuffer(payload))
 	if err := p.session.AuthConnect(ctx); err != nil {
-		encodeError(w, http.StatusUnauthorized, err)
-		p.logger.Error("Failed to authorize connect", slog.Any("error", err))
+		encodeError(w, r, http.StatusUnauthorized, err)
+		p.logger.Error("Failed to authorize connect", slog.String("remote", s.RemoteIP), slog.Any("error", err))
 		return
 	}
 	if err := p.session.Publish(ctx, &r.RequestURI, &payload); err != nil {
-		encodeError(w, http.StatusBadRequest, err)
-		p.logger.Error("Failed to publish", slog.Any("error", err))
+		encodeError(w, r, http.StatusBadRequest, err)
+		p.logger.Error("Failed to publish", slog.String("remote", s.RemoteIP), slog.Any("error", err))
 		return
 	}
-	p.target.ServeHTTP(w, r)
+	p.rewriteRequest(r, s)
+	if p.cache != nil && r.Method == http.MethodGet {
+		p.serveCached(w, r, p.upstream(r))
+		return
+	}
+	p.upstream(r).ServeHTTP(w, r)
+}
+
+// verifyJWT returns the claims of the token of a request, or nil if the
+// proxy doesn't verify tokens.
+func (p Proxy) verifyJWT(r *http.Request) (map[string]any, error) {
+	if p.config.JWT == nil {
+		return nil, nil
+	}
+	token, err := jwt.Token(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.config.JWT.Verify(r.Context(), token)
+}
+
+// body returns the payload of a request, whose body is replaced so it can be
+// copied by httputil.ReverseProxy. Bodies larger than the maximum buffered
+// body are streamed to the target instead, and their payload is nil.
+func (p Proxy) body(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if p.http.MaxBufferedBody > 0 {
+		body = io.LimitReader(r.Body, p.http.MaxBufferedBody+1)
+	}
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if p.http.MaxBufferedBody > 0 && int64(len(payload)) > p.http.MaxBufferedBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(payload), r.Body), r.Body}
+		return nil, nil
+	}
+	if err := r.Body.Close(); err != nil {
+		return nil, err
+	}
+	// No close method is required since NopCloser Close() always returns nil.
+	r.Body = io.NopCloser(bytes.NewReader(payload))
+	// The buffered body can be sent again by the retries.
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	return payload, nil
 }
 
-func encodeError(w http.ResponseWriter, statusCode int, err error) {
+// tooLarge reports whether err is due to a body exceeding the maximum size.
+func tooLarge(err error) bool {
+	var e *http.MaxBytesError
+	return errors.As(err, &e)
+}
+
+// proxyError responds to the requests which failed to be proxied, such as
+// streamed bodies exceeding the maximum size or unavailable targets.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case tooLarge(err):
+		encodeError(w, r, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+	case errors.Is(err, ErrUnavailable):
+		encodeError(w, r, http.StatusServiceUnavailable, ErrUnavailable)
+	case isGRPC(r):
+		grpcError(w, grpcUnavailable, ErrUnavailable)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+func encodeError(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	if isGRPC(r) {
+		grpcError(w, grpcCode(statusCode, err), err)
+		return
+	}
 	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", contentType)
 	if err := json.NewEncoder(w).Encode(err); err != nil {
@@ -96,23 +215,69 @@ func encodeError(w http.ResponseWriter, statusCode int, err error) {
 // Proxy represents HTTP Proxy.
 type Proxy struct {
 	config  mproxy.Config
+	http    Config
 	target  *httputil.ReverseProxy
+	routes  []route
+	cache   *cache
 	session session.Handler
 	logger  *slog.Logger
 }
 
-func NewProxy(config mproxy.Config, handler session.Handler, logger *slog.Logger) (Proxy, error) {
+func NewProxy(config mproxy.Config, httpConfig Config, handler session.Handler, logger *slog.Logger) (Proxy, error) {
 	target, err := url.Parse(config.Target)
 	if err != nil {
 		return Proxy{}, err
 	}
 
-	return Proxy{
+	routes := make([]route, 0, len(httpConfig.rules))
+	for _, r := range httpConfig.rules {
+		u, err := url.Parse(r.target)
+		if err != nil {
+			return Proxy{}, err
+		}
+		routes = append(routes, route{rule: r, proxy: newReverseProxy(u, config, httpConfig)})
+	}
+
+	p := Proxy{
 		config:  config,
-		target:  httputil.NewSingleHostReverseProxy(target),
+		http:    httpConfig,
+		target:  newReverseProxy(target, config, httpConfig),
+		routes:  routes,
 		session: handler,
 		logger:  logger,
-	}, nil
+	}
+	if httpConfig.CacheSize > 0 {
+		p.cache = newCache(httpConfig.CacheSize, httpConfig.CacheTTL)
+	}
+	p.target.ModifyResponse = p.rewriteResponse
+	for _, r := range p.routes {
+		r.proxy.ModifyResponse = p.rewriteResponse
+	}
+	return p, nil
+}
+
+// newReverseProxy returns the reverse proxy of a target.
+func newReverseProxy(target *url.URL, config mproxy.Config, httpConfig Config) *httputil.ReverseProxy {
+	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.FlushInterval = httpConfig.FlushInterval
+	rp.ErrorHandler = proxyError
+	switch {
+	case httpConfig.TargetH2C && target.Scheme == "http":
+		// HTTP/2 without TLS, with prior knowledge of the target support.
+		rp.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	case config.TargetTLSConfig != nil:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config.TargetTLSConfig
+		rp.Transport = transport
+	}
+	rp.Transport = newTransport(rp.Transport, httpConfig)
+	return rp
 }
 
 func (p Proxy) Listen(ctx context.Context) error {
@@ -122,18 +287,41 @@ func (p Proxy) Listen(ctx context.Context) error {
 	}
 
 	if p.config.TLSConfig != nil {
-		l = tls.NewListener(l, p.config.TLSConfig)
+		p.config.TLSJobs.Start(ctx)
+		tlsConfig := p.config.TLSConfig
+		if p.http.HTTP2 {
+			tlsConfig = mptls.WithNextProtos(tlsConfig, "h2", "http/1.1")
+		}
+		l = mptls.NewListener(l, tlsConfig)
 	}
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 
 	p.logger.Info(fmt.Sprintf("HTTP proxy server started at %s%s with %s", p.config.Address, p.config.PathPrefix, status))
+	if err := p.Serve(ctx, l); err != nil {
+		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting with errors", p.config.Address, p.config.PathPrefix, status), slog.String("error", err.Error()))
+	} else {
+		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
+	}
+	return nil
+}
 
+// Serve proxies the requests of the connections accepted by l until ctx is
+// done. The connections of l are expected to be already secured, if needed.
+func (p Proxy) Serve(ctx context.Context, l net.Listener) error {
 	var server http.Server
 	g, ctx := errgroup.WithContext(ctx)
 
 	mux := http.NewServeMux()
 	mux.Handle(p.config.PathPrefix, p)
 	server.Handler = mux
+	if p.http.HTTP2 {
+		// The TLS connections negotiating h2 are served over HTTP/2 by the
+		// server, and the plaintext ones upgrading to h2c by the handler.
+		server.Handler = h2c.NewHandler(mux, &http2.Server{})
+	}
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, c)
+	}
 
 	g.Go(func() error {
 		return server.Serve(l)
@@ -143,10 +331,5 @@ func (p Proxy) Listen(ctx context.Context) error {
 		<-ctx.Done()
 		return server.Close()
 	})
-	if err := g.Wait(); err != nil {
-		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting with errors", p.config.Address, p.config.PathPrefix, status), slog.String("error", err.Error()))
-	} else {
-		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
-	}
-	return nil
+	return g.Wait()
 }
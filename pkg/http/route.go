@@ -0,0 +1,69 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// rule routes the requests of a host, or of any host if empty, whose path
+// starts with path to target.
+type rule struct {
+	host   string
+	path   string
+	target string
+}
+
+// route is a rule with the reverse proxy of its target.
+type route struct {
+	rule
+	proxy *httputil.ReverseProxy
+}
+
+// parseRules returns the routing rules, given as host/path=target, where the
+// host is optional.
+func parseRules(routes []string) ([]rule, error) {
+	rules := make([]rule, 0, len(routes))
+	for _, r := range routes {
+		match, target, ok := strings.Cut(r, "=")
+		i := strings.Index(match, "/")
+		if !ok || i < 0 || target == "" {
+			return nil, fmt.Errorf("%w: %s", errRoute, r)
+		}
+		if _, err := url.Parse(target); err != nil {
+			return nil, fmt.Errorf("%w: %s", errRoute, r)
+		}
+		rules = append(rules, rule{host: strings.ToLower(match[:i]), path: match[i:], target: target})
+	}
+	// The rules of a host come first, then the longest paths.
+	sort.SliceStable(rules, func(i, j int) bool {
+		if (rules[i].host != "") != (rules[j].host != "") {
+			return rules[i].host != ""
+		}
+		return len(rules[i].path) > len(rules[j].path)
+	})
+	return rules, nil
+}
+
+// upstream returns the reverse proxy of the first route matching the host and
+// the path of a request, or of the target of the proxy if none matches.
+func (p Proxy) upstream(r *http.Request) *httputil.ReverseProxy {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, rt := range p.routes {
+		if (rt.host == "" || rt.host == host) && strings.HasPrefix(r.URL.Path, rt.path) {
+			return rt.proxy
+		}
+	}
+	return p.target
+}
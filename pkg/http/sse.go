@@ -0,0 +1,118 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const eventStream = "text/event-stream"
+
+// keepAlive is the comment line sent on idle event streams, which is ignored
+// by the clients wherever it appears at the start of a line.
+var keepAlive = []byte(":\n")
+
+// isEventStream reports whether a response is a stream of server-sent events.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == eventStream
+}
+
+// streamEvents prepares a stream of server-sent events to be passed through.
+// The events are flushed to the client as soon as they're copied by
+// httputil.ReverseProxy, the proxies in front of mProxy are told not to buffer
+// them, and idle streams get comments so they aren't closed as inactive.
+func (p Proxy) streamEvents(resp *http.Response) {
+	resp.Header.Set("X-Accel-Buffering", "no")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if p.http.SSEIdleTimeout > 0 {
+		resp.Body = newKeepAliveBody(resp.Body, p.http.SSEIdleTimeout)
+	}
+}
+
+// keepAliveBody is the body of an event stream, which reads a keep-alive
+// comment once the stream has been idle for the timeout at a line boundary.
+type keepAliveBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+func newKeepAliveBody(body io.ReadCloser, idle time.Duration) io.ReadCloser {
+	pr, pw := io.Pipe()
+	b := &keepAliveBody{PipeReader: pr, body: body, done: make(chan struct{})}
+	go b.pump(pw, idle)
+	return b
+}
+
+func (b *keepAliveBody) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+	})
+	b.PipeReader.Close()
+	return b.body.Close()
+}
+
+// pump copies the body to w, and writes the keep-alive comments in between.
+func (b *keepAliveBody) pump(w *io.PipeWriter, idle time.Duration) {
+	chunks := make(chan []byte)
+	errs := make(chan error, 1)
+	go b.read(chunks, errs)
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	lineStart := true
+	for {
+		select {
+		case chunk := <-chunks:
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			lineStart = chunk[len(chunk)-1] == '\n'
+		case err := <-errs:
+			w.CloseWithError(err)
+			return
+		case <-timer.C:
+			if lineStart {
+				if _, err := w.Write(keepAlive); err != nil {
+					return
+				}
+			}
+		case <-b.done:
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(idle)
+	}
+}
+
+// read sends the chunks of the body to pump until it fails or is closed.
+func (b *keepAliveBody) read(chunks chan<- []byte, errs chan<- error) {
+	for {
+		buf := make([]byte, 4096)
+		n, err := b.body.Read(buf)
+		if n > 0 {
+			select {
+			case chunks <- buf[:n]:
+			case <-b.done:
+				return
+			}
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+	}
+}
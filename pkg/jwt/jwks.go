@@ -0,0 +1,187 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// fetchTimeout bounds the request of the key set.
+	fetchTimeout = 10 * time.Second
+	// minRefresh is the minimum time between two requests of the key set,
+	// so tokens of unknown keys can't flood the JWKS endpoint.
+	minRefresh = time.Minute
+)
+
+var errJWKS = errors.New("failed to fetch JWKS")
+
+// jwk is a JSON Web Key of a key set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the public keys of a JWKS URL by key ID.
+type keySet struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.Mutex
+	keys    map[string][]crypto.PublicKey
+	fetched time.Time
+}
+
+func newKeySet(url string, refresh time.Duration) *keySet {
+	return &keySet{url: url, refresh: refresh, client: &http.Client{Timeout: fetchTimeout}}
+}
+
+// lookup returns the keys of a key ID, or all the keys if kid is empty. The
+// key set is fetched again when it is stale or doesn't hold the key ID.
+func (ks *keySet) lookup(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	keys, ok := ks.find(kid)
+	stale := ks.fetched.IsZero() || time.Since(ks.fetched) > ks.refresh
+	if (ok && !stale) || (!stale && time.Since(ks.fetched) < minRefresh) {
+		if ks.keys == nil {
+			// The last request of the key set failed.
+			return nil, errJWKS
+		}
+		return keys, nil
+	}
+	if err := ks.fetch(ctx); err != nil {
+		if ok {
+			// The cached keys are used while the endpoint is unavailable.
+			return keys, nil
+		}
+		return nil, err
+	}
+	keys, _ = ks.find(kid)
+	return keys, nil
+}
+
+func (ks *keySet) find(kid string) ([]crypto.PublicKey, bool) {
+	if kid != "" {
+		keys, ok := ks.keys[kid]
+		return keys, ok
+	}
+	var all []crypto.PublicKey
+	for _, keys := range ks.keys {
+		all = append(all, keys...)
+	}
+	return all, len(all) > 0
+}
+
+func (ks *keySet) fetch(ctx context.Context) error {
+	ks.fetched = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return errors.Join(errJWKS, err)
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return errors.Join(errJWKS, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", errJWKS, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return errors.Join(errJWKS, err)
+	}
+	keys := make(map[string][]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped.
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = append(keys[k.Kid], key)
+		}
+	}
+	ks.keys = keys
+	return nil
+}
+
+// publicKey returns the public key of a RSA, EC or OKP key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errKey
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errKey
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errKey
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errKey
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errKey
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errKey
+	}
+	return new(big.Int).SetBytes(b), nil
+}
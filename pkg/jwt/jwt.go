@@ -0,0 +1,223 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package jwt verifies the JSON Web Tokens of the HTTP and WebSocket clients
+// against the keys of a JWKS URL.
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	// ErrToken is returned for tokens which are malformed or whose signature
+	// or claims aren't valid.
+	ErrToken = errors.New("invalid JWT")
+	// ErrMissingToken is returned for requests without token.
+	ErrMissingToken = errors.New("missing JWT")
+
+	errKey       = errors.New("unsupported JWK")
+	errAlgorithm = errors.New("unsupported JWT algorithm")
+	errSignature = errors.New("invalid JWT signature")
+	errExpired   = errors.New("JWT expired")
+	errNotYet    = errors.New("JWT not valid yet")
+	errIssuer    = errors.New("invalid JWT issuer")
+	errAudience  = errors.New("invalid JWT audience")
+)
+
+// Config holds the options of the JWT verification.
+type Config struct {
+	JWKSURL     string        `env:"JWT_JWKS_URL"     envDefault:""`
+	Issuer      string        `env:"JWT_ISSUER"       envDefault:""`
+	Audience    string        `env:"JWT_AUDIENCE"     envDefault:""`
+	ClockSkew   time.Duration `env:"JWT_CLOCK_SKEW"   envDefault:"30s"`
+	JWKSRefresh time.Duration `env:"JWT_JWKS_REFRESH" envDefault:"1h"`
+}
+
+// NewConfig parses the JWT options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Verifier verifies the signature and the claims of the tokens.
+type Verifier struct {
+	config Config
+	keys   *keySet
+}
+
+// New returns a Verifier of the configuration, or nil if JWKSURL is empty.
+func New(config Config) *Verifier {
+	if config.JWKSURL == "" {
+		return nil
+	}
+	return &Verifier{config: config, keys: newKeySet(config.JWKSURL, config.JWKSRefresh)}
+}
+
+// Verify returns the claims of a token signed by a key of the JWKS URL, whose
+// issuer, audience and validity period match the configuration.
+func (v *Verifier) Verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSON(parts[0], &header); err != nil {
+		return nil, errors.Join(ErrToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Join(ErrToken, err)
+	}
+	keys, err := v.keys.lookup(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if err := verify(header.Alg, key, signed, sig); err == nil {
+			verified = true
+			break
+		} else if errors.Is(err, errAlgorithm) {
+			return nil, errors.Join(ErrToken, err)
+		}
+	}
+	if !verified {
+		return nil, errors.Join(ErrToken, errSignature)
+	}
+	var claims map[string]any
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, errors.Join(ErrToken, err)
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, errors.Join(ErrToken, err)
+	}
+	return claims, nil
+}
+
+// validate checks the registered claims of a token.
+func (v *Verifier) validate(claims map[string]any) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(v.config.ClockSkew)) {
+		return errExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-v.config.ClockSkew)) {
+		return errNotYet
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return errIssuer
+	}
+	if v.config.Audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == v.config.Audience {
+				return nil
+			}
+		case []any:
+			if slices.Contains(aud, any(v.config.Audience)) {
+				return nil
+			}
+		}
+		return errAudience
+	}
+	return nil
+}
+
+// Token returns the token of a request, from its bearer Authorization header
+// or from its access_token query parameter.
+func Token(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token), nil
+		}
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, nil
+	}
+	return "", ErrMissingToken
+}
+
+// verify checks the signature of a token signed with alg by key.
+func verify(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[len(alg)-min(len(alg), 3):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	switch {
+	case alg == "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return errSignature
+		}
+		return nil
+	case hash == 0:
+		return errAlgorithm
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errSignature
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errSignature
+		}
+		return rsa.VerifyPSS(k, hash, digest, sig, nil)
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errSignature
+		}
+		size := (k.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errSignature
+		}
+		return nil
+	}
+	return errAlgorithm
+}
+
+func decodeJSON(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/absmach/mproxy"
 	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/upstream"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -24,6 +25,7 @@ type Proxy struct {
 	interceptor session.Interceptor
 	logger      *slog.Logger
 	dialer      net.Dialer
+	upstream    *upstream.Dialer
 }
 
 // New returns a new MQTT Proxy instance.
@@ -33,6 +35,7 @@ func New(config mproxy.Config, handler session.Handler, interceptor session.Inte
 		handler:     handler,
 		logger:      logger,
 		interceptor: interceptor,
+		upstream:    upstream.NewDialer(config.Target, config.Upstream),
 	}
 }
 
@@ -55,20 +58,44 @@ func (p Proxy) accept(ctx context.Context, l net.Listener) {
 
 func (p Proxy) handle(ctx context.Context, inbound net.Conn) {
 	defer p.close(inbound)
-	outbound, err := p.dialer.Dial("tcp", p.config.Target)
+	clientCert, err := mptls.ClientCert(inbound)
 	if err != nil {
-		p.logger.Error("Cannot connect to remote broker " + p.config.Target + " due to: " + err.Error())
+		p.logger.Error("Failed to get client certificate: " + err.Error())
 		return
 	}
-	defer p.close(outbound)
 
-	clientCert, err := mptls.ClientCert(inbound)
+	s := session.Session{Cert: clientCert, Identity: session.NewIdentity(clientCert), MTLS: len(clientCert.Raw) > 0}
+	if host, _, err := net.SplitHostPort(inbound.RemoteAddr().String()); err == nil {
+		s.RemoteIP = host
+	}
+	if fp, ok := mptls.ClientFingerprint(inbound); ok {
+		s.JA3, s.JA4 = fp.JA3Hash, fp.JA4
+	}
+
+	if p.config.Upstream.Strategy == upstream.ConsistentHash {
+		// The broker is selected by the client ID of the CONNECT packet.
+		var id string
+		if inbound, id, err = session.PeekClientID(inbound, p.config.MQTT.MaxPacketSize); err != nil {
+			p.logger.Error("Failed to read CONNECT packet: " + err.Error())
+			return
+		}
+		ctx = upstream.WithKey(ctx, id)
+	}
+	outbound, err := p.dial(ctx)
 	if err != nil {
-		p.logger.Error("Failed to get client certificate: " + err.Error())
+		p.logger.Error("Cannot connect to remote broker " + p.config.Target + " due to: " + err.Error())
 		return
 	}
+	defer p.close(outbound)
 
-	if err = session.Stream(ctx, inbound, outbound, p.handler, p.interceptor, clientCert); err != io.EOF {
+	cfg := p.config.MQTT
+	if cfg.Listener == "" {
+		cfg.Listener = p.config.Address
+	}
+	if p.config.Upstream.Reconnect {
+		cfg.Redial = p.dial
+	}
+	if err = session.Stream(ctx, inbound, outbound, p.handler, p.interceptor, s, cfg); err != io.EOF {
 		p.logger.Warn(err.Error())
 	}
 }
@@ -81,10 +108,22 @@ func (p Proxy) Listen(ctx context.Context) error {
 	}
 
 	if p.config.TLSConfig != nil {
-		l = tls.NewListener(l, p.config.TLSConfig)
+		p.config.TLSJobs.Start(ctx)
+		l = mptls.NewListener(l, p.config.TLSConfig)
 	}
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 	p.logger.Info(fmt.Sprintf("MQTT proxy server started at %s  with %s", p.config.Address, status))
+	if err := p.Serve(ctx, l); err != nil {
+		p.logger.Info(fmt.Sprintf("MQTT proxy server at %s with %s exiting with errors", p.config.Address, status), slog.String("error", err.Error()))
+	} else {
+		p.logger.Info(fmt.Sprintf("MQTT proxy server at %s with %s exiting...", p.config.Address, status))
+	}
+	return nil
+}
+
+// Serve proxies the connections accepted by l until ctx is done. The
+// connections of l are expected to be already secured, if needed.
+func (p Proxy) Serve(ctx context.Context, l net.Listener) error {
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Acceptor loop
@@ -97,12 +136,27 @@ func (p Proxy) Listen(ctx context.Context) error {
 		<-ctx.Done()
 		return l.Close()
 	})
-	if err := g.Wait(); err != nil {
-		p.logger.Info(fmt.Sprintf("MQTT proxy server at %s with %s exiting with errors", p.config.Address, status), slog.String("error", err.Error()))
-	} else {
-		p.logger.Info(fmt.Sprintf("MQTT proxy server at %s with %s exiting...", p.config.Address, status))
+	return g.Wait()
+}
+
+// dial connects to the target, or to its fallbacks if it is unreachable.
+func (p Proxy) dial(ctx context.Context) (net.Conn, error) {
+	return p.upstream.Dial(ctx, p.dialTarget)
+}
+
+// dialTarget connects to a target, over TLS if the target TLS configuration is
+// set or the scheme of the target requires it.
+func (p Proxy) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	address, secure := upstream.SplitScheme(target)
+	config := p.config.TargetTLSConfig
+	if config == nil && secure {
+		config = &tls.Config{}
 	}
-	return nil
+	if config != nil {
+		d := tls.Dialer{NetDialer: &p.dialer, Config: config}
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return p.dialer.DialContext(ctx, "tcp", address)
 }
 
 func (p Proxy) close(conn net.Conn) {
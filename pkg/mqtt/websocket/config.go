@@ -0,0 +1,82 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package websocket
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	errCompressionLevel = errors.New("invalid WebSocket compression level")
+	errOrigin           = errors.New("invalid WebSocket origin pattern")
+	errRoute            = errors.New("invalid WebSocket route")
+)
+
+// Config holds the WebSocket options of the proxy.
+type Config struct {
+	Compression         bool          `env:"WS_COMPRESSION"          envDefault:"false"`
+	CompressionLevel    int           `env:"WS_COMPRESSION_LEVEL"    envDefault:"1"`
+	ReadLimit           int64         `env:"WS_READ_LIMIT"           envDefault:"0"`
+	ReadBufferSize      int           `env:"WS_READ_BUFFER_SIZE"     envDefault:"0"`
+	WriteBufferSize     int           `env:"WS_WRITE_BUFFER_SIZE"    envDefault:"0"`
+	Subprotocols        []string      `env:"WS_SUBPROTOCOLS"         envDefault:"mqttv3.1,mqtt"`
+	SubprotocolRequired bool          `env:"WS_SUBPROTOCOL_REQUIRED" envDefault:"false"`
+	AllowedOrigins      []string      `env:"WS_ALLOWED_ORIGINS"      envDefault:""`
+	PingInterval        time.Duration `env:"WS_PING_INTERVAL"        envDefault:"0"`
+	PongTimeout         time.Duration `env:"WS_PONG_TIMEOUT"         envDefault:"10s"`
+	Routes              []string      `env:"WS_ROUTES"               envDefault:""`
+
+	// routes holds the path prefixes and the targets of Routes.
+	routes [][2]string
+}
+
+// NewConfig parses the WebSocket options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	if c.CompressionLevel < flate.HuffmanOnly || c.CompressionLevel > flate.BestCompression {
+		return Config{}, errCompressionLevel
+	}
+	routes, err := parseRoutes(c.Routes)
+	if err != nil {
+		return Config{}, err
+	}
+	c.routes = routes
+	for i, o := range c.AllowedOrigins {
+		c.AllowedOrigins[i] = strings.ToLower(o)
+		if _, err := path.Match(c.AllowedOrigins[i], ""); err != nil {
+			return Config{}, fmt.Errorf("%w: %s", errOrigin, o)
+		}
+	}
+	return c, nil
+}
+
+// allowedOrigin reports whether the Origin header of a request matches the
+// allowed origins. Requests without Origin, which aren't sent by browsers,
+// and all requests if no origin is configured, are allowed.
+func (c Config) allowedOrigin(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if len(c.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if ok, _ := path.Match(o, origin); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/upstream"
+)
+
+// route proxies the WebSocket connections of a path prefix to its target,
+// with its handler if set.
+type route struct {
+	path     string
+	handler  session.Handler
+	upstream *upstream.Dialer
+}
+
+// parseRoutes returns the path prefixes of the routes and their targets,
+// given as path=target.
+func parseRoutes(routes []string) ([][2]string, error) {
+	parsed := make([][2]string, 0, len(routes))
+	for _, r := range routes {
+		path, target, ok := strings.Cut(r, "=")
+		if !ok || !strings.HasPrefix(path, "/") || target == "" {
+			return nil, fmt.Errorf("%w: %s", errRoute, r)
+		}
+		parsed = append(parsed, [2]string{path, target})
+	}
+	return parsed, nil
+}
+
+// newRoutes returns the routes of the configuration, which don't fail over
+// to the fallbacks of the listener target.
+func newRoutes(ws Config, cfg upstream.Config) []*route {
+	cfg.Fallbacks = nil
+	routes := make([]*route, 0, len(ws.routes))
+	for _, r := range ws.routes {
+		routes = append(routes, &route{path: r[0], upstream: upstream.NewDialer(r[1], cfg)})
+	}
+	sortRoutes(routes)
+	return routes
+}
+
+// Handle sets the handler of the connections whose path starts with path,
+// instead of the handler of the proxy. Paths without route are proxied to
+// the target of the proxy. Handle must be called before the proxy serves.
+func (p *Proxy) Handle(path string, handler session.Handler) {
+	for _, r := range p.routes {
+		if r.path == path {
+			r.handler = handler
+			return
+		}
+	}
+	p.routes = append(p.routes, &route{path: path, handler: handler})
+	sortRoutes(p.routes)
+}
+
+// route returns the route of the longest path prefix of a request path, nil
+// if none matches.
+func (p Proxy) route(path string) *route {
+	for _, r := range p.routes {
+		if strings.HasPrefix(path, r.path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// sortRoutes orders the routes by decreasing path length, so the longest
+// prefix matches first.
+func sortRoutes(routes []*route) {
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].path) > len(routes[j].path) })
+}
+
+// routeDialer returns the dial function of the target of a route.
+func (p Proxy) routeDialer(r *route) func(ctx context.Context) (net.Conn, error) {
+	if r == nil || r.upstream == nil {
+		return p.dial
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		return r.upstream.Dial(ctx, p.dialTarget)
+	}
+}
@@ -5,48 +5,68 @@ package websocket
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/jwt"
 	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/upstream"
 	"github.com/gorilla/websocket"
 	"golang.org/x/sync/errgroup"
 )
 
+var errSubprotocol = errors.New("no accepted WebSocket subprotocol offered")
+
 // Proxy represents WS Proxy.
 type Proxy struct {
 	config      mproxy.Config
+	ws          Config
+	upgrader    *websocket.Upgrader
+	routes      []*route
 	handler     session.Handler
 	interceptor session.Interceptor
 	logger      *slog.Logger
+	upstream    *upstream.Dialer
 }
 
 // New - creates new WS proxy.
-func New(config mproxy.Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
+func New(config mproxy.Config, ws Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
 	return &Proxy{
 		config:      config,
+		ws:          ws,
+		upgrader:    newUpgrader(ws),
+		routes:      newRoutes(ws, config.Upstream),
 		handler:     handler,
 		interceptor: interceptor,
 		logger:      logger,
+		upstream:    upstream.NewDialer(config.Target, config.Upstream),
 	}
 }
 
-var upgrader = websocket.Upgrader{
-	// Timeout for WS upgrade request handshake
-	HandshakeTimeout: 10 * time.Second,
-	// Paho JS client expecting header Sec-WebSocket-Protocol:mqtt in Upgrade response during handshake.
-	Subprotocols: []string{"mqttv3.1", "mqtt"},
-	// Allow CORS
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// newUpgrader returns the upgrader of the client connections, which
+// negotiates permessage-deflate with the clients offering it if the
+// compression is enabled.
+func newUpgrader(ws Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		// Timeout for WS upgrade request handshake
+		HandshakeTimeout: 10 * time.Second,
+		ReadBufferSize:   ws.ReadBufferSize,
+		WriteBufferSize:  ws.WriteBufferSize,
+		// Paho JS client expecting header Sec-WebSocket-Protocol:mqtt in Upgrade response during handshake.
+		Subprotocols: ws.Subprotocols,
+		// Allow CORS from the allowed origins
+		CheckOrigin:       ws.allowedOrigin,
+		EnableCompression: ws.Compression,
+	}
 }
 
 func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -54,37 +74,74 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	cconn, err := upgrader.Upgrade(w, r, nil)
+	if p.ws.SubprotocolRequired && !p.subprotocol(r) {
+		http.Error(w, errSubprotocol.Error(), http.StatusBadRequest)
+		return
+	}
+	claims, err := p.verifyJWT(r)
+	if err != nil {
+		p.logger.Error("Failed to verify JWT", slog.String("remote", p.config.ClientIP(r)), slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	cconn, err := p.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		p.logger.Error("Error upgrading connection", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if p.ws.ReadLimit > 0 {
+		// The limit applies to the decompressed messages.
+		cconn.SetReadLimit(p.ws.ReadLimit)
+	}
+	if p.ws.Compression {
+		if err := cconn.SetCompressionLevel(p.ws.CompressionLevel); err != nil {
+			p.logger.Error("Error setting compression level", slog.Any("error", err))
+			cconn.Close()
+			return
+		}
+	}
+
+	go p.pass(cconn, r, p.route(r.URL.Path), claims)
+}
 
-	go p.pass(cconn)
+// verifyJWT returns the claims of the token of an upgrade request, or nil if
+// the proxy doesn't verify tokens.
+func (p Proxy) verifyJWT(r *http.Request) (map[string]any, error) {
+	if p.config.JWT == nil {
+		return nil, nil
+	}
+	token, err := jwt.Token(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.config.JWT.Verify(r.Context(), token)
 }
 
-func (p Proxy) pass(in *websocket.Conn) {
+// subprotocol reports whether the client offers one of the accepted subprotocols.
+func (p Proxy) subprotocol(r *http.Request) bool {
+	for _, sp := range websocket.Subprotocols(r) {
+		if slices.Contains(p.ws.Subprotocols, sp) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Proxy) pass(in *websocket.Conn, r *http.Request, rt *route, claims map[string]any) {
 	defer in.Close()
 	// Using a new context so as to avoiding infinitely long traces.
 	// And also avoiding proxy cancellation due to parent context cancellation.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	dialer := &websocket.Dialer{
-		Subprotocols: []string{"mqtt"},
-	}
-	srv, _, err := dialer.Dial(p.config.Target, nil)
-	if err != nil {
-		p.logger.Error("Unable to connect to broker", slog.Any("error", err))
-		return
-	}
-
 	errc := make(chan error, 1)
 	inboundConn := newConn(in)
-	outboundConn := newConn(srv)
+	remote := p.config.ClientIP(r)
+	if p.ws.PingInterval > 0 {
+		go p.keepAlive(ctx, in, remote)
+	}
 
 	defer inboundConn.Close()
-	defer outboundConn.Close()
 
 	clientCert, err := mptls.ClientCert(in.UnderlyingConn())
 	if err != nil {
@@ -92,9 +149,42 @@ func (p Proxy) pass(in *websocket.Conn) {
 		return
 	}
 
-	err = session.Stream(ctx, inboundConn, outboundConn, p.handler, p.interceptor, clientCert)
+	s := session.Session{Cert: clientCert, Identity: session.NewIdentity(clientCert), MTLS: len(clientCert.Raw) > 0}
+	s.RemoteIP, s.Header, s.Cookies, s.Query = remote, r.Header.Clone(), r.Cookies(), r.URL.Query()
+	s.Claims = claims
+	if fp, ok := mptls.ClientFingerprint(in.UnderlyingConn()); ok {
+		s.JA3, s.JA4 = fp.JA3Hash, fp.JA4
+	}
+
+	if p.config.Upstream.Strategy == upstream.ConsistentHash {
+		// The broker is selected by the client ID of the CONNECT packet.
+		var id string
+		if inboundConn, id, err = session.PeekClientID(inboundConn, p.config.MQTT.MaxPacketSize); err != nil {
+			p.logger.Error("Failed to read CONNECT packet", slog.Any("error", err))
+			return
+		}
+		ctx = upstream.WithKey(ctx, id)
+	}
+	dial, handler := p.routeDialer(rt), p.handler
+	if rt != nil && rt.handler != nil {
+		handler = rt.handler
+	}
+	outboundConn, err := dial(ctx)
+	if err != nil {
+		p.logger.Error("Unable to connect to broker", slog.String("remote", remote), slog.Any("error", err))
+		return
+	}
+	defer outboundConn.Close()
+	cfg := p.config.MQTT
+	if cfg.Listener == "" {
+		cfg.Listener = p.config.Address
+	}
+	if p.config.Upstream.Reconnect {
+		cfg.Redial = dial
+	}
+	err = session.Stream(ctx, inboundConn, outboundConn, handler, p.interceptor, s, cfg)
 	errc <- err
-	p.logger.Warn("Broken connection for client", slog.Any("error", err))
+	p.logger.Warn("Broken connection for client", slog.String("remote", remote), slog.Any("error", err))
 }
 
 func (p Proxy) Listen(ctx context.Context) error {
@@ -104,9 +194,23 @@ func (p Proxy) Listen(ctx context.Context) error {
 	}
 
 	if p.config.TLSConfig != nil {
-		l = tls.NewListener(l, p.config.TLSConfig)
+		p.config.TLSJobs.Start(ctx)
+		l = mptls.NewListener(l, p.config.TLSConfig)
+	}
+	status := mptls.SecurityStatus(p.config.TLSConfig)
+
+	p.logger.Info(fmt.Sprintf("MQTT websocket proxy server started at %s%s with %s", p.config.Address, p.config.PathPrefix, status))
+	if err := p.Serve(ctx, l); err != nil {
+		p.logger.Info(fmt.Sprintf("MQTT websocket proxy server at %s%s with %s exiting with errors", p.config.Address, p.config.PathPrefix, status), slog.String("error", err.Error()))
+	} else {
+		p.logger.Info(fmt.Sprintf("MQTT websocket proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
 	}
+	return nil
+}
 
+// Serve proxies the WebSocket connections accepted by l until ctx is done.
+// The connections of l are expected to be already secured, if needed.
+func (p Proxy) Serve(ctx context.Context, l net.Listener) error {
 	var server http.Server
 	g, ctx := errgroup.WithContext(ctx)
 
@@ -117,18 +221,64 @@ func (p Proxy) Listen(ctx context.Context) error {
 	g.Go(func() error {
 		return server.Serve(l)
 	})
-	status := mptls.SecurityStatus(p.config.TLSConfig)
-
-	p.logger.Info(fmt.Sprintf("MQTT websocket proxy server started at %s%s with %s", p.config.Address, p.config.PathPrefix, status))
 
 	g.Go(func() error {
 		<-ctx.Done()
 		return server.Close()
 	})
-	if err := g.Wait(); err != nil {
-		p.logger.Info(fmt.Sprintf("MQTT websocket proxy server at %s%s with %s exiting with errors", p.config.Address, p.config.PathPrefix, status), slog.String("error", err.Error()))
-	} else {
-		p.logger.Info(fmt.Sprintf("MQTT websocket proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
+	return g.Wait()
+}
+
+// keepAlive pings the client every ping interval and closes its connection
+// if the pong doesn't arrive within the pong timeout, so half-open
+// connections are detected regardless of the MQTT keep alive.
+func (p Proxy) keepAlive(ctx context.Context, conn *websocket.Conn, remote string) {
+	var pong atomic.Int64
+	conn.SetPongHandler(func(string) error {
+		pong.Store(time.Now().UnixNano())
+		return nil
+	})
+	ticker := time.NewTicker(p.ws.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		sent := time.Now()
+		if err := conn.WriteControl(websocket.PingMessage, nil, sent.Add(p.ws.PongTimeout)); err != nil {
+			return
+		}
+		timer := time.NewTimer(p.ws.PongTimeout)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if pong.Load() < sent.UnixNano() {
+			p.logger.Warn("Closing WebSocket connection without pong", slog.String("remote", remote))
+			conn.Close()
+			return
+		}
 	}
-	return nil
+}
+
+// dial connects to the target, or to its fallbacks if it is unreachable.
+func (p Proxy) dial(ctx context.Context) (net.Conn, error) {
+	return p.upstream.Dial(ctx, p.dialTarget)
+}
+
+// dialTarget connects to a WebSocket target.
+func (p Proxy) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		Subprotocols:    []string{"mqtt"},
+		TLSClientConfig: p.config.TargetTLSConfig,
+	}
+	srv, _, err := dialer.DialContext(ctx, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(srv), nil
 }
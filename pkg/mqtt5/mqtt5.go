@@ -0,0 +1,386 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mqtt5 encodes and decodes MQTT v5 control packets.
+package mqtt5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the protocol level of MQTT v5 in the CONNECT packet.
+const Version byte = 5
+
+// Control packet types.
+const (
+	CONNECT     byte = 1
+	CONNACK     byte = 2
+	PUBLISH     byte = 3
+	PUBACK      byte = 4
+	PUBREC      byte = 5
+	PUBREL      byte = 6
+	PUBCOMP     byte = 7
+	SUBSCRIBE   byte = 8
+	SUBACK      byte = 9
+	UNSUBSCRIBE byte = 10
+	UNSUBACK    byte = 11
+	PINGREQ     byte = 12
+	PINGRESP    byte = 13
+	DISCONNECT  byte = 14
+	AUTH        byte = 15
+)
+
+var packetNames = [...]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+	AUTH:        "AUTH",
+}
+
+// PacketName returns the name of a control packet type, such as PUBLISH.
+func PacketName(typ byte) string {
+	if int(typ) < len(packetNames) && packetNames[typ] != "" {
+		return packetNames[typ]
+	}
+	return "UNKNOWN"
+}
+
+// Reason codes used by the proxy.
+const (
+	Success                     byte = 0x00
+	DisconnectWithWill          byte = 0x04
+	UnspecifiedError            byte = 0x80
+	MalformedPacket             byte = 0x81
+	ProtocolError               byte = 0x82
+	ImplementationSpecificError byte = 0x83
+	UnsupportedProtocolVersion  byte = 0x84
+	ClientIdentifierNotValid    byte = 0x85
+	BadUserNameOrPassword       byte = 0x86
+	NotAuthorized               byte = 0x87
+	ServerUnavailable           byte = 0x88
+	ServerBusy                  byte = 0x89
+	BadAuthenticationMethod     byte = 0x8C
+	KeepAliveTimeout            byte = 0x8D
+	SessionTakenOver            byte = 0x8E
+	TopicFilterInvalid          byte = 0x8F
+	TopicNameInvalid            byte = 0x90
+	PacketIdentifierInUse       byte = 0x91
+	ReceiveMaximumExceeded      byte = 0x93
+	TopicAliasInvalid           byte = 0x94
+	PacketTooLarge              byte = 0x95
+	MessageRateTooHigh          byte = 0x96
+	QuotaExceeded               byte = 0x97
+	AdministrativeAction        byte = 0x98
+	PayloadFormatInvalid        byte = 0x99
+	RetainNotSupported          byte = 0x9A
+	QoSNotSupported             byte = 0x9B
+	UseAnotherServer            byte = 0x9C
+	ServerMoved                 byte = 0x9D
+	SharedSubNotSupported       byte = 0x9E
+	ConnectionRateExceeded      byte = 0x9F
+	MaximumConnectTime          byte = 0xA0
+	SubIDsNotSupported          byte = 0xA1
+	WildcardSubNotSupported     byte = 0xA2
+)
+
+// maxRemainingLength is the largest remaining length of an MQTT packet.
+const maxRemainingLength = 268435455
+
+var (
+	// ErrMalformedPacket indicates a packet which can't be decoded.
+	ErrMalformedPacket = errors.New("malformed MQTT v5 packet")
+
+	// ErrPacketTooLarge indicates a packet exceeding the maximum packet size.
+	ErrPacketTooLarge = errors.New("MQTT packet too large")
+
+	errPacketType = errors.New("unknown MQTT packet type")
+	errLength     = errors.New("malformed MQTT remaining length")
+)
+
+// Packet is an MQTT v5 control packet.
+type Packet interface {
+	// Type returns the control packet type.
+	Type() byte
+	// Write encodes the packet to w.
+	Write(w io.Writer) error
+}
+
+// ReadPacket reads and decodes a packet from r.
+func ReadPacket(r io.Reader) (Packet, error) {
+	raw, err := ReadFrame(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(raw)
+}
+
+// ReadFrame reads the raw bytes of a packet of any MQTT version from r,
+// including its fixed header. If limit is positive, packets larger than limit
+// bytes are rejected with an error wrapping ErrPacketTooLarge before their
+// payload is read.
+func ReadFrame(r io.Reader, limit int) ([]byte, error) {
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errLength
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+		length += int(b[0]&0x7f) * multiplier
+		if b[0]&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if limit > 0 && len(header)+length > limit {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPacketTooLarge, len(header)+length)
+	}
+	raw := make([]byte, len(header)+length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[len(header):]); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// ConnectVersion returns the protocol level of a raw CONNECT packet, or zero
+// if raw is not a CONNECT packet.
+func ConnectVersion(raw []byte) byte {
+	if len(raw) == 0 || raw[0]>>4 != CONNECT {
+		return 0
+	}
+	d := decoder{b: raw[1:]}
+	d.varint()
+	d.string()
+	v := d.byte()
+	if d.err != nil {
+		return 0
+	}
+	return v
+}
+
+// ConnectClientID returns the client identifier of a raw CONNECT packet of
+// MQTT v5 or MQTT 3.1.1, or false if raw is not a CONNECT packet.
+func ConnectClientID(raw []byte) (string, bool) {
+	if len(raw) == 0 || raw[0]>>4 != CONNECT {
+		return "", false
+	}
+	d := decoder{b: raw[1:]}
+	d.varint()
+	d.string()
+	v := d.byte()
+	// Skip the connect flags and the keep alive.
+	d.take(3)
+	if v == Version {
+		d.take(d.varint())
+	}
+	id := d.string()
+	if d.err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// Decode decodes a raw packet read by ReadFrame.
+func Decode(raw []byte) (Packet, error) {
+	if len(raw) < 2 {
+		return nil, ErrMalformedPacket
+	}
+	d := decoder{b: raw[1:]}
+	length := d.varint()
+	if d.err != nil || length != len(d.b) {
+		return nil, ErrMalformedPacket
+	}
+	typ, flags := raw[0]>>4, raw[0]&0x0f
+	var pkt interface {
+		Packet
+		decode(flags byte, d *decoder)
+	}
+	switch typ {
+	case CONNECT:
+		pkt = &Connect{}
+	case CONNACK:
+		pkt = &Connack{}
+	case PUBLISH:
+		pkt = &Publish{}
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		pkt = &Ack{PacketType: typ}
+	case SUBSCRIBE:
+		pkt = &Subscribe{}
+	case SUBACK:
+		pkt = &Suback{}
+	case UNSUBSCRIBE:
+		pkt = &Unsubscribe{}
+	case UNSUBACK:
+		pkt = &Unsuback{}
+	case PINGREQ, PINGRESP:
+		pkt = &Ping{PacketType: typ}
+	case DISCONNECT:
+		pkt = &Disconnect{}
+	case AUTH:
+		pkt = &Auth{}
+	default:
+		return nil, errPacketType
+	}
+	pkt.decode(flags, &d)
+	if d.err == nil && !d.empty() {
+		d.err = ErrMalformedPacket
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return pkt, nil
+}
+
+// writePacket writes the fixed header and the body of a packet.
+func writePacket(w io.Writer, typ, flags byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return ErrPacketTooLarge
+	}
+	b := make([]byte, 0, 5+len(body))
+	b = append(b, typ<<4|flags)
+	b = appendVarint(b, len(body))
+	b = append(b, body...)
+	_, err := w.Write(b)
+	return err
+}
+
+// decoder reads the fields of a packet, recording the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = ErrMalformedPacket
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	return 0
+}
+
+func (d *decoder) varint() int {
+	v, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		if d.err != nil {
+			return 0
+		}
+		v += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return v
+		}
+		multiplier *= 128
+	}
+	d.err = ErrMalformedPacket
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := d.uint16()
+	if b := d.take(int(n)); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (d *decoder) string() string {
+	n := d.uint16()
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) rest() []byte {
+	b := append([]byte{}, d.b...)
+	d.b = nil
+	return b
+}
+
+func (d *decoder) empty() bool {
+	return len(d.b) == 0
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendVarint(b []byte, v int) []byte {
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func appendBinary(b, v []byte) []byte {
+	return append(appendUint16(b, uint16(len(v))), v...)
+}
+
+func appendString(b []byte, v string) []byte {
+	return append(appendUint16(b, uint16(len(v))), v...)
+}
+
+// Encode returns the encoded bytes of a packet.
+func Encode(p Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,407 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt5
+
+import "io"
+
+// Connect is the CONNECT packet.
+type Connect struct {
+	ProtocolName    string
+	ProtocolVersion byte
+	CleanStart      bool
+	KeepAlive       uint16
+	Properties      Properties
+	ClientID        string
+
+	WillFlag       bool
+	WillQoS        byte
+	WillRetain     bool
+	WillProperties Properties
+	WillTopic      string
+	WillPayload    []byte
+
+	UsernameFlag bool
+	Username     string
+	PasswordFlag bool
+	Password     []byte
+}
+
+func (p *Connect) Type() byte { return CONNECT }
+
+func (p *Connect) decode(_ byte, d *decoder) {
+	p.ProtocolName = d.string()
+	p.ProtocolVersion = d.byte()
+	flags := d.byte()
+	if flags&0x01 != 0 {
+		d.err = ErrMalformedPacket
+		return
+	}
+	p.CleanStart = flags&0x02 != 0
+	p.WillFlag = flags&0x04 != 0
+	p.WillQoS = flags >> 3 & 0x03
+	p.WillRetain = flags&0x20 != 0
+	p.PasswordFlag = flags&0x40 != 0
+	p.UsernameFlag = flags&0x80 != 0
+	p.KeepAlive = d.uint16()
+	p.Properties.decode(d)
+	p.ClientID = d.string()
+	if p.WillFlag {
+		p.WillProperties.decode(d)
+		p.WillTopic = d.string()
+		p.WillPayload = d.binary()
+	}
+	if p.UsernameFlag {
+		p.Username = d.string()
+	}
+	if p.PasswordFlag {
+		p.Password = d.binary()
+	}
+}
+
+func (p *Connect) Write(w io.Writer) error {
+	b := appendString(nil, p.ProtocolName)
+	b = append(b, p.ProtocolVersion)
+	var flags byte
+	if p.CleanStart {
+		flags |= 0x02
+	}
+	if p.WillFlag {
+		flags |= 0x04 | p.WillQoS<<3
+		if p.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if p.PasswordFlag {
+		flags |= 0x40
+	}
+	if p.UsernameFlag {
+		flags |= 0x80
+	}
+	b = append(b, flags)
+	b = appendUint16(b, p.KeepAlive)
+	b = p.Properties.encode(b)
+	b = appendString(b, p.ClientID)
+	if p.WillFlag {
+		b = p.WillProperties.encode(b)
+		b = appendString(b, p.WillTopic)
+		b = appendBinary(b, p.WillPayload)
+	}
+	if p.UsernameFlag {
+		b = appendString(b, p.Username)
+	}
+	if p.PasswordFlag {
+		b = appendBinary(b, p.Password)
+	}
+	return writePacket(w, CONNECT, 0, b)
+}
+
+// Connack is the CONNACK packet.
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     Properties
+}
+
+func (p *Connack) Type() byte { return CONNACK }
+
+func (p *Connack) decode(_ byte, d *decoder) {
+	p.SessionPresent = d.byte()&0x01 != 0
+	p.ReasonCode = d.byte()
+	if !d.empty() {
+		p.Properties.decode(d)
+	}
+}
+
+func (p *Connack) Write(w io.Writer) error {
+	var b []byte
+	if p.SessionPresent {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, p.ReasonCode)
+	b = p.Properties.encode(b)
+	return writePacket(w, CONNACK, 0, b)
+}
+
+// Publish is the PUBLISH packet.
+type Publish struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+func (p *Publish) Type() byte { return PUBLISH }
+
+func (p *Publish) decode(flags byte, d *decoder) {
+	p.Dup = flags&0x08 != 0
+	p.QoS = flags >> 1 & 0x03
+	p.Retain = flags&0x01 != 0
+	if p.QoS > 2 {
+		d.err = ErrMalformedPacket
+		return
+	}
+	p.Topic = d.string()
+	if p.QoS > 0 {
+		p.PacketID = d.uint16()
+	}
+	p.Properties.decode(d)
+	p.Payload = d.rest()
+}
+
+func (p *Publish) Write(w io.Writer) error {
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+	b := appendString(nil, p.Topic)
+	if p.QoS > 0 {
+		b = appendUint16(b, p.PacketID)
+	}
+	b = p.Properties.encode(b)
+	b = append(b, p.Payload...)
+	return writePacket(w, PUBLISH, flags, b)
+}
+
+// Ack is a PUBACK, PUBREC, PUBREL or PUBCOMP packet.
+type Ack struct {
+	PacketType byte
+	PacketID   uint16
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Ack) Type() byte { return p.PacketType }
+
+func (p *Ack) decode(_ byte, d *decoder) {
+	p.PacketID = d.uint16()
+	if d.empty() {
+		return
+	}
+	p.ReasonCode = d.byte()
+	if !d.empty() {
+		p.Properties.decode(d)
+	}
+}
+
+func (p *Ack) Write(w io.Writer) error {
+	var flags byte
+	if p.PacketType == PUBREL {
+		flags = 0x02
+	}
+	b := appendUint16(nil, p.PacketID)
+	if props := p.Properties.encode(nil); p.ReasonCode != Success || len(props) > 1 {
+		b = append(append(b, p.ReasonCode), props...)
+	}
+	return writePacket(w, p.PacketType, flags, b)
+}
+
+// Subscription is a topic filter of a SUBSCRIBE packet with its options.
+type Subscription struct {
+	Topic             string
+	QoS               byte
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+// Subscribe is the SUBSCRIBE packet.
+type Subscribe struct {
+	PacketID      uint16
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+func (p *Subscribe) Type() byte { return SUBSCRIBE }
+
+func (p *Subscribe) decode(_ byte, d *decoder) {
+	p.PacketID = d.uint16()
+	p.Properties.decode(d)
+	for !d.empty() && d.err == nil {
+		s := Subscription{Topic: d.string()}
+		opts := d.byte()
+		s.QoS = opts & 0x03
+		s.NoLocal = opts&0x04 != 0
+		s.RetainAsPublished = opts&0x08 != 0
+		s.RetainHandling = opts >> 4 & 0x03
+		p.Subscriptions = append(p.Subscriptions, s)
+	}
+	if d.err == nil && len(p.Subscriptions) == 0 {
+		d.err = ErrMalformedPacket
+	}
+}
+
+func (p *Subscribe) Write(w io.Writer) error {
+	b := appendUint16(nil, p.PacketID)
+	b = p.Properties.encode(b)
+	for _, s := range p.Subscriptions {
+		opts := s.QoS | s.RetainHandling<<4
+		if s.NoLocal {
+			opts |= 0x04
+		}
+		if s.RetainAsPublished {
+			opts |= 0x08
+		}
+		b = append(appendString(b, s.Topic), opts)
+	}
+	return writePacket(w, SUBSCRIBE, 0x02, b)
+}
+
+// Topics returns the topic filters of the subscriptions.
+func (p *Subscribe) Topics() []string {
+	topics := make([]string, len(p.Subscriptions))
+	for i, s := range p.Subscriptions {
+		topics[i] = s.Topic
+	}
+	return topics
+}
+
+// Suback is the SUBACK packet.
+type Suback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []byte
+}
+
+func (p *Suback) Type() byte { return SUBACK }
+
+func (p *Suback) decode(_ byte, d *decoder) {
+	p.PacketID = d.uint16()
+	p.Properties.decode(d)
+	p.ReasonCodes = d.rest()
+}
+
+func (p *Suback) Write(w io.Writer) error {
+	b := appendUint16(nil, p.PacketID)
+	b = p.Properties.encode(b)
+	b = append(b, p.ReasonCodes...)
+	return writePacket(w, SUBACK, 0, b)
+}
+
+// Unsubscribe is the UNSUBSCRIBE packet.
+type Unsubscribe struct {
+	PacketID   uint16
+	Properties Properties
+	Topics     []string
+}
+
+func (p *Unsubscribe) Type() byte { return UNSUBSCRIBE }
+
+func (p *Unsubscribe) decode(_ byte, d *decoder) {
+	p.PacketID = d.uint16()
+	p.Properties.decode(d)
+	for !d.empty() && d.err == nil {
+		p.Topics = append(p.Topics, d.string())
+	}
+	if d.err == nil && len(p.Topics) == 0 {
+		d.err = ErrMalformedPacket
+	}
+}
+
+func (p *Unsubscribe) Write(w io.Writer) error {
+	b := appendUint16(nil, p.PacketID)
+	b = p.Properties.encode(b)
+	for _, t := range p.Topics {
+		b = appendString(b, t)
+	}
+	return writePacket(w, UNSUBSCRIBE, 0x02, b)
+}
+
+// Unsuback is the UNSUBACK packet.
+type Unsuback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []byte
+}
+
+func (p *Unsuback) Type() byte { return UNSUBACK }
+
+func (p *Unsuback) decode(_ byte, d *decoder) {
+	p.PacketID = d.uint16()
+	p.Properties.decode(d)
+	p.ReasonCodes = d.rest()
+}
+
+func (p *Unsuback) Write(w io.Writer) error {
+	b := appendUint16(nil, p.PacketID)
+	b = p.Properties.encode(b)
+	b = append(b, p.ReasonCodes...)
+	return writePacket(w, UNSUBACK, 0, b)
+}
+
+// Ping is a PINGREQ or PINGRESP packet.
+type Ping struct {
+	PacketType byte
+}
+
+func (p *Ping) Type() byte { return p.PacketType }
+
+func (p *Ping) decode(_ byte, d *decoder) {
+	if !d.empty() {
+		d.err = ErrMalformedPacket
+	}
+}
+
+func (p *Ping) Write(w io.Writer) error {
+	return writePacket(w, p.PacketType, 0, nil)
+}
+
+// Disconnect is the DISCONNECT packet.
+type Disconnect struct {
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Disconnect) Type() byte { return DISCONNECT }
+
+func (p *Disconnect) decode(_ byte, d *decoder) {
+	if d.empty() {
+		return
+	}
+	p.ReasonCode = d.byte()
+	if !d.empty() {
+		p.Properties.decode(d)
+	}
+}
+
+func (p *Disconnect) Write(w io.Writer) error {
+	var b []byte
+	if props := p.Properties.encode(nil); p.ReasonCode != Success || len(props) > 1 {
+		b = append(append(b, p.ReasonCode), props...)
+	}
+	return writePacket(w, DISCONNECT, 0, b)
+}
+
+// Auth is the AUTH packet, used for enhanced authentication.
+type Auth struct {
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Auth) Type() byte { return AUTH }
+
+func (p *Auth) decode(_ byte, d *decoder) {
+	if d.empty() {
+		return
+	}
+	p.ReasonCode = d.byte()
+	if !d.empty() {
+		p.Properties.decode(d)
+	}
+}
+
+func (p *Auth) Write(w io.Writer) error {
+	var b []byte
+	if props := p.Properties.encode(nil); p.ReasonCode != Success || len(props) > 1 {
+		b = append(append(b, p.ReasonCode), props...)
+	}
+	return writePacket(w, AUTH, 0, b)
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt5
+
+// Property identifiers.
+const (
+	PropPayloadFormat        byte = 0x01
+	PropMessageExpiry        byte = 0x02
+	PropContentType          byte = 0x03
+	PropResponseTopic        byte = 0x08
+	PropCorrelationData      byte = 0x09
+	PropSubscriptionID       byte = 0x0B
+	PropSessionExpiry        byte = 0x11
+	PropAssignedClientID     byte = 0x12
+	PropServerKeepAlive      byte = 0x13
+	PropAuthMethod           byte = 0x15
+	PropAuthData             byte = 0x16
+	PropRequestProblemInfo   byte = 0x17
+	PropWillDelay            byte = 0x18
+	PropRequestResponseInfo  byte = 0x19
+	PropResponseInfo         byte = 0x1A
+	PropServerReference      byte = 0x1C
+	PropReasonString         byte = 0x1F
+	PropReceiveMaximum       byte = 0x21
+	PropTopicAliasMaximum    byte = 0x22
+	PropTopicAlias           byte = 0x23
+	PropMaximumQoS           byte = 0x24
+	PropRetainAvailable      byte = 0x25
+	PropUser                 byte = 0x26
+	PropMaximumPacketSize    byte = 0x27
+	PropWildcardSubAvailable byte = 0x28
+	PropSubIDAvailable       byte = 0x29
+	PropSharedSubAvailable   byte = 0x2A
+)
+
+// UserProperty is a name and value pair of user properties.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the properties of a packet or of a will message. Optional
+// properties which are absent are nil.
+type Properties struct {
+	PayloadFormat        *byte
+	MessageExpiry        *uint32
+	ContentType          *string
+	ResponseTopic        *string
+	CorrelationData      []byte
+	SubscriptionIDs      []int
+	SessionExpiry        *uint32
+	AssignedClientID     *string
+	ServerKeepAlive      *uint16
+	AuthMethod           *string
+	AuthData             []byte
+	RequestProblemInfo   *byte
+	WillDelay            *uint32
+	RequestResponseInfo  *byte
+	ResponseInfo         *string
+	ServerReference      *string
+	ReasonString         *string
+	ReceiveMaximum       *uint16
+	TopicAliasMaximum    *uint16
+	TopicAlias           *uint16
+	MaximumQoS           *byte
+	RetainAvailable      *byte
+	User                 []UserProperty
+	MaximumPacketSize    *uint32
+	WildcardSubAvailable *byte
+	SubIDAvailable       *byte
+	SharedSubAvailable   *byte
+}
+
+func (p *Properties) decode(d *decoder) {
+	length := d.varint()
+	b := d.take(length)
+	if d.err != nil {
+		return
+	}
+	pd := decoder{b: b}
+	for !pd.empty() && pd.err == nil {
+		switch id := pd.byte(); id {
+		case PropPayloadFormat:
+			p.PayloadFormat = ptr(pd.byte())
+		case PropMessageExpiry:
+			p.MessageExpiry = ptr(pd.uint32())
+		case PropContentType:
+			p.ContentType = ptr(pd.string())
+		case PropResponseTopic:
+			p.ResponseTopic = ptr(pd.string())
+		case PropCorrelationData:
+			p.CorrelationData = pd.binary()
+		case PropSubscriptionID:
+			p.SubscriptionIDs = append(p.SubscriptionIDs, pd.varint())
+		case PropSessionExpiry:
+			p.SessionExpiry = ptr(pd.uint32())
+		case PropAssignedClientID:
+			p.AssignedClientID = ptr(pd.string())
+		case PropServerKeepAlive:
+			p.ServerKeepAlive = ptr(pd.uint16())
+		case PropAuthMethod:
+			p.AuthMethod = ptr(pd.string())
+		case PropAuthData:
+			p.AuthData = pd.binary()
+		case PropRequestProblemInfo:
+			p.RequestProblemInfo = ptr(pd.byte())
+		case PropWillDelay:
+			p.WillDelay = ptr(pd.uint32())
+		case PropRequestResponseInfo:
+			p.RequestResponseInfo = ptr(pd.byte())
+		case PropResponseInfo:
+			p.ResponseInfo = ptr(pd.string())
+		case PropServerReference:
+			p.ServerReference = ptr(pd.string())
+		case PropReasonString:
+			p.ReasonString = ptr(pd.string())
+		case PropReceiveMaximum:
+			p.ReceiveMaximum = ptr(pd.uint16())
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum = ptr(pd.uint16())
+		case PropTopicAlias:
+			p.TopicAlias = ptr(pd.uint16())
+		case PropMaximumQoS:
+			p.MaximumQoS = ptr(pd.byte())
+		case PropRetainAvailable:
+			p.RetainAvailable = ptr(pd.byte())
+		case PropUser:
+			p.User = append(p.User, UserProperty{Key: pd.string(), Value: pd.string()})
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize = ptr(pd.uint32())
+		case PropWildcardSubAvailable:
+			p.WildcardSubAvailable = ptr(pd.byte())
+		case PropSubIDAvailable:
+			p.SubIDAvailable = ptr(pd.byte())
+		case PropSharedSubAvailable:
+			p.SharedSubAvailable = ptr(pd.byte())
+		default:
+			pd.err = ErrMalformedPacket
+		}
+	}
+	d.err = pd.err
+}
+
+func (p *Properties) encode(b []byte) []byte {
+	var v []byte
+	if p.PayloadFormat != nil {
+		v = append(v, PropPayloadFormat, *p.PayloadFormat)
+	}
+	if p.MessageExpiry != nil {
+		v = appendUint32(append(v, PropMessageExpiry), *p.MessageExpiry)
+	}
+	if p.ContentType != nil {
+		v = appendString(append(v, PropContentType), *p.ContentType)
+	}
+	if p.ResponseTopic != nil {
+		v = appendString(append(v, PropResponseTopic), *p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		v = appendBinary(append(v, PropCorrelationData), p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIDs {
+		v = appendVarint(append(v, PropSubscriptionID), id)
+	}
+	if p.SessionExpiry != nil {
+		v = appendUint32(append(v, PropSessionExpiry), *p.SessionExpiry)
+	}
+	if p.AssignedClientID != nil {
+		v = appendString(append(v, PropAssignedClientID), *p.AssignedClientID)
+	}
+	if p.ServerKeepAlive != nil {
+		v = appendUint16(append(v, PropServerKeepAlive), *p.ServerKeepAlive)
+	}
+	if p.AuthMethod != nil {
+		v = appendString(append(v, PropAuthMethod), *p.AuthMethod)
+	}
+	if p.AuthData != nil {
+		v = appendBinary(append(v, PropAuthData), p.AuthData)
+	}
+	if p.RequestProblemInfo != nil {
+		v = append(v, PropRequestProblemInfo, *p.RequestProblemInfo)
+	}
+	if p.WillDelay != nil {
+		v = appendUint32(append(v, PropWillDelay), *p.WillDelay)
+	}
+	if p.RequestResponseInfo != nil {
+		v = append(v, PropRequestResponseInfo, *p.RequestResponseInfo)
+	}
+	if p.ResponseInfo != nil {
+		v = appendString(append(v, PropResponseInfo), *p.ResponseInfo)
+	}
+	if p.ServerReference != nil {
+		v = appendString(append(v, PropServerReference), *p.ServerReference)
+	}
+	if p.ReasonString != nil {
+		v = appendString(append(v, PropReasonString), *p.ReasonString)
+	}
+	if p.ReceiveMaximum != nil {
+		v = appendUint16(append(v, PropReceiveMaximum), *p.ReceiveMaximum)
+	}
+	if p.TopicAliasMaximum != nil {
+		v = appendUint16(append(v, PropTopicAliasMaximum), *p.TopicAliasMaximum)
+	}
+	if p.TopicAlias != nil {
+		v = appendUint16(append(v, PropTopicAlias), *p.TopicAlias)
+	}
+	if p.MaximumQoS != nil {
+		v = append(v, PropMaximumQoS, *p.MaximumQoS)
+	}
+	if p.RetainAvailable != nil {
+		v = append(v, PropRetainAvailable, *p.RetainAvailable)
+	}
+	for _, u := range p.User {
+		v = appendString(appendString(append(v, PropUser), u.Key), u.Value)
+	}
+	if p.MaximumPacketSize != nil {
+		v = appendUint32(append(v, PropMaximumPacketSize), *p.MaximumPacketSize)
+	}
+	if p.WildcardSubAvailable != nil {
+		v = append(v, PropWildcardSubAvailable, *p.WildcardSubAvailable)
+	}
+	if p.SubIDAvailable != nil {
+		v = append(v, PropSubIDAvailable, *p.SubIDAvailable)
+	}
+	if p.SharedSubAvailable != nil {
+		v = append(v, PropSharedSubAvailable, *p.SharedSubAvailable)
+	}
+	return append(appendVarint(b, len(v)), v...)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,392 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/dtls"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// queueSize is the number of messages of a client queued while its session
+// is busy.
+const queueSize = 64
+
+// client translates the MQTT-SN messages of a client to MQTT 3.1.1 packets
+// written to inbound, the connection proxied by the session, and the MQTT
+// 3.1.1 packets of the broker read from conn to MQTT-SN messages.
+type client struct {
+	pc   net.PacketConn
+	addr net.Addr
+	// id is the client ID of the CONNECT message.
+	id         string
+	predefined map[uint16]string
+	in         chan []byte
+	inbound    net.Conn
+	conn       net.Conn
+	done       chan struct{}
+	once       sync.Once
+
+	mu sync.Mutex
+	// topics and ids hold the registered topic names by topic ID and the
+	// topic IDs by topic name.
+	topics map[uint16]string
+	ids    map[string]uint16
+	// next is the last topic ID assigned.
+	next uint16
+	// msgID is the message ID of the last REGISTER of the gateway.
+	msgID uint16
+	// subscribes and publishes hold the topic IDs of the pending SUBSCRIBE
+	// and QoS 1 PUBLISH messages, returned in their SUBACK and PUBACK.
+	subscribes map[uint16]uint16
+	publishes  map[uint16]uint16
+	// connect is the CONNECT of a client with a will, which is forwarded
+	// once the will topic and message are received.
+	connect *packets.ConnectPacket
+	// peer is the identity of a DTLS client.
+	peer *dtls.Peer
+}
+
+func newClient(pc net.PacketConn, addr net.Addr, predefined map[uint16]string) *client {
+	inbound, conn := net.Pipe()
+	return &client{
+		pc:         pc,
+		addr:       addr,
+		predefined: predefined,
+		in:         make(chan []byte, queueSize),
+		inbound:    inbound,
+		conn:       conn,
+		done:       make(chan struct{}),
+		topics:     make(map[uint16]string),
+		ids:        make(map[string]uint16),
+		subscribes: make(map[uint16]uint16),
+		publishes:  make(map[uint16]uint16),
+	}
+}
+
+// close ends the session of the client.
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.inbound.Close()
+		c.conn.Close()
+	})
+}
+
+func (c *client) send(typ byte, body []byte) {
+	// Lost datagrams are retransmitted by the client or the broker.
+	_, _ = c.pc.WriteTo(Encode(typ, body), c.addr)
+}
+
+// uplink translates the messages of the client until the session ends.
+func (c *client) uplink(logger *slog.Logger) {
+	for {
+		select {
+		case msg := <-c.in:
+			typ, body, _ := Decode(msg)
+			pkt, err := c.translate(typ, body)
+			if err != nil {
+				logger.Debug(fmt.Sprintf("Invalid MQTT-SN message from %s: %s", c.addr, err))
+				continue
+			}
+			if pkt == nil {
+				continue
+			}
+			if err := pkt.Write(c.conn); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// downlink translates the packets of the broker until the session ends.
+func (c *client) downlink(logger *slog.Logger) {
+	for {
+		pkt, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			c.close()
+			return
+		}
+		if err := c.reply(pkt); err != nil {
+			logger.Debug(fmt.Sprintf("Failed to translate MQTT packet to %s: %s", c.addr, err))
+		}
+	}
+}
+
+// translate returns the MQTT 3.1.1 packet of a message of the client, or nil
+// if the message is answered by the gateway.
+func (c *client) translate(typ byte, body []byte) (packets.ControlPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch typ {
+	case CONNECT:
+		// Flags, protocol ID, duration and client ID.
+		if len(body) < 4 {
+			return nil, errMessage
+		}
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolName, connect.ProtocolVersion = "MQTT", 4
+		connect.CleanSession = body[0]&flagClean != 0
+		connect.Keepalive = binary.BigEndian.Uint16(body[2:])
+		connect.ClientIdentifier = string(body[4:])
+		if c.peer != nil && c.peer.PSKIdentity != "" {
+			// MQTT-SN has no credentials, the PSK identity is the username.
+			connect.UsernameFlag, connect.Username = true, c.peer.PSKIdentity
+		}
+		if body[0]&flagWill != 0 {
+			c.connect = connect
+			c.send(WILLTOPICREQ, nil)
+			return nil, nil
+		}
+		return connect, nil
+	case WILLTOPIC:
+		connect := c.connect
+		if connect == nil {
+			return nil, nil
+		}
+		if len(body) == 0 {
+			// An empty WILLTOPIC removes the will.
+			c.connect = nil
+			return connect, nil
+		}
+		connect.WillFlag = true
+		connect.WillQos = byte(max(qos(body[0]), 0))
+		connect.WillRetain = body[0]&flagRetain != 0
+		connect.WillTopic = string(body[1:])
+		c.send(WILLMSGREQ, nil)
+		return nil, nil
+	case WILLMSG:
+		connect := c.connect
+		if connect == nil || !connect.WillFlag {
+			return nil, nil
+		}
+		connect.WillMessage = body
+		c.connect = nil
+		return connect, nil
+	case REGISTER:
+		// Topic ID, message ID and topic name.
+		if len(body) < 5 {
+			return nil, errMessage
+		}
+		id, ok := c.register(string(body[4:]))
+		rc := Accepted
+		if !ok {
+			rc = RejectedCongestion
+		}
+		c.send(REGACK, append(appendUint16(nil, id), body[2], body[3], rc))
+		return nil, nil
+	case PUBLISH:
+		// Flags, topic ID, message ID and data.
+		if len(body) < 5 {
+			return nil, errMessage
+		}
+		id, msgID := binary.BigEndian.Uint16(body[1:]), binary.BigEndian.Uint16(body[3:])
+		topic, ok := c.topic(body[0]&flagTopicType, body[1:3])
+		if !ok {
+			c.send(PUBACK, append(appendUint16(nil, id), body[3], body[4], RejectedTopicID))
+			return nil, nil
+		}
+		q := qos(body[0])
+		if q < 0 {
+			return nil, fmt.Errorf("%w: QoS -1 publish of a connected client", errMessage)
+		}
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.Dup, publish.Qos, publish.Retain = body[0]&flagDup != 0, byte(q), body[0]&flagRetain != 0
+		publish.TopicName, publish.Payload = topic, body[5:]
+		if q > 0 {
+			publish.MessageID = msgID
+		}
+		if q == 1 {
+			c.publishes[msgID] = id
+		}
+		return publish, nil
+	case PUBACK:
+		// Topic ID, message ID and return code.
+		if len(body) < 5 {
+			return nil, errMessage
+		}
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = binary.BigEndian.Uint16(body[2:])
+		return puback, nil
+	case PUBREC, PUBREL, PUBCOMP:
+		if len(body) < 2 {
+			return nil, errMessage
+		}
+		msgID := binary.BigEndian.Uint16(body)
+		switch typ {
+		case PUBREC:
+			pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			pubrec.MessageID = msgID
+			return pubrec, nil
+		case PUBREL:
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = msgID
+			return pubrel, nil
+		default:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = msgID
+			return pubcomp, nil
+		}
+	case SUBSCRIBE, UNSUBSCRIBE:
+		// Flags, message ID and topic name or topic ID.
+		if len(body) < 4 {
+			return nil, errMessage
+		}
+		msgID := binary.BigEndian.Uint16(body[1:])
+		topicType := body[0] & flagTopicType
+		if topicType != TopicNormal && len(body) < 5 {
+			return nil, errMessage
+		}
+		topic, ok := string(body[3:]), true
+		if topicType != TopicNormal {
+			topic, ok = c.topic(topicType, body[3:5])
+		}
+		if typ == UNSUBSCRIBE {
+			if !ok {
+				c.send(UNSUBACK, body[1:3])
+				return nil, nil
+			}
+			unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+			unsubscribe.MessageID, unsubscribe.Topics = msgID, []string{topic}
+			return unsubscribe, nil
+		}
+		if !ok {
+			c.send(SUBACK, []byte{0, 0, 0, body[1], body[2], RejectedTopicID})
+			return nil, nil
+		}
+		// Subscriptions to a topic name without wildcards register it, so
+		// its publishes don't need a REGISTER.
+		var id uint16
+		switch {
+		case topicType == TopicPredefined:
+			id = binary.BigEndian.Uint16(body[3:])
+		case topicType == TopicNormal && !strings.ContainsAny(topic, "#+"):
+			id, _ = c.register(topic)
+		}
+		c.subscribes[msgID] = id
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.MessageID = msgID
+		subscribe.Topics, subscribe.Qoss = []string{topic}, []byte{byte(max(qos(body[0]), 0))}
+		return subscribe, nil
+	case PINGREQ:
+		return packets.NewControlPacket(packets.Pingreq), nil
+	case DISCONNECT:
+		// Sleeping clients aren't supported, their duration is ignored.
+		return packets.NewControlPacket(packets.Disconnect), nil
+	default:
+		return nil, nil
+	}
+}
+
+// reply sends the MQTT-SN message of a packet of the broker to the client.
+func (c *client) reply(pkt packets.ControlPacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch p := pkt.(type) {
+	case *packets.ConnackPacket:
+		rc := Accepted
+		switch p.ReturnCode {
+		case packets.Accepted:
+		case packets.ErrRefusedServerUnavailable:
+			rc = RejectedCongestion
+		default:
+			rc = RejectedNotSupported
+		}
+		c.send(CONNACK, []byte{rc})
+	case *packets.PublishPacket:
+		id, topicType, ok := c.topicID(p.TopicName)
+		if !ok {
+			return fmt.Errorf("no topic ID left for %s", p.TopicName)
+		}
+		body := []byte{flags(p.Dup, p.Qos, p.Retain, topicType)}
+		body = appendUint16(appendUint16(body, id), p.MessageID)
+		c.send(PUBLISH, append(body, p.Payload...))
+	case *packets.PubackPacket:
+		id := c.publishes[p.MessageID]
+		delete(c.publishes, p.MessageID)
+		c.send(PUBACK, append(appendUint16(appendUint16(nil, id), p.MessageID), Accepted))
+	case *packets.PubrecPacket:
+		c.send(PUBREC, appendUint16(nil, p.MessageID))
+	case *packets.PubrelPacket:
+		c.send(PUBREL, appendUint16(nil, p.MessageID))
+	case *packets.PubcompPacket:
+		c.send(PUBCOMP, appendUint16(nil, p.MessageID))
+	case *packets.SubackPacket:
+		id := c.subscribes[p.MessageID]
+		delete(c.subscribes, p.MessageID)
+		f, rc := byte(0), RejectedNotSupported
+		if len(p.ReturnCodes) > 0 && p.ReturnCodes[0] <= 2 {
+			f, rc = flags(false, p.ReturnCodes[0], false, TopicNormal), Accepted
+		}
+		c.send(SUBACK, append(appendUint16(appendUint16([]byte{f}, id), p.MessageID), rc))
+	case *packets.UnsubackPacket:
+		c.send(UNSUBACK, appendUint16(nil, p.MessageID))
+	case *packets.PingrespPacket:
+		c.send(PINGRESP, nil)
+	}
+	return nil
+}
+
+// register returns the topic ID of a topic name, assigning one if needed.
+func (c *client) register(topic string) (uint16, bool) {
+	if id, ok := c.ids[topic]; ok {
+		return id, true
+	}
+	if c.next == 0xFFFF {
+		return 0, false
+	}
+	c.next++
+	c.topics[c.next], c.ids[topic] = topic, c.next
+	return c.next, true
+}
+
+// topic returns the topic name of a topic ID of the given type.
+func (c *client) topic(topicType byte, id []byte) (string, bool) {
+	switch topicType {
+	case TopicNormal:
+		topic, ok := c.topics[binary.BigEndian.Uint16(id)]
+		return topic, ok
+	case TopicPredefined:
+		topic, ok := c.predefined[binary.BigEndian.Uint16(id)]
+		return topic, ok
+	case TopicShort:
+		return string(id), true
+	default:
+		return "", false
+	}
+}
+
+// topicID returns the topic ID and its type of a topic published to the
+// client. Topics without ID are registered to the client first.
+func (c *client) topicID(topic string) (uint16, byte, bool) {
+	for id, t := range c.predefined {
+		if t == topic {
+			return id, TopicPredefined, true
+		}
+	}
+	if len(topic) == 2 {
+		return binary.BigEndian.Uint16([]byte(topic)), TopicShort, true
+	}
+	if id, ok := c.ids[topic]; ok {
+		return id, TopicNormal, true
+	}
+	id, ok := c.register(topic)
+	if !ok {
+		return 0, 0, false
+	}
+	if c.msgID++; c.msgID == 0 {
+		c.msgID++
+	}
+	c.send(REGISTER, append(appendUint16(appendUint16(nil, id), c.msgID), topic...))
+	return id, TopicNormal, true
+}
@@ -0,0 +1,277 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/dtls"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/upstream"
+	"github.com/caarlos0/env/v11"
+)
+
+// maxMessageSize is the maximum size of an MQTT-SN message, whose length is
+// encoded in two bytes.
+const maxMessageSize = 0xFFFF
+
+var errPredefinedTopic = errors.New("invalid MQTT-SN predefined topic")
+
+// Config holds the options of the MQTT-SN gateway.
+type Config struct {
+	GatewayID        uint8    `env:"MQTT_SN_GATEWAY_ID"        envDefault:"1"`
+	PredefinedTopics []string `env:"MQTT_SN_PREDEFINED_TOPICS" envDefault:""`
+
+	// DTLS holds the DTLS options of the listener.
+	DTLS dtls.Config
+
+	// predefined holds the topic names of PredefinedTopics by topic ID.
+	predefined map[uint16]string
+}
+
+// NewConfig parses the MQTT-SN gateway options from the environment. The
+// predefined topics are given as id:topic, such as 1:sensors/temperature.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	c.predefined = make(map[uint16]string)
+	for _, t := range c.PredefinedTopics {
+		id, topic, ok := strings.Cut(t, ":")
+		if !ok || topic == "" {
+			return Config{}, fmt.Errorf("%w: %s", errPredefinedTopic, t)
+		}
+		n, err := strconv.ParseUint(id, 10, 16)
+		if err != nil || n == 0 {
+			return Config{}, fmt.Errorf("%w: %s", errPredefinedTopic, t)
+		}
+		c.predefined[uint16(n)] = topic
+	}
+	var err error
+	if c.DTLS, err = dtls.NewConfig(opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Proxy is the MQTT-SN gateway. Each MQTT-SN client, identified by its UDP
+// address, is proxied to the broker as an MQTT 3.1.1 session, to which the
+// handler, the interceptor and the MQTT options of the configuration apply.
+type Proxy struct {
+	config      mproxy.Config
+	sn          Config
+	handler     session.Handler
+	interceptor session.Interceptor
+	logger      *slog.Logger
+	dialer      net.Dialer
+	upstream    *upstream.Dialer
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// New returns a new MQTT-SN gateway.
+func New(config mproxy.Config, sn Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
+	return &Proxy{
+		config:      config,
+		sn:          sn,
+		handler:     handler,
+		interceptor: interceptor,
+		logger:      logger,
+		upstream:    upstream.NewDialer(config.Target, config.Upstream),
+		clients:     make(map[string]*client),
+	}
+}
+
+// Listen of the server, this will block.
+func (p *Proxy) Listen(ctx context.Context) error {
+	p.config.TLSJobs.Start(ctx)
+	config, err := dtls.Load(p.sn.DTLS, p.config.TLSConfig)
+	if err != nil {
+		return err
+	}
+	var pc net.PacketConn
+	status := "without DTLS"
+	if config != nil {
+		pc, err = dtls.ListenPacket(p.config.Address, p.sn.DTLS, config, p.logger)
+		status = "with DTLS"
+	} else {
+		pc, err = net.ListenPacket("udp", p.config.Address)
+	}
+	if err != nil {
+		return err
+	}
+	p.logger.Info(fmt.Sprintf("MQTT-SN gateway started at %s %s", p.config.Address, status))
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				p.logger.Info(fmt.Sprintf("MQTT-SN gateway at %s exiting...", p.config.Address))
+				return nil
+			}
+			return err
+		}
+		p.receive(ctx, pc, addr, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// receive dispatches a message to the session of its client. A CONNECT
+// starts a new session, replacing the previous session of the client.
+func (p *Proxy) receive(ctx context.Context, pc net.PacketConn, addr net.Addr, msg []byte) {
+	typ, body, err := Decode(msg)
+	if err != nil {
+		p.logger.Debug(fmt.Sprintf("Invalid MQTT-SN message from %s: %s", addr, err))
+		return
+	}
+	if typ == SEARCHGW {
+		if _, err := pc.WriteTo(Encode(GWINFO, []byte{p.sn.GatewayID}), addr); err != nil {
+			p.logger.Warn("Failed to answer SEARCHGW: " + err.Error())
+		}
+		return
+	}
+
+	p.mu.Lock()
+	c, ok := p.clients[addr.String()]
+	if typ == CONNECT {
+		if ok {
+			c.close()
+		}
+		c = newClient(pc, addr, p.sn.predefined)
+		if len(body) >= 4 {
+			c.id = string(body[4:])
+		}
+		if dc, ok := pc.(*dtls.PacketConn); ok {
+			peer, err := dc.Peer(addr)
+			if err != nil {
+				p.mu.Unlock()
+				p.logger.Debug(fmt.Sprintf("Unknown DTLS session of MQTT-SN client %s: %s", addr, err))
+				return
+			}
+			c.peer = &peer
+		}
+		p.clients[addr.String()] = c
+		go p.serve(ctx, c)
+	}
+	p.mu.Unlock()
+	if c == nil {
+		// The client must connect again, since its session is unknown.
+		if typ != DISCONNECT {
+			if _, err := pc.WriteTo(Encode(DISCONNECT, nil), addr); err != nil {
+				p.logger.Warn("Failed to disconnect MQTT-SN client: " + err.Error())
+			}
+		}
+		return
+	}
+	select {
+	case c.in <- msg:
+	default:
+		p.logger.Warn(fmt.Sprintf("Dropped MQTT-SN message of %s, its session is busy", addr))
+	}
+}
+
+// serve proxies the session of the client until it ends.
+func (p *Proxy) serve(ctx context.Context, c *client) {
+	defer p.remove(c)
+
+	if p.config.Upstream.Strategy == upstream.ConsistentHash {
+		// The broker is selected by the client ID of the CONNECT message.
+		ctx = upstream.WithKey(ctx, c.id)
+	}
+	outbound, err := p.dial(ctx)
+	if err != nil {
+		p.logger.Error("Cannot connect to remote broker " + p.config.Target + " due to: " + err.Error())
+		c.send(CONNACK, []byte{RejectedCongestion})
+		c.close()
+		return
+	}
+	defer p.close(outbound)
+
+	go c.downlink(p.logger)
+	go c.uplink(p.logger)
+
+	cfg := p.config.MQTT
+	if cfg.Listener == "" {
+		cfg.Listener = p.config.Address
+	}
+	if p.config.Upstream.Reconnect {
+		cfg.Redial = p.dial
+	}
+	var s session.Session
+	if host, _, err := net.SplitHostPort(c.addr.String()); err == nil {
+		s.RemoteIP = host
+	}
+	if c.peer != nil && len(c.peer.Certificates) > 0 {
+		s.Cert = *c.peer.Certificates[0]
+		s.Identity = session.NewIdentity(s.Cert)
+		s.MTLS = true
+	}
+	err = session.Stream(ctx, &udpConn{Conn: c.inbound, addr: c.addr}, outbound, p.handler, p.interceptor, s, cfg)
+	c.close()
+	c.send(DISCONNECT, nil)
+	if err != io.EOF {
+		p.logger.Warn(err.Error())
+	}
+}
+
+func (p *Proxy) remove(c *client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[c.addr.String()] == c {
+		delete(p.clients, c.addr.String())
+	}
+}
+
+// dial connects to the target, or to its fallbacks if it is unreachable.
+func (p *Proxy) dial(ctx context.Context) (net.Conn, error) {
+	return p.upstream.Dial(ctx, p.dialTarget)
+}
+
+// dialTarget connects to a target, over TLS if the target TLS configuration is
+// set or the scheme of the target requires it.
+func (p *Proxy) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	address, secure := upstream.SplitScheme(target)
+	config := p.config.TargetTLSConfig
+	if config == nil && secure {
+		config = &tls.Config{}
+	}
+	if config != nil {
+		d := tls.Dialer{NetDialer: &p.dialer, Config: config}
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return p.dialer.DialContext(ctx, "tcp", address)
+}
+
+func (p *Proxy) close(conn net.Conn) {
+	if err := conn.Close(); err != nil {
+		p.logger.Warn(fmt.Sprintf("Error closing connection %s", err.Error()))
+	}
+}
+
+// udpConn is the MQTT 3.1.1 connection translated from an MQTT-SN client,
+// whose remote address is the address of the client.
+type udpConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mqttsn implements an MQTT-SN 1.2 gateway, which translates the
+// MQTT-SN clients connecting over UDP into MQTT 3.1.1 sessions toward the
+// broker.
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Message types.
+const (
+	ADVERTISE    byte = 0x00
+	SEARCHGW     byte = 0x01
+	GWINFO       byte = 0x02
+	CONNECT      byte = 0x04
+	CONNACK      byte = 0x05
+	WILLTOPICREQ byte = 0x06
+	WILLTOPIC    byte = 0x07
+	WILLMSGREQ   byte = 0x08
+	WILLMSG      byte = 0x09
+	REGISTER     byte = 0x0A
+	REGACK       byte = 0x0B
+	PUBLISH      byte = 0x0C
+	PUBACK       byte = 0x0D
+	PUBCOMP      byte = 0x0E
+	PUBREC       byte = 0x0F
+	PUBREL       byte = 0x10
+	SUBSCRIBE    byte = 0x12
+	SUBACK       byte = 0x13
+	UNSUBSCRIBE  byte = 0x14
+	UNSUBACK     byte = 0x15
+	PINGREQ      byte = 0x16
+	PINGRESP     byte = 0x17
+	DISCONNECT   byte = 0x18
+)
+
+// Return codes.
+const (
+	Accepted             byte = 0x00
+	RejectedCongestion   byte = 0x01
+	RejectedTopicID      byte = 0x02
+	RejectedNotSupported byte = 0x03
+)
+
+// Topic ID types of the flags.
+const (
+	TopicNormal     byte = 0x00
+	TopicPredefined byte = 0x01
+	TopicShort      byte = 0x02
+)
+
+// Flags of the CONNECT, WILLTOPIC, PUBLISH, SUBSCRIBE and SUBACK messages.
+const (
+	flagDup       byte = 0x80
+	flagQoS       byte = 0x60
+	flagRetain    byte = 0x10
+	flagWill      byte = 0x08
+	flagClean     byte = 0x04
+	flagTopicType byte = 0x03
+)
+
+var errMessage = errors.New("malformed MQTT-SN message")
+
+// Decode returns the type and the body of an MQTT-SN message, which follows
+// its type.
+func Decode(msg []byte) (byte, []byte, error) {
+	if len(msg) < 2 {
+		return 0, nil, errMessage
+	}
+	n, header := int(msg[0]), 1
+	if n == 0x01 {
+		// A length of 0x01 announces a length encoded in the next two bytes.
+		if len(msg) < 4 {
+			return 0, nil, errMessage
+		}
+		n, header = int(binary.BigEndian.Uint16(msg[1:])), 3
+	}
+	if n != len(msg) || n <= header {
+		return 0, nil, errMessage
+	}
+	return msg[header], msg[header+1:], nil
+}
+
+// Encode returns the MQTT-SN message of the type and the body.
+func Encode(typ byte, body []byte) []byte {
+	n := len(body) + 2
+	if n <= 0xFF {
+		return append([]byte{byte(n), typ}, body...)
+	}
+	n += 2
+	return append([]byte{0x01, byte(n >> 8), byte(n), typ}, body...)
+}
+
+// qos returns the QoS of the flags, -1 for publishes without connection.
+func qos(flags byte) int {
+	q := int(flags&flagQoS) >> 5
+	if q == 3 {
+		return -1
+	}
+	return q
+}
+
+// flags returns the flags of the QoS, the retain flag and the topic ID type.
+func flags(dup bool, q byte, retain bool, topicType byte) byte {
+	f := q<<5 | topicType
+	if dup {
+		f |= flagDup
+	}
+	if retain {
+		f |= flagRetain
+	}
+	return f
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
+}
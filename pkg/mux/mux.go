@@ -0,0 +1,298 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mux shares a single port between the MQTT, MQTT over WebSocket and
+// HTTP proxies, with or without TLS, by sniffing the first bytes of the
+// accepted connections.
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// sniffTimeout bounds the TLS handshake and the wait for the first bytes.
+	sniffTimeout = 10 * time.Second
+	// sniffSize is the maximum size of the HTTP request headers read to
+	// tell WebSocket upgrades from plain requests.
+	sniffSize = 4096
+
+	// recordHandshake is the first byte of a TLS ClientHello record.
+	recordHandshake = 0x16
+	// mqttConnect is the first byte of an MQTT CONNECT packet.
+	mqttConnect = 0x10
+)
+
+var (
+	errClosed   = errors.New("listener closed")
+	errProtocol = errors.New("unknown protocol")
+	errTLS      = errors.New("TLS connection without TLS configuration")
+)
+
+// Mux accepts the connections of a single port and routes them to the
+// listener of their protocol. TLS connections are terminated by the Mux with
+// the TLS configuration of its listener, and routed by their decrypted bytes.
+type Mux struct {
+	config mproxy.Config
+	logger *slog.Logger
+	mqtt   *listener
+	ws     *listener
+	http   *listener
+}
+
+// New returns a Mux listening on the address of config.
+func New(config mproxy.Config, logger *slog.Logger) *Mux {
+	return &Mux{
+		config: config,
+		logger: logger,
+		mqtt:   newListener(config.Address),
+		ws:     newListener(config.Address),
+		http:   newListener(config.Address),
+	}
+}
+
+// MQTT returns the listener of the MQTT connections.
+func (m *Mux) MQTT() net.Listener {
+	return m.mqtt
+}
+
+// WebSocket returns the listener of the HTTP connections upgraded to WebSocket.
+func (m *Mux) WebSocket() net.Listener {
+	return m.ws
+}
+
+// HTTP returns the listener of the other HTTP connections.
+func (m *Mux) HTTP() net.Listener {
+	return m.http
+}
+
+// Listen of the server, this will block.
+func (m *Mux) Listen(ctx context.Context) error {
+	l, err := net.Listen("tcp", m.config.Address)
+	if err != nil {
+		return err
+	}
+	// The TLS connections are handed to a TLS listener, which records their
+	// ClientHello like the listeners of the proxies.
+	secure := newListener(m.config.Address)
+	status := mptls.SecurityStatus(m.config.TLSConfig)
+	m.logger.Info(fmt.Sprintf("Shared MQTT, WebSocket and HTTP server started at %s with %s", m.config.Address, status))
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				m.logger.Warn("Accept error " + err.Error())
+				continue
+			}
+			go m.route(conn, secure)
+		}
+	})
+	if m.config.TLSConfig != nil {
+		m.config.TLSJobs.Start(ctx)
+		tl := mptls.NewListener(secure, m.config.TLSConfig)
+		g.Go(func() error {
+			for {
+				conn, err := tl.Accept()
+				if err != nil {
+					return nil
+				}
+				go m.sniff(conn)
+			}
+		})
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		secure.Close()
+		m.mqtt.Close()
+		m.ws.Close()
+		m.http.Close()
+		return l.Close()
+	})
+	if err := g.Wait(); err != nil {
+		m.logger.Info(fmt.Sprintf("Shared server at %s with %s exiting with errors", m.config.Address, status), slog.String("error", err.Error()))
+	} else {
+		m.logger.Info(fmt.Sprintf("Shared server at %s with %s exiting...", m.config.Address, status))
+	}
+	return nil
+}
+
+// route hands the TLS connections to the secure listener and sniffs the
+// plaintext ones.
+func (m *Mux) route(conn net.Conn, secure *listener) {
+	c := newConn(conn)
+	b, err := c.peek(1)
+	if err != nil {
+		m.reject(conn, err)
+		return
+	}
+	if b[0] != recordHandshake {
+		m.sniff(c)
+		return
+	}
+	if m.config.TLSConfig == nil {
+		m.reject(conn, errTLS)
+		return
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		m.reject(conn, err)
+		return
+	}
+	if err := secure.push(c); err != nil {
+		m.reject(conn, err)
+	}
+}
+
+// sniff hands a connection to the listener of its protocol.
+func (m *Mux) sniff(conn net.Conn) {
+	c, ok := conn.(*sniffedConn)
+	if !ok {
+		c = newConn(conn)
+	}
+	b, err := c.peek(1)
+	if err != nil {
+		m.reject(conn, err)
+		return
+	}
+	l := m.mqtt
+	if b[0] != mqttConnect {
+		if l, err = m.httpListener(c); err != nil {
+			m.reject(conn, err)
+			return
+		}
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		m.reject(conn, err)
+		return
+	}
+	if err := l.push(c); err != nil {
+		m.reject(conn, err)
+	}
+}
+
+// httpListener returns the WebSocket listener for WebSocket upgrades and
+// the HTTP listener for other HTTP requests.
+func (m *Mux) httpListener(c *sniffedConn) (*listener, error) {
+	var b []byte
+	for n := 1; n <= sniffSize; n = len(b) + 1 {
+		var err error
+		if b, err = c.peek(n); err != nil {
+			return nil, err
+		}
+		if bytes.Contains(b, []byte("\r\n\r\n")) {
+			break
+		}
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, errors.Join(errProtocol, err)
+	}
+	if websocket.IsWebSocketUpgrade(req) {
+		return m.ws, nil
+	}
+	return m.http, nil
+}
+
+func (m *Mux) reject(conn net.Conn, err error) {
+	m.logger.Debug(fmt.Sprintf("Rejected connection from %s: %s", conn.RemoteAddr(), err))
+	conn.Close()
+}
+
+// sniffedConn replays the sniffed bytes of its connection. NetConn returns
+// the connection, so the TLS state of the routed connections can be read.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newConn(conn net.Conn) *sniffedConn {
+	return &sniffedConn{Conn: conn, r: bufio.NewReaderSize(conn, sniffSize)}
+}
+
+// peek returns the first n bytes of the connection without consuming them,
+// reading as many as available at once.
+func (c *sniffedConn) peek(n int) ([]byte, error) {
+	if err := c.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.r.Peek(n); err != nil {
+		return nil, err
+	}
+	return c.r.Peek(c.r.Buffered())
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// listener is a net.Listener of the connections routed by the Mux.
+type listener struct {
+	addr  addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener(address string) *listener {
+	return &listener{addr: addr(address), conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *listener) push(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return errClosed
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// addr is the address of the Mux, shared by its listeners.
+type addr string
+
+func (a addr) Network() string {
+	return "tcp"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
@@ -0,0 +1,163 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package schema
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/caarlos0/env/v11"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Actions applied to the publishes whose payload doesn't match the schema.
+const (
+	// Reject closes the connection of the client.
+	Reject = "reject"
+	// Drop drops the publish, which is acknowledged to the client.
+	Drop = "drop"
+)
+
+var (
+	errRule   = errors.New("invalid schema rule")
+	errAction = errors.New("unknown schema action")
+)
+
+var (
+	_ session.Interceptor   = (*Interceptor)(nil)
+	_ session.InterceptorV5 = (*Interceptor)(nil)
+)
+
+// Config holds the options of the schema interceptor.
+type Config struct {
+	File   string `env:"MQTT_SCHEMA_FILE"   envDefault:""`
+	Action string `env:"MQTT_SCHEMA_ACTION" envDefault:"reject"`
+}
+
+// NewConfig parses the schema interceptor options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	switch c.Action {
+	case Reject, Drop:
+	default:
+		return Config{}, errAction
+	}
+	return c, nil
+}
+
+type rule struct {
+	filter string
+	schema *Schema
+}
+
+// Interceptor validates the payloads of the PUBLISH packets of the clients
+// against the JSON Schema of their topic, so malformed messages never reach
+// the broker. Publishes on topics without schema are forwarded unchanged.
+type Interceptor struct {
+	rules []rule
+	drop  bool
+}
+
+// New parses the schema rules, one per line. Empty lines and lines starting
+// with # are ignored. A rule is a topic filter followed by the path of a JSON
+// Schema file, relative to dir unless absolute:
+//
+//	sensors/+/telemetry schemas/telemetry.json
+//
+// The first rule whose topic filter matches the topic applies.
+func New(r io.Reader, dir, action string) (*Interceptor, error) {
+	ic := &Interceptor{drop: action == Drop}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: line %d", errRule, n)
+		}
+		file := fields[1]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		s, err := Parse(data)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("%w: line %d", errRule, n), err)
+		}
+		ic.rules = append(ic.rules, rule{filter: fields[0], schema: s})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ic, nil
+}
+
+// Load reads the schema rules from the file of the configuration. The paths
+// of the schemas are relative to the directory of the file.
+func Load(cfg Config) (*Interceptor, error) {
+	f, err := os.Open(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return New(f, filepath.Dir(cfg.File), cfg.Action)
+}
+
+// Intercept validates the MQTT 3.1.1 PUBLISH packets of the clients.
+func (ic *Interceptor) Intercept(ctx context.Context, pkt packets.ControlPacket, dir session.Direction) (packets.ControlPacket, error) {
+	p, ok := pkt.(*packets.PublishPacket)
+	if !ok || dir != session.Up {
+		return pkt, nil
+	}
+	if err := ic.validate(p.TopicName, p.Payload); err != nil {
+		if ic.drop {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// InterceptV5 validates the MQTT v5 PUBLISH packets of the clients.
+func (ic *Interceptor) InterceptV5(ctx context.Context, pkt mqtt5.Packet, dir session.Direction) (mqtt5.Packet, error) {
+	p, ok := pkt.(*mqtt5.Publish)
+	if !ok || dir != session.Up {
+		return pkt, nil
+	}
+	if err := ic.validate(p.Topic, p.Payload); err != nil {
+		if ic.drop {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (ic *Interceptor) validate(topic string, payload []byte) error {
+	for _, r := range ic.rules {
+		if session.Matches(r.filter, topic) {
+			if err := r.schema.Validate(payload); err != nil {
+				return fmt.Errorf("topic %s: %w", topic, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
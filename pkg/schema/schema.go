@@ -0,0 +1,282 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package schema validates the payloads published by the MQTT clients against
+// JSON Schemas.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+var (
+	errSchema  = errors.New("invalid JSON Schema")
+	errPayload = errors.New("payload does not match the JSON Schema")
+)
+
+// Schema is a JSON Schema. The validation keywords type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength
+// and pattern, and the allOf, anyOf, oneOf and not keywords are supported.
+// Other keywords, such as $ref and format, are ignored.
+type Schema struct {
+	Type                 types              `json:"type"`
+	Enum                 []any              `json:"enum"`
+	Const                json.RawMessage    `json:"const"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64           `json:"exclusiveMaximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	AllOf                []*Schema          `json:"allOf"`
+	AnyOf                []*Schema          `json:"anyOf"`
+	OneOf                []*Schema          `json:"oneOf"`
+	Not                  *Schema            `json:"not"`
+
+	// never is set by the false schema, which matches nothing.
+	never    bool
+	pattern  *regexp.Regexp
+	constant any
+}
+
+// types is the type keyword, a type name or a list of type names.
+type types []string
+
+func (t *types) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = types{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	*t = names
+	return nil
+}
+
+// UnmarshalJSON decodes a schema, which may be a boolean schema.
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*s = Schema{never: !b}
+		return nil
+	}
+	// schema has the fields of Schema without its methods.
+	type schema Schema
+	return json.Unmarshal(data, (*schema)(s))
+}
+
+// Parse parses a JSON Schema.
+func Parse(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Join(errSchema, err)
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) compile() error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return errors.Join(errSchema, err)
+		}
+		s.pattern = re
+	}
+	if s.Const != nil {
+		if err := json.Unmarshal(s.Const, &s.constant); err != nil {
+			return errors.Join(errSchema, err)
+		}
+	}
+	children := []*Schema{s.AdditionalProperties, s.Items, s.Not}
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	children = append(children, s.AllOf...)
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	for _, child := range children {
+		if err := child.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate reports whether the JSON payload matches the schema.
+func (s *Schema) Validate(payload []byte) error {
+	d := json.NewDecoder(bytes.NewReader(payload))
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return errors.Join(errPayload, err)
+	}
+	if d.More() {
+		return fmt.Errorf("%w: trailing data after the JSON value", errPayload)
+	}
+	if reason := s.validate(v, "$"); reason != "" {
+		return fmt.Errorf("%w: %s", errPayload, reason)
+	}
+	return nil
+}
+
+// validate returns the reason why v doesn't match the schema, or an empty
+// string if it matches. The path locates v in the payload.
+func (s *Schema) validate(v any, path string) string {
+	if s == nil {
+		return ""
+	}
+	if s.never {
+		return path + " is not allowed"
+	}
+	if len(s.Type) > 0 && !s.typed(v) {
+		return fmt.Sprintf("%s must be of type %v", path, []string(s.Type))
+	}
+	if s.Enum != nil && !contains(s.Enum, v) {
+		return path + " is not one of the enum values"
+	}
+	if s.Const != nil && !reflect.DeepEqual(s.constant, v) {
+		return path + " is not the const value"
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		if reason := s.object(v, path); reason != "" {
+			return reason
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems || s.MaxItems != nil && len(v) > *s.MaxItems {
+			return path + " has too few or too many items"
+		}
+		for i, item := range v {
+			if reason := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); reason != "" {
+				return reason
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum || s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum ||
+			s.Maximum != nil && v > *s.Maximum || s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum {
+			return path + " is out of range"
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength || s.MaxLength != nil && n > *s.MaxLength {
+			return path + " is too short or too long"
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return path + " does not match the pattern"
+		}
+	}
+	for _, sub := range s.AllOf {
+		if reason := sub.validate(v, path); reason != "" {
+			return reason
+		}
+	}
+	if s.AnyOf != nil && matching(s.AnyOf, v, path) == 0 {
+		return path + " matches none of the anyOf schemas"
+	}
+	if s.OneOf != nil && matching(s.OneOf, v, path) != 1 {
+		return path + " does not match exactly one of the oneOf schemas"
+	}
+	if s.Not != nil && s.Not.validate(v, path) == "" {
+		return path + " matches the not schema"
+	}
+	return ""
+}
+
+func (s *Schema) object(v map[string]any, path string) string {
+	for _, name := range s.Required {
+		if _, ok := v[name]; !ok {
+			return fmt.Sprintf("%s.%s is required", path, name)
+		}
+	}
+	// Sort the names so the same invalid payload always reports the same reason.
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, ok := s.Properties[name]
+		if !ok {
+			p = s.AdditionalProperties
+		}
+		if reason := p.validate(v[name], path+"."+name); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+func (s *Schema) typed(v any) bool {
+	for _, t := range s.Type {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case float64:
+			if t == "number" || t == "integer" && v == math.Trunc(v) {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case []any:
+			if t == "array" {
+				return true
+			}
+		case map[string]any:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matching(schemas []*Schema, v any, path string) int {
+	n := 0
+	for _, s := range schemas {
+		if s.validate(v, path) == "" {
+			n++
+		}
+	}
+	return n
+}
+
+func contains(values []any, v any) bool {
+	for _, value := range values {
+		if reflect.DeepEqual(value, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,425 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var (
+	errACLRule       = errors.New("invalid ACL rule")
+	errNotAuthorized = errors.New("not authorized by the ACL rules")
+)
+
+// Access is the access granted or denied by an ACL rule.
+type Access uint8
+
+const (
+	// AccessRead allows to subscribe to the topics.
+	AccessRead Access = 1 << iota
+	// AccessWrite allows to publish to the topics.
+	AccessWrite
+	// AccessDeny denies both publishing and subscribing, regardless of the
+	// other rules.
+	AccessDeny
+
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+var accesses = map[string]Access{
+	"read":      AccessRead,
+	"write":     AccessWrite,
+	"readwrite": AccessReadWrite,
+	"deny":      AccessDeny,
+}
+
+// ACLRule grants or denies access to the topics matching a topic filter.
+type ACLRule struct {
+	Topic  string
+	Access Access
+}
+
+// ACL holds the topic access rules of the clients, in the format of the
+// Mosquitto ACL files:
+//
+//	# Rules before the first user line apply to all clients.
+//	topic read public/#
+//	user alice
+//	topic readwrite alice/#
+//	# Patterns apply to all clients, with %c replaced by the client ID
+//	# and %u by the username.
+//	pattern write devices/%c/#
+//
+// The access is one of read, write, readwrite and deny, and defaults to
+// readwrite. A client may publish to or subscribe to a topic only if a rule
+// grants the access and no deny rule matches the topic.
+type ACL struct {
+	all      []ACLRule
+	users    map[string][]ACLRule
+	patterns []ACLRule
+}
+
+// NewACL parses the ACL rules.
+func NewACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{users: make(map[string][]ACLRule)}
+	// user is the user of the current section, the rules before the first
+	// user line apply to all clients.
+	user, section := "", false
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return nil, fmt.Errorf("%w: line %d", errACLRule, n)
+		}
+		switch keyword {
+		case "user":
+			user, section = rest, true
+		case "topic", "pattern":
+			rule := ACLRule{Topic: rest, Access: AccessReadWrite}
+			if access, topic, ok := strings.Cut(rest, " "); ok {
+				a, ok := accesses[access]
+				if !ok {
+					return nil, fmt.Errorf("%w: line %d", errACLRule, n)
+				}
+				rule = ACLRule{Topic: strings.TrimSpace(topic), Access: a}
+			}
+			switch {
+			case keyword == "pattern":
+				acl.patterns = append(acl.patterns, rule)
+			case section:
+				acl.users[user] = append(acl.users[user], rule)
+			default:
+				acl.all = append(acl.all, rule)
+			}
+		default:
+			return nil, fmt.Errorf("%w: line %d", errACLRule, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// LoadACL reads the ACL rules from a file.
+func LoadACL(file string) (*ACL, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewACL(f)
+}
+
+// Rules returns the rules which apply to the client of the session.
+func (acl *ACL) Rules(s *Session) []ACLRule {
+	rules := append([]ACLRule{}, acl.all...)
+	rules = append(rules, acl.users[s.Username]...)
+	r := strings.NewReplacer("%c", s.ID, "%u", s.Username)
+	for _, p := range acl.patterns {
+		rules = append(rules, ACLRule{Topic: r.Replace(p.Topic), Access: p.Access})
+	}
+	return rules
+}
+
+// allowed reports whether the rules grant the access to the topic, which is a
+// topic filter for AccessRead. A topic filter is only readable if a single
+// rule grants access to all the topics it matches and no deny rule matches
+// any of them.
+func allowed(rules []ACLRule, topic string, access Access) bool {
+	granted := false
+	for _, r := range rules {
+		if r.Access&AccessDeny != 0 {
+			if access == AccessRead && overlaps(r.Topic, topic) || access == AccessWrite && covers(r.Topic, topic) {
+				return false
+			}
+			continue
+		}
+		if r.Access&access != 0 && covers(r.Topic, topic) {
+			granted = true
+		}
+	}
+	return granted
+}
+
+// Matches reports whether the topic filter matches the topic.
+func Matches(filter, topic string) bool {
+	return covers(filter, topic)
+}
+
+// covers reports whether all the topics matched by the topic or topic filter
+// topic are matched by filter.
+func covers(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	for i := range f {
+		switch {
+		case f[i] == "#":
+			return true
+		case i >= len(t):
+			return false
+		case f[i] == "+":
+			if t[i] == "#" {
+				return false
+			}
+		case f[i] != t[i]:
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// overlaps reports whether a topic may be matched by both topic filters.
+func overlaps(a, b string) bool {
+	x, y := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(x) && i < len(y); i++ {
+		switch {
+		case x[i] == "#" || y[i] == "#":
+			return true
+		case x[i] == "+" || y[i] == "+" || x[i] == y[i]:
+			continue
+		default:
+			return false
+		}
+	}
+	switch {
+	case len(x) == len(y):
+		return true
+	case len(x) == len(y)+1:
+		return x[len(y)] == "#"
+	case len(y) == len(x)+1:
+		return y[len(x)] == "#"
+	default:
+		return false
+	}
+}
+
+// aclState holds the ACL rules of a connection and the SUBSCRIBE packets of
+// which some topic filters were not forwarded.
+type aclState struct {
+	// enabled is set if the ACL rules of the client are enforced.
+	enabled bool
+	rules   []ACLRule
+
+	mu sync.Mutex
+	// subscribes holds, by packet identifier, the reason codes of the topic
+	// filters which were not forwarded and -1 for the forwarded ones.
+	subscribes map[uint16][]int
+}
+
+// loadACL loads the ACL rules of the client once its CONNECT is authorized.
+func (c *conn) loadACL(ctx context.Context, h Handler) error {
+	s, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if c.cfg.ACL != nil {
+		c.acl.enabled = true
+		c.acl.rules = c.cfg.ACL.Rules(s)
+	}
+	if ah, ok := h.(ACLHandler); ok {
+		rules, err := ah.ACLRules(ctx)
+		if err != nil {
+			return err
+		}
+		if rules != nil {
+			c.acl.enabled = true
+			c.acl.rules = append(c.acl.rules, rules...)
+		}
+	}
+	return nil
+}
+
+// subscriptionCodes returns the reason codes of the denied topic filters and
+// -1 for the allowed ones, and whether any topic filter is denied. In drop
+// mode, the topic filters denied by the ACL rules are acknowledged with the
+// requested QoS. The rules apply to the topic filter of shared subscriptions,
+// which are refused with sharedDenied if the configuration denies them.
+func (c *conn) subscriptionCodes(topics []string, qos func(int) byte, denied, sharedDenied byte) ([]int, bool) {
+	codes := make([]int, len(topics))
+	deny := false
+	for i, filter := range topics {
+		codes[i] = -1
+		_, topic, _ := SharedSubscription(filter)
+		switch {
+		case c.sharedDenied(filter):
+			deny = true
+			codes[i] = int(sharedDenied)
+		case c.acl.enabled && !allowed(c.acl.rules, topic, AccessRead):
+			deny = true
+			codes[i] = int(denied)
+			if c.cfg.ACLDrop {
+				codes[i] = int(qos(i))
+			}
+		}
+	}
+	return codes, deny
+}
+
+// acknowledged returns the reason codes of a SUBSCRIBE packet which was
+// entirely denied, or stores them to merge them with the SUBACK of the broker.
+func (c *conn) acknowledged(id uint16, codes []int) []byte {
+	forwarded := false
+	for _, code := range codes {
+		forwarded = forwarded || code == -1
+	}
+	if !forwarded {
+		ret := make([]byte, len(codes))
+		for i, code := range codes {
+			ret[i] = byte(code)
+		}
+		return ret
+	}
+	c.acl.mu.Lock()
+	defer c.acl.mu.Unlock()
+	if c.acl.subscribes == nil {
+		c.acl.subscribes = make(map[uint16][]int)
+	}
+	c.acl.subscribes[id] = codes
+	return nil
+}
+
+// mergeCodes adds the reason codes of the denied topic filters to the reason
+// codes of a SUBACK of the broker.
+func (c *conn) mergeCodes(id uint16, received []byte) []byte {
+	c.acl.mu.Lock()
+	codes, ok := c.acl.subscribes[id]
+	delete(c.acl.subscribes, id)
+	c.acl.mu.Unlock()
+	if !ok {
+		return received
+	}
+	ret := make([]byte, len(codes))
+	for i, code := range codes {
+		if code == -1 && len(received) > 0 {
+			code, received = int(received[0]), received[1:]
+		}
+		ret[i] = byte(code)
+	}
+	return ret
+}
+
+// enforce applies the ACL rules to an MQTT 3.1.1 packet of the client and
+// reports whether the packet must be dropped. Denied publishes close the
+// connection, as MQTT 3.1.1 has no negative acknowledgments, unless the
+// packets are dropped silently.
+func (c *conn) enforce(pkt packets.ControlPacket) (bool, error) {
+	if !c.acl.enabled && c.cfg.SharedSubscriptions != SharedDeny {
+		return false, nil
+	}
+	switch p := pkt.(type) {
+	case *packets.PublishPacket:
+		if !c.acl.enabled || allowed(c.acl.rules, p.TopicName, AccessWrite) {
+			return false, nil
+		}
+		if !c.cfg.ACLDrop {
+			return true, errNotAuthorized
+		}
+		var ack packets.ControlPacket
+		switch p.Qos {
+		case 1:
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = p.MessageID
+			ack = puback
+		case 2:
+			pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			pubrec.MessageID = p.MessageID
+			ack = pubrec
+		default:
+			return true, nil
+		}
+		return true, c.reply(ack)
+	case *packets.SubscribePacket:
+		qos := func(i int) byte {
+			if i < len(p.Qoss) {
+				return p.Qoss[i]
+			}
+			return 0
+		}
+		codes, deny := c.subscriptionCodes(p.Topics, qos, 0x80, 0x80)
+		if !deny {
+			return false, nil
+		}
+		if ret := c.acknowledged(p.MessageID, codes); ret != nil {
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID, suback.ReturnCodes = p.MessageID, ret
+			return true, c.reply(suback)
+		}
+		var topics []string
+		var qoss []byte
+		for i, code := range codes {
+			if code == -1 {
+				topics, qoss = append(topics, p.Topics[i]), append(qoss, qos(i))
+			}
+		}
+		p.Topics, p.Qoss = topics, qoss
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// enforce5 applies the ACL rules to an MQTT v5 packet of the client and
+// reports whether the packet must be dropped. Denied publishes are
+// acknowledged with the Not authorized reason code, or as successful if the
+// packets are dropped silently.
+func (c *conn) enforce5(pkt mqtt5.Packet) (bool, error) {
+	if !c.acl.enabled && c.cfg.SharedSubscriptions != SharedDeny {
+		return false, nil
+	}
+	switch p := pkt.(type) {
+	case *mqtt5.Publish:
+		if !c.acl.enabled || allowed(c.acl.rules, p.Topic, AccessWrite) {
+			return false, nil
+		}
+		reason := mqtt5.NotAuthorized
+		if c.cfg.ACLDrop {
+			reason = mqtt5.Success
+		}
+		switch p.QoS {
+		case 1:
+			return true, c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBACK, PacketID: p.PacketID, ReasonCode: reason})
+		case 2:
+			return true, c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBREC, PacketID: p.PacketID, ReasonCode: reason})
+		default:
+			return true, nil
+		}
+	case *mqtt5.Subscribe:
+		qos := func(i int) byte { return p.Subscriptions[i].QoS }
+		codes, deny := c.subscriptionCodes(p.Topics(), qos, mqtt5.NotAuthorized, mqtt5.SharedSubNotSupported)
+		if !deny {
+			return false, nil
+		}
+		if ret := c.acknowledged(p.PacketID, codes); ret != nil {
+			return true, c.reply(&mqtt5.Suback{PacketID: p.PacketID, ReasonCodes: ret})
+		}
+		var subs []mqtt5.Subscription
+		for i, code := range codes {
+			if code == -1 {
+				subs = append(subs, p.Subscriptions[i])
+			}
+		}
+		p.Subscriptions = subs
+		return false, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrTopicAliasInvalid indicates a topic alias of zero or greater than the negotiated Topic Alias Maximum.
+	ErrTopicAliasInvalid = errors.New("topic alias invalid")
+
+	// ErrTopicAliasUnknown indicates a PUBLISH referencing a topic alias which has not been established.
+	ErrTopicAliasUnknown = errors.New("topic alias not established")
+)
+
+// TopicAliases keeps the MQTT v5 topic alias mapping for one direction of a connection.
+// Incoming aliases are resolved to real topics with Resolve so that topic rewriting and
+// authorization always see the full topic. Outgoing aliases are assigned with Alias,
+// within the Topic Alias Maximum announced by the receiving side.
+type TopicAliases struct {
+	mu      sync.Mutex
+	max     uint16
+	topics  map[uint16]string
+	aliases map[string]uint16
+}
+
+// NewTopicAliases returns a topic alias mapping which accepts aliases from 1 to maximum.
+// A maximum of zero disables topic aliases.
+func NewTopicAliases(maximum uint16) *TopicAliases {
+	return &TopicAliases{
+		max:     maximum,
+		topics:  make(map[uint16]string),
+		aliases: make(map[string]uint16),
+	}
+}
+
+// Max returns the Topic Alias Maximum of the mapping.
+func (ta *TopicAliases) Max() uint16 {
+	return ta.max
+}
+
+// Resolve returns the real topic of a received PUBLISH packet. A non-empty topic
+// together with a non-zero alias establishes or replaces the alias, while an empty
+// topic references a previously established alias.
+func (ta *TopicAliases) Resolve(topic string, alias uint16) (string, error) {
+	if alias == 0 {
+		return topic, nil
+	}
+	if alias > ta.max {
+		return "", ErrTopicAliasInvalid
+	}
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if topic != "" {
+		if old, ok := ta.topics[alias]; ok {
+			delete(ta.aliases, old)
+		}
+		ta.topics[alias] = topic
+		ta.aliases[topic] = alias
+		return topic, nil
+	}
+	t, ok := ta.topics[alias]
+	if !ok {
+		return "", ErrTopicAliasUnknown
+	}
+	return t, nil
+}
+
+// Alias returns the alias to use when sending a PUBLISH with the given topic.
+// The second return value reports whether the alias is already established on the
+// receiving side, in which case the topic may be sent empty. An alias of zero means
+// that no alias is available and the full topic must be sent.
+func (ta *TopicAliases) Alias(topic string) (uint16, bool) {
+	if ta.max == 0 || topic == "" {
+		return 0, false
+	}
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if alias, ok := ta.aliases[topic]; ok {
+		return alias, true
+	}
+	if len(ta.topics) >= int(ta.max) {
+		return 0, false
+	}
+	alias := uint16(len(ta.topics) + 1)
+	ta.topics[alias] = topic
+	ta.aliases[topic] = alias
+	return alias, false
+}
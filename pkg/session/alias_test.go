@@ -0,0 +1,220 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+)
+
+func TestTopicAliasesResolve(t *testing.T) {
+	type publish struct {
+		topic string
+		alias uint16
+	}
+	cases := []struct {
+		desc     string
+		max      uint16
+		set      []publish
+		pub      publish
+		expected string
+		err      error
+	}{
+		{
+			desc:     "publish without alias",
+			max:      10,
+			pub:      publish{topic: "a/b"},
+			expected: "a/b",
+		},
+		{
+			desc:     "set alias",
+			max:      10,
+			pub:      publish{topic: "a/b", alias: 1},
+			expected: "a/b",
+		},
+		{
+			desc:     "resolve alias",
+			max:      10,
+			set:      []publish{{topic: "a/b", alias: 1}},
+			pub:      publish{alias: 1},
+			expected: "a/b",
+		},
+		{
+			desc:     "resolve replaced alias",
+			max:      10,
+			set:      []publish{{topic: "a/b", alias: 1}, {topic: "c/d", alias: 1}},
+			pub:      publish{alias: 1},
+			expected: "c/d",
+		},
+		{
+			desc: "resolve unknown alias",
+			max:  10,
+			set:  []publish{{topic: "a/b", alias: 1}},
+			pub:  publish{alias: 2},
+			err:  ErrTopicAliasUnknown,
+		},
+		{
+			desc: "set alias over the maximum",
+			max:  2,
+			pub:  publish{topic: "a/b", alias: 3},
+			err:  ErrTopicAliasInvalid,
+		},
+		{
+			desc: "set alias with aliases disabled",
+			max:  0,
+			pub:  publish{topic: "a/b", alias: 1},
+			err:  ErrTopicAliasInvalid,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ta := NewTopicAliases(tc.max)
+			for _, p := range tc.set {
+				if _, err := ta.Resolve(p.topic, p.alias); err != nil {
+					t.Fatalf("setting alias %d: unexpected error %v", p.alias, err)
+				}
+			}
+			topic, err := ta.Resolve(tc.pub.topic, tc.pub.alias)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if topic != tc.expected {
+				t.Errorf("expected topic %q, got %q", tc.expected, topic)
+			}
+		})
+	}
+}
+
+func TestTopicAliasesAlias(t *testing.T) {
+	type alias struct {
+		alias       uint16
+		established bool
+	}
+	cases := []struct {
+		desc     string
+		max      uint16
+		sent     []string
+		topic    string
+		expected alias
+	}{
+		{
+			desc:     "assign alias",
+			max:      10,
+			topic:    "a/b",
+			expected: alias{alias: 1},
+		},
+		{
+			desc:     "assign next alias",
+			max:      10,
+			sent:     []string{"a/b"},
+			topic:    "c/d",
+			expected: alias{alias: 2},
+		},
+		{
+			desc:     "reuse established alias",
+			max:      10,
+			sent:     []string{"a/b", "c/d"},
+			topic:    "a/b",
+			expected: alias{alias: 1, established: true},
+		},
+		{
+			desc:  "no alias over the maximum",
+			max:   2,
+			sent:  []string{"a/b", "c/d"},
+			topic: "e/f",
+		},
+		{
+			desc:     "established alias at the maximum",
+			max:      2,
+			sent:     []string{"a/b", "c/d"},
+			topic:    "c/d",
+			expected: alias{alias: 2, established: true},
+		},
+		{
+			desc:  "no alias with aliases disabled",
+			max:   0,
+			topic: "a/b",
+		},
+		{
+			desc:  "no alias for empty topic",
+			max:   10,
+			topic: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ta := NewTopicAliases(tc.max)
+			for _, topic := range tc.sent {
+				ta.Alias(topic)
+			}
+			a, established := ta.Alias(tc.topic)
+			if got := (alias{alias: a, established: established}); got != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConnAlias(t *testing.T) {
+	redial := func(context.Context) (net.Conn, error) { return nil, errors.New("unreachable") }
+	cases := []struct {
+		desc    string
+		redial  func(context.Context) (net.Conn, error)
+		sent    int
+		topic   string
+		alias   uint16
+		aliased bool
+	}{
+		{
+			desc:    "first publish establishes the alias",
+			sent:    0,
+			topic:   "a/b",
+			alias:   1,
+			aliased: true,
+		},
+		{
+			desc:    "next publish uses the alias",
+			sent:    1,
+			topic:   "",
+			alias:   1,
+			aliased: true,
+		},
+		{
+			desc:   "reconnectable session sends the full topic",
+			redial: redial,
+			sent:   1,
+			topic:  "a/b",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &conn{cfg: Config{Redial: tc.redial}}
+			c.brokerAliases.Store(NewTopicAliases(10))
+			for i := 0; i < tc.sent; i++ {
+				c.alias(&mqtt5.Publish{Topic: "a/b"})
+			}
+			in := &mqtt5.Publish{Topic: "a/b"}
+			out := c.alias(in).(*mqtt5.Publish)
+			if in.Topic != "a/b" || in.Properties.TopicAlias != nil {
+				t.Errorf("expected the forwarded packet to be left unchanged, got %+v", in)
+			}
+			if out.Topic != tc.topic {
+				t.Errorf("expected topic %q, got %q", tc.topic, out.Topic)
+			}
+			switch {
+			case !tc.aliased && out.Properties.TopicAlias != nil:
+				t.Errorf("expected no alias, got %d", *out.Properties.TopicAlias)
+			case tc.aliased && (out.Properties.TopicAlias == nil || *out.Properties.TopicAlias != tc.alias):
+				t.Errorf("expected alias %d, got %v", tc.alias, out.Properties.TopicAlias)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"net"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+)
+
+// reconnectBuffer holds the PUBLISH packets of the client received while the
+// session is reconnected, which are sent to the new broker connection.
+type reconnectBuffer struct {
+	mu sync.Mutex
+	// active is set while the broker connection is replaced.
+	active  bool
+	packets [][]byte
+}
+
+// buffering starts buffering the publishes of the client.
+func (c *conn) buffering() {
+	if c.cfg.ReconnectBuffer <= 0 {
+		return
+	}
+	b := &c.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active = true
+}
+
+// buffered keeps a PUBLISH packet of the client while the session is
+// reconnected and reports whether it was kept. Other packets, and publishes
+// exceeding the buffer, wait for the reconnection.
+func (c *conn) buffered(raw []byte) bool {
+	if c.cfg.ReconnectBuffer <= 0 || raw[0]>>4 != mqtt5.PUBLISH {
+		return false
+	}
+	b := &c.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.active || len(b.packets) >= c.cfg.ReconnectBuffer {
+		return false
+	}
+	b.packets = append(b.packets, raw)
+	return true
+}
+
+// flush sends the buffered publishes to the new broker connection, where
+// they are in flight again, and stops buffering.
+func (c *conn) flush(broker net.Conn) error {
+	b := &c.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	packets := b.packets
+	b.active, b.packets = false, nil
+	for _, raw := range packets {
+		c.publishing(raw)
+		if err := c.setWriteDeadline(broker); err != nil {
+			return err
+		}
+		if _, err := broker.Write(raw); err != nil {
+			return c.slowConsumer(Up, err)
+		}
+	}
+	return nil
+}
+
+// unbuffer stops buffering and drops the publishes of a failed reconnection.
+func (c *conn) unbuffer() {
+	b := &c.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active, b.packets = false, nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var errClientIDPattern = errors.New("client ID does not match the client ID pattern")
+
+// transformID applies the client ID options to the client ID of a CONNECT
+// packet: it is checked against the pattern, replaced by the attribute of the
+// client certificate and prefixed, in that order.
+func (c *conn) transformID(ctx context.Context, id, username string) (string, error) {
+	if re := c.cfg.clientIDPattern; re != nil && !re.MatchString(id) {
+		return "", errClientIDPattern
+	}
+	s, ok := FromContext(ctx)
+	if attr := c.cfg.ClientIDSource; attr != "" {
+		if !ok || !s.MTLS {
+			return "", errNoIdentity
+		}
+		if id = s.Identity.attribute(attr); id == "" {
+			return "", errNoIdentity
+		}
+	}
+	// Empty client IDs are assigned by the broker, so they are not prefixed.
+	if c.cfg.ClientIDPrefix != "" && id != "" {
+		var cn string
+		if ok {
+			cn = s.Identity.CommonName
+		}
+		id = strings.NewReplacer("%u", username, "%n", cn).Replace(c.cfg.ClientIDPrefix) + id
+	}
+	return id, nil
+}
+
+// transformID311 applies the client ID options to an MQTT 3.1.1 CONNECT
+// packet. Rejected clients receive a CONNACK with the identifier rejected
+// return code.
+func (c *conn) transformID311(ctx context.Context, pkt packets.ControlPacket) error {
+	p, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return nil
+	}
+	id, err := c.transformID(ctx, p.ClientIdentifier, p.Username)
+	if err != nil {
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		connack.ReturnCode = packets.ErrRefusedIDRejected
+		_ = c.reply(connack)
+		return err
+	}
+	p.ClientIdentifier = id
+	return nil
+}
+
+// transformID5 applies the client ID options to an MQTT v5 CONNECT packet.
+// Rejected clients receive a CONNACK with the Client Identifier not valid
+// reason code.
+func (c *conn) transformID5(ctx context.Context, pkt mqtt5.Packet) error {
+	p, ok := pkt.(*mqtt5.Connect)
+	if !ok {
+		return nil
+	}
+	id, err := c.transformID(ctx, p.ClientID, p.Username)
+	if err != nil {
+		c.reject5(mqtt5.CONNECT, mqtt5.ClientIdentifierNotValid)
+		return err
+	}
+	p.ClientID = id
+	return nil
+}
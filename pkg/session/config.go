@@ -0,0 +1,141 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Config holds the MQTT options applied by Stream to the proxied connections.
+type Config struct {
+	TranslateV5         bool          `env:"MQTT_V5_TRANSLATION"       envDefault:"false"`
+	TopicRewriteFile    string        `env:"MQTT_TOPIC_REWRITE_FILE"   envDefault:""`
+	ACLFile             string        `env:"MQTT_ACL_FILE"             envDefault:""`
+	ACLDrop             bool          `env:"MQTT_ACL_DROP"             envDefault:"false"`
+	PublishRate         float64       `env:"MQTT_PUBLISH_RATE"         envDefault:"0"`
+	PublishBurst        int           `env:"MQTT_PUBLISH_BURST"        envDefault:"10"`
+	PublishRateAction   string        `env:"MQTT_PUBLISH_RATE_ACTION"  envDefault:"delay"`
+	MaxPacketSize       int           `env:"MQTT_MAX_PACKET_SIZE"      envDefault:"0"`
+	KeepAlive           bool          `env:"MQTT_KEEPALIVE_ENFORCE"    envDefault:"false"`
+	IdleTimeout         time.Duration `env:"MQTT_IDLE_TIMEOUT"         envDefault:"0"`
+	TakeoverPolicy      string        `env:"MQTT_SESSION_TAKEOVER"     envDefault:"off"`
+	MaxQoS              *int          `env:"MQTT_MAX_QOS"              envDefault:""`
+	RetainStrip         bool          `env:"MQTT_RETAIN_STRIP"         envDefault:"false"`
+	RetainDenyTopics    []string      `env:"MQTT_RETAIN_DENY_TOPICS"   envDefault:""`
+	WillTopics          []string      `env:"MQTT_WILL_TOPICS"          envDefault:""`
+	PayloadLimits       []string      `env:"MQTT_PAYLOAD_LIMITS"       envDefault:""`
+	IdentityUsername    string        `env:"MQTT_IDENTITY_USERNAME"    envDefault:""`
+	IdentityPassword    string        `env:"MQTT_IDENTITY_PASSWORD"    envDefault:""`
+	IdentityToken       string        `env:"MQTT_IDENTITY_TOKEN"       envDefault:""`
+	ClientIDPattern     string        `env:"MQTT_CLIENT_ID_PATTERN"    envDefault:""`
+	ClientIDSource      string        `env:"MQTT_CLIENT_ID_SOURCE"     envDefault:""`
+	ClientIDPrefix      string        `env:"MQTT_CLIENT_ID_PREFIX"     envDefault:""`
+	SharedSubscriptions string        `env:"MQTT_SHARED_SUBSCRIPTIONS" envDefault:"allow"`
+	WriteTimeout        time.Duration `env:"MQTT_WRITE_TIMEOUT"        envDefault:"0"`
+	MaxInflight         int           `env:"MQTT_MAX_INFLIGHT"         envDefault:"0"`
+	ReconnectBuffer     int           `env:"MQTT_RECONNECT_BUFFER"     envDefault:"0"`
+	LoopDetection       bool          `env:"MQTT_LOOP_DETECTION"       envDefault:"false"`
+	LoopID              string        `env:"MQTT_LOOP_ID"              envDefault:""`
+	LoopMaxHops         int           `env:"MQTT_LOOP_MAX_HOPS"        envDefault:"8"`
+	LoopTTL             time.Duration `env:"MQTT_LOOP_TTL"             envDefault:"30s"`
+
+	// TopicRewriter rewrites the topics of the client. It is loaded from
+	// TopicRewriteFile if set.
+	TopicRewriter *TopicRewriter
+	// ACL holds the topic access rules of the clients. It is loaded from
+	// ACLFile if set.
+	ACL *ACL
+	// Sessions holds the connected clients to apply TakeoverPolicy. It is
+	// created unless TakeoverPolicy is off.
+	Sessions *Registry
+	// Loops holds the fingerprints of the MQTT 3.1.1 publishes. It is created
+	// if LoopDetection is set.
+	Loops *LoopDetector
+	// Redial connects to the broker again when its connection drops, so the
+	// session of the client is reconnected instead of closed. It is set by
+	// the proxies when the reconnection is enabled.
+	Redial func(ctx context.Context) (net.Conn, error)
+	// Metrics, if set, receives the proxied packets by type and direction.
+	Metrics Metrics
+	// Listener names the listener in the metrics. The proxies set it to
+	// their address if it is empty.
+	Listener string
+	// payloadLimits is parsed from PayloadLimits.
+	payloadLimits []payloadLimit
+	// clientIDPattern is compiled from ClientIDPattern.
+	clientIDPattern *regexp.Regexp
+}
+
+// NewConfig parses the MQTT options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	switch c.PublishRateAction {
+	case RateDrop, RateDelay, RateDisconnect:
+	default:
+		return Config{}, errRateAction
+	}
+	if c.MaxQoS != nil && (*c.MaxQoS < 0 || *c.MaxQoS > 2) {
+		return Config{}, errMaxQoS
+	}
+	switch c.SharedSubscriptions {
+	case SharedAllow, SharedDeny, SharedStrip:
+	default:
+		return Config{}, errSharedPolicy
+	}
+	switch c.TakeoverPolicy {
+	case TakeoverEvict, TakeoverReject:
+		c.Sessions = NewRegistry()
+	case TakeoverOff:
+	default:
+		return Config{}, errTakeoverPolicy
+	}
+	if c.LoopDetection {
+		if c.LoopID == "" {
+			id, err := loopID()
+			if err != nil {
+				return Config{}, err
+			}
+			c.LoopID = id
+		}
+		c.Loops = NewLoopDetector(c.LoopTTL)
+	}
+	if !validAttribute(c.IdentityUsername) || !validAttribute(c.IdentityPassword) || !validAttribute(c.ClientIDSource) {
+		return Config{}, errIdentityAttribute
+	}
+	if c.ClientIDPattern != "" {
+		re, err := regexp.Compile(c.ClientIDPattern)
+		if err != nil {
+			return Config{}, err
+		}
+		c.clientIDPattern = re
+	}
+	limits, err := parsePayloadLimits(c.PayloadLimits)
+	if err != nil {
+		return Config{}, err
+	}
+	c.payloadLimits = limits
+	if c.TopicRewriteFile != "" {
+		tr, err := LoadTopicRewriter(c.TopicRewriteFile)
+		if err != nil {
+			return Config{}, err
+		}
+		c.TopicRewriter = tr
+	}
+	if c.ACLFile != "" {
+		acl, err := LoadACL(c.ACLFile)
+		if err != nil {
+			return Config{}, err
+		}
+		c.ACL = acl
+	}
+	return c, nil
+}
@@ -5,7 +5,17 @@ package session
 
 import "context"
 
-// Handler is an interface for mProxy hooks.
+// Handler is an interface for mProxy hooks. The authorization hooks may
+// return a ReasonError, with Reject, to choose the MQTT reason code of the
+// rejection.
+//
+// The context of the hooks holds the Session of the client and is tied to
+// its connection: it is canceled once the proxy ends the connection, such as
+// when the broker or the client closes it, and once the proxy shuts down, so
+// the hooks calling external services should pass it on and give up when it
+// is done. Disconnect is called after the end of the connection, with a
+// context which isn't canceled by it. The deadline of the hooks is set with
+// WithTimeout.
 type Handler interface {
 	// Authorization on client `CONNECT`
 	// Each of the params are passed by reference, so that it can be changed
@@ -34,3 +44,19 @@ type Handler interface {
 	// Disconnect on connection with client lost
 	Disconnect(ctx context.Context) error
 }
+
+// ACLHandler is implemented by handlers which provide the ACL rules of the
+// clients, in addition to the rules of the ACL file.
+type ACLHandler interface {
+	// ACLRules is called after the client `CONNECT` is authorized and returns
+	// the ACL rules of the client.
+	ACLRules(ctx context.Context) ([]ACLRule, error)
+}
+
+// GRPCHandler is implemented by handlers which authorize the gRPC calls
+// proxied by the HTTP proxy by their method.
+type GRPCHandler interface {
+	// AuthGRPC is called after the client is authorized with AuthConnect,
+	// with the method of the call given as /package.Service/Method.
+	AuthGRPC(ctx context.Context, method string) error
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/url"
+)
+
+// Identity is the mTLS identity of a client, extracted from its verified certificate.
+type Identity struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// SerialNumber is the hex encoded serial number of the certificate.
+	SerialNumber string
+	// Fingerprint is the hex encoded SHA-256 hash of the DER encoded certificate.
+	Fingerprint string
+}
+
+// NewIdentity returns the identity of the client certificate. The zero
+// Identity is returned if the client did not present a certificate.
+func NewIdentity(cert x509.Certificate) Identity {
+	if len(cert.Raw) == 0 {
+		return Identity{}
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	id := Identity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+	}
+	if cert.SerialNumber != nil {
+		id.SerialNumber = cert.SerialNumber.Text(16)
+	}
+	return id
+}
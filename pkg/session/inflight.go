@@ -0,0 +1,125 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// inflightState holds the QoS 1 and QoS 2 publishes of the client which
+// aren't acknowledged to it yet, by packet identifier.
+type inflightState struct {
+	mu  sync.Mutex
+	ids map[uint16]bool
+	// released is signaled when a publish is acknowledged.
+	released chan struct{}
+}
+
+// awaitInflight blocks until the client has fewer unacknowledged publishes
+// than the inflight limit, which stops reading from the client meanwhile.
+func (c *conn) awaitInflight(ctx context.Context) error {
+	if c.cfg.MaxInflight <= 0 {
+		return nil
+	}
+	f := &c.inflight
+	for {
+		f.mu.Lock()
+		n := len(f.ids)
+		f.mu.Unlock()
+		if n < c.cfg.MaxInflight {
+			return nil
+		}
+		select {
+		case <-f.released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// publishing tracks a QoS 1 or QoS 2 PUBLISH packet of the client. It is
+// called before the packet is forwarded, since the proxy may acknowledge it.
+func (c *conn) publishing(raw []byte) {
+	if c.cfg.MaxInflight <= 0 || raw[0]>>4 != mqtt5.PUBLISH || raw[0]>>1&0x03 == 0 {
+		return
+	}
+	id, ok := publishID(raw)
+	if !ok {
+		return
+	}
+	f := &c.inflight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ids == nil {
+		f.ids = make(map[uint16]bool)
+	}
+	f.ids[id] = true
+}
+
+// completed releases the publish completed by a packet sent to the client:
+// a PUBACK, a PUBCOMP or an MQTT v5 PUBREC with an error reason code.
+func (c *conn) completed(pkt interface{ Write(io.Writer) error }) {
+	if c.cfg.MaxInflight <= 0 {
+		return
+	}
+	var id uint16
+	switch p := pkt.(type) {
+	case *packets.PubackPacket:
+		id = p.MessageID
+	case *packets.PubcompPacket:
+		id = p.MessageID
+	case *mqtt5.Ack:
+		if p.PacketType != mqtt5.PUBACK && p.PacketType != mqtt5.PUBCOMP && (p.PacketType != mqtt5.PUBREC || p.ReasonCode < 0x80) {
+			return
+		}
+		id = p.PacketID
+	default:
+		return
+	}
+	c.release(func(ids map[uint16]bool) { delete(ids, id) })
+}
+
+// releaseInflight forgets the unacknowledged publishes, which are lost when
+// the broker connection is replaced.
+func (c *conn) releaseInflight() {
+	if c.cfg.MaxInflight <= 0 {
+		return
+	}
+	c.release(func(ids map[uint16]bool) { clear(ids) })
+}
+
+func (c *conn) release(fn func(ids map[uint16]bool)) {
+	f := &c.inflight
+	f.mu.Lock()
+	fn(f.ids)
+	f.mu.Unlock()
+	select {
+	case f.released <- struct{}{}:
+	default:
+	}
+}
+
+// publishID returns the packet identifier of a PUBLISH packet, which follows
+// the topic name.
+func publishID(raw []byte) (uint16, bool) {
+	i := 1
+	for i < len(raw) && raw[i]&0x80 != 0 {
+		i++
+	}
+	i++
+	if i+2 > len(raw) {
+		return 0, false
+	}
+	i += 2 + int(binary.BigEndian.Uint16(raw[i:]))
+	if i+2 > len(raw) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(raw[i:]), true
+}
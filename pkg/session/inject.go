@@ -0,0 +1,130 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Attributes of the client certificate injected as credentials.
+const (
+	AttributeCN          = "cn"
+	AttributeDNS         = "dns"
+	AttributeEmail       = "email"
+	AttributeURI         = "uri"
+	AttributeIP          = "ip"
+	AttributeSerial      = "serial"
+	AttributeFingerprint = "fingerprint"
+)
+
+var (
+	errIdentityAttribute = errors.New("unknown client certificate attribute")
+	errNoIdentity        = errors.New("client certificate has no identity to inject")
+)
+
+// attribute returns an attribute of the identity, the first one of its kind
+// for the subject alternative names.
+func (id Identity) attribute(name string) string {
+	switch name {
+	case AttributeCN:
+		return id.CommonName
+	case AttributeDNS:
+		if len(id.DNSNames) > 0 {
+			return id.DNSNames[0]
+		}
+	case AttributeEmail:
+		if len(id.EmailAddresses) > 0 {
+			return id.EmailAddresses[0]
+		}
+	case AttributeURI:
+		if len(id.URIs) > 0 {
+			return id.URIs[0].String()
+		}
+	case AttributeIP:
+		if len(id.IPAddresses) > 0 {
+			return id.IPAddresses[0].String()
+		}
+	case AttributeSerial:
+		return id.SerialNumber
+	case AttributeFingerprint:
+		return id.Fingerprint
+	}
+	return ""
+}
+
+func validAttribute(name string) bool {
+	switch name {
+	case "", AttributeCN, AttributeDNS, AttributeEmail, AttributeURI, AttributeIP, AttributeSerial, AttributeFingerprint:
+		return true
+	default:
+		return false
+	}
+}
+
+// injecting reports whether credentials are injected from the client certificate.
+func (c *conn) injecting() bool {
+	return c.cfg.IdentityUsername != "" || c.cfg.IdentityPassword != "" || c.cfg.IdentityToken != ""
+}
+
+// inject replaces the credentials with the ones derived from the client
+// certificate. Clients without certificate, or whose certificate lacks the
+// injected attributes, are rejected.
+func (c *conn) inject(ctx context.Context, username *string, password *[]byte) error {
+	s, ok := FromContext(ctx)
+	if !ok || !s.MTLS {
+		return errNoIdentity
+	}
+	if attr := c.cfg.IdentityUsername; attr != "" {
+		if *username = s.Identity.attribute(attr); *username == "" {
+			return errNoIdentity
+		}
+	}
+	switch {
+	case c.cfg.IdentityToken != "":
+		*password = []byte(c.cfg.IdentityToken)
+	case c.cfg.IdentityPassword != "":
+		pass := s.Identity.attribute(c.cfg.IdentityPassword)
+		if pass == "" {
+			return errNoIdentity
+		}
+		*password = []byte(pass)
+	}
+	return nil
+}
+
+// inject311 injects the credentials in an MQTT 3.1.1 CONNECT packet.
+// Rejected clients receive a CONNACK with the not authorized return code.
+func (c *conn) inject311(ctx context.Context, pkt packets.ControlPacket) error {
+	p, ok := pkt.(*packets.ConnectPacket)
+	if !ok || !c.injecting() {
+		return nil
+	}
+	if err := c.inject(ctx, &p.Username, &p.Password); err != nil {
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		_ = c.reply(connack)
+		return err
+	}
+	p.UsernameFlag, p.PasswordFlag = p.Username != "", len(p.Password) > 0
+	return nil
+}
+
+// inject5 injects the credentials in an MQTT v5 CONNECT packet. Rejected
+// clients receive a CONNACK with the Not authorized reason code.
+func (c *conn) inject5(ctx context.Context, pkt mqtt5.Packet) error {
+	p, ok := pkt.(*mqtt5.Connect)
+	if !ok || !c.injecting() {
+		return nil
+	}
+	if err := c.inject(ctx, &p.Username, &p.Password); err != nil {
+		c.reject5(mqtt5.CONNECT, mqtt5.NotAuthorized)
+		return err
+	}
+	p.UsernameFlag, p.PasswordFlag = p.Username != "", len(p.Password) > 0
+	return nil
+}
@@ -6,6 +6,7 @@ package session
 import (
 	"context"
 
+	"github.com/absmach/mproxy/pkg/mqtt5"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -14,6 +15,17 @@ type Interceptor interface {
 	// Intercept is called on every packet flowing through the Proxy.
 	// Packets can be modified before being sent to the broker or the client.
 	// If the interceptor returns a non-nil packet, the modified packet is sent.
+	// If it returns a nil packet, the packet is dropped, and a dropped PUBLISH
+	// is acknowledged by the proxy on behalf of its receiver.
 	// The error indicates unsuccessful interception and mProxy is cancelling the packet.
 	Intercept(ctx context.Context, pkt packets.ControlPacket, dir Direction) (packets.ControlPacket, error)
 }
+
+// InterceptorV5 is implemented by interceptors which also intercept the
+// packets of MQTT v5 connections. MQTT v5 connections are refused with the
+// Unsupported Protocol Version reason code if the interceptor doesn't
+// implement it.
+type InterceptorV5 interface {
+	// InterceptV5 is called on every packet of MQTT v5 connections, like Intercept.
+	InterceptV5(ctx context.Context, pkt mqtt5.Packet, dir Direction) (mqtt5.Packet, error)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	errKeepAlive   = errors.New("client exceeded its keep alive without sending packets")
+	errIdleTimeout = errors.New("client exceeded the idle timeout without sending packets")
+)
+
+// setKeepAlive sets the keep alive of the client in seconds, after which the
+// client is disconnected if it sent no packets for one and a half times the
+// keep alive. A keep alive of zero disables the check.
+func (c *conn) setKeepAlive(seconds uint16) {
+	if !c.cfg.KeepAlive {
+		return
+	}
+	c.keepAlive.Store(int64(time.Duration(seconds) * time.Second * 3 / 2))
+}
+
+// setReadDeadline sets the deadline of the next packet of the client from the
+// keep alive of the client and the idle timeout.
+func (c *conn) setReadDeadline() error {
+	timeout := time.Duration(c.keepAlive.Load())
+	if idle := c.cfg.IdleTimeout; idle > 0 && (timeout == 0 || idle < timeout) {
+		timeout = idle
+	}
+	if timeout == 0 {
+		return nil
+	}
+	return c.client.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// timeoutError returns the reason of a read timeout of the client, or nil if
+// err is not a timeout.
+func (c *conn) timeoutError(err error) error {
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return nil
+	}
+	if idle := c.cfg.IdleTimeout; idle > 0 && (c.keepAlive.Load() == 0 || idle < time.Duration(c.keepAlive.Load())) {
+		return errIdleTimeout
+	}
+	return errKeepAlive
+}
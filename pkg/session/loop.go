@@ -0,0 +1,122 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	// LoopProperty is the MQTT v5 user property listing the proxies a
+	// publish went through, one property per proxy.
+	LoopProperty = "mproxy-via"
+	// maxFingerprints bounds the publishes remembered by a LoopDetector.
+	maxFingerprints = 1 << 16
+)
+
+// LoopDetector remembers the fingerprints of the MQTT 3.1.1 publishes seen
+// by the sessions of a proxy, so a publish bridged back to the proxy within
+// the TTL is recognized. It is safe for concurrent use.
+type LoopDetector struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[uint64]time.Time
+}
+
+// NewLoopDetector returns a LoopDetector remembering publishes for ttl.
+func NewLoopDetector(ttl time.Duration) *LoopDetector {
+	return &LoopDetector{ttl: ttl, seen: make(map[uint64]time.Time)}
+}
+
+// Observe records a publish and reports whether the same topic and payload
+// were observed within the TTL.
+func (d *LoopDetector) Observe(topic string, payload []byte) bool {
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	key := h.Sum64()
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.seen[key]; ok && now.Sub(t) < d.ttl {
+		d.seen[key] = now
+		return true
+	}
+	if len(d.seen) >= maxFingerprints {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.ttl {
+				delete(d.seen, k)
+			}
+		}
+		if len(d.seen) >= maxFingerprints {
+			clear(d.seen)
+		}
+	}
+	d.seen[key] = now
+	return false
+}
+
+// loopID returns a random identifier of the proxy for LoopProperty.
+func loopID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "mproxy-" + hex.EncodeToString(b), nil
+}
+
+// loop311 reports whether an MQTT 3.1.1 publish of the client is circulating
+// between bridged brokers, because the same message went through the proxy,
+// in either direction, within the TTL of the loop detection.
+func (c *conn) loop311(ctx context.Context, pkt packets.ControlPacket) (bool, error) {
+	p, ok := pkt.(*packets.PublishPacket)
+	if !ok || c.cfg.Loops == nil || !c.cfg.Loops.Observe(p.TopicName, p.Payload) {
+		return false, nil
+	}
+	return true, c.dropped(ctx, Up, pkt)
+}
+
+// observe records an MQTT 3.1.1 publish delivered to the client, so the
+// client echoing it back to the proxy is detected as a loop.
+func (c *conn) observe(pkt packets.ControlPacket) {
+	if p, ok := pkt.(*packets.PublishPacket); ok && c.cfg.Loops != nil {
+		c.cfg.Loops.Observe(p.TopicName, p.Payload)
+	}
+}
+
+// loop5 reports whether an MQTT v5 publish of the client is circulating
+// between bridged brokers, because it already went through this proxy or
+// through more proxies than allowed. Other publishes get the LoopProperty of
+// the proxy, which the brokers and bridges pass along.
+func (c *conn) loop5(ctx context.Context, pkt mqtt5.Packet) (bool, error) {
+	p, ok := pkt.(*mqtt5.Publish)
+	if !ok || !c.cfg.LoopDetection {
+		return false, nil
+	}
+	hops := 0
+	for _, u := range p.Properties.User {
+		if u.Key != LoopProperty {
+			continue
+		}
+		if u.Value == c.cfg.LoopID {
+			return true, c.dropped5(ctx, Up, pkt)
+		}
+		hops++
+	}
+	if c.cfg.LoopMaxHops > 0 && hops >= c.cfg.LoopMaxHops {
+		return true, c.dropped5(ctx, Up, pkt)
+	}
+	p.Properties.User = append(p.Properties.User, mqtt5.UserProperty{Key: LoopProperty, Value: c.cfg.LoopID})
+	return false, nil
+}
@@ -0,0 +1,33 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import "time"
+
+// Metrics receives the packets proxied by Stream, so that they can be
+// exported to a monitoring system such as Prometheus. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	// PacketObserved is called after every packet read from the client or the
+	// broker is handled, with the name of its type, such as PUBLISH, and the
+	// time spent by the proxy to handle and forward it. Packets dropped by
+	// the proxy are observed too.
+	PacketObserved(listener string, dir Direction, packetType string, latency time.Duration)
+	// SlowConsumer is called when a connection is closed because the client,
+	// for the Down direction, or the broker, for the Up direction, didn't
+	// read the packets written to it within the write timeout.
+	SlowConsumer(listener string, dir Direction)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) PacketObserved(string, Direction, string, time.Duration) {}
+func (nopMetrics) SlowConsumer(string, Direction)                          {}
+
+func (c *conn) metrics() Metrics {
+	if c.cfg.Metrics != nil {
+		return c.cfg.Metrics
+	}
+	return nopMetrics{}
+}
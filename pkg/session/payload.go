@@ -0,0 +1,74 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var (
+	errPayloadLimit    = errors.New("invalid payload limit")
+	errPayloadTooLarge = errors.New("publish payload exceeds the limit of the topic")
+)
+
+// payloadLimit is the maximum payload size of the publishes on the topics
+// matched by filter.
+type payloadLimit struct {
+	filter string
+	size   int
+}
+
+// parsePayloadLimits parses payload limits of the form filter:size.
+func parsePayloadLimits(limits []string) ([]payloadLimit, error) {
+	var ret []payloadLimit
+	for _, l := range limits {
+		i := strings.LastIndex(l, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%w: %s", errPayloadLimit, l)
+		}
+		size, err := strconv.Atoi(l[i+1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: %s", errPayloadLimit, l)
+		}
+		ret = append(ret, payloadLimit{filter: l[:i], size: size})
+	}
+	return ret, nil
+}
+
+// payloadAllowed reports whether the payload size is within the limit of the
+// first limit matching the topic.
+func (c *conn) payloadAllowed(topic string, size int) bool {
+	for _, l := range c.cfg.payloadLimits {
+		if covers(l.filter, topic) {
+			return size <= l.size
+		}
+	}
+	return true
+}
+
+// payload311 applies the payload limits to an MQTT 3.1.1 packet of the
+// client. Publishes exceeding their limit close the connection.
+func (c *conn) payload311(pkt packets.ControlPacket) error {
+	if p, ok := pkt.(*packets.PublishPacket); ok && !c.payloadAllowed(p.TopicName, len(p.Payload)) {
+		return errPayloadTooLarge
+	}
+	return nil
+}
+
+// payload5 applies the payload limits to an MQTT v5 packet of the client.
+// Publishes exceeding their limit close the connection with the Packet too
+// large reason code.
+func (c *conn) payload5(pkt mqtt5.Packet) error {
+	if p, ok := pkt.(*mqtt5.Publish); ok && !c.payloadAllowed(p.Topic, len(p.Payload)) {
+		c.reject5(mqtt5.PUBLISH, mqtt5.PacketTooLarge)
+		return errPayloadTooLarge
+	}
+	return nil
+}
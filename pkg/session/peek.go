@@ -0,0 +1,41 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+)
+
+var errNotConnect = errors.New("first packet of the client is not a CONNECT")
+
+// PeekClientID reads the CONNECT packet of the client and returns its client
+// identifier, along with a connection which reads the packet again, so the
+// broker can be selected by client identifier before Stream starts. Packets
+// larger than limit are rejected, unless limit is zero.
+func PeekClientID(conn net.Conn, limit int) (net.Conn, string, error) {
+	raw, err := mqtt5.ReadFrame(conn, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	id, ok := mqtt5.ConnectClientID(raw)
+	if !ok {
+		return nil, "", errNotConnect
+	}
+	return &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(raw), conn)}, id, nil
+}
+
+// peekedConn is a connection whose first bytes were already read.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var errMaxQoS = errors.New("maximum QoS must be 0, 1 or 2")
+
+// qosState holds the acknowledgment flows of the publishes of the client
+// whose QoS was capped, by packet identifier.
+type qosState struct {
+	mu sync.Mutex
+	// downgraded holds the QoS 2 publishes forwarded with QoS 1, whose PUBACK
+	// is answered to the client with a PUBREC.
+	downgraded map[uint16]bool
+	// released holds the QoS 2 publishes answered with a PUBREC by the proxy,
+	// whose PUBREL is answered with a PUBCOMP.
+	released map[uint16]bool
+}
+
+func (q *qosState) mark(m *map[uint16]bool, id uint16) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if *m == nil {
+		*m = make(map[uint16]bool)
+	}
+	(*m)[id] = true
+}
+
+// take removes id from m and reports whether it was present.
+func (q *qosState) take(m *map[uint16]bool, id uint16) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ok := (*m)[id]
+	delete(*m, id)
+	return ok
+}
+
+// maxQoS returns the maximum QoS and whether the QoS is capped.
+func (c *conn) maxQoS() (byte, bool) {
+	if c.cfg.MaxQoS == nil || *c.cfg.MaxQoS >= 2 {
+		return 2, false
+	}
+	return byte(*c.cfg.MaxQoS), true
+}
+
+// capped reports whether the QoS must be capped.
+func (c *conn) capped(qos byte) bool {
+	limit, ok := c.maxQoS()
+	return ok && qos > limit
+}
+
+func (c *conn) capQoS(qos byte) byte {
+	if limit, _ := c.maxQoS(); qos > limit {
+		return limit
+	}
+	return qos
+}
+
+// capQoS311 caps the QoS of an MQTT 3.1.1 packet of the client and reports
+// whether the packet must be dropped, because the proxy answers it.
+func (c *conn) capQoS311(pkt packets.ControlPacket) (bool, error) {
+	limit, ok := c.maxQoS()
+	if !ok {
+		return false, nil
+	}
+	q := &c.qos
+	switch p := pkt.(type) {
+	case *packets.ConnectPacket:
+		p.WillQos = c.capQoS(p.WillQos)
+	case *packets.SubscribePacket:
+		for i := range p.Qoss {
+			p.Qoss[i] = c.capQoS(p.Qoss[i])
+		}
+	case *packets.PublishPacket:
+		if !c.capped(p.Qos) {
+			return false, nil
+		}
+		if limit == 1 {
+			// The QoS 2 flow is completed by the proxy on the PUBACK of the broker.
+			q.mark(&q.downgraded, p.MessageID)
+			p.Qos = 1
+			return false, nil
+		}
+		// The publish is acknowledged by the proxy and forwarded with QoS 0.
+		var ack packets.ControlPacket
+		if p.Qos == 2 {
+			q.mark(&q.released, p.MessageID)
+			pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			pubrec.MessageID = p.MessageID
+			ack = pubrec
+		} else {
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = p.MessageID
+			ack = puback
+		}
+		p.Qos, p.MessageID, p.Dup = 0, 0, false
+		return false, c.reply(ack)
+	case *packets.PubrelPacket:
+		if q.take(&q.released, p.MessageID) {
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			return true, c.reply(pubcomp)
+		}
+	}
+	return false, nil
+}
+
+// capQoS5 caps the QoS of an MQTT v5 packet of the client and reports whether
+// the packet must be dropped, because the proxy answers it.
+func (c *conn) capQoS5(pkt mqtt5.Packet) (bool, error) {
+	limit, ok := c.maxQoS()
+	if !ok {
+		return false, nil
+	}
+	q := &c.qos
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		p.WillQoS = c.capQoS(p.WillQoS)
+	case *mqtt5.Subscribe:
+		for i := range p.Subscriptions {
+			p.Subscriptions[i].QoS = c.capQoS(p.Subscriptions[i].QoS)
+		}
+	case *mqtt5.Publish:
+		if !c.capped(p.QoS) {
+			return false, nil
+		}
+		if limit == 1 {
+			// The QoS 2 flow is completed by the proxy on the PUBACK of the broker.
+			q.mark(&q.downgraded, p.PacketID)
+			p.QoS = 1
+			return false, nil
+		}
+		// The publish is acknowledged by the proxy and forwarded with QoS 0.
+		ack := &mqtt5.Ack{PacketType: mqtt5.PUBACK, PacketID: p.PacketID}
+		if p.QoS == 2 {
+			q.mark(&q.released, p.PacketID)
+			ack.PacketType = mqtt5.PUBREC
+		}
+		p.QoS, p.PacketID, p.Dup = 0, 0, false
+		return false, c.reply(ack)
+	case *mqtt5.Ack:
+		if p.PacketType == mqtt5.PUBREL && q.take(&q.released, p.PacketID) {
+			return true, c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBCOMP, PacketID: p.PacketID})
+		}
+	}
+	return false, nil
+}
+
+// downgradedAck answers the PUBACK of the broker to a QoS 2 publish forwarded
+// with QoS 1 with a PUBREC, whose PUBREL is then answered by the proxy.
+func (c *conn) downgradedAck(pkt packets.ControlPacket) packets.ControlPacket {
+	q := &c.qos
+	p, ok := pkt.(*packets.PubackPacket)
+	if !ok || !q.take(&q.downgraded, p.MessageID) {
+		return pkt
+	}
+	q.mark(&q.released, p.MessageID)
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = p.MessageID
+	return pubrec
+}
+
+// downgradedAck5 is downgradedAck for MQTT v5 packets.
+func (c *conn) downgradedAck5(pkt mqtt5.Packet) {
+	q := &c.qos
+	p, ok := pkt.(*mqtt5.Ack)
+	if !ok || p.PacketType != mqtt5.PUBACK || !q.take(&q.downgraded, p.PacketID) {
+		return
+	}
+	if p.ReasonCode < 0x80 {
+		q.mark(&q.released, p.PacketID)
+	}
+	p.PacketType = mqtt5.PUBREC
+}
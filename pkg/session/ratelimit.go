@@ -0,0 +1,153 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Actions applied to the publishes exceeding the rate limit.
+const (
+	RateDrop       = "drop"
+	RateDelay      = "delay"
+	RateDisconnect = "disconnect"
+)
+
+var (
+	errRateAction  = errors.New("unknown publish rate limit action")
+	errRateLimited = errors.New("publish rate limit exceeded")
+)
+
+// tokenBucket limits the rate of events to rate per second, with bursts of
+// up to burst events.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limited applies the publish rate limit and reports whether the publish
+// exceeds it and must be dropped. Delayed publishes are held until the rate
+// allows them, which also stops reading from the client.
+func (c *conn) limited(ctx context.Context) (bool, error) {
+	if c.publishes == nil {
+		return false, nil
+	}
+	now := time.Now()
+	if c.cfg.PublishRateAction == RateDelay {
+		wait := c.publishes.reserve(now)
+		if wait == 0 {
+			return false, nil
+		}
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return false, nil
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+	if c.publishes.allow(now) {
+		return false, nil
+	}
+	if c.cfg.PublishRateAction == RateDisconnect {
+		return true, errRateLimited
+	}
+	return true, nil
+}
+
+// limit applies the publish rate limit to an MQTT 3.1.1 packet of the client
+// and reports whether the packet must be dropped. Dropped publishes are
+// acknowledged as successful, since MQTT 3.1.1 has no negative
+// acknowledgments.
+func (c *conn) limit(ctx context.Context, pkt packets.ControlPacket) (bool, error) {
+	p, ok := pkt.(*packets.PublishPacket)
+	if !ok {
+		return false, nil
+	}
+	drop, err := c.limited(ctx)
+	if !drop || err != nil {
+		return drop, err
+	}
+	switch p.Qos {
+	case 1:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		return true, c.reply(puback)
+	case 2:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		return true, c.reply(pubrec)
+	default:
+		return true, nil
+	}
+}
+
+// limit5 applies the publish rate limit to an MQTT v5 packet of the client
+// and reports whether the packet must be dropped. Dropped publishes are
+// acknowledged with the Quota exceeded reason code, and disconnected clients
+// receive a DISCONNECT with the Message rate too high reason code.
+func (c *conn) limit5(ctx context.Context, pkt mqtt5.Packet) (bool, error) {
+	p, ok := pkt.(*mqtt5.Publish)
+	if !ok {
+		return false, nil
+	}
+	drop, err := c.limited(ctx)
+	if err == errRateLimited {
+		c.reject5(mqtt5.PUBLISH, mqtt5.MessageRateTooHigh)
+	}
+	if !drop || err != nil {
+		return drop, err
+	}
+	switch p.QoS {
+	case 1:
+		return true, c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBACK, PacketID: p.PacketID, ReasonCode: mqtt5.QuotaExceeded})
+	case 2:
+		return true, c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBREC, PacketID: p.PacketID, ReasonCode: mqtt5.QuotaExceeded})
+	default:
+		return true, nil
+	}
+}
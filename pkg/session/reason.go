@@ -0,0 +1,149 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var (
+	// pubackCodes are the reason codes rejecting a PUBLISH in its PUBACK or
+	// PUBREC, without closing the connection.
+	pubackCodes = map[byte]bool{
+		mqtt5.UnspecifiedError:            true,
+		mqtt5.ImplementationSpecificError: true,
+		mqtt5.NotAuthorized:               true,
+		mqtt5.TopicNameInvalid:            true,
+		mqtt5.PacketIdentifierInUse:       true,
+		mqtt5.QuotaExceeded:               true,
+		mqtt5.PayloadFormatInvalid:        true,
+	}
+	// subackCodes are the reason codes rejecting a SUBSCRIBE in its SUBACK,
+	// without closing the connection.
+	subackCodes = map[byte]bool{
+		mqtt5.UnspecifiedError:            true,
+		mqtt5.ImplementationSpecificError: true,
+		mqtt5.NotAuthorized:               true,
+		mqtt5.TopicFilterInvalid:          true,
+		mqtt5.PacketIdentifierInUse:       true,
+		mqtt5.QuotaExceeded:               true,
+		mqtt5.SharedSubNotSupported:       true,
+		mqtt5.SubIDsNotSupported:          true,
+		mqtt5.WildcardSubNotSupported:     true,
+	}
+)
+
+// ReasonError is returned by the handler to reject a packet with an MQTT
+// reason code, such as mqtt5.NotAuthorized or mqtt5.QuotaExceeded. Rejected
+// MQTT v5 publishes and subscriptions are answered with the reason code and
+// the connection is kept, if the code is valid for their acknowledgment.
+// Otherwise the client receives a CONNACK or a DISCONNECT and is closed.
+// MQTT 3.1.1 clients receive the closest CONNACK return code or a failed
+// SUBACK, while their rejected publishes close the connection.
+type ReasonError struct {
+	Code byte
+	Err  error
+}
+
+// Reject returns a ReasonError rejecting a packet with the reason code. The
+// error err, which may be nil, describes the rejection.
+func Reject(code byte, err error) error {
+	return &ReasonError{Code: code, Err: err}
+}
+
+func (e *ReasonError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("rejected with reason code 0x%02X", e.Code)
+	}
+	return fmt.Sprintf("%s: rejected with reason code 0x%02X", e.Err, e.Code)
+}
+
+func (e *ReasonError) Unwrap() error {
+	return e.Err
+}
+
+// reasonCode returns the reason code of the error, or the fallback if the
+// error isn't a ReasonError.
+func reasonCode(err error, fallback byte) byte {
+	var re *ReasonError
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	return fallback
+}
+
+// rejected answers an MQTT 3.1.1 packet rejected by the handler. The error is
+// returned, closing the connection, unless the rejection is acknowledged.
+func (c *conn) rejected(pkt packets.ControlPacket, err error) error {
+	var re *ReasonError
+	if !errors.As(err, &re) {
+		return err
+	}
+	switch p := pkt.(type) {
+	case *packets.ConnectPacket:
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		connack.ReturnCode = returnCode(re.Code)
+		_ = c.reply(connack)
+	case *packets.SubscribePacket:
+		suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		suback.MessageID, suback.ReturnCodes = p.MessageID, make([]byte, len(p.Topics))
+		for i := range suback.ReturnCodes {
+			suback.ReturnCodes[i] = 0x80
+		}
+		return c.reply(suback)
+	}
+	return err
+}
+
+// rejected5 answers an MQTT v5 packet rejected by the handler. The error is
+// returned, closing the connection, unless the rejection is acknowledged.
+func (c *conn) rejected5(pkt mqtt5.Packet, err error) error {
+	code := reasonCode(err, mqtt5.NotAuthorized)
+	var re *ReasonError
+	if errors.As(err, &re) {
+		switch p := pkt.(type) {
+		case *mqtt5.Publish:
+			if !pubackCodes[code] {
+				break
+			}
+			switch p.QoS {
+			case 1:
+				return c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBACK, PacketID: p.PacketID, ReasonCode: code})
+			case 2:
+				return c.reply(&mqtt5.Ack{PacketType: mqtt5.PUBREC, PacketID: p.PacketID, ReasonCode: code})
+			default:
+				return nil
+			}
+		case *mqtt5.Subscribe:
+			if !subackCodes[code] {
+				break
+			}
+			codes := make([]byte, len(p.Subscriptions))
+			for i := range codes {
+				codes[i] = code
+			}
+			return c.reply(&mqtt5.Suback{PacketID: p.PacketID, ReasonCodes: codes})
+		}
+	}
+	c.reject5(pkt.Type(), code)
+	return err
+}
+
+// returnCode returns the MQTT 3.1.1 CONNACK return code closest to an MQTT v5
+// reason code.
+func returnCode(reason byte) byte {
+	if reason == mqtt5.ServerBusy {
+		return packets.ErrRefusedServerUnavailable
+	}
+	for rc, r := range connackReasonCodes {
+		if r == reason && rc != packets.Accepted {
+			return rc
+		}
+	}
+	return packets.ErrRefusedNotAuthorised
+}
@@ -0,0 +1,343 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	// maxReplayed is the maximum number of SUBSCRIBE packets
+	// recorded to be replayed. Connections exceeding it aren't reconnected.
+	maxReplayed = 1024
+	// replayTimeout bounds the wait for the CONNACK of the new broker connection.
+	replayTimeout = 10 * time.Second
+)
+
+var (
+	errReconnect = errors.New("broker refused the reconnection")
+	errReplay    = errors.New("unexpected replayed packet")
+)
+
+// reconnection holds the packets replayed to a new broker connection when the
+// broker connection drops, so the session continues transparently for the
+// client. The in-flight publishes of the dropped connection are lost.
+type reconnection struct {
+	mu sync.Mutex
+	// connect is the CONNECT packet sent to the broker.
+	connect []byte
+	// subscriptions holds the SUBSCRIBE packets sent to the broker, in order,
+	// without the topics subscribed again or unsubscribed since.
+	subscriptions [][]byte
+	// replayed holds the packet identifiers of the replayed packets, whose
+	// acknowledgments aren't forwarded to the client.
+	replayed map[uint16]bool
+	// connected is set once the broker accepts the connection and closing
+	// once the client disconnects.
+	connected bool
+	closing   bool
+	overflow  bool
+}
+
+// upstream returns the current broker connection.
+func (c *conn) upstream() net.Conn {
+	c.brokerMu.Lock()
+	defer c.brokerMu.Unlock()
+	return c.broker
+}
+
+// send writes a packet of the client to the broker. If the write fails, the
+// session is reconnected and the packet is sent to the new broker connection.
+func (c *conn) send(ctx context.Context, pkt interface{ Write(io.Writer) error }) error {
+	if c.cfg.Redial == nil {
+		if err := c.setWriteDeadline(c.broker); err != nil {
+			return err
+		}
+		return c.slowConsumer(Up, pkt.Write(c.broker))
+	}
+	var buf bytes.Buffer
+	if err := pkt.Write(&buf); err != nil {
+		return err
+	}
+	raw := buf.Bytes()
+	if c.buffered(raw) {
+		return nil
+	}
+	broker := c.upstream()
+	if err := c.setWriteDeadline(broker); err != nil {
+		return err
+	}
+	if _, err := broker.Write(raw); err != nil {
+		// A slow broker is not replaced, as the client may be the cause.
+		if err = c.slowConsumer(Up, err); errors.Is(err, errSlowConsumer) || !c.reconnectable() {
+			return err
+		}
+		if rerr := c.reconnect(ctx, broker); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		broker = c.upstream()
+		if err := c.setWriteDeadline(broker); err != nil {
+			return err
+		}
+		if _, err := broker.Write(raw); err != nil {
+			return c.slowConsumer(Up, err)
+		}
+	}
+	c.record(raw)
+	return nil
+}
+
+// record keeps the packets sent to the broker which are replayed on reconnection.
+func (c *conn) record(raw []byte) {
+	r := &c.reconnection
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch raw[0] >> 4 {
+	case mqtt5.CONNECT:
+		r.connect = raw
+	case mqtt5.SUBSCRIBE, mqtt5.UNSUBSCRIBE:
+		r.subscribed(raw)
+	case mqtt5.DISCONNECT:
+		r.closing = true
+	}
+}
+
+// subscribed folds a SUBSCRIBE or UNSUBSCRIBE packet into the recorded
+// subscriptions, so the replayed subscriptions are the current state of the
+// session: its topics are removed from the previous SUBSCRIBE packets, which
+// are dropped once empty, and only SUBSCRIBE packets are kept.
+func (r *reconnection) subscribed(raw []byte) {
+	v5 := mqtt5.ConnectVersion(r.connect) == mqtt5.Version
+	topics, err := filters(raw, v5)
+	if err == nil {
+		kept := r.subscriptions[:0]
+		for _, sub := range r.subscriptions {
+			if sub, err = without(sub, topics, v5); err == nil && sub != nil {
+				kept = append(kept, sub)
+			}
+		}
+		r.subscriptions = kept
+		if raw[0]>>4 == mqtt5.UNSUBSCRIBE {
+			return
+		}
+	}
+	if len(r.subscriptions) >= maxReplayed {
+		r.overflow = true
+		return
+	}
+	r.subscriptions = append(r.subscriptions, raw)
+}
+
+// filters returns the topic filters of a SUBSCRIBE or UNSUBSCRIBE packet.
+func filters(raw []byte, v5 bool) ([]string, error) {
+	if v5 {
+		pkt, err := mqtt5.Decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		switch p := pkt.(type) {
+		case *mqtt5.Subscribe:
+			return p.Topics(), nil
+		case *mqtt5.Unsubscribe:
+			return p.Topics, nil
+		}
+		return nil, errReplay
+	}
+	pkt, err := packets.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	switch p := pkt.(type) {
+	case *packets.SubscribePacket:
+		return p.Topics, nil
+	case *packets.UnsubscribePacket:
+		return p.Topics, nil
+	}
+	return nil, errReplay
+}
+
+// without returns a SUBSCRIBE packet without the topics, or nil if none is left.
+func without(raw []byte, topics []string, v5 bool) ([]byte, error) {
+	removed := func(topic string) bool { return slices.Contains(topics, topic) }
+	var buf bytes.Buffer
+	if v5 {
+		pkt, err := mqtt5.Decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := pkt.(*mqtt5.Subscribe)
+		if !ok {
+			return nil, errReplay
+		}
+		subs := slices.DeleteFunc(slices.Clone(p.Subscriptions), func(s mqtt5.Subscription) bool { return removed(s.Topic) })
+		switch len(subs) {
+		case len(p.Subscriptions):
+			return raw, nil
+		case 0:
+			return nil, nil
+		}
+		p.Subscriptions = subs
+		err = p.Write(&buf)
+		return buf.Bytes(), err
+	}
+	pkt, err := packets.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	p, ok := pkt.(*packets.SubscribePacket)
+	if !ok {
+		return nil, errReplay
+	}
+	var subs []string
+	var qoss []byte
+	for i, topic := range p.Topics {
+		if !removed(topic) {
+			subs, qoss = append(subs, topic), append(qoss, p.Qoss[i])
+		}
+	}
+	switch len(subs) {
+	case len(p.Topics):
+		return raw, nil
+	case 0:
+		return nil, nil
+	}
+	p.Topics, p.Qoss = subs, qoss
+	err = p.Write(&buf)
+	return buf.Bytes(), err
+}
+
+// received tracks a packet of the broker and reports whether it acknowledges
+// a replayed packet, so it must not be forwarded to the client.
+func (c *conn) received(raw []byte) bool {
+	if c.cfg.Redial == nil {
+		return false
+	}
+	r := &c.reconnection
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch raw[0] >> 4 {
+	case mqtt5.CONNACK:
+		// The reason code of MQTT v5 is at the position of the return code of MQTT 3.1.1.
+		r.connected = len(raw) > 3 && raw[3] == 0
+	case mqtt5.SUBACK, mqtt5.UNSUBACK:
+		id := packetID(raw)
+		if r.replayed[id] {
+			delete(r.replayed, id)
+			return true
+		}
+	}
+	return false
+}
+
+// reconnectable reports whether the session can be reconnected to a new
+// broker connection.
+func (c *conn) reconnectable() bool {
+	if c.cfg.Redial == nil || c.closed.Load() {
+		return false
+	}
+	r := &c.reconnection
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connected && !r.closing && !r.overflow
+}
+
+// reconnect replaces the failed broker connection with a new one, to which the
+// CONNECT and the subscriptions of the client are replayed, followed by the
+// publishes buffered meanwhile. It does nothing if the other direction
+// already replaced the failed connection.
+func (c *conn) reconnect(ctx context.Context, failed net.Conn) error {
+	c.brokerMu.Lock()
+	defer c.brokerMu.Unlock()
+	if c.broker != failed {
+		return nil
+	}
+	c.buffering()
+	defer c.unbuffer()
+	broker, err := c.cfg.Redial(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.replay(broker); err != nil {
+		broker.Close()
+		return err
+	}
+	if c.reconnected {
+		failed.Close()
+	} else {
+		// The initial connection is closed by the caller of Stream, the
+		// deadline only unblocks its reader.
+		_ = failed.SetDeadline(time.Now())
+	}
+	if aliases := c.downAliases.Load(); aliases != nil {
+		c.downAliases.Store(NewTopicAliases(aliases.Max()))
+	}
+	c.broker, c.reconnected = broker, true
+	c.releaseInflight()
+	return c.flush(broker)
+}
+
+func (c *conn) replay(broker net.Conn) error {
+	r := &c.reconnection
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := broker.Write(r.connect); err != nil {
+		return err
+	}
+	if err := broker.SetReadDeadline(time.Now().Add(replayTimeout)); err != nil {
+		return err
+	}
+	raw, err := mqtt5.ReadFrame(broker, 0)
+	if err != nil {
+		return err
+	}
+	if raw[0]>>4 != mqtt5.CONNACK || len(raw) < 4 || raw[3] != 0 {
+		return errReconnect
+	}
+	if err := broker.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	r.replayed = make(map[uint16]bool)
+	for _, sub := range r.subscriptions {
+		if _, err := broker.Write(sub); err != nil {
+			return err
+		}
+		r.replayed[packetID(sub)] = true
+	}
+	return nil
+}
+
+// close closes the broker connection which replaced the initial one.
+func (c *conn) close() {
+	c.closed.Store(true)
+	c.brokerMu.Lock()
+	defer c.brokerMu.Unlock()
+	if c.reconnected {
+		c.broker.Close()
+	}
+}
+
+// packetID returns the packet identifier of a SUBSCRIBE, UNSUBSCRIBE, SUBACK
+// or UNSUBACK packet, which follows the fixed header.
+func packetID(raw []byte) uint16 {
+	i := 1
+	for i < len(raw) && raw[i]&0x80 != 0 {
+		i++
+	}
+	i++
+	if i+2 > len(raw) {
+		return 0
+	}
+	return binary.BigEndian.Uint16(raw[i:])
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var errRetainDenied = errors.New("retained publish denied on the topic")
+
+// retainDenied reports whether retained publishes to the topic are rejected.
+func (c *conn) retainDenied(topic string) bool {
+	for _, filter := range c.cfg.RetainDenyTopics {
+		if covers(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// retain311 applies the retain options to an MQTT 3.1.1 packet of the client.
+// Rejected retained publishes close the connection.
+func (c *conn) retain311(pkt packets.ControlPacket) error {
+	switch p := pkt.(type) {
+	case *packets.ConnectPacket:
+		if c.cfg.RetainStrip {
+			p.WillRetain = false
+		}
+	case *packets.PublishPacket:
+		if !p.Retain {
+			return nil
+		}
+		if c.retainDenied(p.TopicName) {
+			return errRetainDenied
+		}
+		if c.cfg.RetainStrip {
+			p.Retain = false
+		}
+	}
+	return nil
+}
+
+// retain5 applies the retain options to an MQTT v5 packet of the client.
+// Rejected retained publishes close the connection with the Retain not
+// supported reason code.
+func (c *conn) retain5(pkt mqtt5.Packet) error {
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		if c.cfg.RetainStrip {
+			p.WillRetain = false
+		}
+	case *mqtt5.Publish:
+		if !p.Retain {
+			return nil
+		}
+		if c.retainDenied(p.Topic) {
+			c.reject5(mqtt5.PUBLISH, mqtt5.RetainNotSupported)
+			return errRetainDenied
+		}
+		if c.cfg.RetainStrip {
+			p.Retain = false
+		}
+	}
+	return nil
+}
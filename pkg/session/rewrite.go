@@ -0,0 +1,170 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var errRewriteRule = errors.New("invalid topic rewrite rule")
+
+// TopicRewriter rewrites the topics of the packets exchanged with the client,
+// so clients using a legacy topic layout can be bridged to the topic layout of
+// the broker. Topics are rewritten at the client side of the proxy: the handler
+// and the interceptor see the topics of the broker.
+type TopicRewriter struct {
+	up   []rewriteRule
+	down []rewriteRule
+}
+
+type rewriteRule struct {
+	// prefix is replaced by replacement if re is nil.
+	prefix      string
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (r rewriteRule) apply(topic string) (string, bool) {
+	if r.re == nil {
+		if !strings.HasPrefix(topic, r.prefix) {
+			return topic, false
+		}
+		return r.replacement + topic[len(r.prefix):], true
+	}
+	if !r.re.MatchString(topic) {
+		return topic, false
+	}
+	return r.re.ReplaceAllString(topic, r.replacement), true
+}
+
+// NewTopicRewriter parses topic rewrite rules, one per line. Empty lines and
+// lines starting with # are ignored. A rule is one of:
+//
+//	prefix <client prefix> <broker prefix>
+//	up <regexp> <replacement>
+//	down <regexp> <replacement>
+//
+// A prefix rule replaces the client prefix with the broker prefix in the topics
+// sent by the client and the broker prefix with the client prefix in the topics
+// sent by the broker. The up and down rules rewrite the topics sent by the
+// client and by the broker respectively, replacing the matches of the regular
+// expression with the replacement, which may reference capture groups as $1.
+// The first matching rule of each direction applies.
+func NewTopicRewriter(r io.Reader) (*TopicRewriter, error) {
+	tr := &TopicRewriter{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: line %d", errRewriteRule, n)
+		}
+		switch fields[0] {
+		case "prefix":
+			tr.up = append(tr.up, rewriteRule{prefix: fields[1], replacement: fields[2]})
+			tr.down = append(tr.down, rewriteRule{prefix: fields[2], replacement: fields[1]})
+		case "up", "down":
+			re, err := regexp.Compile(fields[1])
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("%w: line %d", errRewriteRule, n), err)
+			}
+			if fields[0] == "up" {
+				tr.up = append(tr.up, rewriteRule{re: re, replacement: fields[2]})
+			} else {
+				tr.down = append(tr.down, rewriteRule{re: re, replacement: fields[2]})
+			}
+		default:
+			return nil, fmt.Errorf("%w: line %d", errRewriteRule, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// LoadTopicRewriter reads the topic rewrite rules from a file.
+func LoadTopicRewriter(file string) (*TopicRewriter, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewTopicRewriter(f)
+}
+
+// Rewrite returns the topic or topic filter rewritten for the given direction:
+// Up for topics sent by the client and Down for topics sent by the broker.
+func (tr *TopicRewriter) Rewrite(topic string, dir Direction) string {
+	rules := tr.up
+	if dir == Down {
+		rules = tr.down
+	}
+	for _, r := range rules {
+		if t, ok := r.apply(topic); ok {
+			return t
+		}
+	}
+	return topic
+}
+
+func (tr *TopicRewriter) rewriteAll(topics []string, dir Direction) {
+	for i, topic := range topics {
+		topics[i] = tr.Rewrite(topic, dir)
+	}
+}
+
+// rewrite rewrites the topics of an MQTT 3.1.1 packet.
+func (c *conn) rewrite(dir Direction, pkt packets.ControlPacket) {
+	tr := c.cfg.TopicRewriter
+	if tr == nil {
+		return
+	}
+	switch p := pkt.(type) {
+	case *packets.ConnectPacket:
+		if p.WillFlag {
+			p.WillTopic = tr.Rewrite(p.WillTopic, dir)
+		}
+	case *packets.PublishPacket:
+		p.TopicName = tr.Rewrite(p.TopicName, dir)
+	case *packets.SubscribePacket:
+		tr.rewriteAll(p.Topics, dir)
+	case *packets.UnsubscribePacket:
+		tr.rewriteAll(p.Topics, dir)
+	}
+}
+
+// rewrite5 rewrites the topics of an MQTT v5 packet.
+func (c *conn) rewrite5(dir Direction, pkt mqtt5.Packet) {
+	tr := c.cfg.TopicRewriter
+	if tr == nil {
+		return
+	}
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		if p.WillFlag {
+			p.WillTopic = tr.Rewrite(p.WillTopic, dir)
+		}
+	case *mqtt5.Publish:
+		p.Topic = tr.Rewrite(p.Topic, dir)
+	case *mqtt5.Subscribe:
+		for i := range p.Subscriptions {
+			p.Subscriptions[i].Topic = tr.Rewrite(p.Subscriptions[i].Topic, dir)
+		}
+	case *mqtt5.Unsubscribe:
+		tr.rewriteAll(p.Topics, dir)
+	}
+}
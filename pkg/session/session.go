@@ -6,6 +6,8 @@ package session
 import (
 	"context"
 	"crypto/x509"
+	"net/http"
+	"net/url"
 )
 
 // The sessionKey type is unexported to prevent collisions with context keys defined in
@@ -18,6 +20,39 @@ type Session struct {
 	Username string
 	Password []byte
 	Cert     x509.Certificate
+	Identity Identity
+	// RemoteIP is the IP address of the client. Behind trusted proxies, it
+	// is read from the X-Forwarded-For or X-Real-IP headers of the WebSocket
+	// and HTTP clients.
+	RemoteIP string
+	// MTLS reports whether the client authenticated with a TLS client
+	// certificate, which is only optional with CLIENT_CERT_OPTIONAL.
+	MTLS bool
+	// JA3 holds the JA3 hash and JA4 the JA4 fingerprint of the TLS
+	// ClientHello, if the client connected over TLS.
+	JA3 string
+	JA4 string
+	// Will holds the Last Will of the client CONNECT, nil if the client has
+	// none. The handler may modify it in AuthConnect, or set it to nil to
+	// remove the Last Will.
+	Will *Will
+	// Header, Cookies and Query hold the headers, the cookies and the query
+	// parameters of the HTTP upgrade request of the WebSocket clients, so
+	// AuthConnect can validate the credentials of a web application.
+	Header  http.Header
+	Cookies []*http.Cookie
+	Query   url.Values
+	// Claims holds the claims of the JWT of the HTTP and WebSocket clients,
+	// if the proxy verifies them.
+	Claims map[string]any
+}
+
+// Will is the Last Will of a client.
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
 }
 
 // NewContext stores Session in context.Context values.
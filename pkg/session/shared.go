@@ -0,0 +1,84 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Policies applied to the shared subscriptions of the clients.
+const (
+	// SharedAllow forwards the shared subscriptions.
+	SharedAllow = "allow"
+	// SharedDeny refuses the shared subscriptions in the SUBACK.
+	SharedDeny = "deny"
+	// SharedStrip subscribes to the topic filter of the shared subscriptions,
+	// for brokers which don't support them.
+	SharedStrip = "strip"
+)
+
+const sharedPrefix = "$share/"
+
+var errSharedPolicy = errors.New("unknown shared subscription policy")
+
+// SharedSubscription splits a shared subscription $share/<group>/<filter>
+// into its group and topic filter. It reports false if filter is not a
+// shared subscription.
+func SharedSubscription(filter string) (group, topic string, ok bool) {
+	rest, ok := strings.CutPrefix(filter, sharedPrefix)
+	if !ok {
+		return "", filter, false
+	}
+	group, topic, ok = strings.Cut(rest, "/")
+	if !ok || group == "" || topic == "" || strings.ContainsAny(group, "+#") {
+		return "", filter, false
+	}
+	return group, topic, true
+}
+
+// sharedDenied reports whether the topic filter is a shared subscription
+// refused by the configuration.
+func (c *conn) sharedDenied(filter string) bool {
+	_, _, ok := SharedSubscription(filter)
+	return ok && c.cfg.SharedSubscriptions == SharedDeny
+}
+
+func stripShared(filters []string) {
+	for i, filter := range filters {
+		_, filters[i], _ = SharedSubscription(filter)
+	}
+}
+
+// unshare strips the shared subscriptions of an MQTT 3.1.1 packet of the
+// client if the configuration requires it.
+func (c *conn) unshare(pkt packets.ControlPacket) {
+	if c.cfg.SharedSubscriptions != SharedStrip {
+		return
+	}
+	switch p := pkt.(type) {
+	case *packets.SubscribePacket:
+		stripShared(p.Topics)
+	case *packets.UnsubscribePacket:
+		stripShared(p.Topics)
+	}
+}
+
+// unshare5 is unshare for MQTT v5 packets.
+func (c *conn) unshare5(pkt mqtt5.Packet) {
+	if c.cfg.SharedSubscriptions != SharedStrip {
+		return
+	}
+	switch p := pkt.(type) {
+	case *mqtt5.Subscribe:
+		for i := range p.Subscriptions {
+			_, p.Subscriptions[i].Topic, _ = SharedSubscription(p.Subscriptions[i].Topic)
+		}
+	case *mqtt5.Unsubscribe:
+		stripShared(p.Topics)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errSlowConsumer = errors.New("slow consumer did not read the packets within the write timeout")
+
+// setWriteDeadline bounds the time a write to conn may block on a peer which
+// doesn't read its packets.
+func (c *conn) setWriteDeadline(conn net.Conn) error {
+	if c.cfg.WriteTimeout <= 0 {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+}
+
+// slowConsumer reports a write which timed out as a slow consumer, the client
+// for the Down direction and the broker for the Up direction.
+func (c *conn) slowConsumer(dir Direction, err error) error {
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return err
+	}
+	c.metrics().SlowConsumer(c.cfg.Listener, dir)
+	return errors.Join(errSlowConsumer, err)
+}
@@ -4,13 +4,17 @@
 package session
 
 import (
+	"bytes"
 	"context"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/absmach/mproxy/pkg/mqtt5"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -21,70 +25,321 @@ const (
 	Down
 )
 
+func (d Direction) String() string {
+	if d == Down {
+		return "down"
+	}
+	return "up"
+}
+
 const unknownID = "unknown"
 
+// v311 is the protocol level of MQTT 3.1.1.
+const v311 = 4
+
 var (
 	errBroker = "failed to proxy from MQTT client with id %s to MQTT broker with error: %s"
 	errClient = "failed to proxy from MQTT broker to client with id %s with error: %s"
 )
 
-// Stream starts proxy between client and broker.
-func Stream(ctx context.Context, in, out net.Conn, h Handler, ic Interceptor, cert x509.Certificate) error {
-	s := Session{
-		Cert: cert,
-	}
+// Stream starts proxy between client and broker. The session s holds the
+// client details known before the MQTT connection, such as its certificate.
+func Stream(ctx context.Context, in, out net.Conn, h Handler, ic Interceptor, s Session, cfg Config) error {
 	ctx = NewContext(ctx, &s)
+	c := &conn{client: in, broker: out, cfg: cfg}
+	if cfg.PublishRate > 0 {
+		c.publishes = newTokenBucket(cfg.PublishRate, cfg.PublishBurst)
+	}
+	if cfg.MaxInflight > 0 {
+		c.inflight.released = make(chan struct{}, 1)
+	}
 	errs := make(chan error, 2)
 
-	go stream(ctx, Up, in, out, h, ic, errs)
-	go stream(ctx, Down, out, in, h, ic, errs)
+	// The streams are canceled once one of them fails, which stops a
+	// pending reconnection.
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.stream(sctx, Up, h, ic, errs)
+	go c.stream(sctx, Down, h, ic, errs)
 
 	// Handle whichever error happens first.
 	// The other routine won't be blocked when writing
 	// to the errors channel because it is buffered.
 	err := <-errs
+	cancel()
+	c.close()
+	c.unregister()
 
 	disconnectErr := h.Disconnect(ctx)
 
 	return errors.Join(err, disconnectErr)
 }
 
-func stream(ctx context.Context, dir Direction, r, w net.Conn, h Handler, ic Interceptor, errs chan error) {
-	for {
-		// Read from one connection.
-		pkt, err := packets.ReadPacket(r)
-		if err != nil {
-			errs <- wrap(ctx, err, dir)
-			return
-		}
+// conn holds the state shared by both directions of a proxied connection.
+type conn struct {
+	client net.Conn
+	// broker is replaced when the session is reconnected, guarded by brokerMu.
+	broker      net.Conn
+	brokerMu    sync.Mutex
+	reconnected bool
+	// closed is set once the proxied connection is closed.
+	closed       atomic.Bool
+	reconnection reconnection
+	buffer       reconnectBuffer
+	cfg          Config
+	// clientMu serializes the writes to the client, which are made by both
+	// directions when the proxy answers the client itself.
+	clientMu sync.Mutex
+	// version is the protocol level of the CONNECT packet, zero until it is received.
+	version atomic.Uint32
+	// upAliases and downAliases resolve the topic aliases sent by the client
+	// and by the broker.
+	upAliases   atomic.Pointer[TopicAliases]
+	downAliases atomic.Pointer[TopicAliases]
+	// brokerAliases assigns the topic aliases of the PUBLISH packets sent to
+	// the broker.
+	brokerAliases atomic.Pointer[TopicAliases]
+	// translation holds the state of MQTT v5 clients translated to MQTT 3.1.1.
+	translation translation
+	acl         aclState
+	// publishes limits the rate of the client publishes, it is only used by
+	// the Up direction.
+	publishes *tokenBucket
+	// keepAlive is the time without packets after which the client is
+	// disconnected, as a time.Duration.
+	keepAlive atomic.Int64
+	// id is the client ID registered in cfg.Sessions, guarded by its mutex.
+	id string
+	// evicted is set when a new connection took over the session.
+	evicted  atomic.Bool
+	qos      qosState
+	inflight inflightState
+}
 
+func (c *conn) stream(ctx context.Context, dir Direction, h Handler, ic Interceptor, errs chan error) {
+	r := c.broker
+	var frames <-chan frame
+	if dir == Up {
+		// The hooks are canceled once the client closes its connection.
+		var cancel context.CancelCauseFunc
+		ctx, frames, cancel = c.watchClient(ctx)
+		defer cancel(nil)
+	}
+	for {
 		if dir == Up {
-			if err = authorize(ctx, pkt, h); err != nil {
+			// The keep alive isn't enforced while the client is held back.
+			if err := c.awaitInflight(ctx); err != nil {
+				errs <- wrap(ctx, clientErr(ctx, err), dir)
+				return
+			}
+			if err := c.setReadDeadline(); err != nil {
 				errs <- wrap(ctx, err, dir)
 				return
 			}
+			if c.evicted.Load() {
+				c.takenOver(ctx, errs)
+				return
+			}
 		}
-		if ic != nil {
-			pkt, err = ic.Intercept(ctx, pkt, dir)
-			if err != nil {
-				errs <- wrap(ctx, err, dir)
+		// Read from one connection.
+		raw, err := c.next(ctx, r, frames)
+		if err != nil && dir == Down && c.reconnectable() {
+			rerr := c.reconnect(ctx, r)
+			if rerr == nil {
+				r = c.upstream()
+				continue
+			}
+			err = errors.Join(err, rerr)
+		}
+		if err != nil {
+			v5 := byte(c.version.Load()) == mqtt5.Version
+			if dir == Up && c.evicted.Load() {
+				c.takenOver(ctx, errs)
 				return
 			}
+			if dir == Up {
+				if terr := c.timeoutError(err); terr != nil {
+					err = terr
+					if v5 {
+						c.reject5(mqtt5.PUBLISH, mqtt5.KeepAliveTimeout)
+					}
+				}
+			}
+			if errors.Is(err, mqtt5.ErrPacketTooLarge) && v5 {
+				c.reject5(mqtt5.PUBLISH, mqtt5.PacketTooLarge)
+			}
+			errs <- wrap(ctx, err, dir)
+			return
+		}
+		if dir == Up && c.version.Load() == 0 {
+			version := mqtt5.ConnectVersion(raw)
+			if version == 0 {
+				version = v311
+			}
+			c.version.Store(uint32(version))
+		}
+		if dir == Down && c.received(raw) {
+			continue
+		}
+		if dir == Up {
+			c.publishing(raw)
 		}
 
-		// Send to another.
-		if err := pkt.Write(w); err != nil {
-			errs <- wrap(ctx, err, dir)
+		start := time.Now()
+		if byte(c.version.Load()) == mqtt5.Version {
+			err = c.forward5(ctx, dir, raw, h, ic)
+		} else {
+			err = c.forward(ctx, dir, raw, h, ic)
+		}
+		c.metrics().PacketObserved(c.cfg.Listener, dir, mqtt5.PacketName(raw[0]>>4), time.Since(start))
+		if err != nil {
+			if dir == Up && c.evicted.Load() {
+				c.takenOver(ctx, errs)
+				return
+			}
+			errs <- wrap(ctx, clientErr(ctx, err), dir)
 			return
 		}
+	}
+}
 
-		// Notify only for packets sent from client to broker (incoming packets).
-		if dir == Up {
-			if err := notify(ctx, pkt, h); err != nil {
-				errs <- wrap(ctx, err, dir)
+// takenOver closes the connection of a client whose session was taken over.
+func (c *conn) takenOver(ctx context.Context, errs chan error) {
+	if byte(c.version.Load()) == mqtt5.Version {
+		c.reject5(mqtt5.PUBLISH, mqtt5.SessionTakenOver)
+	}
+	errs <- wrap(ctx, errTakenOver, Up)
+}
+
+// forward forwards an MQTT 3.1.1 packet.
+func (c *conn) forward(ctx context.Context, dir Direction, raw []byte, h Handler, ic Interceptor) error {
+	pkt, err := packets.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	if dir == Up {
+		if drop, err := c.limit(ctx, pkt); drop || err != nil {
+			return err
+		}
+		if drop, err := c.loop311(ctx, pkt); drop || err != nil {
+			return err
+		}
+		c.rewrite(Up, pkt)
+		c.unshare(pkt)
+		if err := c.payload311(pkt); err != nil {
+			return err
+		}
+		if err := c.inject311(ctx, pkt); err != nil {
+			return err
+		}
+		if err := c.transformID311(ctx, pkt); err != nil {
+			return err
+		}
+		if err = authorize(ctx, pkt, h); err != nil {
+			return c.rejected(pkt, err)
+		}
+		if p, ok := pkt.(*packets.ConnectPacket); ok {
+			if err := c.register(p.ClientIdentifier); err != nil {
+				connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				connack.ReturnCode = packets.ErrRefusedIDRejected
+				_ = c.reply(connack)
+				return err
+			}
+			c.setKeepAlive(p.Keepalive)
+			if err := c.loadACL(ctx, h); err != nil {
+				return err
 			}
+			if c.strikeWill(ctx) {
+				setWill(p, nil)
+			}
+		}
+		drop, err := c.enforce(pkt)
+		if drop || err != nil {
+			return err
+		}
+		if drop, err := c.capQoS311(pkt); drop || err != nil {
+			return err
+		}
+		if err := c.retain311(pkt); err != nil {
+			return err
+		}
+	}
+	if ic != nil {
+		in := pkt
+		pkt, err = ic.Intercept(ctx, pkt, dir)
+		if err != nil {
+			return err
+		}
+		if pkt == nil {
+			return c.dropped(ctx, dir, in)
 		}
 	}
+
+	if dir == Down {
+		c.observe(pkt)
+		c.rewrite(Down, pkt)
+		if p, ok := pkt.(*packets.SubackPacket); ok {
+			p.ReturnCodes = c.mergeCodes(p.MessageID, p.ReturnCodes)
+		}
+		pkt = c.downgradedAck(pkt)
+	}
+
+	// Send to another.
+	if err := c.write(ctx, dir, pkt); err != nil {
+		return err
+	}
+
+	// Notify only for packets sent from client to broker (incoming packets).
+	if dir == Up {
+		return notify(ctx, pkt, h)
+	}
+	return nil
+}
+
+// write sends a packet read in the given direction to its destination.
+func (c *conn) write(ctx context.Context, dir Direction, pkt interface{ Write(io.Writer) error }) error {
+	if dir == Up {
+		return c.send(ctx, pkt)
+	}
+	return c.reply(pkt)
+}
+
+// dropped answers a PUBLISH packet dropped by the interceptor on behalf of its
+// receiver, so the sender completes the flow of the publish.
+func (c *conn) dropped(ctx context.Context, dir Direction, pkt packets.ControlPacket) error {
+	p, ok := pkt.(*packets.PublishPacket)
+	if !ok {
+		return nil
+	}
+	var ack packets.ControlPacket
+	switch p.Qos {
+	case 1:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		ack = puback
+	case 2:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		ack = pubrec
+	default:
+		return nil
+	}
+	if dir == Down {
+		return c.send(ctx, ack)
+	}
+	return c.reply(c.downgradedAck(ack))
+}
+
+// reply sends a packet to the client.
+func (c *conn) reply(pkt interface{ Write(io.Writer) error }) error {
+	c.completed(pkt)
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	if err := c.setWriteDeadline(c.client); err != nil {
+		return err
+	}
+	return c.slowConsumer(Down, pkt.Write(c.client))
 }
 
 func authorize(ctx context.Context, pkt packets.ControlPacket, h Handler) error {
@@ -95,6 +350,10 @@ func authorize(ctx context.Context, pkt packets.ControlPacket, h Handler) error
 			s.ID = p.ClientIdentifier
 			s.Username = p.Username
 			s.Password = p.Password
+			s.Will = nil
+			if p.WillFlag {
+				s.Will = &Will{Topic: p.WillTopic, Payload: p.WillMessage, QoS: p.WillQos, Retain: p.WillRetain}
+			}
 		}
 
 		ctx = NewContext(ctx, s)
@@ -106,6 +365,7 @@ func authorize(ctx context.Context, pkt packets.ControlPacket, h Handler) error
 		p.ClientIdentifier = s.ID
 		p.Username = s.Username
 		p.Password = s.Password
+		setWill(p, s.Will)
 		return nil
 	case *packets.PublishPacket:
 		return h.AuthPublish(ctx, &p.TopicName, &p.Payload)
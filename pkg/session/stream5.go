@@ -0,0 +1,304 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+)
+
+var errInterceptorV5 = errors.New("interceptor does not intercept MQTT v5 packets")
+
+// forward5 forwards an MQTT v5 packet. Topic aliases are resolved so the
+// handler and the interceptor always see full topics, and PUBLISH packets are
+// forwarded to the broker with the aliases assigned by the proxy. If the translation to
+// MQTT 3.1.1 is enabled, the packets of the broker are read as MQTT 3.1.1
+// packets and translated, so the handler and the interceptor only see MQTT v5
+// packets. MQTT v5 connections are refused if the interceptor can't intercept
+// their packets, so they can't bypass it.
+func (c *conn) forward5(ctx context.Context, dir Direction, raw []byte, h Handler, ic Interceptor) error {
+	if _, ok := ic.(InterceptorV5); ic != nil && !ok {
+		if dir == Up {
+			c.reject5(raw[0]>>4, mqtt5.UnsupportedProtocolVersion)
+		}
+		return errInterceptorV5
+	}
+	var pkt mqtt5.Packet
+	var err error
+	if dir == Down && c.cfg.TranslateV5 {
+		pkt, err = c.decode311(raw)
+	} else {
+		pkt, err = mqtt5.Decode(raw)
+	}
+	if err != nil {
+		if dir == Up {
+			c.reject5(raw[0]>>4, mqtt5.MalformedPacket)
+		}
+		return err
+	}
+
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		c.downAliases.Store(NewTopicAliases(value(p.Properties.TopicAliasMaximum)))
+	case *mqtt5.Connack:
+		c.upAliases.Store(NewTopicAliases(value(p.Properties.TopicAliasMaximum)))
+		c.brokerAliases.Store(NewTopicAliases(value(p.Properties.TopicAliasMaximum)))
+		if p.Properties.ServerKeepAlive != nil {
+			// The keep alive of the server replaces the keep alive of the client.
+			c.setKeepAlive(*p.Properties.ServerKeepAlive)
+		}
+		if size := uint32(c.cfg.MaxPacketSize); size > 0 && (p.Properties.MaximumPacketSize == nil || *p.Properties.MaximumPacketSize > size) {
+			// Tell the client the maximum packet size accepted by the proxy.
+			p.Properties.MaximumPacketSize = &size
+		}
+		if c.cfg.RetainStrip {
+			p.Properties.RetainAvailable = new(byte)
+		}
+		if c.cfg.SharedSubscriptions == SharedDeny {
+			p.Properties.SharedSubAvailable = new(byte)
+		}
+		if qos, ok := c.maxQoS(); ok && (p.Properties.MaximumQoS == nil || *p.Properties.MaximumQoS > qos) {
+			p.Properties.MaximumQoS = &qos
+		}
+		if limit := uint16(min(c.cfg.MaxInflight, 65535)); c.cfg.MaxInflight > 0 && (p.Properties.ReceiveMaximum == nil || *p.Properties.ReceiveMaximum > limit) {
+			// Tell the client the number of publishes the proxy lets in flight.
+			p.Properties.ReceiveMaximum = &limit
+		}
+	case *mqtt5.Publish:
+		if err := c.resolveAlias(dir, p); err != nil {
+			if dir == Up {
+				c.reject5(mqtt5.PUBLISH, mqtt5.TopicAliasInvalid)
+			}
+			return err
+		}
+	}
+
+	if dir == Up {
+		if drop, err := c.limit5(ctx, pkt); drop || err != nil {
+			return err
+		}
+		if drop, err := c.loop5(ctx, pkt); drop || err != nil {
+			return err
+		}
+		c.rewrite5(Up, pkt)
+		c.unshare5(pkt)
+		if err := c.payload5(pkt); err != nil {
+			return err
+		}
+		if err := c.inject5(ctx, pkt); err != nil {
+			return err
+		}
+		if err := c.transformID5(ctx, pkt); err != nil {
+			return err
+		}
+		if err := authorize5(ctx, pkt, h); err != nil {
+			return c.rejected5(pkt, err)
+		}
+		if p, ok := pkt.(*mqtt5.Connect); ok {
+			if err := c.register(p.ClientID); err != nil {
+				c.reject5(mqtt5.CONNECT, mqtt5.ClientIdentifierNotValid)
+				return err
+			}
+			c.setKeepAlive(p.KeepAlive)
+			if err := c.loadACL(ctx, h); err != nil {
+				c.reject5(mqtt5.CONNECT, reasonCode(err, mqtt5.NotAuthorized))
+				return err
+			}
+			if c.strikeWill(ctx) {
+				setWill5(p, nil)
+			}
+		}
+		drop, err := c.enforce5(pkt)
+		if drop || err != nil {
+			return err
+		}
+		if drop, err := c.capQoS5(pkt); drop || err != nil {
+			return err
+		}
+		if err := c.retain5(pkt); err != nil {
+			return err
+		}
+	}
+	if ic, ok := ic.(InterceptorV5); ok {
+		in := pkt
+		if pkt, err = ic.InterceptV5(ctx, pkt, dir); err != nil {
+			return err
+		}
+		if pkt == nil {
+			return c.dropped5(ctx, dir, in)
+		}
+	}
+
+	switch {
+	case dir == Down:
+		c.rewrite5(Down, pkt)
+		if p, ok := pkt.(*mqtt5.Suback); ok {
+			p.ReasonCodes = c.mergeCodes(p.PacketID, p.ReasonCodes)
+		}
+		c.downgradedAck5(pkt)
+		err = c.write(ctx, dir, pkt)
+	case c.cfg.TranslateV5:
+		err = c.write311(ctx, pkt)
+	default:
+		err = c.write(ctx, dir, c.alias(pkt))
+	}
+	if err != nil {
+		return err
+	}
+
+	if dir == Up {
+		return notify5(ctx, pkt, h)
+	}
+	return nil
+}
+
+func (c *conn) resolveAlias(dir Direction, p *mqtt5.Publish) error {
+	if p.Properties.TopicAlias == nil {
+		return nil
+	}
+	aliases := c.upAliases.Load()
+	if dir == Down {
+		aliases = c.downAliases.Load()
+	}
+	if aliases == nil {
+		aliases = NewTopicAliases(0)
+	}
+	topic, err := aliases.Resolve(p.Topic, *p.Properties.TopicAlias)
+	if err != nil {
+		return err
+	}
+	p.Topic, p.Properties.TopicAlias = topic, nil
+	return nil
+}
+
+// alias returns the PUBLISH packet sent to the broker with a topic alias, or
+// the packet unchanged when no alias is available. The packets sent to the
+// broker are replayed as they are on reconnection, so no alias is assigned if
+// the session can be reconnected.
+func (c *conn) alias(pkt mqtt5.Packet) mqtt5.Packet {
+	p, ok := pkt.(*mqtt5.Publish)
+	aliases := c.brokerAliases.Load()
+	if !ok || aliases == nil || c.cfg.Redial != nil {
+		return pkt
+	}
+	alias, established := aliases.Alias(p.Topic)
+	if alias == 0 {
+		return pkt
+	}
+	// The handler is notified with the full topic, so the packet is copied.
+	out := *p
+	out.Properties.TopicAlias = &alias
+	if established {
+		out.Topic = ""
+	}
+	return &out
+}
+
+// dropped5 is dropped for MQTT v5 packets.
+func (c *conn) dropped5(ctx context.Context, dir Direction, pkt mqtt5.Packet) error {
+	p, ok := pkt.(*mqtt5.Publish)
+	if !ok || p.QoS == 0 {
+		return nil
+	}
+	ack := &mqtt5.Ack{PacketType: mqtt5.PUBACK, PacketID: p.PacketID}
+	if p.QoS == 2 {
+		ack.PacketType = mqtt5.PUBREC
+	}
+	switch {
+	case dir == Down && c.cfg.TranslateV5:
+		return c.write311(ctx, ack)
+	case dir == Down:
+		return c.send(ctx, ack)
+	}
+	c.downgradedAck5(ack)
+	return c.reply(ack)
+}
+
+// reject5 tells the client why the proxy closes the connection, with a CONNACK
+// if the rejected packet is a CONNECT and with a DISCONNECT otherwise.
+func (c *conn) reject5(typ, reason byte) {
+	var reply mqtt5.Packet = &mqtt5.Disconnect{ReasonCode: reason}
+	if typ == mqtt5.CONNECT {
+		reply = &mqtt5.Connack{ReasonCode: reason}
+	}
+	// The connection is closed anyway, so the error is not relevant.
+	_ = c.reply(reply)
+}
+
+func authorize5(ctx context.Context, pkt mqtt5.Packet, h Handler) error {
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		s, ok := FromContext(ctx)
+		if ok {
+			s.ID = p.ClientID
+			s.Username = p.Username
+			s.Password = p.Password
+			s.Will = nil
+			if p.WillFlag {
+				s.Will = &Will{Topic: p.WillTopic, Payload: p.WillPayload, QoS: p.WillQoS, Retain: p.WillRetain}
+			}
+		}
+
+		ctx = NewContext(ctx, s)
+		if err := h.AuthConnect(ctx); err != nil {
+			return err
+		}
+		// Copy back to the packet in case values are changed by Event handler.
+		p.ClientID = s.ID
+		p.Username, p.UsernameFlag = s.Username, p.UsernameFlag || s.Username != ""
+		p.Password, p.PasswordFlag = s.Password, p.PasswordFlag || len(s.Password) > 0
+		setWill5(p, s.Will)
+		return nil
+	case *mqtt5.Publish:
+		return h.AuthPublish(ctx, &p.Topic, &p.Payload)
+	case *mqtt5.Subscribe:
+		topics := p.Topics()
+		if err := h.AuthSubscribe(ctx, &topics); err != nil {
+			return err
+		}
+		setTopics(p, topics)
+		return nil
+	default:
+		return nil
+	}
+}
+
+func notify5(ctx context.Context, pkt mqtt5.Packet, h Handler) error {
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		return h.Connect(ctx)
+	case *mqtt5.Publish:
+		return h.Publish(ctx, &p.Topic, &p.Payload)
+	case *mqtt5.Subscribe:
+		topics := p.Topics()
+		return h.Subscribe(ctx, &topics)
+	case *mqtt5.Unsubscribe:
+		return h.Unsubscribe(ctx, &p.Topics)
+	default:
+		return nil
+	}
+}
+
+// setTopics applies the topics changed by the handler to the subscriptions,
+// keeping the options of the subscription at the same position.
+func setTopics(p *mqtt5.Subscribe, topics []string) {
+	subs := make([]mqtt5.Subscription, len(topics))
+	for i, topic := range topics {
+		if i < len(p.Subscriptions) {
+			subs[i] = p.Subscriptions[i]
+		}
+		subs[i].Topic = topic
+	}
+	p.Subscriptions = subs
+}
+
+func value[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+	return *v
+}
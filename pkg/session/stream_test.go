@@ -0,0 +1,86 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// blockingHandler blocks AuthPublish until its context is done.
+type blockingHandler struct {
+	published chan struct{}
+	canceled  chan error
+}
+
+func (h *blockingHandler) AuthConnect(context.Context) error { return nil }
+
+func (h *blockingHandler) AuthPublish(ctx context.Context, _ *string, _ *[]byte) error {
+	close(h.published)
+	<-ctx.Done()
+	h.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func (h *blockingHandler) AuthSubscribe(context.Context, *[]string) error { return nil }
+
+func (h *blockingHandler) Connect(context.Context) error { return nil }
+
+func (h *blockingHandler) Publish(context.Context, *string, *[]byte) error { return nil }
+
+func (h *blockingHandler) Subscribe(context.Context, *[]string) error { return nil }
+
+func (h *blockingHandler) Unsubscribe(context.Context, *[]string) error { return nil }
+
+func (h *blockingHandler) Disconnect(context.Context) error { return nil }
+
+func TestStreamClientClose(t *testing.T) {
+	client, in := net.Pipe()
+	out, broker := net.Pipe()
+	defer broker.Close()
+	go func() { _, _ = io.Copy(io.Discard, broker) }()
+
+	h := &blockingHandler{published: make(chan struct{}), canceled: make(chan error, 1)}
+	done := make(chan error, 1)
+	go func() {
+		done <- Stream(context.Background(), in, out, h, nil, Session{}, Config{})
+	}()
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion, connect.ClientIdentifier = "MQTT", v311, "client"
+	if err := connect.Write(client); err != nil {
+		t.Fatalf("writing CONNECT: %v", err)
+	}
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName, publish.Payload = "a/b", []byte("payload")
+	if err := publish.Write(client); err != nil {
+		t.Fatalf("writing PUBLISH: %v", err)
+	}
+
+	select {
+	case <-h.published:
+	case <-time.After(time.Second):
+		t.Fatal("AuthPublish was not called")
+	}
+	client.Close()
+
+	select {
+	case err := <-h.canceled:
+		if err == nil {
+			t.Error("expected the context of AuthPublish to be canceled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the context of AuthPublish to be canceled once the client closed its connection")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stream to end once the client closed its connection")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Policies applied when a client connects with the client ID of a connected client.
+const (
+	TakeoverEvict  = "evict"
+	TakeoverReject = "reject"
+	TakeoverOff    = "off"
+)
+
+var (
+	errTakeoverPolicy = errors.New("unknown session takeover policy")
+	errSessionExists  = errors.New("client ID is already connected")
+	errTakenOver      = errors.New("session taken over by a new connection with the same client ID")
+)
+
+// Registry holds the connected clients of a proxy by client ID, to detect
+// clients connecting with the client ID of a connected client.
+type Registry struct {
+	mu    sync.Mutex
+	conns map[string]*conn
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{conns: make(map[string]*conn)}
+}
+
+// register registers the client ID of the connection. If a client is already
+// connected with the same client ID, it is evicted or the connection is
+// rejected with errSessionExists, depending on the takeover policy.
+func (c *conn) register(id string) error {
+	r := c.cfg.Sessions
+	if r == nil || id == "" {
+		return nil
+	}
+	r.mu.Lock()
+	old, ok := r.conns[id]
+	if ok && old != c && c.cfg.TakeoverPolicy == TakeoverReject {
+		r.mu.Unlock()
+		return errSessionExists
+	}
+	if c.id != "" && r.conns[c.id] == c {
+		delete(r.conns, c.id)
+	}
+	r.conns[id], c.id = c, id
+	r.mu.Unlock()
+	if ok && old != c {
+		old.evict()
+	}
+	return nil
+}
+
+// unregister removes the connection from the registry, unless it was replaced.
+func (c *conn) unregister() {
+	r := c.cfg.Sessions
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c.id != "" && r.conns[c.id] == c {
+		delete(r.conns, c.id)
+	}
+}
+
+// evict interrupts the pending read of the client, which then closes the
+// connection with errTakenOver.
+func (c *conn) evict() {
+	c.evicted.Store(true)
+	_ = c.client.SetReadDeadline(time.Now())
+}
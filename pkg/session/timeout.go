@@ -0,0 +1,133 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// HandlerConfig holds the options of the hooks of the handler.
+type HandlerConfig struct {
+	Timeout time.Duration `env:"HANDLER_TIMEOUT" envDefault:"0"`
+}
+
+// NewHandlerConfig parses the handler options from the environment.
+func NewHandlerConfig(opts env.Options) (HandlerConfig, error) {
+	c := HandlerConfig{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return HandlerConfig{}, err
+	}
+	return c, nil
+}
+
+// WithTimeout returns a handler calling the hooks of h with a context whose
+// deadline is the timeout, so the hooks calling external services give up in
+// time. The returned handler implements the optional interfaces implemented by
+// h, such as ACLHandler. A zero timeout returns h.
+func WithTimeout(h Handler, timeout time.Duration) Handler {
+	if timeout <= 0 {
+		return h
+	}
+	t := timeoutHandler{h: h, timeout: timeout}
+	ah, acl := h.(ACLHandler)
+	gh, grpc := h.(GRPCHandler)
+	switch {
+	case acl && grpc:
+		return struct {
+			timeoutHandler
+			timeoutACLHandler
+			timeoutGRPCHandler
+		}{t, timeoutACLHandler{ah, timeout}, timeoutGRPCHandler{gh, timeout}}
+	case acl:
+		return struct {
+			timeoutHandler
+			timeoutACLHandler
+		}{t, timeoutACLHandler{ah, timeout}}
+	case grpc:
+		return struct {
+			timeoutHandler
+			timeoutGRPCHandler
+		}{t, timeoutGRPCHandler{gh, timeout}}
+	default:
+		return t
+	}
+}
+
+type timeoutHandler struct {
+	h       Handler
+	timeout time.Duration
+}
+
+func (t timeoutHandler) AuthConnect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.AuthConnect(ctx)
+}
+
+func (t timeoutHandler) AuthPublish(ctx context.Context, topic *string, payload *[]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.AuthPublish(ctx, topic, payload)
+}
+
+func (t timeoutHandler) AuthSubscribe(ctx context.Context, topics *[]string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.AuthSubscribe(ctx, topics)
+}
+
+func (t timeoutHandler) Connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.Connect(ctx)
+}
+
+func (t timeoutHandler) Publish(ctx context.Context, topic *string, payload *[]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.Publish(ctx, topic, payload)
+}
+
+func (t timeoutHandler) Subscribe(ctx context.Context, topics *[]string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.Subscribe(ctx, topics)
+}
+
+func (t timeoutHandler) Unsubscribe(ctx context.Context, topics *[]string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.Unsubscribe(ctx, topics)
+}
+
+func (t timeoutHandler) Disconnect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.Disconnect(ctx)
+}
+
+type timeoutACLHandler struct {
+	h       ACLHandler
+	timeout time.Duration
+}
+
+func (t timeoutACLHandler) ACLRules(ctx context.Context) ([]ACLRule, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.ACLRules(ctx)
+}
+
+type timeoutGRPCHandler struct {
+	h       GRPCHandler
+	timeout time.Duration
+}
+
+func (t timeoutGRPCHandler) AuthGRPC(ctx context.Context, method string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.h.AuthGRPC(ctx, method)
+}
@@ -0,0 +1,202 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// translatedAliasMax is the Topic Alias Maximum announced to translated MQTT v5
+// clients. Their aliases are resolved by the proxy, since MQTT 3.1.1 brokers
+// don't support them.
+const translatedAliasMax = 64
+
+var (
+	errAuthMethod       = errors.New("enhanced authentication is not supported by the MQTT 3.1.1 target")
+	errTranslatedPacket = errors.New("packet can't be translated between MQTT v5 and MQTT 3.1.1")
+	connackReasonCodes  = map[byte]byte{
+		packets.Accepted:                        mqtt5.Success,
+		packets.ErrRefusedBadProtocolVersion:    mqtt5.UnsupportedProtocolVersion,
+		packets.ErrRefusedIDRejected:            mqtt5.ClientIdentifierNotValid,
+		packets.ErrRefusedServerUnavailable:     mqtt5.ServerUnavailable,
+		packets.ErrRefusedBadUsernameOrPassword: mqtt5.BadUserNameOrPassword,
+		packets.ErrRefusedNotAuthorised:         mqtt5.NotAuthorized,
+	}
+)
+
+// translation holds the state needed to translate the packets of an MQTT v5
+// client to and from an MQTT 3.1.1 broker.
+type translation struct {
+	mu sync.Mutex
+	// assignedID is the client identifier assigned by the proxy to a client
+	// which connected without one.
+	assignedID string
+	// unsubscribes holds the number of topics of the pending UNSUBSCRIBE
+	// packets by packet identifier, as MQTT 3.1.1 UNSUBACK packets have no
+	// reason codes.
+	unsubscribes map[uint16]int
+}
+
+// decode311 reads a packet of an MQTT 3.1.1 broker as an MQTT v5 packet.
+func (c *conn) decode311(raw []byte) (mqtt5.Packet, error) {
+	pkt, err := packets.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	t := &c.translation
+	switch p := pkt.(type) {
+	case *packets.ConnackPacket:
+		reason, ok := connackReasonCodes[p.ReturnCode]
+		if !ok {
+			reason = mqtt5.UnspecifiedError
+		}
+		connack := &mqtt5.Connack{SessionPresent: p.SessionPresent, ReasonCode: reason}
+		connack.Properties.TopicAliasMaximum = pointer(uint16(translatedAliasMax))
+		connack.Properties.SubIDAvailable = pointer(byte(0))
+		t.mu.Lock()
+		if t.assignedID != "" {
+			connack.Properties.AssignedClientID = pointer(t.assignedID)
+		}
+		t.mu.Unlock()
+		return connack, nil
+	case *packets.PublishPacket:
+		return &mqtt5.Publish{
+			Dup:      p.Dup,
+			QoS:      p.Qos,
+			Retain:   p.Retain,
+			Topic:    p.TopicName,
+			PacketID: p.MessageID,
+			Payload:  p.Payload,
+		}, nil
+	case *packets.PubackPacket:
+		return &mqtt5.Ack{PacketType: mqtt5.PUBACK, PacketID: p.MessageID}, nil
+	case *packets.PubrecPacket:
+		return &mqtt5.Ack{PacketType: mqtt5.PUBREC, PacketID: p.MessageID}, nil
+	case *packets.PubrelPacket:
+		return &mqtt5.Ack{PacketType: mqtt5.PUBREL, PacketID: p.MessageID}, nil
+	case *packets.PubcompPacket:
+		return &mqtt5.Ack{PacketType: mqtt5.PUBCOMP, PacketID: p.MessageID}, nil
+	case *packets.SubackPacket:
+		// The MQTT 3.1.1 return codes are valid MQTT v5 reason codes.
+		return &mqtt5.Suback{PacketID: p.MessageID, ReasonCodes: p.ReturnCodes}, nil
+	case *packets.UnsubackPacket:
+		t.mu.Lock()
+		n := t.unsubscribes[p.MessageID]
+		delete(t.unsubscribes, p.MessageID)
+		t.mu.Unlock()
+		return &mqtt5.Unsuback{PacketID: p.MessageID, ReasonCodes: make([]byte, n)}, nil
+	case *packets.PingrespPacket:
+		return &mqtt5.Ping{PacketType: mqtt5.PINGRESP}, nil
+	default:
+		return nil, errTranslatedPacket
+	}
+}
+
+// write311 sends a packet of an MQTT v5 client to the MQTT 3.1.1 broker.
+// Properties without MQTT 3.1.1 equivalent are dropped.
+func (c *conn) write311(ctx context.Context, pkt mqtt5.Packet) error {
+	var out packets.ControlPacket
+	switch p := pkt.(type) {
+	case *mqtt5.Connect:
+		if p.Properties.AuthMethod != nil {
+			c.reject5(mqtt5.CONNECT, mqtt5.BadAuthenticationMethod)
+			return errAuthMethod
+		}
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolName, connect.ProtocolVersion = "MQTT", v311
+		// A clean MQTT 3.1.1 session is discarded when the connection closes,
+		// like an MQTT v5 session with a Session Expiry Interval of zero.
+		connect.CleanSession = p.CleanStart && value(p.Properties.SessionExpiry) == 0
+		connect.Keepalive = p.KeepAlive
+		connect.ClientIdentifier = p.ClientID
+		if p.ClientID == "" {
+			// MQTT 3.1.1 brokers reject persistent sessions without client
+			// identifier, while MQTT v5 servers assign one.
+			id, err := clientID()
+			if err != nil {
+				return err
+			}
+			c.translation.mu.Lock()
+			c.translation.assignedID = id
+			c.translation.mu.Unlock()
+			connect.ClientIdentifier = id
+		}
+		connect.WillFlag, connect.WillQos, connect.WillRetain = p.WillFlag, p.WillQoS, p.WillRetain
+		connect.WillTopic, connect.WillMessage = p.WillTopic, p.WillPayload
+		connect.UsernameFlag, connect.Username = p.UsernameFlag, p.Username
+		connect.PasswordFlag, connect.Password = p.PasswordFlag, p.Password
+		out = connect
+	case *mqtt5.Publish:
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.Dup, publish.Qos, publish.Retain = p.Dup, p.QoS, p.Retain
+		publish.TopicName, publish.MessageID, publish.Payload = p.Topic, p.PacketID, p.Payload
+		out = publish
+	case *mqtt5.Ack:
+		ack := packets.NewControlPacket(p.PacketType)
+		switch a := ack.(type) {
+		case *packets.PubackPacket:
+			a.MessageID = p.PacketID
+		case *packets.PubrecPacket:
+			a.MessageID = p.PacketID
+		case *packets.PubrelPacket:
+			a.MessageID = p.PacketID
+		case *packets.PubcompPacket:
+			a.MessageID = p.PacketID
+		}
+		out = ack
+	case *mqtt5.Subscribe:
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.MessageID = p.PacketID
+		for _, s := range p.Subscriptions {
+			subscribe.Topics = append(subscribe.Topics, s.Topic)
+			subscribe.Qoss = append(subscribe.Qoss, s.QoS)
+		}
+		out = subscribe
+	case *mqtt5.Unsubscribe:
+		unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+		unsubscribe.MessageID, unsubscribe.Topics = p.PacketID, p.Topics
+		c.translation.mu.Lock()
+		if c.translation.unsubscribes == nil {
+			c.translation.unsubscribes = make(map[uint16]int)
+		}
+		c.translation.unsubscribes[p.PacketID] = len(p.Topics)
+		c.translation.mu.Unlock()
+		out = unsubscribe
+	case *mqtt5.Ping:
+		out = packets.NewControlPacket(packets.Pingreq)
+	case *mqtt5.Disconnect:
+		if p.ReasonCode == mqtt5.DisconnectWithWill {
+			// MQTT 3.1.1 brokers publish the will message only if the
+			// connection is closed without DISCONNECT.
+			return io.EOF
+		}
+		out = packets.NewControlPacket(packets.Disconnect)
+	default:
+		c.reject5(pkt.Type(), mqtt5.ProtocolError)
+		return errTranslatedPacket
+	}
+	return c.send(ctx, out)
+}
+
+// clientID returns a random client identifier.
+func clientID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "mproxy-" + hex.EncodeToString(b), nil
+}
+
+func pointer[T any](v T) *T {
+	return &v
+}
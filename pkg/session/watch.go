@@ -0,0 +1,86 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+)
+
+// frame is a packet read from the client, or the error which ended the reads.
+type frame struct {
+	raw []byte
+	err error
+}
+
+// watchClient reads the packets of the client one ahead of the Up stream, so a
+// client closing its connection is noticed while the hooks of its previous
+// packet are pending. It returns the context of the hooks, which is canceled
+// with the error of the read as cause in that case. The reads stop once ctx is
+// done and the connection of the client is closed.
+func (c *conn) watchClient(ctx context.Context) (context.Context, <-chan frame, context.CancelCauseFunc) {
+	hctx, cancel := context.WithCancelCause(ctx)
+	frames := make(chan frame)
+	go func() {
+		defer close(frames)
+		for {
+			// Packets larger than the maximum packet size are rejected
+			// before their payload is read.
+			raw, err := mqtt5.ReadFrame(c.client, c.cfg.MaxPacketSize)
+			f := frame{raw: raw, err: err}
+			if err != nil {
+				select {
+				case frames <- f:
+					// The Up stream was waiting for the packet.
+					return
+				default:
+					cancel(err)
+				}
+			}
+			select {
+			case frames <- f:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return hctx, frames, cancel
+}
+
+// next returns the next packet of the connection read by the stream: from r
+// for the broker, or from frames for the client.
+func (c *conn) next(ctx context.Context, r io.Reader, frames <-chan frame) ([]byte, error) {
+	if frames == nil {
+		return mqtt5.ReadFrame(r, 0)
+	}
+	f, ok := <-frames
+	if !ok {
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	// The keep alive isn't enforced while the packet is processed, the next
+	// packet being read ahead.
+	if err := c.client.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return f.raw, nil
+}
+
+// clientErr returns the error of the client read which canceled the hooks in
+// place of err, which is usually the error of the canceled hook.
+func clientErr(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	return err
+}
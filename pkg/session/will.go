@@ -0,0 +1,57 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/mqtt5"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// setWill sets the Last Will of an MQTT 3.1.1 CONNECT packet, removing it if w is nil.
+func setWill(p *packets.ConnectPacket, w *Will) {
+	if w == nil {
+		p.WillFlag, p.WillTopic, p.WillMessage, p.WillQos, p.WillRetain = false, "", nil, 0, false
+		return
+	}
+	p.WillFlag, p.WillTopic, p.WillMessage, p.WillQos, p.WillRetain = true, w.Topic, w.Payload, w.QoS, w.Retain
+}
+
+// setWill5 sets the Last Will of an MQTT v5 CONNECT packet, removing it and
+// its properties if w is nil.
+func setWill5(p *mqtt5.Connect, w *Will) {
+	if w == nil {
+		p.WillFlag, p.WillTopic, p.WillPayload, p.WillQoS, p.WillRetain = false, "", nil, 0, false
+		p.WillProperties = mqtt5.Properties{}
+		return
+	}
+	p.WillFlag, p.WillTopic, p.WillPayload, p.WillQoS, p.WillRetain = true, w.Topic, w.Payload, w.QoS, w.Retain
+}
+
+// strikeWill removes the Last Will of the session if its topic is not
+// allowed by the will topics of the configuration or by the ACL rules of the
+// client, and reports whether it was removed.
+func (c *conn) strikeWill(ctx context.Context) bool {
+	s, ok := FromContext(ctx)
+	if !ok || s.Will == nil {
+		return false
+	}
+	permitted := !c.acl.enabled || allowed(c.acl.rules, s.Will.Topic, AccessWrite)
+	if permitted && len(c.cfg.WillTopics) > 0 {
+		permitted = false
+		r := strings.NewReplacer("%c", s.ID, "%u", s.Username)
+		for _, filter := range c.cfg.WillTopics {
+			if covers(r.Replace(filter), s.Will.Topic) {
+				permitted = true
+				break
+			}
+		}
+	}
+	if !permitted {
+		s.Will = nil
+	}
+	return !permitted
+}
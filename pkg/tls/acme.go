@@ -0,0 +1,113 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var errACMECacheDir = errors.New("ACME_CACHE_DIR is required to store ACME certificates")
+
+// setupACME makes the TLS configuration obtain and renew certificates for
+// ACMEDomains from an ACME CA, such as Let's Encrypt. The TLS-ALPN-01
+// challenge is answered by the TLS listener itself, which must be reachable on
+// port 443. If ACMEHTTPAddress is set, HTTP-01 challenges are answered by an
+// HTTP server listening on that address, which must be reachable on port 80.
+func setupACME(c *Config, tlsConfig *tls.Config) error {
+	if c.ACMECacheDir == "" {
+		return errACMECacheDir
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+		Email:      c.ACMEEmail,
+	}
+	if c.ACMEDirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.ACMEDirectoryURL}
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = m.GetCertificate
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+			return nil, nil
+		}
+		// The CA validating the TLS-ALPN-01 challenge has no client certificate.
+		config := tlsConfig.Clone()
+		config.GetConfigForClient = nil
+		config.NextProtos = []string{acme.ALPNProto}
+		config.ClientAuth = tls.NoClientCert
+		config.VerifyPeerCertificate, config.VerifyConnection = nil, nil
+		return config, nil
+	}
+
+	if c.ACMEHTTPAddress != "" {
+		serveACMEChallenges(c.ACMEHTTPAddress, c.ACMEDomains, m)
+	}
+	return nil
+}
+
+// acmeServers holds the HTTP-01 challenge servers by address, so listeners
+// with their own ACME domains can share the same address, usually port 80.
+var (
+	acmeServersMu sync.Mutex
+	acmeServers   = make(map[string]*acmeServer)
+)
+
+// acmeServer answers the HTTP-01 challenges of the manager of the requested domain.
+type acmeServer struct {
+	mu       sync.RWMutex
+	managers map[string]http.Handler
+}
+
+func serveACMEChallenges(addr string, domains []string, m *autocert.Manager) {
+	acmeServersMu.Lock()
+	defer acmeServersMu.Unlock()
+	s, ok := acmeServers[addr]
+	if !ok {
+		s = &acmeServer{managers: make(map[string]http.Handler)}
+		acmeServers[addr] = s
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           s,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				slog.Error("ACME HTTP-01 challenge server stopped", slog.String("address", addr), slog.Any("error", err))
+			}
+		}()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, domain := range domains {
+		s.managers[strings.ToLower(domain)] = m.HTTPHandler(nil)
+	}
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	s.mu.RLock()
+	h, ok := s.managers[strings.ToLower(host)]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
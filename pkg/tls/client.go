@@ -0,0 +1,77 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/absmach/mproxy/pkg/tls/verifier"
+	"github.com/caarlos0/env/v11"
+)
+
+var errLoadTargetCA = errors.New("failed to load target CA")
+
+// ClientConfig represents the TLS configuration used to dial the target.
+type ClientConfig struct {
+	TLS        bool   `env:"TLS"         envDefault:"false"`
+	CAFile     string `env:"CA_FILE"     envDefault:""`
+	CertFile   string `env:"CERT_FILE"   envDefault:""`
+	KeyFile    string `env:"KEY_FILE"    envDefault:""`
+	ServerName string `env:"SERVER_NAME" envDefault:""`
+	// Validator verifies the certificate of the target, after the chain was
+	// verified against CAFile or the system roots.
+	Validator verifier.Validator
+}
+
+// NewClientConfig parses the target TLS configuration. The verifier chain is
+// configured like the one of client certificates, by CERT_VERIFICATION_METHODS
+// and the variables of each method, with the same prefix.
+func NewClientConfig(opts env.Options) (ClientConfig, error) {
+	var c ClientConfig
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return ClientConfig{}, err
+	}
+	// The background workers of the verifiers, such as the CRL prefetch
+	// worker, only run with the listeners.
+	chain, _, err := newVerifiers(opts)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+	if len(chain) > 0 {
+		c.Validator = verifier.NewValidator(chain)
+	}
+	return c, nil
+}
+
+// LoadClient returns a TLS configuration that can be used to dial the target,
+// or nil if TLS is not enabled.
+func LoadClient(c *ClientConfig) (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:            c.ServerName,
+		VerifyPeerCertificate: c.Validator,
+	}
+	if c.CAFile != "" {
+		ca, err := loadCertFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Join(errLoadTargetCA, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errAppendCA
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Join(errLoadCerts, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -4,16 +4,64 @@
 package tls
 
 import (
+	"time"
+
 	"github.com/absmach/mproxy/pkg/tls/verifier"
+	"github.com/absmach/mproxy/pkg/tls/verifier/pin"
 	"github.com/caarlos0/env/v11"
 )
 
 type Config struct {
-	CertFile     string `env:"CERT_FILE"      envDefault:""`
-	KeyFile      string `env:"KEY_FILE"       envDefault:""`
-	ServerCAFile string `env:"SERVER_CA_FILE" envDefault:""`
-	ClientCAFile string `env:"CLIENT_CA_FILE" envDefault:""`
-	Validator    verifier.Validator
+	CertFile                 string        `env:"CERT_FILE"                       envDefault:""`
+	KeyFile                  string        `env:"KEY_FILE"                        envDefault:""`
+	SNICertFiles             []string      `env:"SNI_CERT_FILES"                  envDefault:""`
+	SNIKeyFiles              []string      `env:"SNI_KEY_FILES"                   envDefault:""`
+	ServerCAFile             string        `env:"SERVER_CA_FILE"                  envDefault:""`
+	ClientCAFile             string        `env:"CLIENT_CA_FILE"                  envDefault:""`
+	ClientCertOptional       bool          `env:"CLIENT_CERT_OPTIONAL"            envDefault:"false"`
+	OCSPStaple               bool          `env:"OCSP_STAPLE"                     envDefault:"false"`
+	OCSPStapleMaxRefresh     time.Duration `env:"OCSP_STAPLE_MAX_REFRESH"         envDefault:"1h"`
+	OCSPMustStaple           bool          `env:"OCSP_MUST_STAPLE"                envDefault:"false"`
+	CertReloadInterval       time.Duration `env:"CERT_RELOAD_INTERVAL"            envDefault:"0"`
+	CertReloadOnSIGHUP       bool          `env:"CERT_RELOAD_ON_SIGHUP"           envDefault:"false"`
+	MinVersion               string        `env:"TLS_MIN_VERSION"                 envDefault:""`
+	MaxVersion               string        `env:"TLS_MAX_VERSION"                 envDefault:""`
+	CipherSuites             []string      `env:"TLS_CIPHER_SUITES"               envDefault:""`
+	CurvePreferences         []string      `env:"TLS_CURVE_PREFERENCES"           envDefault:""`
+	ACMEDomains              []string      `env:"ACME_DOMAINS"                    envDefault:""`
+	ACMECacheDir             string        `env:"ACME_CACHE_DIR"                  envDefault:"acme-cache"`
+	ACMEEmail                string        `env:"ACME_EMAIL"                      envDefault:""`
+	ACMEDirectoryURL         string        `env:"ACME_DIRECTORY_URL"              envDefault:""`
+	ACMEHTTPAddress          string        `env:"ACME_HTTP_ADDRESS"               envDefault:""`
+	PKCS11Module             string        `env:"PKCS11_MODULE"                   envDefault:""`
+	PKCS11Slot               uint          `env:"PKCS11_SLOT"                     envDefault:"0"`
+	PKCS11PIN                string        `env:"PKCS11_PIN"                      envDefault:""`
+	PKCS11KeyLabel           string        `env:"PKCS11_KEY_LABEL"                envDefault:""`
+	VaultAddr                string        `env:"VAULT_ADDR"                      envDefault:""`
+	VaultNamespace           string        `env:"VAULT_NAMESPACE"                 envDefault:""`
+	VaultCAFile              string        `env:"VAULT_CA_FILE"                   envDefault:""`
+	VaultAuthMethod          string        `env:"VAULT_AUTH_METHOD"               envDefault:"token"`
+	VaultAuthMount           string        `env:"VAULT_AUTH_MOUNT"                envDefault:""`
+	VaultToken               string        `env:"VAULT_TOKEN"                     envDefault:""`
+	VaultAppRoleID           string        `env:"VAULT_APPROLE_ROLE_ID"           envDefault:""`
+	VaultAppRoleSecretID     string        `env:"VAULT_APPROLE_SECRET_ID"         envDefault:""`
+	VaultKubernetesRole      string        `env:"VAULT_KUBERNETES_ROLE"           envDefault:""`
+	VaultPKIMount            string        `env:"VAULT_PKI_MOUNT"                 envDefault:"pki"`
+	VaultPKIRole             string        `env:"VAULT_PKI_ROLE"                  envDefault:""`
+	VaultPKICommonName       string        `env:"VAULT_PKI_COMMON_NAME"           envDefault:""`
+	VaultPKIAltNames         []string      `env:"VAULT_PKI_ALT_NAMES"             envDefault:""`
+	VaultPKITTL              time.Duration `env:"VAULT_PKI_TTL"                   envDefault:"0"`
+	SessionTicketsDisabled   bool          `env:"TLS_SESSION_TICKETS_DISABLED"    envDefault:"false"`
+	SessionTicketKeyFile     string        `env:"TLS_SESSION_TICKET_KEY_FILE"     envDefault:""`
+	SessionTicketKeyRotation time.Duration `env:"TLS_SESSION_TICKET_KEY_ROTATION" envDefault:"0"`
+	FingerprintBlocklist     []string      `env:"TLS_FINGERPRINT_BLOCKLIST"       envDefault:""`
+	Validator                verifier.Validator
+	// pinned is set when client certificates are verified against pins, in
+	// which case they are requested even without a client CA.
+	pinned bool
+	// workers holds the background workers of the verifiers, which run as
+	// jobs of the TLS configuration.
+	workers []worker
 }
 
 func NewConfig(opts env.Options) (Config, error) {
@@ -22,11 +70,27 @@ func NewConfig(opts env.Options) (Config, error) {
 	if err = env.ParseWithOptions(&c, opts); err != nil {
 		return Config{}, err
 	}
-	verifiers, err := newVerifiers(opts)
+	chain, workers, err := newVerifiers(opts)
 	if err != nil {
 		return Config{}, err
 	}
-	c.Validator = verifier.NewValidator(verifiers)
+	c.AddVerifiers(chain...)
+	c.workers = workers
 
 	return c, nil
 }
+
+// AddVerifiers appends verifiers to the chain verifying client certificates.
+// Each verifier receives the verified chains and must accept the certificate,
+// in the order they were added.
+func (c *Config) AddVerifiers(verifiers ...verifier.Verifier) {
+	if c.Validator != nil {
+		verifiers = append([]verifier.Verifier{c.Validator}, verifiers...)
+	}
+	c.Validator = verifier.NewValidator(verifiers)
+	for _, v := range verifiers {
+		if _, ok := v.(*pin.Config); ok {
+			c.pinned = true
+		}
+	}
+}
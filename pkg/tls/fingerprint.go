@@ -0,0 +1,380 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/md5" //nolint:gosec // JA3 is defined as an MD5 hash.
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake  = 22
+	handshakeClientHello = 1
+	maxClientHelloSize   = 1 << 16
+
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extPointFormats        = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+)
+
+var (
+	errClientHello        = errors.New("malformed TLS ClientHello")
+	errFingerprintBlocked = errors.New("TLS client fingerprint is blocked")
+)
+
+// Fingerprint holds the JA3 and JA4 fingerprints of the ClientHello of a TLS client.
+type Fingerprint struct {
+	// JA3 is the JA3 string, JA3Hash its MD5 hash as usually reported.
+	JA3     string
+	JA3Hash string
+	JA4     string
+}
+
+// NewListener returns a TLS listener like tls.NewListener, which also records
+// the ClientHello of the accepted connections to compute their fingerprints.
+func NewListener(l net.Listener, config *tls.Config) net.Listener {
+	return tls.NewListener(helloListener{l}, config)
+}
+
+// ClientFingerprint returns the fingerprint of a TLS connection accepted by a
+// listener returned by NewListener. It must be called after the handshake.
+func ClientFingerprint(conn net.Conn) (Fingerprint, bool) {
+	tc, ok := unwrap(conn).(*tls.Conn)
+	if !ok {
+		return Fingerprint{}, false
+	}
+	hc, ok := tc.NetConn().(*helloConn)
+	if !ok || hc.hello == nil {
+		return Fingerprint{}, false
+	}
+	fp, err := parseFingerprint(hc.hello)
+	if err != nil {
+		return Fingerprint{}, false
+	}
+	return fp, true
+}
+
+// blockFingerprints wraps GetConfigForClient to abort the handshake of clients
+// whose JA3 hash or JA4 fingerprint is in the blocklist.
+func blockFingerprints(tlsConfig *tls.Config, blocklist []string) {
+	blocked := make(map[string]bool, len(blocklist))
+	for _, fp := range blocklist {
+		blocked[strings.ToLower(strings.TrimSpace(fp))] = true
+	}
+	next := tlsConfig.GetConfigForClient
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hc, ok := hello.Conn.(*helloConn); ok && hc.hello != nil {
+			fp, err := parseFingerprint(hc.hello)
+			if err != nil {
+				return nil, err
+			}
+			if blocked[fp.JA3Hash] || blocked[strings.ToLower(fp.JA4)] {
+				slog.Warn("Blocked TLS client", slog.String("remote", hc.RemoteAddr().String()), slog.String("ja3", fp.JA3Hash), slog.String("ja4", fp.JA4))
+				return nil, fmt.Errorf("%w: %s", errFingerprintBlocked, fp.JA4)
+			}
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+type helloListener struct {
+	net.Listener
+}
+
+func (l helloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: conn}, nil
+}
+
+// helloConn records the bytes read until the ClientHello message is complete.
+type helloConn struct {
+	net.Conn
+	raw   []byte
+	done  bool
+	hello []byte
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.done && n > 0 {
+		c.raw = append(c.raw, b[:n]...)
+		c.parse()
+	}
+	return n, err
+}
+
+// parse extracts the ClientHello message from the handshake records read so
+// far, giving up on anything else or on oversized messages.
+func (c *helloConn) parse() {
+	var msg []byte
+	rest := c.raw
+	for len(rest) >= 5 {
+		if rest[0] != recordTypeHandshake {
+			c.stop()
+			return
+		}
+		n := int(rest[3])<<8 | int(rest[4])
+		if len(rest) < 5+n {
+			break
+		}
+		msg, rest = append(msg, rest[5:5+n]...), rest[5+n:]
+	}
+	switch {
+	case len(msg) >= 1 && msg[0] != handshakeClientHello, len(c.raw) > maxClientHelloSize:
+		c.stop()
+	case len(msg) >= 4:
+		if n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]); len(msg) >= 4+n {
+			c.hello = msg[4 : 4+n]
+			c.stop()
+		}
+	}
+}
+
+func (c *helloConn) stop() {
+	c.done, c.raw = true, nil
+}
+
+type clientHello struct {
+	version       uint16
+	ciphers       []uint16
+	extensions    []uint16
+	groups        []uint16
+	pointFormats  []uint8
+	sigAlgs       []uint16
+	alpn          []string
+	versions      []uint16
+	hasServerName bool
+}
+
+func parseFingerprint(msg []byte) (Fingerprint, error) {
+	h, err := parseClientHello(msg)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", h.version, joinDec(h.ciphers), joinDec(h.extensions), joinDec(h.groups), joinDec8(h.pointFormats))
+	sum := md5.Sum([]byte(ja3)) //nolint:gosec // JA3 is defined as an MD5 hash.
+	return Fingerprint{JA3: ja3, JA3Hash: hex.EncodeToString(sum[:]), JA4: ja4(h)}, nil
+}
+
+func parseClientHello(msg []byte) (*clientHello, error) {
+	h := &clientHello{}
+	s := cryptobyte.String(msg)
+	var sessionID, ciphers, compression cryptobyte.String
+	if !s.ReadUint16(&h.version) || !s.Skip(32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return nil, errClientHello
+	}
+	for !ciphers.Empty() {
+		var v uint16
+		if !ciphers.ReadUint16(&v) {
+			return nil, errClientHello
+		}
+		if !isGREASE(v) {
+			h.ciphers = append(h.ciphers, v)
+		}
+	}
+	if s.Empty() {
+		return h, nil
+	}
+	var exts cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&exts) {
+		return nil, errClientHello
+	}
+	for !exts.Empty() {
+		var ext uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&ext) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, errClientHello
+		}
+		if isGREASE(ext) {
+			continue
+		}
+		h.extensions = append(h.extensions, ext)
+		var ok bool
+		switch ext {
+		case extServerName:
+			h.hasServerName, ok = true, true
+		case extSupportedGroups:
+			h.groups, ok = readUint16List(data)
+		case extSignatureAlgorithms:
+			h.sigAlgs, ok = readUint16List(data)
+		case extSupportedVersions:
+			var list cryptobyte.String
+			ok = data.ReadUint8LengthPrefixed(&list)
+			for ok && !list.Empty() {
+				var v uint16
+				if ok = list.ReadUint16(&v); ok && !isGREASE(v) {
+					h.versions = append(h.versions, v)
+				}
+			}
+		case extPointFormats:
+			var list cryptobyte.String
+			ok = data.ReadUint8LengthPrefixed(&list)
+			h.pointFormats = list
+		case extALPN:
+			var list cryptobyte.String
+			ok = data.ReadUint16LengthPrefixed(&list)
+			for ok && !list.Empty() {
+				var proto cryptobyte.String
+				if ok = list.ReadUint8LengthPrefixed(&proto); ok {
+					h.alpn = append(h.alpn, string(proto))
+				}
+			}
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, errClientHello
+		}
+	}
+	return h, nil
+}
+
+func readUint16List(data cryptobyte.String) ([]uint16, bool) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil, false
+	}
+	var vs []uint16
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			return nil, false
+		}
+		if !isGREASE(v) {
+			vs = append(vs, v)
+		}
+	}
+	return vs, true
+}
+
+// ja4 returns the JA4 fingerprint of a ClientHello received over TCP.
+func ja4(h *clientHello) string {
+	version := h.version
+	for _, v := range h.versions {
+		if v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	if h.hasServerName {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		p := h.alpn[0]
+		alpn = string(p[0]) + string(p[len(p)-1])
+		if !isAlnum(p[0]) || !isAlnum(p[len(p)-1]) {
+			x := hex.EncodeToString([]byte(p))
+			alpn = string(x[0]) + string(x[len(x)-1])
+		}
+	}
+
+	var exts []uint16
+	for _, ext := range h.extensions {
+		if ext != extServerName && ext != extALPN {
+			exts = append(exts, ext)
+		}
+	}
+	extHash := joinHex(sortedCopy(exts))
+	if len(h.sigAlgs) > 0 {
+		extHash += "_" + joinHex(h.sigAlgs)
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), sni, min99(len(h.ciphers)), min99(len(h.extensions)), alpn,
+		truncatedHash(joinHex(sortedCopy(h.ciphers))), truncatedHash(extHash))
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func sortedCopy(vs []uint16) []uint16 {
+	sorted := append([]uint16(nil), vs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func joinHex(vs []uint16) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+func joinDec(vs []uint16) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+func joinDec8(vs []uint8) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func isAlnum(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
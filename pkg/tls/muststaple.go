@@ -0,0 +1,94 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// statusRequest is the TLS Feature value of the status_request extension, RFC 7633.
+const statusRequest = 5
+
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+var (
+	errTLSFeature        = errors.New("failed to parse TLS feature extension")
+	errMissingStaple     = errors.New("client certificate requires a stapled OCSP response but none was provided")
+	errStapleNoIssuer    = errors.New("issuer of the client certificate is not available to verify the stapled OCSP response")
+	errStapleInvalid     = errors.New("invalid stapled OCSP response")
+	errStapleExpired     = errors.New("stapled OCSP response expired")
+	errStapleCertRevoked = errors.New("stapled OCSP response reports the client certificate as revoked")
+	errStapleCertUnknown = errors.New("stapled OCSP response reports the client certificate status as unknown")
+)
+
+// mustStaple reports whether the certificate carries the TLS Feature extension
+// with status_request, also known as OCSP Must-Staple.
+func mustStaple(cert *x509.Certificate) (bool, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false, errors.Join(errTLSFeature, err)
+		}
+		for _, f := range features {
+			if f == statusRequest {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// verifyMustStaple is used as tls.Config.VerifyConnection. It rejects client
+// certificates with OCSP Must-Staple unless the handshake carries a valid
+// stapled OCSP response reporting them as good. Clients can only staple OCSP
+// responses in TLS 1.3.
+func verifyMustStaple(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := cs.PeerCertificates[0]
+	required, err := mustStaple(leaf)
+	if err != nil || !required {
+		return err
+	}
+	if len(cs.OCSPResponse) == 0 {
+		return errMissingStaple
+	}
+
+	var issuer *x509.Certificate
+	switch {
+	case len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 1:
+		issuer = cs.VerifiedChains[0][1]
+	case len(cs.PeerCertificates) > 1:
+		issuer = cs.PeerCertificates[1]
+	default:
+		return errStapleNoIssuer
+	}
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return errors.Join(errStapleInvalid, err)
+	}
+	now := time.Now()
+	if resp.ThisUpdate.After(now) || (!resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now)) {
+		return errStapleExpired
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w with serial number %x at %v", errStapleCertRevoked, leaf.SerialNumber, resp.RevokedAt)
+	default:
+		return errStapleCertUnknown
+	}
+}
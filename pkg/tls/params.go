@@ -0,0 +1,94 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errTLSVersion = errors.New("invalid TLS version, supported are 1.0, 1.1, 1.2 and 1.3")
+	errCipher     = errors.New("unknown TLS cipher suite")
+	errCurve      = errors.New("unknown TLS curve")
+	errTLSRange   = errors.New("TLS_MIN_VERSION is greater than TLS_MAX_VERSION")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// applyParams sets the TLS versions, cipher suites and curves of the Config.
+func applyParams(c *Config, tlsConfig *tls.Config) error {
+	var err error
+	if tlsConfig.MinVersion, err = parseTLSVersion(c.MinVersion); err != nil {
+		return err
+	}
+	if tlsConfig.MaxVersion, err = parseTLSVersion(c.MaxVersion); err != nil {
+		return err
+	}
+	if tlsConfig.MaxVersion != 0 && tlsConfig.MinVersion > tlsConfig.MaxVersion {
+		return errTLSRange
+	}
+	for _, name := range c.CipherSuites {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	for _, name := range c.CurvePreferences {
+		id, err := parseCurve(name)
+		if err != nil {
+			return err
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, id)
+	}
+	return nil
+}
+
+// parseTLSVersion parses versions such as 1.2 or TLS1.3. An empty version
+// keeps the Go default.
+func parseTLSVersion(v string) (uint16, error) {
+	v = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "TLS")
+	if v == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[strings.TrimSpace(v)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errTLSVersion, v)
+	}
+	return version, nil
+}
+
+// parseCipherSuite parses the IANA name of a cipher suite, such as
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Cipher suites are only used up to
+// TLS 1.2, the TLS 1.3 suites are not configurable.
+func parseCipherSuite(name string) (uint16, error) {
+	name = strings.TrimSpace(name)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", errCipher, name)
+}
+
+// parseCurve parses curve names such as X25519, P-256 or P256.
+func parseCurve(name string) (tls.CurveID, error) {
+	name = strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(name)), "-", "")
+	for _, id := range curves {
+		if strings.ReplaceAll(strings.ToUpper(id.String()), "-", "") == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", errCurve, name)
+}
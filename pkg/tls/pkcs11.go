@@ -0,0 +1,204 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build cgo
+
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	errPKCS11Module  = errors.New("failed to load PKCS#11 module")
+	errPKCS11Key     = errors.New("PKCS#11 private key not found")
+	errPKCS11KeyType = errors.New("unsupported PKCS#11 key type, only RSA and ECDSA keys are supported")
+	errPKCS11Hash    = errors.New("unsupported hash function for PKCS#11 signature")
+)
+
+// pkcs11Sessions holds the sessions opened so far by module and slot, so
+// certificate reloads reuse them instead of logging in again.
+var (
+	pkcs11Mu       sync.Mutex
+	pkcs11Sessions = map[string]*pkcs11Session{}
+)
+
+type pkcs11Session struct {
+	// mu serializes the use of the session, which is not safe for concurrent use.
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+}
+
+// pkcs11Key is a crypto.Signer whose private key never leaves the PKCS#11 token.
+type pkcs11Key struct {
+	pub    crypto.PublicKey
+	s      *pkcs11Session
+	handle pkcs11.ObjectHandle
+}
+
+// loadPKCS11Key returns a signer using the private key of the PKCS#11 token
+// labeled PKCS11KeyLabel, which must match the public key of the certificate.
+func loadPKCS11Key(c *Config, pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, errPKCS11KeyType
+	}
+	s, err := openPKCS11Session(c)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	handle, err := findPKCS11Key(s.ctx, s.session, c.PKCS11KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Key{pub: pub, s: s, handle: handle}, nil
+}
+
+func openPKCS11Session(c *Config) (*pkcs11Session, error) {
+	id := fmt.Sprintf("%s/%d", c.PKCS11Module, c.PKCS11Slot)
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+	if s, ok := pkcs11Sessions[id]; ok {
+		return s, nil
+	}
+
+	ctx := pkcs11.New(c.PKCS11Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("%w %s", errPKCS11Module, c.PKCS11Module)
+	}
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return nil, errors.Join(errPKCS11Module, err)
+	}
+	session, err := ctx.OpenSession(c.PKCS11Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, errors.Join(errPKCS11Module, err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, c.PKCS11PIN); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		ctx.CloseSession(session) //nolint:errcheck
+		return nil, errors.Join(errPKCS11Module, err)
+	}
+	s := &pkcs11Session{ctx: ctx, session: session}
+	pkcs11Sessions[id] = s
+	return s, nil
+}
+
+func findPKCS11Key(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+	handles, _, err := ctx.FindObjects(session, 1)
+	if ferr := ctx.FindObjectsFinal(session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("%w: %s", errPKCS11Key, label)
+	}
+	return handles[0], nil
+}
+
+// Public implements crypto.Signer.
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign implements crypto.Signer.
+func (k *pkcs11Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mech *pkcs11.Mechanism
+	data := digest
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			params, err := pssParams(pss, pub)
+			if err != nil {
+				return nil, err
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+			break
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, errPKCS11Hash
+		}
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	default:
+		return nil, errPKCS11KeyType
+	}
+
+	k.s.mu.Lock()
+	sig, err := k.sign(mech, data)
+	k.s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := k.pub.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns the raw r || s values, TLS expects an ASN.1 signature.
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			R: new(big.Int).SetBytes(sig[:half]),
+			S: new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+func (k *pkcs11Key) sign(mech *pkcs11.Mechanism, data []byte) ([]byte, error) {
+	if err := k.s.ctx.SignInit(k.s.session, []*pkcs11.Mechanism{mech}, k.handle); err != nil {
+		return nil, err
+	}
+	return k.s.ctx.Sign(k.s.session, data)
+}
+
+func pssParams(opts *rsa.PSSOptions, pub *rsa.PublicKey) ([]byte, error) {
+	var hashAlg, mgf uint
+	switch opts.Hash {
+	case crypto.SHA256:
+		hashAlg, mgf = pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256
+	case crypto.SHA384:
+		hashAlg, mgf = pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384
+	case crypto.SHA512:
+		hashAlg, mgf = pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512
+	default:
+		return nil, errPKCS11Hash
+	}
+	saltLength := opts.SaltLength
+	switch saltLength {
+	case rsa.PSSSaltLengthEqualsHash:
+		saltLength = opts.Hash.Size()
+	case rsa.PSSSaltLengthAuto:
+		saltLength = (pub.N.BitLen()-1+7)/8 - 2 - opts.Hash.Size()
+	}
+	return pkcs11.NewPSSParams(hashAlg, mgf, uint(saltLength)), nil
+}
+
+// digestInfoPrefixes holds the DER encoded DigestInfo headers which
+// PKCS #1 v1.5 signatures prepend to the digest.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
@@ -0,0 +1,17 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !cgo
+
+package tls
+
+import (
+	"crypto"
+	"errors"
+)
+
+var errPKCS11Unsupported = errors.New("PKCS#11 keys require mproxy to be built with cgo")
+
+func loadPKCS11Key(*Config, crypto.PublicKey) (crypto.Signer, error) {
+	return nil, errPKCS11Unsupported
+}
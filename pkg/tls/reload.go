@@ -0,0 +1,135 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloader serves the certificate and CA pools of a Config, reloading them
+// when their files change or the process receives SIGHUP. Established
+// connections keep the certificates they were set up with.
+type reloader struct {
+	c      *Config
+	config *tls.Config
+
+	mu      sync.RWMutex
+	certs   *certs
+	version string
+}
+
+func newReloader(c *Config, config *tls.Config, st *certs) (*reloader, error) {
+	version, err := certFilesVersion(c)
+	if err != nil {
+		return nil, err
+	}
+	return &reloader{c: c, config: config, certs: st, version: version}, nil
+}
+
+func (r *reloader) current() *certs {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certs
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (r *reloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current().getCertificate(hello)
+}
+
+// getConfigForClient is used as tls.Config.GetConfigForClient to apply the
+// current CA pools to the handshake.
+func (r *reloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if r.c.ServerCAFile == "" && r.c.ClientCAFile == "" {
+		return nil, nil
+	}
+	st := r.current()
+	config := r.config.Clone()
+	config.GetConfigForClient = nil
+	config.RootCAs, config.ClientCAs = st.rootCAs, st.clientCAs
+	// A client CA added by a reload requires the client certificates.
+	r.c.setClientAuth(config, st.clientCAs)
+	return config, nil
+}
+
+// run reloads the certificates until ctx is done, refreshing the OCSP
+// responses of the current certificates.
+func (r *reloader) run(ctx context.Context) {
+	r.current().start(ctx)
+	sighup := make(chan os.Signal, 1)
+	if r.c.CertReloadOnSIGHUP {
+		signal.Notify(sighup, syscall.SIGHUP)
+		defer signal.Stop(sighup)
+	}
+	var tick <-chan time.Time
+	if r.c.CertReloadInterval > 0 {
+		ticker := time.NewTicker(r.c.CertReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			r.reload(ctx, true)
+		case <-tick:
+			r.reload(ctx, false)
+		}
+	}
+}
+
+// reload loads the certificates again if their files changed or force is set.
+// On failure, the current certificates are kept.
+func (r *reloader) reload(ctx context.Context, force bool) {
+	version, err := certFilesVersion(r.c)
+	if err != nil {
+		slog.Warn("Failed to check TLS certificate files", slog.Any("error", err))
+		return
+	}
+	r.mu.RLock()
+	unchanged := version == r.version
+	r.mu.RUnlock()
+	if unchanged && !force {
+		return
+	}
+	st, err := loadCerts(r.c)
+	if err != nil {
+		slog.Warn("Failed to reload TLS certificates", slog.String("cert_file", r.c.CertFile), slog.Any("error", err))
+		return
+	}
+	r.mu.Lock()
+	old := r.certs
+	r.certs, r.version = st, version
+	r.mu.Unlock()
+	old.close()
+	st.start(ctx)
+	slog.Info("Reloaded TLS certificates", slog.String("cert_file", r.c.CertFile))
+}
+
+// certFilesVersion returns a string which changes when any of the certificate files is modified.
+func certFilesVersion(c *Config) (string, error) {
+	var b strings.Builder
+	files := append([]string{c.CertFile, c.KeyFile, c.ServerCAFile, c.ClientCAFile}, c.SNICertFiles...)
+	for _, file := range append(files, c.SNIKeyFiles...) {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	stapleRetryInterval = time.Minute
+	stapleFetchTimeout  = 10 * time.Second
+	stapleMaxSize       = 1 << 20
+)
+
+var (
+	errStapleIssuer    = errors.New("OCSP stapling requires the issuer certificate after the server certificate in the certificate file")
+	errStapleNoOCSPURL = errors.New("server certificate has no OCSP responder URL")
+	errStapleStatus    = errors.New("unexpected OCSP responder response status")
+)
+
+// stapler keeps an OCSP response for the server certificate and attaches it to
+// the certificate presented in TLS handshakes. The response is refreshed in the
+// background halfway through its validity period.
+type stapler struct {
+	leaf       *x509.Certificate
+	issuer     *x509.Certificate
+	maxRefresh time.Duration
+
+	mu   sync.RWMutex
+	cert tls.Certificate
+	next time.Time
+	done chan struct{}
+}
+
+func newStapler(cert tls.Certificate, maxRefresh time.Duration) (*stapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errStapleIssuer
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errStapleNoOCSPURL
+	}
+	s := &stapler{leaf: leaf, issuer: issuer, maxRefresh: maxRefresh, cert: cert, done: make(chan struct{})}
+	return s, nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (s *stapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert := s.cert
+	if !s.next.IsZero() && time.Now().After(s.next) {
+		cert.OCSPStaple = nil
+	}
+	return &cert, nil
+}
+
+// run fetches the first response and keeps refreshing it until ctx is done or
+// stop is called. The certificate is presented without a staple until the
+// first response is fetched, so an unreachable responder doesn't delay the
+// start of the server.
+func (s *stapler) run(ctx context.Context) {
+	for {
+		wait := s.refreshAndSchedule()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// stop stops the background refresh, for instance when the certificate is reloaded.
+func (s *stapler) stop() {
+	close(s.done)
+}
+
+func (s *stapler) refreshAndSchedule() time.Duration {
+	if err := s.refresh(); err != nil {
+		slog.Warn("Failed to refresh stapled OCSP response", slog.String("subject", s.leaf.Subject.String()), slog.Any("error", err))
+		return stapleRetryInterval
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.refreshIn()
+}
+
+// refreshIn returns the delay until the next refresh, halfway through the
+// validity of the current response and at most maxRefresh.
+func (s *stapler) refreshIn() time.Duration {
+	wait := s.maxRefresh
+	if !s.next.IsZero() {
+		if half := time.Until(s.next) / 2; half < wait {
+			wait = half
+		}
+	}
+	if wait < stapleRetryInterval {
+		wait = stapleRetryInterval
+	}
+	return wait
+}
+
+func (s *stapler) refresh() error {
+	req, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, url := range s.leaf.OCSPServer {
+		raw, resp, err := s.fetch(url, req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("OCSP responder %s: %w", url, err))
+			continue
+		}
+		s.mu.Lock()
+		s.cert.OCSPStaple, s.next = raw, resp.NextUpdate
+		s.mu.Unlock()
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (s *stapler) fetch(url string, req []byte) ([]byte, *ocsp.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stapleFetchTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpReq.Header.Set("Accept", "application/ocsp-response")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w %s", errStapleStatus, httpResp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, stapleMaxSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, s.leaf, s.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	errTicketKey     = errors.New("invalid session ticket key, expected 32 base64 encoded bytes")
+	errNoTicketKeys  = errors.New("no session ticket keys found in TLS_SESSION_TICKET_KEY_FILE")
+	errTicketsConfig = errors.New("TLS_SESSION_TICKETS_DISABLED can't be combined with session ticket keys")
+)
+
+// ticketKeys manages the session ticket keys of a TLS configuration, either
+// generating a new random key every rotation interval or reading the keys
+// from a file shared by several proxy instances.
+type ticketKeys struct {
+	c      *Config
+	config *tls.Config
+	keys   [][32]byte
+}
+
+// setupSessionTickets applies the session ticket settings of c. Without a key
+// file or rotation interval, the Go defaults are kept: random keys rotated
+// daily, which can't be shared between instances.
+func setupSessionTickets(c *Config, tlsConfig *tls.Config) error {
+	if c.SessionTicketsDisabled {
+		if c.SessionTicketKeyFile != "" || c.SessionTicketKeyRotation > 0 {
+			return errTicketsConfig
+		}
+		tlsConfig.SessionTicketsDisabled = true
+		return nil
+	}
+	if c.SessionTicketKeyFile == "" && c.SessionTicketKeyRotation == 0 {
+		return nil
+	}
+	t := &ticketKeys{c: c, config: tlsConfig}
+	if err := t.rotate(); err != nil {
+		return err
+	}
+	if c.SessionTicketKeyRotation > 0 {
+		go t.run()
+	}
+	return nil
+}
+
+func (t *ticketKeys) run() {
+	ticker := time.NewTicker(t.c.SessionTicketKeyRotation)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.rotate(); err != nil {
+			slog.Warn("Failed to rotate session ticket keys", slog.Any("error", err))
+		}
+	}
+}
+
+// rotate sets the session ticket keys. Keys read from the file are used as
+// they are, the first one encrypting new tickets. A generated key replaces the
+// oldest of the two kept keys, so a ticket is accepted for at most two
+// rotation intervals, which bounds the exposure of past sessions if a key leaks.
+func (t *ticketKeys) rotate() error {
+	if t.c.SessionTicketKeyFile != "" {
+		keys, err := loadTicketKeys(t.c.SessionTicketKeyFile)
+		if err != nil {
+			return err
+		}
+		t.config.SetSessionTicketKeys(keys)
+		return nil
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	t.keys = append([][32]byte{key}, t.keys...)
+	if len(t.keys) > 2 {
+		t.keys = t.keys[:2]
+	}
+	t.config.SetSessionTicketKeys(t.keys)
+	return nil
+}
+
+// loadTicketKeys reads one base64 encoded 32 bytes key per line, ignoring
+// empty lines and lines starting with #.
+func loadTicketKeys(file string) ([][32]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][32]byte
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		v := strings.TrimSpace(s.Text())
+		if v == "" || strings.HasPrefix(v, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%w on line %d", errTicketKey, line)
+		}
+		keys = append(keys, [32]byte(key))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errNoTicketKeys
+	}
+	return keys, nil
+}
@@ -4,74 +4,348 @@
 package tls
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
 )
 
 var (
-	errTLSdetails   = errors.New("failed to get TLS details of connection")
-	errLoadCerts    = errors.New("failed to load certificates")
-	errLoadServerCA = errors.New("failed to load Server CA")
-	errLoadClientCA = errors.New("failed to load Client CA")
-	errAppendCA     = errors.New("failed to append root ca tls.Config")
+	errTLSdetails    = errors.New("failed to get TLS details of connection")
+	errLoadCerts     = errors.New("failed to load certificates")
+	errLoadServerCA  = errors.New("failed to load Server CA")
+	errLoadClientCA  = errors.New("failed to load Client CA")
+	errAppendCA      = errors.New("failed to append root ca tls.Config")
+	errOCSPStaple    = errors.New("failed to set up OCSP stapling")
+	errSNIFiles      = errors.New("SNI_CERT_FILES and SNI_KEY_FILES must list the same number of files")
+	errNoCertificate = errors.New("no certificate found in the certificate file")
 )
 
-// Load return a TLS configuration that can be used in TLS servers.
-func Load(c *Config) (*tls.Config, error) {
-	if c.CertFile == "" || c.KeyFile == "" {
-		return nil, nil
+// Load return a TLS configuration that can be used in TLS servers, and the
+// background jobs of the configuration, such as the reloading of the
+// certificates, which run once started with Jobs.Start.
+func Load(c *Config) (*tls.Config, *Jobs, error) {
+	acmeMode, vaultMode := len(c.ACMEDomains) > 0, c.VaultPKIRole != ""
+	managed := acmeMode || vaultMode
+	if !managed && (c.CertFile == "" || (c.KeyFile == "" && c.PKCS11Module == "")) {
+		return nil, nil, nil
+	}
+
+	var st *certs
+	var err error
+	if managed {
+		// ACME and Vault certificates are not read from files, only the CA files are loaded.
+		st = &certs{}
+		err = st.loadCAs(c)
+	} else {
+		st, err = loadCerts(c)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	jobs := &Jobs{}
+	tlsConfig := &tls.Config{
+		Certificates: st.certs,
+		RootCAs:      st.rootCAs,
+		ClientCAs:    st.clientCAs,
+	}
+	if err := applyParams(c, tlsConfig); err != nil {
+		return nil, nil, err
+	}
+	if err := setupSessionTickets(c, tlsConfig); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case acmeMode:
+		if err := setupACME(c, tlsConfig); err != nil {
+			return nil, nil, err
+		}
+	case vaultMode:
+		v, err := newVaultIssuer(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = v.getCertificate
+		jobs.add(v.run)
+	}
+	if len(st.certs) > 1 || st.staplers != nil {
+		// crypto/tls presents the first of Certificates to the clients without
+		// SNI, without calling GetCertificate, unless Certificates is empty.
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = st.getCertificate
+	}
+	c.setClientAuth(tlsConfig, st.clientCAs)
+	if !managed && (c.CertReloadInterval > 0 || c.CertReloadOnSIGHUP) {
+		r, err := newReloader(c, tlsConfig, st)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = r.getCertificate
+		tlsConfig.GetConfigForClient = r.getConfigForClient
+		jobs.add(r.run)
+	} else if st.staplers != nil {
+		jobs.add(st.start)
+	}
+	for _, w := range c.workers {
+		jobs.add(runWorker(w))
+	}
+	if len(c.FingerprintBlocklist) > 0 {
+		blockFingerprints(tlsConfig, c.FingerprintBlocklist)
+	}
+	return tlsConfig, jobs, nil
+}
+
+// setClientAuth requires the client certificates if client CAs are set or
+// the clients are verified by their pinned certificates. Without client CAs,
+// a previously set requirement is kept.
+func (c *Config) setClientAuth(tlsConfig *tls.Config, clientCAs *x509.CertPool) {
+	switch {
+	case clientCAs != nil:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.ClientCertOptional {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		if c.Validator != nil {
+			tlsConfig.VerifyPeerCertificate = c.peerValidator()
+		}
+		if c.OCSPMustStaple {
+			tlsConfig.VerifyConnection = verifyMustStaple
+		}
+	case c.pinned:
+		// Pinned client certificates may be self-signed, they are only checked against the pins.
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		if c.ClientCertOptional {
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		}
+		tlsConfig.VerifyPeerCertificate = c.peerValidator()
+	}
+}
+
+// runWorker returns a job running the worker of a verifier until ctx is done.
+func runWorker(w worker) func(context.Context) {
+	return func(ctx context.Context) {
+		if err := w.Start(ctx); err != nil {
+			slog.Warn("Failed to start the certificate verifier worker", slog.Any("error", err))
+			return
+		}
+		<-ctx.Done()
+		w.Stop()
+	}
+}
+
+// Jobs holds the background jobs of a TLS configuration returned by Load.
+type Jobs struct {
+	mu      sync.Mutex
+	jobs    []func(context.Context)
+	started bool
+}
+
+func (j *Jobs) add(job func(context.Context)) {
+	j.jobs = append(j.jobs, job)
+}
+
+// Start runs the jobs until ctx is done. The proxies call it with the context
+// of their listener. Only the first call has an effect, and a nil Jobs has no
+// jobs.
+func (j *Jobs) Start(ctx context.Context) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.started {
+		return
+	}
+	j.started = true
+	for _, job := range j.jobs {
+		go job(ctx)
+	}
+}
+
+// peerValidator returns the validator of client certificates. If client
+// certificates are optional, clients without one are left to the handler.
+func (c *Config) peerValidator() func([][]byte, [][]*x509.Certificate) error {
+	if !c.ClientCertOptional {
+		return c.Validator
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		return c.Validator(rawCerts, verifiedChains)
+	}
+}
+
+// certs holds the server certificates and CA pools loaded from the files of a Config.
+type certs struct {
+	// certs holds the default certificate first, followed by the SNI certificates.
+	certs    []tls.Certificate
+	staplers []*stapler
+	// names indexes certs by the lower case DNS names of their leaf certificate.
+	names     map[string]int
+	rootCAs   *x509.CertPool
+	clientCAs *x509.CertPool
+}
+
+func loadCerts(c *Config) (*certs, error) {
+	if len(c.SNICertFiles) != len(c.SNIKeyFiles) {
+		return nil, errSNIFiles
+	}
+	st := &certs{names: make(map[string]int)}
+	certFiles := append([]string{c.CertFile}, c.SNICertFiles...)
+	keyFiles := append([]string{c.KeyFile}, c.SNIKeyFiles...)
+	for i := range certFiles {
+		certificate, err := loadKeyPair(c, certFiles[i], keyFiles[i], i == 0)
+		if err != nil {
+			return nil, errors.Join(errLoadCerts, err)
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, errors.Join(errLoadCerts, err)
+		}
+		for _, name := range append(leaf.DNSNames, leaf.Subject.CommonName) {
+			name = strings.ToLower(name)
+			if _, ok := st.names[name]; !ok && name != "" {
+				st.names[name] = i
+			}
+		}
+		st.certs = append(st.certs, certificate)
+	}
+
+	if err := st.loadCAs(c); err != nil {
+		return nil, err
 	}
 
-	tlsConfig := &tls.Config{}
+	if c.OCSPStaple {
+		for _, certificate := range st.certs {
+			s, err := newStapler(certificate, c.OCSPStapleMaxRefresh)
+			if err != nil {
+				st.close()
+				return nil, errors.Join(errOCSPStaple, err)
+			}
+			st.staplers = append(st.staplers, s)
+		}
+	}
+	return st, nil
+}
 
-	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+// loadKeyPair loads a certificate and its key. The key of the default
+// certificate is taken from the PKCS#11 token if PKCS11Module is set.
+func loadKeyPair(c *Config, certFile, keyFile string, def bool) (tls.Certificate, error) {
+	if !def || c.PKCS11Module == "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certPEM, err := os.ReadFile(certFile)
 	if err != nil {
-		return nil, errors.Join(errLoadCerts, err)
+		return tls.Certificate{}, err
+	}
+	var certificate tls.Certificate
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certificate.Certificate = append(certificate.Certificate, block.Bytes)
+		}
 	}
-	tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{certificate},
+	if len(certificate.Certificate) == 0 {
+		return tls.Certificate{}, errNoCertificate
 	}
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	if certificate.PrivateKey, err = loadPKCS11Key(c, certificate.Leaf.PublicKey); err != nil {
+		return tls.Certificate{}, err
+	}
+	return certificate, nil
+}
 
+// loadCAs loads the server and client CA pools.
+func (st *certs) loadCAs(c *Config) error {
 	// Loading Server CA file
 	rootCA, err := loadCertFile(c.ServerCAFile)
 	if err != nil {
-		return nil, errors.Join(errLoadServerCA, err)
+		return errors.Join(errLoadServerCA, err)
 	}
 	if len(rootCA) > 0 {
-		if tlsConfig.RootCAs == nil {
-			tlsConfig.RootCAs = x509.NewCertPool()
-		}
-		if !tlsConfig.RootCAs.AppendCertsFromPEM(rootCA) {
-			return nil, errAppendCA
+		st.rootCAs = x509.NewCertPool()
+		if !st.rootCAs.AppendCertsFromPEM(rootCA) {
+			return errAppendCA
 		}
 	}
 
 	// Loading Client CA File
 	clientCA, err := loadCertFile(c.ClientCAFile)
 	if err != nil {
-		return nil, errors.Join(errLoadClientCA, err)
+		return errors.Join(errLoadClientCA, err)
 	}
 	if len(clientCA) > 0 {
-		if tlsConfig.ClientCAs == nil {
-			tlsConfig.ClientCAs = x509.NewCertPool()
+		st.clientCAs = x509.NewCertPool()
+		if !st.clientCAs.AppendCertsFromPEM(clientCA) {
+			return errAppendCA
 		}
-		if !tlsConfig.ClientCAs.AppendCertsFromPEM(clientCA) {
-			return nil, errAppendCA
+	}
+	return nil
+}
+
+// getCertificate selects the certificate by the server name requested by the
+// client, falling back to the first certificate supported by the client and
+// then to the default certificate.
+func (st *certs) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	i := st.index(hello)
+	if st.staplers != nil {
+		return st.staplers[i].getCertificate(hello)
+	}
+	return &st.certs[i], nil
+}
+
+func (st *certs) index(hello *tls.ClientHelloInfo) int {
+	if hello == nil || len(st.certs) == 1 {
+		return 0
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if i, ok := st.names[name]; ok {
+		return i
+	}
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if i, ok := st.names["*"+name[dot:]]; ok {
+			return i
 		}
-		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		if c.Validator != nil {
-			tlsConfig.VerifyPeerCertificate = c.Validator
+	}
+	for i := range st.certs {
+		if hello.SupportsCertificate(&st.certs[i]) == nil {
+			return i
 		}
 	}
-	return tlsConfig, nil
+	return 0
+}
+
+// close releases the resources of certificates which were replaced.
+// start refreshes the OCSP responses of the certificates until ctx is done or
+// close is called.
+func (st *certs) start(ctx context.Context) {
+	for _, s := range st.staplers {
+		go s.run(ctx)
+	}
+}
+
+func (st *certs) close() {
+	for _, s := range st.staplers {
+		s.stop()
+	}
 }
 
 // ClientCert returns client certificate.
 func ClientCert(conn net.Conn) (x509.Certificate, error) {
-	switch connVal := conn.(type) {
+	switch connVal := unwrap(conn).(type) {
 	case *tls.Conn:
 		if err := connVal.Handshake(); err != nil {
 			return x509.Certificate{}, err
@@ -90,6 +364,67 @@ func ClientCert(conn net.Conn) (x509.Certificate, error) {
 	}
 }
 
+// ConnState returns the state of a TLS connection, which may be wrapped by
+// a connection returning it from a NetConn method, like the connections
+// routed by a listener shared between protocols.
+func ConnState(conn net.Conn) (tls.ConnectionState, bool) {
+	tc, ok := unwrap(conn).(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tc.ConnectionState(), true
+}
+
+// unwrap returns the TLS connection wrapped by conn, or conn if it wraps none.
+func unwrap(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return conn
+		}
+	}
+}
+
+// WithNextProtos returns a copy of a TLS configuration negotiating the
+// application protocols with ALPN, including with the configurations
+// returned by its GetConfigForClient. The protocols are added to those of the
+// configuration, such as the one of the ACME TLS-ALPN-01 challenge, whose
+// configuration is left as is.
+func WithNextProtos(c *tls.Config, protos ...string) *tls.Config {
+	config := c.Clone()
+	config.NextProtos = appendProtos(config.NextProtos, protos)
+	if next := config.GetConfigForClient; next != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := next(hello)
+			if cfg == nil || err != nil {
+				return cfg, err
+			}
+			if len(cfg.NextProtos) == 1 && cfg.NextProtos[0] == acme.ALPNProto {
+				return cfg, nil
+			}
+			cfg = cfg.Clone()
+			cfg.NextProtos = appendProtos(cfg.NextProtos, protos)
+			return cfg, nil
+		}
+	}
+	return config
+}
+
+// appendProtos appends the protocols missing from next.
+func appendProtos(next, protos []string) []string {
+	next = slices.Clone(next)
+	for _, proto := range protos {
+		if !slices.Contains(next, proto) {
+			next = append(next, proto)
+		}
+	}
+	return next
+}
+
 // SecurityStatus returns log message from TLS config.
 func SecurityStatus(c *tls.Config) string {
 	if c == nil {
@@ -97,10 +432,10 @@ func SecurityStatus(c *tls.Config) string {
 	}
 	ret := "TLS"
 	// It is possible to establish TLS with client certificates only.
-	if c.Certificates == nil || len(c.Certificates) == 0 {
+	if len(c.Certificates) == 0 && c.GetCertificate == nil {
 		ret = "no server certificates"
 	}
-	if c.ClientCAs != nil {
+	if c.ClientAuth != tls.NoClientCert {
 		ret += " and " + c.ClientAuth.String()
 	}
 	return ret
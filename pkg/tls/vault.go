@@ -0,0 +1,223 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultRetryInterval = time.Minute
+	vaultTimeout       = 30 * time.Second
+	vaultMaxSize       = 1 << 20
+	vaultK8sTokenFile  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+var (
+	errVaultConfig     = errors.New("VAULT_ADDR and VAULT_PKI_COMMON_NAME are required to issue certificates from Vault")
+	errVaultAuthMethod = errors.New("unsupported VAULT_AUTH_METHOD, accepted values are token, approle and kubernetes")
+	errVaultCA         = errors.New("no certificates found in VAULT_CA_FILE")
+	errVaultResponse   = errors.New("unexpected Vault response")
+)
+
+// vaultIssuer issues the server certificate from the PKI secrets engine of
+// HashiCorp Vault and renews it before it expires.
+type vaultIssuer struct {
+	c      *Config
+	client *http.Client
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newVaultIssuer(c *Config) (*vaultIssuer, error) {
+	if c.VaultAddr == "" || c.VaultPKICommonName == "" {
+		return nil, errVaultConfig
+	}
+	switch c.VaultAuthMethod {
+	case "token", "approle", "kubernetes":
+	default:
+		return nil, errVaultAuthMethod
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.VaultCAFile != "" {
+		b, err := os.ReadFile(c.VaultCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errVaultCA
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	v := &vaultIssuer{c: c, client: &http.Client{Transport: transport, Timeout: vaultTimeout}}
+	if err := v.issue(context.Background()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (v *vaultIssuer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.cert, nil
+}
+
+// run renews the certificate until ctx is done, once two thirds of its
+// validity period have elapsed.
+func (v *vaultIssuer) run(ctx context.Context) {
+	wait := v.renewIn()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := v.issue(ctx); err != nil {
+			slog.Warn("Failed to renew the certificate from Vault", slog.Any("error", err))
+			wait = vaultRetryInterval
+			continue
+		}
+		wait = v.renewIn()
+	}
+}
+
+func (v *vaultIssuer) renewIn() time.Duration {
+	v.mu.RLock()
+	leaf := v.cert.Leaf
+	v.mu.RUnlock()
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	wait := time.Until(leaf.NotBefore.Add(lifetime * 2 / 3))
+	if wait < vaultRetryInterval {
+		wait = vaultRetryInterval
+	}
+	return wait
+}
+
+func (v *vaultIssuer) issue(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, vaultTimeout)
+	defer cancel()
+	token, err := v.login(ctx)
+	if err != nil {
+		return err
+	}
+	req := map[string]string{
+		"common_name": v.c.VaultPKICommonName,
+		"alt_names":   strings.Join(v.c.VaultPKIAltNames, ","),
+	}
+	if v.c.VaultPKITTL > 0 {
+		req["ttl"] = v.c.VaultPKITTL.String()
+	}
+	var resp struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+			PrivateKey  string   `json:"private_key"`
+		} `json:"data"`
+	}
+	path := fmt.Sprintf("/v1/%s/issue/%s", v.c.VaultPKIMount, v.c.VaultPKIRole)
+	if err := v.post(ctx, path, token, req, &resp); err != nil {
+		return err
+	}
+	chain := []string{resp.Data.Certificate}
+	if len(resp.Data.CAChain) > 0 {
+		chain = append(chain, resp.Data.CAChain...)
+	} else if resp.Data.IssuingCA != "" {
+		chain = append(chain, resp.Data.IssuingCA)
+	}
+	cert, err := tls.X509KeyPair([]byte(strings.Join(chain, "\n")), []byte(resp.Data.PrivateKey))
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.cert = &cert
+	v.mu.Unlock()
+	return nil
+}
+
+// login returns a Vault token obtained with the configured auth method.
+func (v *vaultIssuer) login(ctx context.Context) (string, error) {
+	var req map[string]string
+	switch v.c.VaultAuthMethod {
+	case "token":
+		return v.c.VaultToken, nil
+	case "approle":
+		req = map[string]string{"role_id": v.c.VaultAppRoleID, "secret_id": v.c.VaultAppRoleSecretID}
+	case "kubernetes":
+		jwt, err := os.ReadFile(vaultK8sTokenFile)
+		if err != nil {
+			return "", err
+		}
+		req = map[string]string{"role": v.c.VaultKubernetesRole, "jwt": strings.TrimSpace(string(jwt))}
+	}
+	mount := v.c.VaultAuthMount
+	if mount == "" {
+		mount = v.c.VaultAuthMethod
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.post(ctx, "/v1/auth/"+mount+"/login", "", req, &resp); err != nil {
+		return "", err
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+func (v *vaultIssuer) post(ctx context.Context, path, token string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(v.c.VaultAddr, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.c.VaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.c.VaultNamespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err = io.ReadAll(io.LimitReader(resp.Body, vaultMaxSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(b, &e)
+		return fmt.Errorf("%w %s on %s: %s", errVaultResponse, resp.Status, path, strings.Join(e.Errors, "; "))
+	}
+	return json.Unmarshal(b, out)
+}
@@ -4,6 +4,7 @@
 package tls
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"strings"
@@ -11,74 +12,132 @@ import (
 	"github.com/absmach/mproxy/pkg/tls/verifier"
 	"github.com/absmach/mproxy/pkg/tls/verifier/crl"
 	"github.com/absmach/mproxy/pkg/tls/verifier/ocsp"
+	"github.com/absmach/mproxy/pkg/tls/verifier/pin"
+	"github.com/absmach/mproxy/pkg/tls/verifier/spiffe"
 	"github.com/caarlos0/env/v11"
 )
 
-// ErrInvalidCertVerification represents an error during the cert verification
-// method loading. Supported are OCSP and CRL verification methods.
-var ErrInvalidCertVerification = errors.New("invalid certificate verification method")
+var (
+	// ErrInvalidCertVerification represents an error during the cert verification
+	// method loading. Supported are OCSP, CRL, SPIFFE and PIN verification methods,
+	// and the methods registered with verifier.Register.
+	ErrInvalidCertVerification = errors.New("invalid certificate verification method")
+
+	// ErrInvalidCertVerificationPolicy represents an error during the cert
+	// verification policy loading. Supported are all, any and fallback.
+	ErrInvalidCertVerificationPolicy = errors.New("invalid certificate verification policy")
+)
 
 type verification int
 
 const (
 	OCSP verification = iota + 1
 	CRL
+	SPIFFE
+	PIN
 )
 
-func newVerifiers(opts env.Options) ([]verifier.Verifier, error) {
+// method is a verification method of CERT_VERIFICATION_METHODS: a built-in
+// verification, or the name of a verifier registered with verifier.Register.
+type method struct {
+	verification
+	name string
+}
+
+// worker is implemented by the verifiers running a background worker, such as
+// the CRL prefetch worker.
+type worker interface {
+	Start(ctx context.Context) error
+	Stop()
+}
+
+// newVerifiers returns the chain of configured verifiers, in the order of
+// CERT_VERIFICATION_METHODS. The revocation verifiers are combined according
+// to CERT_VERIFICATION_POLICY into a single link, placed at the position of
+// the first of them. The other verifiers must always accept the certificate.
+// The workers of the verifiers are returned to run with the listener.
+func newVerifiers(opts env.Options) ([]verifier.Verifier, []worker, error) {
 	if opts.FuncMap == nil {
 		opts.FuncMap = make(map[reflect.Type]env.ParserFunc)
 	}
-	opts.FuncMap[reflect.TypeOf(make([]verification, 0))] = envParseSliceValidate
-	opts.FuncMap[reflect.TypeOf(new(verification))] = envParseValidation
+	opts.FuncMap[reflect.TypeOf(make([]method, 0))] = envParseSliceValidate
+	opts.FuncMap[reflect.TypeOf(new(method))] = envParseValidation
+	opts.FuncMap[reflect.TypeOf(verifier.RequireAll)] = envParsePolicy
 
 	var c struct {
-		Verifications []verification `env:"CERT_VERIFICATION_METHODS"             envDefault:""`
+		Verifications []method        `env:"CERT_VERIFICATION_METHODS"             envDefault:""`
+		Policy        verifier.Policy `env:"CERT_VERIFICATION_POLICY"              envDefault:"all"`
 	}
 	if err := env.ParseWithOptions(&c, opts); err != nil {
-		return nil, err
-	}
-	if len(c.Verifications) == 0 {
-		return nil, nil
+		return nil, nil, err
 	}
 
-	var vms []verifier.Verifier
+	var chain, revocation []verifier.Verifier
+	var workers []worker
+	revocationAt := -1
 	for _, v := range c.Verifications {
-		switch v {
+		var vm verifier.Verifier
+		var err error
+		switch v.verification {
 		case OCSP:
-			vm, err := ocsp.New(opts)
-			if err != nil {
-				return nil, err
-			}
-			vms = append(vms, vm)
+			vm, err = ocsp.New(opts)
 		case CRL:
-			vm, err := crl.New(opts)
-			if err != nil {
-				return nil, err
+			var cv *crl.Config
+			if cv, err = crl.New(opts); err == nil && cv.CRLPrefetchInterval > 0 {
+				workers = append(workers, cv)
 			}
-			vms = append(vms, vm)
+			vm = cv
+		case SPIFFE:
+			vm, err = spiffe.New(opts)
+		case PIN:
+			vm, err = pin.New(opts)
 		default:
-			return nil, ErrInvalidCertVerification
+			f, ok := verifier.Lookup(v.name)
+			if !ok {
+				return nil, nil, ErrInvalidCertVerification
+			}
+			vm, err = f(opts)
+		}
+		if err != nil {
+			return nil, nil, err
 		}
+		if v.verification == OCSP || v.verification == CRL {
+			if revocationAt < 0 {
+				revocationAt = len(chain)
+				chain = append(chain, nil)
+			}
+			revocation = append(revocation, vm)
+			continue
+		}
+		chain = append(chain, vm)
+	}
+	if revocationAt >= 0 {
+		chain[revocationAt] = verifier.NewPolicyValidator(revocation, c.Policy)
 	}
 
-	return vms, nil
+	return chain, workers, nil
 }
 
-func parseValidation(v string) (verification, error) {
+func parseValidation(v string) (method, error) {
 	v = strings.ToUpper(strings.TrimSpace(v))
 	switch v {
 	case "OCSP":
-		return OCSP, nil
+		return method{verification: OCSP}, nil
 	case "CRL":
-		return CRL, nil
-	default:
-		return 0, ErrInvalidCertVerification
+		return method{verification: CRL}, nil
+	case "SPIFFE":
+		return method{verification: SPIFFE}, nil
+	case "PIN":
+		return method{verification: PIN}, nil
 	}
+	if _, ok := verifier.Lookup(v); ok {
+		return method{name: v}, nil
+	}
+	return method{}, ErrInvalidCertVerification
 }
 
 func envParseSliceValidate(v string) (interface{}, error) {
-	var vms []verification
+	var vms []method
 	v = strings.TrimSpace(v)
 	vmss := strings.Split(v, ",")
 	for _, vm := range vmss {
@@ -94,3 +153,16 @@ func envParseSliceValidate(v string) (interface{}, error) {
 func envParseValidation(v string) (interface{}, error) {
 	return parseValidation(v)
 }
+
+func envParsePolicy(v string) (interface{}, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "all", "":
+		return verifier.RequireAll, nil
+	case "any":
+		return verifier.RequireAny, nil
+	case "fallback":
+		return verifier.Fallback, nil
+	default:
+		return nil, ErrInvalidCertVerificationPolicy
+	}
+}
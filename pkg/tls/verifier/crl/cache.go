@@ -0,0 +1,156 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cache keeps verified CRLs in memory, keyed by distribution point URL,
+// until their expiry. A CRL is only used for the issuer it was verified with.
+// Concurrent refreshes of the same URL and issuer are collapsed into a single
+// fetch.
+type cache struct {
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+	// gen is incremented by clear, so that the refreshes started before
+	// don't cache their CRL.
+	gen   uint64
+	group singleflight.Group
+}
+
+// expiryFunc returns the time until which a CRL fetched now may be cached.
+type expiryFunc func(*revocationList) time.Time
+
+type cacheEntry struct {
+	crl     *revocationList
+	issuer  *x509.Certificate
+	expires time.Time
+}
+
+// get returns the cached CRL of url, unless it expired or was verified with
+// another issuer than the given one.
+func (c *cache) get(url string, issuer *x509.Certificate) (*revocationList, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[url]
+	if !ok || !time.Now().Before(e.expires) || !sameKey(e.issuer, issuer) {
+		return nil, false
+	}
+	return e.crl, true
+}
+
+// set caches the CRL of url, unless the cache was cleared since gen.
+func (c *cache) set(url string, crl *revocationList, issuer *x509.Certificate, expires time.Time, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[url] = cacheEntry{crl: crl, issuer: issuer, expires: expires}
+}
+
+// load returns the cached CRL for url or refreshes it with fetch, and whether
+// the CRL was cached. Only one refresh per url runs at a time, other callers
+// wait for its result.
+func (c *cache) load(url string, issuer *x509.Certificate, expiry expiryFunc, fetch func() (*revocationList, error)) (*revocationList, bool, error) {
+	if crl, ok := c.get(url, issuer); ok {
+		return crl, true, nil
+	}
+	crl, err := c.refresh(url, issuer, expiry, fetch, false)
+	return crl, false, err
+}
+
+// refresh fetches the CRL for url and stores it in the cache. Unless force is
+// set, a CRL cached while waiting for a concurrent refresh is returned instead.
+func (c *cache) refresh(url string, issuer *x509.Certificate, expiry expiryFunc, fetch func() (*revocationList, error), force bool) (*revocationList, error) {
+	key := url
+	if issuer != nil {
+		key += "\x00" + string(issuer.RawSubjectPublicKeyInfo)
+	}
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		if crl, ok := c.get(url, issuer); ok && !force {
+			return crl, nil
+		}
+		c.mu.RLock()
+		gen := c.gen
+		c.mu.RUnlock()
+		crl, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		c.set(url, crl, issuer, expiry(crl), gen)
+		return crl, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*revocationList), nil
+}
+
+// expiring returns the URLs and issuers of the cached CRLs which expire within d.
+func (c *cache) expiring(d time.Duration) map[string]*x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	deadline := time.Now().Add(d)
+	urls := make(map[string]*x509.Certificate)
+	for url, e := range c.entries {
+		if e.expires.Before(deadline) {
+			urls[url] = e.issuer
+		}
+	}
+	return urls
+}
+
+func (c *cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.gen++
+}
+
+// sameKey reports whether the certificates have the same subject and key.
+func sameKey(a, b *x509.Certificate) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.RawSubject, b.RawSubject) && bytes.Equal(a.RawSubjectPublicKeyInfo, b.RawSubjectPublicKeyInfo)
+}
+
+// cacheExpiry returns the earliest of the CRL's NextUpdate, CRLCacheMaxTTL from
+// now and the time the CRL becomes older than CRLMaxAge.
+func (c *Config) cacheExpiry(crl *revocationList) time.Time {
+	expires := crl.NextUpdate
+	if c.CRLCacheMaxTTL > 0 {
+		if ttl := time.Now().Add(c.CRLCacheMaxTTL); ttl.Before(expires) {
+			expires = ttl
+		}
+	}
+	if c.CRLMaxAge > 0 {
+		if stale := crl.ThisUpdate.Add(c.CRLMaxAge); stale.Before(expires) {
+			expires = stale
+		}
+	}
+	return expires
+}
+
+// ClearCache purges all CRLs cached in memory, so the next verification fetches
+// them again from their distribution points or the disk cache. It is safe to
+// call concurrently with ongoing verifications.
+func (c *Config) ClearCache() {
+	c.cache.clear()
+}
+
+// ClearDiskCache purges all CRLs stored in CRLCacheDir.
+func (c *Config) ClearDiskCache() error {
+	return diskCache(c.CRLCacheDir).clear()
+}
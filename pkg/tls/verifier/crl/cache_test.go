@@ -0,0 +1,32 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import "testing"
+
+func TestClearCache(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	srv, hits := newCRLServer(t, ca.crl(t))
+	cert := ca.issue(t, 2, srv.URL)
+	c := newTestConfig(t, nil)
+
+	verify := func() {
+		t.Helper()
+		if err := c.VerifyPeerCertificate([][]byte{cert.Raw, ca.cert.Raw}, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	verify()
+	verify()
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("expected the cached CRL to be fetched once, got %d fetches", got)
+	}
+
+	c.ClearCache()
+	verify()
+	if got := hits.Load(); got != 2 {
+		t.Errorf("expected the CRL to be fetched again after ClearCache, got %d fetches", got)
+	}
+}
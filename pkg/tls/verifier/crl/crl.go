@@ -4,12 +4,17 @@
 package crl
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,19 +24,42 @@ import (
 	"github.com/caarlos0/env/v11"
 )
 
+// ErrCRLUnavailable indicates a transient failure to retrieve a CRL, such as an
+// unreachable distribution point. Custom Fetchers should wrap it in such errors,
+// so that they are tolerated in soft-fail mode.
+var ErrCRLUnavailable = errors.New("CRL distribution point unavailable")
+
+// ErrCertRevoked is wrapped by every RevokedError. It is the same error as
+// verifier.ErrCertRevoked.
+var ErrCertRevoked = verifier.ErrCertRevoked
+
 var (
 	errRetrieveCRL         = errors.New("failed to retrieve CRL")
+	errCRLHTTPStatus       = errors.New("unexpected CRL distribution point response status")
+	errCRLTooLarge         = errors.New("CRL too large")
 	errReadCRL             = errors.New("failed to read CRL")
 	errParseCRL            = errors.New("failed to parse CRL")
 	errExpiredCRL          = errors.New("crl expired")
+	errStaleCRL            = errors.New("crl older than configured max age")
 	errCRLSign             = errors.New("failed to verify CRL signature")
 	errOfflineCRLLoad      = errors.New("failed to load offline CRL file")
 	errOfflineCRLIssuer    = errors.New("failed to load offline CRL issuer cert file")
 	errOfflineCRLIssuerPEM = errors.New("failed to decode PEM block in offline CRL issuer cert file")
+	errOfflineCRLNoMatch   = errors.New("no offline CRL issuer cert matches the offline CRL issuer")
+	errOfflineCRLNoIssuer  = errors.New("offline CRL issuer cert file is required to verify the offline CRL signature")
 	errCRLDistIssuer       = errors.New("failed to load CRL distribution points issuer cert file")
 	errCRLDistIssuerPEM    = errors.New("failed to decode PEM block in CRL distribution points issuer cert file")
+	errCRLDistIssuerCount  = errors.New("CRL_DISTRIBUTION_POINTS_ISSUER_CERT_FILE must list either one issuer cert file or one per CRL distribution point")
 	errNoCRL               = errors.New("neither offline crl file nor crl distribution points in certificate / environmental variable CRL_DISTRIBUTION_POINTS & CRL_DISTRIBUTION_POINTS_ISSUER_CERT_FILE have values")
-	errCertRevoked         = errors.New("certificate revoked")
+)
+
+// oidCertificateIssuer is the CRL entry extension naming the issuer of the revoked certificate in indirect CRLs.
+var oidCertificateIssuer = asn1.ObjectIdentifier{2, 5, 29, 29}
+
+const (
+	directoryNameTag = 4
+	uriNameTag       = 6
+	asn1TagSequence  = 0x30
 )
 
 var (
@@ -39,42 +67,122 @@ var (
 	errClientCrt = errors.New("client certificate not received")
 )
 
-type config struct {
-	CRLDepth                            uint    `env:"CRL_DEPTH"                                envDefault:"1"`
-	OfflineCRLFile                      string  `env:"OFFLINE_CRL_FILE"                         envDefault:""`
-	OfflineCRLIssuerCertFile            string  `env:"OFFLINE_CRL_ISSUER_CERT_FILE"             envDefault:""`
-	CRLDistributionPoints               url.URL `env:"CRL_DISTRIBUTION_POINTS"                  envDefault:""`
-	CRLDistributionPointsIssuerCertFile string  `env:"CRL_DISTRIBUTION_POINTS_ISSUER_CERT_FILE" envDefault:""`
+// Timings holds the time spent in each phase of CRL verification for a single
+// peer certificate chain.
+type Timings struct {
+	Fetch time.Duration
+	Parse time.Duration
+	Check time.Duration
 }
 
-var _ verifier.Verifier = (*config)(nil)
+type phase int
 
-func New(opts env.Options) (verifier.Verifier, error) {
-	var c config
+const (
+	fetchPhase phase = iota
+	parsePhase
+	checkPhase
+)
+
+// TimingsFunc is called with the CRL verification timings of each connection.
+type TimingsFunc func(Timings)
+
+// Config represents CRL verifier configuration.
+type Config struct {
+	CRLDepth                            uint          `env:"CRL_DEPTH"                                envDefault:"1"`
+	OfflineCRLFile                      string        `env:"OFFLINE_CRL_FILE"                         envDefault:""`
+	OfflineCRLIssuerCertFile            string        `env:"OFFLINE_CRL_ISSUER_CERT_FILE"             envDefault:""`
+	OfflineCRLSkipSignatureVerify       bool          `env:"OFFLINE_CRL_SKIP_SIGNATURE_VERIFY"        envDefault:"false"`
+	CRLDistributionPoints               []url.URL     `env:"CRL_DISTRIBUTION_POINTS"                  envDefault:""`
+	CRLDistributionPointsIssuerCertFile []string      `env:"CRL_DISTRIBUTION_POINTS_ISSUER_CERT_FILE" envDefault:""`
+	CRLStrictIssuerMatch                bool          `env:"CRL_STRICT_ISSUER_MATCH"                  envDefault:"false"`
+	CRLIgnoredReasons                   []string      `env:"CRL_IGNORED_REASONS"                      envDefault:""`
+	CRLSoftFail                         bool          `env:"CRL_SOFT_FAIL"                            envDefault:"false"`
+	CRLMaxAge                           time.Duration `env:"CRL_MAX_AGE"                              envDefault:"0"`
+	CRLCacheMaxTTL                      time.Duration `env:"CRL_CACHE_MAX_TTL"                        envDefault:"1h"`
+	CRLCacheDir                         string        `env:"CRL_CACHE_DIR"                            envDefault:""`
+	CRLMaxSize                          int64         `env:"CRL_MAX_SIZE"                             envDefault:"33554432"`
+	CRLHTTPTimeout                      time.Duration `env:"CRL_HTTP_TIMEOUT"                         envDefault:"5s"`
+	CRLHTTPProxy                        url.URL       `env:"CRL_HTTP_PROXY"                           envDefault:""`
+	CRLHTTPCAFile                       string        `env:"CRL_HTTP_CA_FILE"                         envDefault:""`
+	CRLHTTPRetries                      uint          `env:"CRL_HTTP_RETRIES"                         envDefault:"0"`
+	CRLHTTPRetryBackoff                 time.Duration `env:"CRL_HTTP_RETRY_BACKOFF"                   envDefault:"500ms"`
+	CRLHTTPUserAgent                    string        `env:"CRL_HTTP_USER_AGENT"                      envDefault:"mproxy"`
+	CRLPrefetchInterval                 time.Duration `env:"CRL_PREFETCH_INTERVAL"                    envDefault:"0"`
+	CRLDelta                            bool          `env:"CRL_DELTA"                                envDefault:"true"`
+	CRLLDAPBindDN                       string        `env:"CRL_LDAP_BIND_DN"                         envDefault:""`
+	CRLLDAPBindPassword                 string        `env:"CRL_LDAP_BIND_PASSWORD"                   envDefault:""`
+	// OnTimings, if set, receives the time spent fetching, parsing and
+	// checking CRLs for every verified connection.
+	OnTimings TimingsFunc
+	// Fetcher, if set, retrieves CRLs from distribution points instead of the
+	// built-in HTTP and LDAP clients.
+	Fetcher Fetcher
+	// Metrics, if set, receives fetch latencies, cache hits, revocations and
+	// verification failures.
+	Metrics Metrics
+	// Logger is used to report CRLs skipped in soft-fail mode. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	client   *http.Client
+	cache    cache
+	offline  offlineCache
+	prefetch prefetcher
+}
+
+var _ verifier.Verifier = (*Config)(nil)
+
+func New(opts env.Options) (*Config, error) {
+	var c Config
 	if err := env.ParseWithOptions(&c, opts); err != nil {
 		return nil, err
 	}
+	if err := c.validateIgnoredReasons(); err != nil {
+		return nil, err
+	}
+	if err := c.validateDistPoints(); err != nil {
+		return nil, err
+	}
+	client, err := c.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
 	return &c, nil
 }
 
-func (c *config) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+func (c *Config) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var t *Timings
+	if c.OnTimings != nil {
+		t = &Timings{}
+		defer func() { c.OnTimings(*t) }()
+	}
+	// The TLS handshake does not provide a context, fetches are bounded by CRLHTTPTimeout instead.
+	ctx := context.Background()
 	switch {
 	case len(verifiedChains) > 0:
-		return c.VerifyVerifiedPeerCertificates(verifiedChains)
+		return c.observe(c.verifyVerifiedPeerCertificates(ctx, verifiedChains, t))
 	case len(rawCerts) > 0:
 		var peerCertificates []*x509.Certificate
 		peerCertificates, err := parseCertificates(rawCerts)
 		if err != nil {
-			return err
+			return c.observe(err)
 		}
-		return c.VerifyRawPeerCertificates(peerCertificates)
+		return c.observe(c.verifyRawPeerCertificates(ctx, peerCertificates, t))
 	default:
-		return errClientCrt
+		return c.observe(errClientCrt)
 	}
 }
 
-func (c *config) VerifyVerifiedPeerCertificates(verifiedPeerCertificateChains [][]*x509.Certificate) error {
-	offlineCRL, err := c.loadOfflineCRL()
+func (c *Config) VerifyVerifiedPeerCertificates(ctx context.Context, verifiedPeerCertificateChains [][]*x509.Certificate) error {
+	return c.observe(c.verifyVerifiedPeerCertificates(ctx, verifiedPeerCertificateChains, nil))
+}
+
+func (c *Config) VerifyRawPeerCertificates(ctx context.Context, peerCertificates []*x509.Certificate) error {
+	return c.observe(c.verifyRawPeerCertificates(ctx, peerCertificates, nil))
+}
+
+func (c *Config) verifyVerifiedPeerCertificates(ctx context.Context, verifiedPeerCertificateChains [][]*x509.Certificate, t *Timings) error {
+	offlineCRLs, err := c.loadOfflineCRLs(t)
 	if err != nil {
 		return err
 	}
@@ -86,18 +194,7 @@ func (c *config) VerifyVerifiedPeerCertificates(verifiedPeerCertificateChains []
 				issuer = verifiedChain[i+1]
 			}
 
-			crl, err := c.getCRLFromDistributionPoint(cert, issuer)
-			if err != nil {
-				return err
-			}
-			switch {
-			case crl == nil && offlineCRL != nil:
-				crl = offlineCRL
-			case crl == nil && offlineCRL == nil:
-				return errNoCRL
-			}
-
-			if err := c.crlVerify(cert, crl); err != nil {
+			if err := c.verifyCert(ctx, cert, issuer, offlineCRLs, t); err != nil {
 				return err
 			}
 		}
@@ -105,82 +202,168 @@ func (c *config) VerifyVerifiedPeerCertificates(verifiedPeerCertificateChains []
 	return nil
 }
 
-func (c *config) VerifyRawPeerCertificates(peerCertificates []*x509.Certificate) error {
-	offlineCRL, err := c.loadOfflineCRL()
+func (c *Config) verifyRawPeerCertificates(ctx context.Context, peerCertificates []*x509.Certificate, t *Timings) error {
+	offlineCRLs, err := c.loadOfflineCRLs(t)
 	if err != nil {
 		return err
 	}
 	for i, peerCertificate := range peerCertificates {
 		issuerCert := retrieveIssuerCert(peerCertificate.Issuer, peerCertificates)
-		crl, err := c.getCRLFromDistributionPoint(peerCertificate, issuerCert)
-		if err != nil {
+		if err := c.verifyCert(ctx, peerCertificate, issuerCert, offlineCRLs, t); err != nil {
 			return err
 		}
-		switch {
-		case crl == nil && offlineCRL != nil:
-			crl = offlineCRL
-		case crl == nil && offlineCRL == nil:
-			return errNoCRL
+		if i+1 == int(c.CRLDepth) {
+			return nil
 		}
+	}
+	return nil
+}
 
-		if err := c.crlVerify(peerCertificate, crl); err != nil {
+// verifyCert checks the certificate against the CRL of its distribution point,
+// falling back to the offline CRL. In soft-fail mode, a CRL which cannot be
+// retrieved due to a transient error is replaced by the offline CRL, if one
+// applies, or else logged and the certificate accepted.
+func (c *Config) verifyCert(ctx context.Context, cert, issuer *x509.Certificate, offlineCRLs offlineCRLs, t *Timings) error {
+	crl, err := c.getCRLFromDistributionPoint(ctx, cert, issuer, t)
+	if err != nil {
+		if !c.CRLSoftFail || !errors.Is(err, ErrCRLUnavailable) {
 			return err
 		}
-		if i+1 == int(c.CRLDepth) {
+		if crl = offlineCRLs.forCert(cert); crl == nil {
+			c.logger().Warn("CRL unavailable, accepting certificate in soft-fail mode",
+				slog.String("serial_number", fmt.Sprintf("%x", cert.SerialNumber)),
+				slog.Any("error", err))
 			return nil
 		}
 	}
-	return nil
+	if crl == nil {
+		crl = offlineCRLs.forCert(cert)
+	}
+	if crl == nil {
+		return errNoCRL
+	}
+	if err := c.checkAge(crl); err != nil {
+		return err
+	}
+	if err := checkScope(cert, crl.RevocationList); err != nil {
+		return err
+	}
+	return c.crlVerify(cert, crl, t)
 }
 
-func (c *config) crlVerify(peerCertificate *x509.Certificate, crl *x509.RevocationList) error {
-	for _, revokedCertificate := range crl.RevokedCertificateEntries {
-		if revokedCertificate.SerialNumber.Cmp(peerCertificate.SerialNumber) == 0 {
-			return errCertRevoked
-		}
+// checkAge rejects CRLs issued longer than CRLMaxAge ago.
+func (c *Config) checkAge(crl *revocationList) error {
+	if c.CRLMaxAge > 0 && time.Since(crl.ThisUpdate) > c.CRLMaxAge {
+		return fmt.Errorf("%w: issued at %v", errStaleCRL, crl.ThisUpdate)
 	}
 	return nil
 }
 
-func (c *config) loadOfflineCRL() (*x509.RevocationList, error) {
-	offlineCRLBytes, err := loadCertFile(c.OfflineCRLFile)
-	if err != nil {
-		return nil, errors.Join(errOfflineCRLLoad, err)
+func (c *Config) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
 	}
-	if len(offlineCRLBytes) == 0 {
-		return nil, nil
-	}
-	fmt.Println(c.OfflineCRLIssuerCertFile)
-	issuer, err := c.loadOfflineCRLIssuerCert()
-	if err != nil {
-		return nil, err
-	}
-	_ = issuer
-	offlineCRL, err := parseVerifyCRL(offlineCRLBytes, nil, false)
-	if err != nil {
-		return nil, err
+	return slog.Default()
+}
+
+func (c *Config) crlVerify(peerCertificate *x509.Certificate, crl *revocationList, t *Timings) error {
+	defer t.track(checkPhase, t.start())
+	for _, revokedCertificate := range crl.lookup(peerCertificate.SerialNumber) {
+		if c.CRLStrictIssuerMatch && !sameIssuer(peerCertificate, crl, revokedCertificate.RevocationListEntry) {
+			continue
+		}
+		if c.reasonIgnored(revokedCertificate.ReasonCode) {
+			continue
+		}
+		c.metrics().CertificateRevoked(reasonName(revokedCertificate.ReasonCode))
+		return &RevokedError{
+			SerialNumber:   peerCertificate.SerialNumber,
+			RevocationTime: revokedCertificate.RevocationTime,
+			ReasonCode:     revokedCertificate.ReasonCode,
+			Source:         revokedCertificate.source,
+		}
 	}
-	return offlineCRL, nil
+	return nil
 }
 
-func (c *config) getCRLFromDistributionPoint(cert, issuer *x509.Certificate) (*x509.RevocationList, error) {
+func (c *Config) getCRLFromDistributionPoint(ctx context.Context, cert, issuer *x509.Certificate, t *Timings) (*revocationList, error) {
+	var dps []distPoint
 	switch {
-	case len(cert.CRLDistributionPoints) > 0:
-		return retrieveCRL(cert.CRLDistributionPoints[0], issuer, true)
-	case c.CRLDistributionPoints.String() != "" && c.CRLDistributionPointsIssuerCertFile != "":
-		var crlIssuerCrt *x509.Certificate
+	case len(remoteDistPoints(cert.CRLDistributionPoints)) > 0:
+		for _, dp := range remoteDistPoints(cert.CRLDistributionPoints) {
+			dps = append(dps, distPoint{url: dp, issuer: issuer})
+		}
+	case len(c.CRLDistributionPoints) > 0 && len(c.CRLDistributionPointsIssuerCertFile) > 0:
 		var err error
-		if crlIssuerCrt, err = c.loadDistPointCRLIssuerCert(); err != nil {
+		if dps, err = c.configuredDistPoints(); err != nil {
 			return nil, err
 		}
-		return retrieveCRL(c.CRLDistributionPoints.String(), crlIssuerCrt, true)
 	default:
 		return nil, nil
 	}
+	crl, issuer, err := c.retrieveCRLFromAny(ctx, dps, t)
+	if err != nil || !c.CRLDelta {
+		return crl, err
+	}
+	return c.applyDeltaCRL(ctx, cert, crl, issuer, t)
+}
+
+// distPoint is a CRL distribution point together with the certificate of the CRL issuer.
+type distPoint struct {
+	url    string
+	issuer *x509.Certificate
+}
+
+// retrieveCRLFromAny tries the distribution points in order and returns the
+// first CRL which is retrieved and verified successfully, along with its issuer.
+func (c *Config) retrieveCRLFromAny(ctx context.Context, dps []distPoint, t *Timings) (*revocationList, *x509.Certificate, error) {
+	var errs []error
+	for _, dp := range dps {
+		crl, err := c.retrieveCRL(ctx, dp.url, dp.issuer, true, t)
+		if err == nil {
+			return crl, dp.issuer, nil
+		}
+		errs = append(errs, fmt.Errorf("distribution point %s: %w", dp.url, err))
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// validateDistPoints checks that CRLDistributionPointsIssuerCertFile lists
+// either a single issuer cert file shared by all CRLDistributionPoints or one
+// issuer cert file per distribution point.
+func (c *Config) validateDistPoints() error {
+	if n := len(c.CRLDistributionPointsIssuerCertFile); len(c.CRLDistributionPoints) > 0 && n > 1 && n != len(c.CRLDistributionPoints) {
+		return errCRLDistIssuerCount
+	}
+	return nil
+}
+
+// configuredDistPoints returns CRLDistributionPoints, in order of preference,
+// with their issuer certificates.
+func (c *Config) configuredDistPoints() ([]distPoint, error) {
+	if err := c.validateDistPoints(); err != nil {
+		return nil, err
+	}
+	issuers := make([]*x509.Certificate, len(c.CRLDistributionPointsIssuerCertFile))
+	for i, file := range c.CRLDistributionPointsIssuerCertFile {
+		issuer, err := loadDistPointCRLIssuerCert(file)
+		if err != nil {
+			return nil, err
+		}
+		issuers[i] = issuer
+	}
+	dps := make([]distPoint, len(c.CRLDistributionPoints))
+	for i, u := range c.CRLDistributionPoints {
+		dps[i] = distPoint{url: u.String(), issuer: issuers[0]}
+		if len(issuers) > 1 {
+			dps[i].issuer = issuers[i]
+		}
+	}
+	return dps, nil
 }
 
-func (c *config) loadDistPointCRLIssuerCert() (*x509.Certificate, error) {
-	crlIssuerCertBytes, err := loadCertFile(c.CRLDistributionPointsIssuerCertFile)
+func loadDistPointCRLIssuerCert(file string) (*x509.Certificate, error) {
+	crlIssuerCertBytes, err := loadCertFile(file)
 	if err != nil {
 		return nil, errors.Join(errCRLDistIssuer, err)
 	}
@@ -198,48 +381,183 @@ func (c *config) loadDistPointCRLIssuerCert() (*x509.Certificate, error) {
 	return crlIssuerCert, nil
 }
 
-func (c *config) loadOfflineCRLIssuerCert() (*x509.Certificate, error) {
-	offlineCrlIssuerCertBytes, err := loadCertFile(c.OfflineCRLIssuerCertFile)
+func (c *Config) retrieveCRL(ctx context.Context, crlDistributionPoints string, issuerCert *x509.Certificate, checkSign bool, t *Timings) (*revocationList, error) {
+	crl, hit, err := c.cache.load(crlDistributionPoints, issuerCert, c.cacheExpiry, c.fetchVerifyCRL(ctx, crlDistributionPoints, issuerCert, checkSign, true, t))
+	if hit {
+		c.metrics().CacheHit(crlDistributionPoints)
+	} else {
+		c.metrics().CacheMiss(crlDistributionPoints)
+	}
+	return crl, err
+}
+
+// fetchVerifyCRL returns a function downloading and verifying the CRL. With
+// useStored set, a CRL stored in the disk cache within CRLCacheMaxTTL is used
+// without contacting the distribution point.
+func (c *Config) fetchVerifyCRL(ctx context.Context, crlDistributionPoints string, issuerCert *x509.Certificate, checkSign, useStored bool, t *Timings) func() (*revocationList, error) {
+	return func() (*revocationList, error) {
+		disk := diskCache(c.CRLCacheDir)
+		stored, ok := disk.load(crlDistributionPoints)
+		if ok && useStored && stored.fresh(c.CRLCacheMaxTTL) {
+			if crl, err := parseVerifyCRL(stored.Body, issuerCert, checkSign, t); err == nil && c.checkAge(crl) == nil {
+				crl.source = crlDistributionPoints
+				return crl, nil
+			}
+		}
+		fetched, err := c.fetchCRL(ctx, crlDistributionPoints, stored, t)
+		if err != nil {
+			return nil, err
+		}
+		crl, err := parseVerifyCRL(fetched.Body, issuerCert, checkSign, t)
+		if err != nil {
+			return nil, err
+		}
+		crl.source = crlDistributionPoints
+		if isLocalDistPoint(crlDistributionPoints) {
+			return crl, nil
+		}
+		if err := disk.store(fetched); err != nil {
+			c.logger().Warn("Failed to store CRL in disk cache", slog.String("url", crlDistributionPoints), slog.Any("error", err))
+		}
+		return crl, nil
+	}
+}
+
+// fetchCRL downloads the CRL from the distribution point. For HTTP distribution
+// points, the validators of the stored copy are sent as a conditional request
+// and the stored copy is returned if it has not been modified.
+func (c *Config) fetchCRL(ctx context.Context, crlDistributionPoints string, stored storedCRL, t *Timings) (storedCRL, error) {
+	defer t.track(fetchPhase, t.start())
+	start := time.Now()
+	fetched, err := c.retry(ctx, func() (storedCRL, error) {
+		return c.fetchCRLOnce(ctx, crlDistributionPoints, stored)
+	})
+	c.metrics().FetchObserved(crlDistributionPoints, time.Since(start), err)
+	return fetched, err
+}
+
+func (c *Config) fetchCRLOnce(ctx context.Context, crlDistributionPoints string, stored storedCRL) (storedCRL, error) {
+	if c.CRLHTTPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CRLHTTPTimeout)
+		defer cancel()
+	}
+	fetched := storedCRL{URL: crlDistributionPoints, Fetched: time.Now()}
+	if c.Fetcher != nil {
+		body, err := c.Fetcher.Fetch(ctx, crlDistributionPoints)
+		if err != nil {
+			return storedCRL{}, errors.Join(errRetrieveCRL, err)
+		}
+		if c.CRLMaxSize > 0 && int64(len(body)) > c.CRLMaxSize {
+			return storedCRL{}, fmt.Errorf("%w: exceeds limit of %d bytes", errCRLTooLarge, c.CRLMaxSize)
+		}
+		fetched.Body = body
+		return fetched, nil
+	}
+	u, err := url.Parse(crlDistributionPoints)
 	if err != nil {
-		return nil, errors.Join(errOfflineCRLIssuer, err)
+		return storedCRL{}, errors.Join(errRetrieveCRL, err)
 	}
-	if len(offlineCrlIssuerCertBytes) == 0 {
-		return nil, nil
+	if isLocalDistPoint(crlDistributionPoints) {
+		body, err := c.fetchFile(u)
+		if err != nil {
+			return storedCRL{}, err
+		}
+		fetched.Body = body
+		return fetched, nil
 	}
-	offlineCrlIssuerCertPEM, _ := pem.Decode(offlineCrlIssuerCertBytes)
-	if offlineCrlIssuerCertPEM == nil {
-		return nil, errOfflineCRLIssuerPEM
+	if u.Scheme == "ldap" || u.Scheme == "ldaps" {
+		body, err := c.fetchLDAP(ctx, u)
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded):
+			return storedCRL{}, errors.Join(errRetrieveCRL, ErrCRLUnavailable, err)
+		case err != nil:
+			return storedCRL{}, errors.Join(errRetrieveCRL, err)
+		}
+		fetched.Body = body
+		return fetched, nil
 	}
-	crlIssuerCert, err := x509.ParseCertificate(offlineCrlIssuerCertPEM.Bytes)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, crlDistributionPoints, http.NoBody)
 	if err != nil {
-		return nil, errors.Join(errOfflineCRLIssuer, err)
+		return storedCRL{}, errors.Join(errRetrieveCRL, err)
 	}
-	return crlIssuerCert, nil
-}
-
-func retrieveCRL(crlDistributionPoints string, issuerCert *x509.Certificate, checkSign bool) (*x509.RevocationList, error) {
-	resp, err := http.Get(crlDistributionPoints)
+	if len(stored.Body) > 0 {
+		if stored.ETag != "" {
+			req.Header.Set("If-None-Match", stored.ETag)
+		}
+		if stored.LastModified != "" {
+			req.Header.Set("If-Modified-Since", stored.LastModified)
+		}
+	}
+	if c.CRLHTTPUserAgent != "" {
+		req.Header.Set("User-Agent", c.CRLHTTPUserAgent)
+	}
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
-		return nil, errors.Join(errRetrieveCRL, err)
+		return storedCRL{}, errors.Join(errRetrieveCRL, ErrCRLUnavailable, err)
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && len(stored.Body) > 0:
+		stored.Fetched = fetched.Fetched
+		return stored, nil
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return storedCRL{}, errors.Join(errRetrieveCRL, ErrCRLUnavailable, fmt.Errorf("%w %s", errCRLHTTPStatus, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return storedCRL{}, errors.Join(errRetrieveCRL, fmt.Errorf("%w %s", errCRLHTTPStatus, resp.Status))
+	}
+	if fetched.Body, err = readLimited(resp.Body, resp.ContentLength, c.CRLMaxSize); err != nil {
+		if errors.Is(err, errReadCRL) {
+			// A body cut short is as transient as a failed connection.
+			return storedCRL{}, errors.Join(ErrCRLUnavailable, err)
+		}
+		return storedCRL{}, err
+	}
+	fetched.ETag = resp.Header.Get("ETag")
+	fetched.LastModified = resp.Header.Get("Last-Modified")
+	return fetched, nil
+}
+
+// readLimited reads a CRL body, failing as soon as it is known to exceed maxSize bytes.
+// A maxSize of zero disables the limit.
+func readLimited(r io.Reader, contentLength, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Join(errReadCRL, err)
+		}
+		return body, nil
+	}
+	if contentLength > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d bytes", errCRLTooLarge, contentLength, maxSize)
+	}
+	var buf bytes.Buffer
+	if contentLength > 0 {
+		buf.Grow(int(contentLength))
+	}
+	n, err := io.Copy(&buf, io.LimitReader(r, maxSize+1))
 	if err != nil {
 		return nil, errors.Join(errReadCRL, err)
 	}
-	return parseVerifyCRL(body, issuerCert, checkSign)
+	if n > maxSize {
+		return nil, fmt.Errorf("%w: exceeds limit of %d bytes", errCRLTooLarge, maxSize)
+	}
+	return buf.Bytes(), nil
 }
 
-func parseVerifyCRL(clrB []byte, issuerCert *x509.Certificate, checkSign bool) (*x509.RevocationList, error) {
-	block, _ := pem.Decode(clrB)
-	if block == nil {
-		return nil, errParseCRL
+func parseVerifyCRL(clrB []byte, issuerCert *x509.Certificate, checkSign bool, t *Timings) (*revocationList, error) {
+	defer t.track(parsePhase, t.start())
+	der, err := decodeCRL(clrB)
+	if err != nil {
+		return nil, err
 	}
 
-	crl, err := x509.ParseRevocationList(block.Bytes)
+	rl, err := x509.ParseRevocationList(der)
 	if err != nil {
 		return nil, errors.Join(errParseCRL, err)
 	}
+	crl := newRevocationList(rl)
 
 	if checkSign {
 		if err := crl.CheckSignatureFrom(issuerCert); err != nil {
@@ -253,6 +571,70 @@ func parseVerifyCRL(clrB []byte, issuerCert *x509.Certificate, checkSign bool) (
 	return crl, nil
 }
 
+// decodeCRL returns the DER bytes of a PEM or DER encoded CRL.
+func decodeCRL(clrB []byte) ([]byte, error) {
+	if block, _ := pem.Decode(clrB); block != nil {
+		return block.Bytes, nil
+	}
+	// DER encoded CRLs start with an ASN.1 SEQUENCE tag.
+	if len(clrB) > 0 && clrB[0] == asn1TagSequence {
+		return clrB, nil
+	}
+	return nil, errParseCRL
+}
+
+// sameIssuer reports whether the revoked entry was issued by the same issuer and key
+// as the certificate. The entry's certificate issuer extension is used when present,
+// otherwise the authority key identifiers or the issuer names are compared.
+func sameIssuer(cert *x509.Certificate, crl *revocationList, entry x509.RevocationListEntry) bool {
+	for _, ext := range entry.Extensions {
+		if ext.Id.Equal(oidCertificateIssuer) {
+			return generalNamesContain(ext.Value, cert.RawIssuer)
+		}
+	}
+	if len(crl.AuthorityKeyId) > 0 && len(cert.AuthorityKeyId) > 0 {
+		return bytes.Equal(crl.AuthorityKeyId, cert.AuthorityKeyId)
+	}
+	return bytes.Equal(crl.RawIssuer, cert.RawIssuer)
+}
+
+// generalNamesContain reports whether the DER encoded GeneralNames contain the given directory name.
+func generalNamesContain(generalNames, rawName []byte) bool {
+	var names []asn1.RawValue
+	if _, err := asn1.Unmarshal(generalNames, &names); err != nil {
+		return false
+	}
+	for _, name := range names {
+		if name.Class == asn1.ClassContextSpecific && name.Tag == directoryNameTag && bytes.Equal(name.Bytes, rawName) {
+			return true
+		}
+	}
+	return false
+}
+
+// start returns the current time, or the zero time if timings are not collected.
+func (t *Timings) start() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// track adds the time elapsed since start to the given phase.
+func (t *Timings) track(p phase, start time.Time) {
+	if t == nil {
+		return
+	}
+	switch p {
+	case fetchPhase:
+		t.Fetch += time.Since(start)
+	case parsePhase:
+		t.Parse += time.Since(start)
+	case checkPhase:
+		t.Check += time.Since(start)
+	}
+}
+
 func loadCertFile(certFile string) ([]byte, error) {
 	if certFile != "" {
 		return os.ReadFile(certFile)
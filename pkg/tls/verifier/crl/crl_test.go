@@ -0,0 +1,197 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing CA certificate: %v", err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) issue(t *testing.T, serial int64, dps ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		CRLDistributionPoints: dps,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	return cert
+}
+
+func (ca testCA) crl(t *testing.T, revoked ...int64) []byte {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("creating CRL: %v", err)
+	}
+	return der
+}
+
+// newCRLServer serves the CRL and counts the requests it receives.
+func newCRLServer(t *testing.T, crl []byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	return newSlowCRLServer(t, crl, 0)
+}
+
+// newSlowCRLServer serves the CRL after the delay and counts the requests it
+// receives.
+func newSlowCRLServer(t *testing.T, crl []byte, delay time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		_, _ = w.Write(crl)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func newTestConfig(t *testing.T, vars map[string]string) *Config {
+	t.Helper()
+	c, err := New(env.Options{Environment: vars})
+	if err != nil {
+		t.Fatalf("creating CRL verifier: %v", err)
+	}
+	return c
+}
+
+func TestTimings(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	srv, _ := newSlowCRLServer(t, ca.crl(t), 50*time.Millisecond)
+	cert := ca.issue(t, 2, srv.URL)
+
+	c := newTestConfig(t, nil)
+	var timings []Timings
+	c.OnTimings = func(tm Timings) { timings = append(timings, tm) }
+
+	if err := c.VerifyPeerCertificate([][]byte{cert.Raw, ca.cert.Raw}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(timings) != 1 {
+		t.Fatalf("expected 1 timings report, got %d", len(timings))
+	}
+	got := timings[0]
+	if got.Fetch < 0 || got.Parse < 0 || got.Check < 0 {
+		t.Errorf("expected non-negative timings, got %+v", got)
+	}
+	if got.Fetch < 50*time.Millisecond || got.Parse <= 0 {
+		t.Errorf("expected the slow fetch and the parse to be recorded, got %+v", got)
+	}
+	if got.Fetch <= got.Parse+got.Check {
+		t.Errorf("expected the slow fetch to exceed the parse and check timings, got %+v", got)
+	}
+
+	// The cached CRL is not parsed again.
+	if err := c.VerifyPeerCertificate([][]byte{cert.Raw, ca.cert.Raw}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := timings[1]; got.Parse != 0 {
+		t.Errorf("expected no parse timing for the cached CRL, got %+v", got)
+	}
+}
+
+func TestSameIssuer(t *testing.T) {
+	// Both issuers have the same subject, only their keys differ.
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "ca")
+	rl, err := x509.ParseRevocationList(ca.crl(t, 2))
+	if err != nil {
+		t.Fatalf("parsing CRL: %v", err)
+	}
+	crl := newRevocationList(rl)
+	entry := crl.RevokedCertificateEntries[0]
+
+	cases := []struct {
+		desc     string
+		cert     *x509.Certificate
+		expected bool
+	}{
+		{
+			desc:     "certificate of the CRL issuer",
+			cert:     ca.issue(t, 2),
+			expected: true,
+		},
+		{
+			desc:     "certificate of an issuer with the same subject and another key",
+			cert:     other.issue(t, 2),
+			expected: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := sameIssuer(tc.cert, crl, entry); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
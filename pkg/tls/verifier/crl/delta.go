@@ -0,0 +1,160 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// removeFromCRL is the reason code used by delta CRLs to release a certificate
+// put on hold in the base CRL.
+const removeFromCRL = 8
+
+var (
+	oidFreshestCRL       = asn1.ObjectIdentifier{2, 5, 29, 46}
+	oidDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+
+	errDeltaCRLNotDelta = errors.New("CRL retrieved from freshest CRL distribution point is not a delta CRL")
+	errDeltaCRLBase     = errors.New("delta CRL does not apply to the base CRL")
+	errDeltaCRLIssuer   = errors.New("delta CRL and base CRL issuers differ")
+	errDeltaCRLScope    = errors.New("delta CRL and base CRL issuing distribution points differ")
+	errFreshestCRL      = errors.New("failed to parse freshest CRL extension")
+)
+
+type distributionPointName struct {
+	FullName     []asn1.RawValue  `asn1:"optional,tag:0"`
+	RelativeName pkix.RDNSequence `asn1:"optional,tag:1"`
+}
+
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+	Reason            asn1.BitString        `asn1:"optional,tag:1"`
+	CRLIssuer         asn1.RawValue         `asn1:"optional,tag:2"`
+}
+
+// applyDeltaCRL merges the delta CRL announced by the Freshest CRL extension of
+// the certificate or the base CRL into the base CRL. The base CRL is returned
+// unchanged when no delta CRL is announced.
+func (c *Config) applyDeltaCRL(ctx context.Context, cert *x509.Certificate, base *revocationList, issuer *x509.Certificate, t *Timings) (*revocationList, error) {
+	urls, err := freshestCRLURLs(cert.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	urls = remoteDistPoints(urls)
+	if len(urls) == 0 {
+		if urls, err = freshestCRLURLs(base.Extensions); err != nil {
+			return nil, err
+		}
+		urls = remoteDistPoints(urls)
+	}
+	if len(urls) == 0 {
+		return base, nil
+	}
+
+	dps := make([]distPoint, len(urls))
+	for i, u := range urls {
+		dps[i] = distPoint{url: u, issuer: issuer}
+	}
+	delta, _, err := c.retrieveCRLFromAny(ctx, dps, t)
+	if err != nil {
+		return nil, err
+	}
+	return delta.mergeInto(base)
+}
+
+// mergeInto returns the merge of the delta CRL into base, reusing the previous
+// result while neither CRL has been refreshed.
+func (delta *revocationList) mergeInto(base *revocationList) (*revocationList, error) {
+	delta.mu.Lock()
+	defer delta.mu.Unlock()
+	if delta.mergedBase == base {
+		return delta.mergedResult, nil
+	}
+	merged, deltaEntries, err := mergeDeltaCRL(base.RevocationList, delta.RevocationList)
+	if err != nil {
+		return nil, err
+	}
+	result := newRevocationList(merged)
+	result.source, result.deltaSource, result.deltaEntries = base.source, delta.source, deltaEntries
+	delta.mergedBase, delta.mergedResult = base, result
+	return delta.mergedResult, nil
+}
+
+// mergeDeltaCRL validates that delta applies to base and returns a CRL holding
+// the revocation entries of both, those of delta first, along with the number
+// of entries taken from delta.
+func mergeDeltaCRL(base, delta *x509.RevocationList) (*x509.RevocationList, int, error) {
+	var baseNumber *big.Int
+	for _, ext := range delta.Extensions {
+		if ext.Id.Equal(oidDeltaCRLIndicator) {
+			if _, err := asn1.Unmarshal(ext.Value, &baseNumber); err != nil {
+				return nil, 0, errors.Join(errDeltaCRLNotDelta, err)
+			}
+		}
+	}
+	if baseNumber == nil {
+		return nil, 0, errDeltaCRLNotDelta
+	}
+	// RFC 5280 5.2.4: the base CRL must be at least as recent as the one the delta was built on.
+	if base.Number == nil || base.Number.Cmp(baseNumber) < 0 || (delta.Number != nil && delta.Number.Cmp(base.Number) <= 0) {
+		return nil, 0, errDeltaCRLBase
+	}
+	if string(base.RawIssuer) != string(delta.RawIssuer) {
+		return nil, 0, errDeltaCRLIssuer
+	}
+	if string(idpValue(base.Extensions)) != string(idpValue(delta.Extensions)) {
+		return nil, 0, errDeltaCRLScope
+	}
+
+	merged := *base
+	merged.NextUpdate = delta.NextUpdate
+	if base.NextUpdate.Before(merged.NextUpdate) {
+		merged.NextUpdate = base.NextUpdate
+	}
+	removed := make(map[string]bool)
+	entries := make([]x509.RevocationListEntry, 0, len(base.RevokedCertificateEntries)+len(delta.RevokedCertificateEntries))
+	for _, e := range delta.RevokedCertificateEntries {
+		if e.ReasonCode == removeFromCRL {
+			removed[e.SerialNumber.String()] = true
+			continue
+		}
+		entries = append(entries, e)
+	}
+	deltaEntries := len(entries)
+	for _, e := range base.RevokedCertificateEntries {
+		if !removed[e.SerialNumber.String()] {
+			entries = append(entries, e)
+		}
+	}
+	merged.RevokedCertificateEntries = entries
+	return &merged, deltaEntries, nil
+}
+
+// freshestCRLURLs returns the URIs listed in the Freshest CRL extension, if present.
+func freshestCRLURLs(exts []pkix.Extension) ([]string, error) {
+	for _, ext := range exts {
+		if !ext.Id.Equal(oidFreshestCRL) {
+			continue
+		}
+		var dps []distributionPoint
+		if _, err := asn1.Unmarshal(ext.Value, &dps); err != nil {
+			return nil, errors.Join(errFreshestCRL, err)
+		}
+		var urls []string
+		for _, dp := range dps {
+			for _, name := range dp.DistributionPoint.FullName {
+				if name.Class == asn1.ClassContextSpecific && name.Tag == uriNameTag {
+					urls = append(urls, string(name.Bytes))
+				}
+			}
+		}
+		return urls, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func freshestCRLExtension(t *testing.T, urls ...string) pkix.Extension {
+	t.Helper()
+	dps := make([]distributionPoint, len(urls))
+	for i, u := range urls {
+		dps[i].DistributionPoint.FullName = []asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: uriNameTag, Bytes: []byte(u)}}
+	}
+	value, err := asn1.Marshal(dps)
+	if err != nil {
+		t.Fatalf("marshaling freshest CRL extension: %v", err)
+	}
+	return pkix.Extension{Id: oidFreshestCRL, Value: value}
+}
+
+func TestApplyDeltaCRLLocal(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	// The file holds a base CRL, so reading it as a delta CRL would fail.
+	path := filepath.Join(t.TempDir(), "delta.crl")
+	if err := os.WriteFile(path, ca.crl(t), 0o600); err != nil {
+		t.Fatalf("writing CRL: %v", err)
+	}
+
+	cases := []struct {
+		desc string
+		url  string
+	}{
+		{
+			desc: "file URL",
+			url:  "file://" + filepath.ToSlash(path),
+		},
+		{
+			desc: "local path",
+			url:  path,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tmpl := &x509.RevocationList{
+				Number:          big.NewInt(1),
+				ThisUpdate:      time.Now().Add(-time.Minute),
+				NextUpdate:      time.Now().Add(time.Hour),
+				ExtraExtensions: []pkix.Extension{freshestCRLExtension(t, tc.url)},
+			}
+			der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+			if err != nil {
+				t.Fatalf("creating CRL: %v", err)
+			}
+			rl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				t.Fatalf("parsing CRL: %v", err)
+			}
+			base := newRevocationList(rl)
+
+			c := newTestConfig(t, nil)
+			got, err := c.applyDeltaCRL(context.Background(), ca.issue(t, 2), base, ca.cert, &Timings{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != base {
+				t.Errorf("expected the base CRL to be returned unchanged")
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	diskCacheBodyExt = ".crl"
+	diskCacheMetaExt = ".json"
+)
+
+// storedCRL is a downloaded CRL together with the validators used for
+// conditional requests when it is refreshed.
+type storedCRL struct {
+	Body         []byte    `json:"-"`
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// fresh reports whether the stored CRL was downloaded within maxTTL.
+func (s storedCRL) fresh(maxTTL time.Duration) bool {
+	return maxTTL <= 0 || time.Since(s.Fetched) < maxTTL
+}
+
+// diskCache persists downloaded CRLs in a directory, so they survive restarts.
+// A diskCache with an empty directory stores nothing.
+type diskCache string
+
+func (d diskCache) path(url, ext string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(string(d), hex.EncodeToString(sum[:])+ext)
+}
+
+func (d diskCache) load(url string) (storedCRL, bool) {
+	if d == "" {
+		return storedCRL{}, false
+	}
+	meta, err := os.ReadFile(d.path(url, diskCacheMetaExt))
+	if err != nil {
+		return storedCRL{}, false
+	}
+	var s storedCRL
+	if err := json.Unmarshal(meta, &s); err != nil || s.URL != url {
+		return storedCRL{}, false
+	}
+	if s.Body, err = os.ReadFile(d.path(url, diskCacheBodyExt)); err != nil {
+		return storedCRL{}, false
+	}
+	return s, true
+}
+
+func (d diskCache) store(s storedCRL) error {
+	if d == "" {
+		return nil
+	}
+	if err := os.MkdirAll(string(d), 0o700); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.path(s.URL, diskCacheBodyExt), s.Body); err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path(s.URL, diskCacheMetaExt), meta)
+}
+
+func (d diskCache) clear() error {
+	if d == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(string(d))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		if name := e.Name(); strings.HasSuffix(name, diskCacheBodyExt) || strings.HasSuffix(name, diskCacheMetaExt) {
+			errs = append(errs, os.Remove(filepath.Join(string(d), name)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
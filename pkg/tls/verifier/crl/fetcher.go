@@ -0,0 +1,21 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import "context"
+
+// Fetcher retrieves the raw PEM or DER encoded CRL published at a distribution
+// point URL. It allows plugging in custom transports, such as corporate proxies,
+// object storage or mocks. Transient failures should wrap ErrCRLUnavailable.
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) ([]byte, error)
+}
+
+// FetcherFunc is an adapter to allow the use of ordinary functions as Fetcher.
+type FetcherFunc func(ctx context.Context, url string) ([]byte, error)
+
+// Fetch calls f(ctx, url).
+func (f FetcherFunc) Fetch(ctx context.Context, url string) ([]byte, error) {
+	return f(ctx, url)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+)
+
+var errFileDistPoint = errors.New("file CRL distribution point must not name a remote host")
+
+// isLocalDistPoint reports whether the distribution point is a file:// URL or
+// a local path. Local distribution points are only read when configured in
+// CRL_DISTRIBUTION_POINTS, never when announced by a peer certificate.
+func isLocalDistPoint(dp string) bool {
+	u, err := url.Parse(dp)
+	return err == nil && (u.Scheme == "file" || u.Scheme == "")
+}
+
+// remoteDistPoints returns the distribution points which are not local.
+func remoteDistPoints(dps []string) []string {
+	var remote []string
+	for _, dp := range dps {
+		if !isLocalDistPoint(dp) {
+			remote = append(remote, dp)
+		}
+	}
+	return remote
+}
+
+// fetchFile reads the CRL of a file:// URL or local path, such as a CRL kept
+// up to date on disk by an external process.
+func (c *Config) fetchFile(u *url.URL) ([]byte, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, errFileDistPoint
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	body, err := readFileLimited(filepath.FromSlash(path), c.CRLMaxSize)
+	if err != nil && !errors.Is(err, errCRLTooLarge) {
+		// The file may be missing while it is being replaced by the external process.
+		return nil, errors.Join(errRetrieveCRL, ErrCRLUnavailable, err)
+	}
+	return body, err
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	errCRLHTTPCA    = errors.New("failed to load CRL HTTP CA file")
+	errCRLHTTPCAPEM = errors.New("no certificates found in CRL HTTP CA file")
+)
+
+// newHTTPClient builds the client used to download CRLs, honouring the
+// configured proxy and CA bundle.
+func (c *Config) newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CRLHTTPProxy.String() != "" {
+		transport.Proxy = http.ProxyURL(&c.CRLHTTPProxy)
+	}
+	if c.CRLHTTPCAFile != "" {
+		rootCAs, err := loadCertPool(c.CRLHTTPCAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// httpClient returns the client used to download CRLs.
+func (c *Config) httpClient() *http.Client {
+	if c.client != nil {
+		return c.client
+	}
+	return http.DefaultClient
+}
+
+// rootCAs returns the CA bundle used to verify HTTPS and LDAPS distribution points,
+// or nil to use the system roots.
+func (c *Config) rootCAs() *x509.CertPool {
+	if c.client == nil {
+		return nil
+	}
+	if t, ok := c.client.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		return t.TLSClientConfig.RootCAs
+	}
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Join(errCRLHTTPCA, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errCRLHTTPCAPEM
+	}
+	return pool, nil
+}
+
+// retry calls fetch until it succeeds, fails with an error other than
+// ErrCRLUnavailable or CRLHTTPRetries retries are exhausted. The delay between
+// attempts starts at CRLHTTPRetryBackoff and doubles after every attempt.
+func (c *Config) retry(ctx context.Context, fetch func() (storedCRL, error)) (storedCRL, error) {
+	backoff := c.CRLHTTPRetryBackoff
+	for attempt := uint(0); ; attempt++ {
+		crl, err := fetch()
+		if err == nil || attempt >= c.CRLHTTPRetries || !errors.Is(err, ErrCRLUnavailable) {
+			return crl, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return storedCRL{}, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+var oidIssuingDistributionPoint = asn1.ObjectIdentifier{2, 5, 29, 28}
+
+var (
+	errIDP      = errors.New("failed to parse issuing distribution point extension")
+	errCRLScope = errors.New("CRL does not cover the certificate")
+)
+
+type issuingDistributionPoint struct {
+	DistributionPoint          distributionPointName `asn1:"optional,tag:0"`
+	OnlyContainsUserCerts      bool                  `asn1:"optional,tag:1"`
+	OnlyContainsCACerts        bool                  `asn1:"optional,tag:2"`
+	OnlySomeReasons            asn1.BitString        `asn1:"optional,tag:3"`
+	IndirectCRL                bool                  `asn1:"optional,tag:4"`
+	OnlyContainsAttributeCerts bool                  `asn1:"optional,tag:5"`
+}
+
+// checkScope verifies that the Issuing Distribution Point extension of the CRL,
+// if any, covers the certificate as described in RFC 5280 6.3.3 (b.2), so that
+// a partitioned CRL is never mistaken for the complete CRL of the issuer.
+// CRLs partitioned by revocation reason are rejected, as they cannot prove on
+// their own that the certificate is not revoked.
+func checkScope(cert *x509.Certificate, crl *x509.RevocationList) error {
+	idp, ok, err := parseIDP(crl.Extensions)
+	if err != nil || !ok {
+		return err
+	}
+	isCA := cert.BasicConstraintsValid && cert.IsCA
+	switch {
+	case idp.OnlyContainsUserCerts && isCA:
+		return fmt.Errorf("%w: CRL only contains end entity certificates", errCRLScope)
+	case idp.OnlyContainsCACerts && !isCA:
+		return fmt.Errorf("%w: CRL only contains CA certificates", errCRLScope)
+	case idp.OnlyContainsAttributeCerts:
+		return fmt.Errorf("%w: CRL only contains attribute certificates", errCRLScope)
+	case idp.OnlySomeReasons.BitLength > 0:
+		return fmt.Errorf("%w: CRL only covers some revocation reasons", errCRLScope)
+	}
+	// The distribution point only needs to match the one of the certificate,
+	// if it has one, so that the CRLs of the certificates without it, set
+	// with the distribution points or the offline CRL of the configuration,
+	// still apply.
+	if len(idp.DistributionPoint.FullName) == 0 || len(cert.CRLDistributionPoints) == 0 {
+		return nil
+	}
+	for _, name := range idp.DistributionPoint.FullName {
+		if name.Class != asn1.ClassContextSpecific || name.Tag != uriNameTag {
+			continue
+		}
+		for _, dp := range cert.CRLDistributionPoints {
+			if dp == string(name.Bytes) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: CRL distribution point does not match the certificate", errCRLScope)
+}
+
+// parseIDP returns the Issuing Distribution Point extension and whether it is present.
+func parseIDP(exts []pkix.Extension) (issuingDistributionPoint, bool, error) {
+	var idp issuingDistributionPoint
+	for _, ext := range exts {
+		if !ext.Id.Equal(oidIssuingDistributionPoint) {
+			continue
+		}
+		if rest, err := asn1.Unmarshal(ext.Value, &idp); err != nil || len(rest) > 0 {
+			return idp, false, errors.Join(errIDP, err)
+		}
+		return idp, true, nil
+	}
+	return idp, false, nil
+}
+
+// idpValue returns the raw Issuing Distribution Point extension, or nil.
+func idpValue(exts []pkix.Extension) []byte {
+	for _, ext := range exts {
+		if ext.Id.Equal(oidIssuingDistributionPoint) {
+			return ext.Value
+		}
+	}
+	return nil
+}
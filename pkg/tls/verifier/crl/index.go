@@ -0,0 +1,64 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"crypto/x509"
+	"math/big"
+	"sync"
+)
+
+// revocationList is a parsed CRL with its revoked certificate entries indexed
+// by serial number, so that lookups do not scan the whole CRL on every handshake.
+type revocationList struct {
+	*x509.RevocationList
+	revoked map[string][]int
+
+	// source is the distribution point URL or file the CRL was loaded from.
+	// The first deltaEntries entries of a merged CRL come from deltaSource.
+	source       string
+	deltaSource  string
+	deltaEntries int
+
+	// merged memoizes the result of merging this delta CRL into a base CRL.
+	mu           sync.Mutex
+	mergedBase   *revocationList
+	mergedResult *revocationList
+}
+
+func newRevocationList(rl *x509.RevocationList) *revocationList {
+	revoked := make(map[string][]int, len(rl.RevokedCertificateEntries))
+	for i, e := range rl.RevokedCertificateEntries {
+		key := string(e.SerialNumber.Bytes())
+		revoked[key] = append(revoked[key], i)
+	}
+	return &revocationList{RevocationList: rl, revoked: revoked}
+}
+
+// revokedEntry is a revoked certificate entry along with the source of its CRL.
+type revokedEntry struct {
+	x509.RevocationListEntry
+	source string
+}
+
+// lookup returns the revoked certificate entries with the given serial number.
+func (rl *revocationList) lookup(serial *big.Int) []revokedEntry {
+	idx := rl.revoked[string(serial.Bytes())]
+	if len(idx) == 0 {
+		return nil
+	}
+	entries := make([]revokedEntry, 0, len(idx))
+	for _, i := range idx {
+		e := rl.RevokedCertificateEntries[i]
+		if e.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		source := rl.source
+		if i < rl.deltaEntries {
+			source = rl.deltaSource
+		}
+		entries = append(entries, revokedEntry{RevocationListEntry: e, source: source})
+	}
+	return entries
+}
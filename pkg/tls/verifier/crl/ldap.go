@@ -0,0 +1,333 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// LDAP protocol operation tags, RFC 4511.
+const (
+	ldapBindRequest      = 0
+	ldapBindResponse     = 1
+	ldapUnbindRequest    = 2
+	ldapSearchRequest    = 3
+	ldapSearchResultEnt  = 4
+	ldapSearchResultDone = 5
+
+	ldapVersion        = 3
+	ldapSuccess        = 0
+	ldapDefaultPort    = "389"
+	ldapsDefaultPort   = "636"
+	ldapDefaultCRLAttr = "certificateRevocationList;binary"
+
+	berClassUniversal   = 0x00
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berCompound         = 0x20
+
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x10
+)
+
+var (
+	errLDAPURL      = errors.New("invalid LDAP CRL distribution point URL")
+	errLDAPBind     = errors.New("LDAP bind failed")
+	errLDAPSearch   = errors.New("LDAP search failed")
+	errLDAPResponse = errors.New("malformed LDAP response")
+	errLDAPNoCRL    = errors.New("LDAP entry has no CRL attribute")
+)
+
+// fetchLDAP retrieves a CRL from an ldap:// or ldaps:// distribution point.
+// The URL path holds the DN of the entry and the first query component the
+// attribute to read, as defined in RFC 4516.
+func (c *Config) fetchLDAP(ctx context.Context, u *url.URL) ([]byte, error) {
+	dn, err := url.PathUnescape(strings.TrimPrefix(u.Path, "/"))
+	if err != nil || dn == "" {
+		return nil, errLDAPURL
+	}
+	attr := ldapDefaultCRLAttr
+	if q := strings.SplitN(u.RawQuery, "?", 2); q[0] != "" {
+		if attr, err = url.QueryUnescape(q[0]); err != nil {
+			return nil, errors.Join(errLDAPURL, err)
+		}
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := ldapDefaultPort
+		if u.Scheme == "ldaps" {
+			port = ldapsDefaultPort
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if u.Scheme == "ldaps" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), RootCAs: c.rootCAs()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	lc := ldapConn{w: conn, r: bufio.NewReader(conn), maxSize: c.CRLMaxSize}
+	if err := lc.bind(c.CRLLDAPBindDN, c.CRLLDAPBindPassword); err != nil {
+		return nil, err
+	}
+	crl, err := lc.search(dn, attr)
+	if err != nil {
+		return nil, err
+	}
+	_ = lc.unbind()
+	return crl, nil
+}
+
+// ldapConn is a minimal LDAPv3 client supporting simple bind and base object search.
+type ldapConn struct {
+	w       io.Writer
+	r       *bufio.Reader
+	msgID   int
+	maxSize int64
+}
+
+func (lc *ldapConn) send(op []byte) error {
+	lc.msgID++
+	msg := berEncode(berClassUniversal|berCompound|berTagSequence, append(berInteger(berTagInteger, lc.msgID), op...))
+	_, err := lc.w.Write(msg)
+	return err
+}
+
+// receive reads the next LDAP message and returns its protocol operation.
+func (lc *ldapConn) receive() (berElement, error) {
+	msg, err := readBER(lc.r, lc.maxSize)
+	if err != nil {
+		return berElement{}, err
+	}
+	children, err := msg.children()
+	if err != nil || len(children) < 2 {
+		return berElement{}, errLDAPResponse
+	}
+	return children[1], nil
+}
+
+func (lc *ldapConn) bind(dn, password string) error {
+	req := berSequence(berClassApplication|berCompound|ldapBindRequest,
+		berInteger(berTagInteger, ldapVersion),
+		berEncode(berTagOctetString, []byte(dn)),
+		berEncode(berClassContext|0, []byte(password)),
+	)
+	if err := lc.send(req); err != nil {
+		return err
+	}
+	op, err := lc.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != berClassApplication|berCompound|ldapBindResponse {
+		return errLDAPResponse
+	}
+	if err := ldapResult(op); err != nil {
+		return errors.Join(errLDAPBind, err)
+	}
+	return nil
+}
+
+func (lc *ldapConn) search(dn, attr string) ([]byte, error) {
+	req := berSequence(berClassApplication|berCompound|ldapSearchRequest,
+		berEncode(berTagOctetString, []byte(dn)),
+		berInteger(berTagEnumerated, 0), // baseObject scope
+		berInteger(berTagEnumerated, 0), // neverDerefAliases
+		berInteger(berTagInteger, 0),    // no size limit
+		berInteger(berTagInteger, 0),    // no time limit
+		berEncode(berTagBoolean, []byte{0}),
+		berEncode(berClassContext|7, []byte("objectClass")), // (objectClass=*)
+		berSequence(berClassUniversal|berCompound|berTagSequence, berEncode(berTagOctetString, []byte(attr))),
+	)
+	if err := lc.send(req); err != nil {
+		return nil, err
+	}
+
+	var crl []byte
+	for {
+		op, err := lc.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case berClassApplication | berCompound | ldapSearchResultEnt:
+			if crl == nil {
+				crl = ldapAttribute(op, attr)
+			}
+		case berClassApplication | berCompound | ldapSearchResultDone:
+			if err := ldapResult(op); err != nil {
+				return nil, errors.Join(errLDAPSearch, err)
+			}
+			if crl == nil {
+				return nil, errLDAPNoCRL
+			}
+			return crl, nil
+		}
+	}
+}
+
+func (lc *ldapConn) unbind() error {
+	return lc.send(berEncode(berClassApplication|ldapUnbindRequest, nil))
+}
+
+// ldapResult returns an error if the LDAPResult in op is not a success.
+func ldapResult(op berElement) error {
+	children, err := op.children()
+	if err != nil || len(children) < 3 {
+		return errLDAPResponse
+	}
+	if code := children[0].int(); code != ldapSuccess {
+		return fmt.Errorf("result code %d: %s", code, children[2].value)
+	}
+	return nil
+}
+
+// ldapAttribute returns the first value of attr in a SearchResultEntry.
+func ldapAttribute(entry berElement, attr string) []byte {
+	children, err := entry.children()
+	if err != nil || len(children) < 2 {
+		return nil
+	}
+	attrs, err := children[1].children()
+	if err != nil {
+		return nil
+	}
+	for _, a := range attrs {
+		parts, err := a.children()
+		if err != nil || len(parts) < 2 || !strings.EqualFold(string(parts[0].value), attr) {
+			continue
+		}
+		vals, err := parts[1].children()
+		if err != nil || len(vals) == 0 {
+			continue
+		}
+		return vals[0].value
+	}
+	return nil
+}
+
+// berElement is a decoded BER element with a single byte tag.
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+func (e berElement) children() ([]berElement, error) {
+	var elems []berElement
+	r := bufio.NewReader(bytes.NewReader(e.value))
+	for {
+		child, err := readBER(r, 0)
+		if err == io.EOF {
+			return elems, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, child)
+	}
+}
+
+func (e berElement) int() int {
+	var n int
+	for _, b := range e.value {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// readBER reads a single BER element. A maxSize greater than zero limits the element length.
+func readBER(r *bufio.Reader, maxSize int64) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, errLDAPResponse
+	}
+	length := int(l)
+	if l&0x80 != 0 {
+		n := int(l & 0x7f)
+		if n == 0 || n > 4 {
+			return berElement{}, errLDAPResponse
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, errLDAPResponse
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if maxSize > 0 && int64(length) > maxSize {
+		return berElement{}, errCRLTooLarge
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return berElement{}, errLDAPResponse
+	}
+	return berElement{tag: tag, value: value}, nil
+}
+
+func berEncode(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	switch l := len(value); {
+	case l < 0x80:
+		b = append(b, byte(l))
+	case l <= 0xff:
+		b = append(b, 0x81, byte(l))
+	case l <= 0xffff:
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	default:
+		b = append(b, 0x84, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(b, value...)
+}
+
+func berSequence(tag byte, elems ...[]byte) []byte {
+	var value []byte
+	for _, e := range elems {
+		value = append(value, e...)
+	}
+	return berEncode(tag, value)
+}
+
+func berInteger(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berEncode(tag, b)
+}
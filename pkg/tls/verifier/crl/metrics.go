@@ -0,0 +1,52 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics receives CRL verification events, so that they can be exported to a
+// monitoring system such as Prometheus. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// FetchObserved is called after every download of a CRL from a distribution
+	// point, including retries, with its latency and resulting error.
+	FetchObserved(url string, latency time.Duration, err error)
+	// CacheHit is called when a CRL is served from the in-memory cache.
+	CacheHit(url string)
+	// CacheMiss is called when a CRL is not in the in-memory cache.
+	CacheMiss(url string)
+	// CertificateRevoked is called when a certificate is rejected because it
+	// is listed in a CRL, with the name of the revocation reason.
+	CertificateRevoked(reason string)
+	// VerificationFailed is called when a certificate chain is rejected for
+	// any reason other than revocation, such as an unavailable or invalid CRL.
+	VerificationFailed(err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) FetchObserved(string, time.Duration, error) {}
+func (nopMetrics) CacheHit(string)                            {}
+func (nopMetrics) CacheMiss(string)                           {}
+func (nopMetrics) CertificateRevoked(string)                  {}
+func (nopMetrics) VerificationFailed(error)                   {}
+
+func (c *Config) metrics() Metrics {
+	if c.Metrics != nil {
+		return c.Metrics
+	}
+	return nopMetrics{}
+}
+
+// observe reports the result of a verification to Metrics and returns err.
+// Revocations are reported where they are detected, along with their reason.
+func (c *Config) observe(err error) error {
+	if err != nil && !errors.Is(err, ErrCertRevoked) {
+		c.metrics().VerificationFailed(err)
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offlineCRLs indexes the offline CRLs by the DER encoded name of their issuer.
+type offlineCRLs map[string]*revocationList
+
+// forCert returns the offline CRL issued by the issuer of the certificate.
+func (o offlineCRLs) forCert(cert *x509.Certificate) *revocationList {
+	return o[string(cert.RawIssuer)]
+}
+
+// loadOfflineCRLs loads the CRLs listed in OfflineCRLFile, a comma separated
+// list of CRL files and directories containing CRL files. Unless signature
+// verification is skipped, each CRL must be signed by one of the certificates
+// in OfflineCRLIssuerCertFile.
+func (c *Config) loadOfflineCRLs(t *Timings) (offlineCRLs, error) {
+	start := t.start()
+	files, err := listFiles(c.OfflineCRLFile)
+	if err != nil {
+		return nil, errors.Join(errOfflineCRLLoad, err)
+	}
+	version, err := filesVersion(append(files, splitList(c.OfflineCRLIssuerCertFile)...))
+	if err != nil {
+		return nil, errors.Join(errOfflineCRLLoad, err)
+	}
+	if crls, ok := c.offline.get(version); ok {
+		t.track(fetchPhase, start)
+		return crls, nil
+	}
+	var crlsBytes [][]byte
+	for _, file := range files {
+		b, err := readFileLimited(file, c.CRLMaxSize)
+		if err != nil {
+			return nil, errors.Join(errOfflineCRLLoad, err)
+		}
+		crlsBytes = append(crlsBytes, b)
+	}
+	t.track(fetchPhase, start)
+	if len(crlsBytes) == 0 {
+		return nil, nil
+	}
+
+	var issuers []*x509.Certificate
+	if !c.OfflineCRLSkipSignatureVerify {
+		if issuers, err = c.loadOfflineCRLIssuerCerts(); err != nil {
+			return nil, err
+		}
+		if len(issuers) == 0 {
+			return nil, errOfflineCRLNoIssuer
+		}
+	}
+
+	crls := make(offlineCRLs, len(crlsBytes))
+	for i, b := range crlsBytes {
+		crl, err := c.parseVerifyOfflineCRL(b, issuers, t)
+		if err != nil {
+			return nil, fmt.Errorf("offline CRL file %s: %w", files[i], err)
+		}
+		crl.source = files[i]
+		crls[string(crl.RawIssuer)] = crl
+	}
+	c.offline.set(version, crls)
+	return crls, nil
+}
+
+// offlineCache keeps the loaded offline CRLs, and their indexes, until one of
+// the files they were loaded from changes or one of the CRLs expires.
+type offlineCache struct {
+	mu      sync.Mutex
+	version string
+	crls    offlineCRLs
+}
+
+func (oc *offlineCache) get(version string) (offlineCRLs, bool) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.version != version {
+		return nil, false
+	}
+	now := time.Now()
+	for _, crl := range oc.crls {
+		if crl.NextUpdate.Before(now) {
+			return nil, false
+		}
+	}
+	return oc.crls, true
+}
+
+func (oc *offlineCache) set(version string, crls offlineCRLs) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.version, oc.crls = version, crls
+}
+
+// filesVersion returns a string which changes when any of the files is modified.
+func filesVersion(files []string) (string, error) {
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+func (c *Config) parseVerifyOfflineCRL(crlBytes []byte, issuers []*x509.Certificate, t *Timings) (*revocationList, error) {
+	crl, err := parseVerifyCRL(crlBytes, nil, false, t)
+	if err != nil || c.OfflineCRLSkipSignatureVerify {
+		return crl, err
+	}
+	for _, issuer := range issuers {
+		if string(issuer.RawSubject) != string(crl.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			return nil, errors.Join(errCRLSign, err)
+		}
+		return crl, nil
+	}
+	return nil, errOfflineCRLNoMatch
+}
+
+// loadOfflineCRLIssuerCerts loads all PEM certificates from the comma separated
+// list of files in OfflineCRLIssuerCertFile.
+func (c *Config) loadOfflineCRLIssuerCerts() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, file := range splitList(c.OfflineCRLIssuerCertFile) {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Join(errOfflineCRLIssuer, err)
+		}
+		var block *pem.Block
+		found := false
+		for {
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Join(errOfflineCRLIssuer, err)
+			}
+			certs, found = append(certs, cert), true
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", errOfflineCRLIssuerPEM, file)
+		}
+	}
+	return certs, nil
+}
+
+func readFileLimited(path string, maxSize int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readLimited(f, info.Size(), maxSize)
+}
+
+// listFiles expands a comma separated list of files and directories into files.
+func listFiles(list string) ([]string, error) {
+	var files []string
+	for _, path := range splitList(list) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
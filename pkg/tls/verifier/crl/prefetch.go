@@ -0,0 +1,94 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errPrefetchInterval = errors.New("CRL prefetch interval must be positive")
+	errPrefetchRunning  = errors.New("CRL prefetch worker already running")
+)
+
+// prefetcher holds the state of the background CRL refresh worker.
+type prefetcher struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start launches a background worker which, every CRLPrefetchInterval, downloads
+// the configured distribution point and refreshes cached CRLs expiring before the
+// next run, so TLS handshakes do not block on CRL downloads. The worker runs until
+// ctx is canceled or Stop is called. The TLS listeners start it with their
+// context when CRLPrefetchInterval is set.
+func (c *Config) Start(ctx context.Context) error {
+	if c.CRLPrefetchInterval <= 0 {
+		return errPrefetchInterval
+	}
+	c.prefetch.mu.Lock()
+	defer c.prefetch.mu.Unlock()
+	if c.prefetch.cancel != nil {
+		return errPrefetchRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.prefetch.cancel = cancel
+	c.prefetch.done = done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(c.CRLPrefetchInterval)
+		defer ticker.Stop()
+		for {
+			c.prefetchCRLs(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the background worker started by Start and waits for it to exit.
+func (c *Config) Stop() {
+	c.prefetch.mu.Lock()
+	cancel, done := c.prefetch.cancel, c.prefetch.done
+	c.prefetch.cancel, c.prefetch.done = nil, nil
+	c.prefetch.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (c *Config) prefetchCRLs(ctx context.Context) {
+	urls := c.cache.expiring(c.CRLPrefetchInterval)
+	if len(c.CRLDistributionPointsIssuerCertFile) > 0 {
+		// Only the preferred distribution point is prefetched, the fallbacks
+		// are fetched on demand when it is unavailable.
+		if dps, err := c.configuredDistPoints(); err == nil && len(dps) > 0 {
+			dp := dps[0]
+			_, cached := c.cache.get(dp.url, dp.issuer)
+			if _, expiring := urls[dp.url]; !cached || expiring {
+				urls[dp.url] = dp.issuer
+			}
+		}
+	}
+	for url, issuer := range urls {
+		if ctx.Err() != nil {
+			return
+		}
+		// Failures are ignored, the CRL is fetched again on the next handshake
+		// or prefetch run while the cached copy stays valid until it expires.
+		_, _ = c.cache.refresh(url, issuer, c.cacheExpiry, c.fetchVerifyCRL(ctx, url, issuer, true, false, nil), true)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidReason = errors.New("invalid CRL revocation reason")
+
+// reasonCodes maps the CRLReason names of RFC 5280 section 5.3.1 to their codes.
+var reasonCodes = map[string]int{
+	"unspecified":          0,
+	"keycompromise":        1,
+	"cacompromise":         2,
+	"affiliationchanged":   3,
+	"superseded":           4,
+	"cessationofoperation": 5,
+	"certificatehold":      6,
+	"removefromcrl":        8,
+	"privilegewithdrawn":   9,
+	"aacompromise":         10,
+}
+
+var reasonNames = map[int]string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "cACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "aACompromise",
+}
+
+// parseReason parses a revocation reason given by name, case insensitive, or by numeric code.
+func parseReason(reason string) (int, error) {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if code, ok := reasonCodes[reason]; ok {
+		return code, nil
+	}
+	code, err := strconv.Atoi(reason)
+	if err != nil {
+		return 0, errors.Join(errInvalidReason, err)
+	}
+	if _, ok := reasonNames[code]; !ok {
+		return 0, errInvalidReason
+	}
+	return code, nil
+}
+
+// reasonName returns the RFC 5280 name of a revocation reason code.
+func reasonName(code int) string {
+	if name, ok := reasonNames[code]; ok {
+		return name
+	}
+	return strconv.Itoa(code)
+}
+
+func (c *Config) validateIgnoredReasons() error {
+	for _, r := range c.CRLIgnoredReasons {
+		if _, err := parseReason(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reasonIgnored reports whether revocations with the given reason code are allowed by CRLIgnoredReasons.
+func (c *Config) reasonIgnored(code int) bool {
+	for _, r := range c.CRLIgnoredReasons {
+		if ignored, err := parseReason(r); err == nil && ignored == code {
+			return true
+		}
+	}
+	return false
+}
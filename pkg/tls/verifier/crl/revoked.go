@@ -0,0 +1,34 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package crl
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// RevokedError is returned when a certificate is listed in a CRL.
+// It wraps ErrCertRevoked.
+type RevokedError struct {
+	SerialNumber   *big.Int
+	RevocationTime time.Time
+	ReasonCode     int
+	// Source is the distribution point URL or the offline CRL file listing the certificate.
+	Source string
+}
+
+func (e *RevokedError) Error() string {
+	return fmt.Sprintf("%s with serial number %x at %s, reason %s, listed in %s",
+		ErrCertRevoked, e.SerialNumber, e.RevocationTime.Format(time.RFC3339), e.Reason(), e.Source)
+}
+
+func (e *RevokedError) Unwrap() error {
+	return ErrCertRevoked
+}
+
+// Reason returns the RFC 5280 name of the revocation reason, such as keyCompromise.
+func (e *RevokedError) Reason() string {
+	return reasonName(e.ReasonCode)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package ocsp
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// sweepInterval is the number of insertions after which expired entries are removed.
+const sweepInterval = 1024
+
+// cache keeps good and revoked OCSP responses in memory, keyed by the issuer
+// key and serial number of the certificate, until their expiry.
+type cache struct {
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+	inserts int
+}
+
+type cacheEntry struct {
+	resp    *ocsp.Response
+	expires time.Time
+}
+
+// cacheKey identifies a certificate by the hash of its issuer public key and its serial number.
+func cacheKey(cert, issuer *x509.Certificate) string {
+	h := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	return string(h[:]) + string(cert.SerialNumber.Bytes())
+}
+
+func (c *cache) get(key string) (*ocsp.Response, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.resp, true
+}
+
+// set caches a good or revoked response until expires. Other responses and
+// responses which already expired are not cached.
+func (c *cache) set(key string, resp *ocsp.Response, expires time.Time) {
+	if (resp.Status != ocsp.Good && resp.Status != ocsp.Revoked) || !time.Now().Before(expires) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[key] = cacheEntry{resp: resp, expires: expires}
+	if c.inserts++; c.inserts%sweepInterval == 0 {
+		now := time.Now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+}
+
+func (c *cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// cacheExpiry returns the time until which the response may be cached: its
+// NextUpdate, bounded by OCSPCacheMaxTTL. Responses without NextUpdate are
+// only cached for OCSPCacheMaxTTL.
+func (c *Config) cacheExpiry(resp *ocsp.Response) time.Time {
+	var expires time.Time
+	if c.OCSPCacheMaxTTL > 0 {
+		expires = time.Now().Add(c.OCSPCacheMaxTTL)
+	}
+	if !resp.NextUpdate.IsZero() && (expires.IsZero() || resp.NextUpdate.Before(expires)) {
+		expires = resp.NextUpdate
+	}
+	return expires
+}
+
+// ClearCache removes all cached OCSP responses, so that the next handshake of
+// every certificate queries the responder again.
+func (c *Config) ClearCache() {
+	c.cache.clear()
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package ocsp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// nonceSize is the length of the nonce sent in OCSP requests, RFC 8954 2.1.
+const nonceSize = 32
+
+var oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+var (
+	errOCSPNonce        = errors.New("OCSP response nonce does not match the request")
+	errOCSPNonceMissing = errors.New("OCSP response does not contain the request nonce")
+)
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version           int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+// addNonce adds a random nonce extension to the DER encoded OCSP request and
+// returns the new request along with the encoded nonce.
+func addNonce(der []byte) ([]byte, []byte, error) {
+	var req ocspRequest
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, nil, err
+	}
+	n := make([]byte, nonceSize)
+	if _, err := rand.Read(n); err != nil {
+		return nil, nil, err
+	}
+	nonce, err := asn1.Marshal(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.TBSRequest.RequestExtensions = append(req.TBSRequest.RequestExtensions, pkix.Extension{Id: oidOCSPNonce, Value: nonce})
+	der, err = asn1.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, nonce, nil
+}
+
+// checkNonce verifies that a nonce echoed in the response matches the one sent.
+// Unless required, responses without a nonce, such as pre-signed responses,
+// are accepted.
+func checkNonce(resp *ocsp.Response, nonce []byte, required bool) error {
+	if nonce == nil {
+		return nil
+	}
+	for _, ext := range resp.Extensions {
+		if !ext.Id.Equal(oidOCSPNonce) {
+			continue
+		}
+		if !bytes.Equal(ext.Value, nonce) {
+			return errOCSPNonce
+		}
+		return nil
+	}
+	if required {
+		return errOCSPNonceMissing
+	}
+	return nil
+}
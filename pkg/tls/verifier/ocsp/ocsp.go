@@ -5,6 +5,7 @@ package ocsp
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -14,12 +15,17 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/absmach/mproxy/pkg/tls/verifier"
 	"github.com/caarlos0/env/v11"
 	"golang.org/x/crypto/ocsp"
 )
 
+// ErrCertRevoked is wrapped by the error returned for revoked certificates. It
+// is the same error as verifier.ErrCertRevoked.
+var ErrCertRevoked = verifier.ErrCertRevoked
+
 var (
 	errParseIssuerCrt       = errors.New("failed to parse issuer certificate")
 	errCreateOCSPReq        = errors.New("failed to create OCSP Request")
@@ -32,7 +38,6 @@ var (
 	errNoOCSPURL            = errors.New("neither OCSP Server/Responder URL is not present AIA of certificate nor environmental variable OCSP_RESPONDER_URL have value")
 	errOCSPServerFailed     = errors.New("OCSP Server Failed")
 	errOCSPUnknown          = errors.New("OCSP status unknown")
-	errCertRevoked          = errors.New("certificate revoked")
 	errRetrieveIssuerCrt    = errors.New("failed to retrieve issuer certificate")
 	errReadIssuerCrt        = errors.New("failed to read issuer certificate")
 	errIssuerCrtPEM         = errors.New("failed to decode issuer certificate PEM")
@@ -41,41 +46,52 @@ var (
 	errClientCrt = errors.New("client certificate not received")
 )
 
-type config struct {
-	OCSPDepth        uint    `env:"OCSP_DEPTH"         envDefault:"0"`
-	OCSPResponderURL url.URL `env:"OCSP_RESPONDER_URL" envDefault:""`
+// Config represents OCSP verifier configuration.
+type Config struct {
+	OCSPDepth            uint          `env:"OCSP_DEPTH"             envDefault:"0"`
+	OCSPResponderURL     []url.URL     `env:"OCSP_RESPONDER_URL"     envDefault:""`
+	OCSPTimeout          time.Duration `env:"OCSP_TIMEOUT"           envDefault:"5s"`
+	OCSPResponderTimeout time.Duration `env:"OCSP_RESPONDER_TIMEOUT" envDefault:"2s"`
+	OCSPNonce            bool          `env:"OCSP_NONCE"             envDefault:"false"`
+	OCSPNonceRequired    bool          `env:"OCSP_NONCE_REQUIRED"    envDefault:"false"`
+	OCSPVerifyResponder  bool          `env:"OCSP_VERIFY_RESPONDER"  envDefault:"false"`
+	OCSPCacheMaxTTL      time.Duration `env:"OCSP_CACHE_MAX_TTL"     envDefault:"1h"`
+
+	cache cache
 }
 
-var _ verifier.Verifier = (*config)(nil)
+var _ verifier.Verifier = (*Config)(nil)
 
-func New(opts env.Options) (verifier.Verifier, error) {
-	var c config
+func New(opts env.Options) (*Config, error) {
+	var c Config
 	if err := env.ParseWithOptions(&c, opts); err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-func (c *config) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+func (c *Config) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	// The TLS handshake does not provide a context, requests are bounded by OCSPTimeout instead.
+	ctx := context.Background()
 	switch {
 	case len(verifiedChains) > 0:
-		return c.VerifyVerifiedPeerCertificates(verifiedChains)
+		return c.VerifyVerifiedPeerCertificates(ctx, verifiedChains)
 	case len(rawCerts) > 0:
 		var peerCertificates []*x509.Certificate
 		peerCertificates, err := parseCertificates(rawCerts)
 		if err != nil {
 			return err
 		}
-		return c.VerifyRawPeerCertificates(peerCertificates)
+		return c.VerifyRawPeerCertificates(ctx, peerCertificates)
 	default:
 		return errClientCrt
 	}
 }
 
-func (c *config) VerifyRawPeerCertificates(peerCertificates []*x509.Certificate) error {
+func (c *Config) VerifyRawPeerCertificates(ctx context.Context, peerCertificates []*x509.Certificate) error {
 	for i, peerCertificate := range peerCertificates {
 		issuer := retrieveIssuerCert(peerCertificate.Issuer, peerCertificates)
-		if err := c.ocspVerify(peerCertificate, issuer); err != nil {
+		if err := c.ocspVerify(ctx, peerCertificate, issuer); err != nil {
 			return err
 		}
 		if i+1 == int(c.OCSPDepth) {
@@ -85,7 +101,7 @@ func (c *config) VerifyRawPeerCertificates(peerCertificates []*x509.Certificate)
 	return nil
 }
 
-func (c *config) VerifyVerifiedPeerCertificates(verifiedPeerCertificateChains [][]*x509.Certificate) error {
+func (c *Config) VerifyVerifiedPeerCertificates(ctx context.Context, verifiedPeerCertificateChains [][]*x509.Certificate) error {
 	for _, verifiedChain := range verifiedPeerCertificateChains {
 		for i := range verifiedChain {
 			cert := verifiedChain[i]
@@ -93,7 +109,7 @@ func (c *config) VerifyVerifiedPeerCertificates(verifiedPeerCertificateChains []
 			if i+1 < len(verifiedChain) {
 				issuer = verifiedChain[i+1]
 			}
-			if err := c.ocspVerify(cert, issuer); err != nil {
+			if err := c.ocspVerify(ctx, cert, issuer); err != nil {
 				return err
 			}
 		}
@@ -101,16 +117,20 @@ func (c *config) VerifyVerifiedPeerCertificates(verifiedPeerCertificateChains []
 	return nil
 }
 
-func (c *config) ocspVerify(peerCertificate, issuerCert *x509.Certificate) error {
-	opts := &ocsp.RequestOptions{Hash: crypto.SHA256}
-	var err error
+func (c *Config) ocspVerify(ctx context.Context, peerCertificate, issuerCert *x509.Certificate) error {
+	if c.OCSPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.OCSPTimeout)
+		defer cancel()
+	}
 
+	var err error
 	if !isRootCA(peerCertificate) {
 		if issuerCert == nil {
 			if len(peerCertificate.IssuingCertificateURL) < 1 {
 				return fmt.Errorf("%w common name %s  and serial number %x", errIssuerCert, peerCertificate.Subject.CommonName, peerCertificate.SerialNumber)
 			}
-			issuerCert, err = retrieveIssuingCertificate(peerCertificate.IssuingCertificateURL[0])
+			issuerCert, err = retrieveIssuingCertificate(ctx, peerCertificate.IssuingCertificateURL[0])
 			if err != nil {
 				return err
 			}
@@ -119,62 +139,118 @@ func (c *config) ocspVerify(peerCertificate, issuerCert *x509.Certificate) error
 		issuerCert = peerCertificate
 	}
 
+	key := cacheKey(peerCertificate, issuerCert)
+	ocspResponse, ok := c.cache.get(key)
+	if !ok {
+		if ocspResponse, err = c.queryResponder(ctx, peerCertificate, issuerCert); err != nil {
+			return err
+		}
+		c.cache.set(key, ocspResponse, c.cacheExpiry(ocspResponse))
+	}
+	switch ocspResponse.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w command name %s and serial number %x revoked at %v", ErrCertRevoked, peerCertificate.Subject.CommonName, peerCertificate.SerialNumber, ocspResponse.RevokedAt)
+	case ocsp.ServerFailed:
+		return errOCSPServerFailed
+	case ocsp.Unknown:
+		fallthrough
+	default:
+		return errOCSPUnknown
+	}
+}
+
+// queryResponder sends an OCSP request for the certificate to its responder
+// and returns the verified response.
+func (c *Config) queryResponder(ctx context.Context, peerCertificate, issuerCert *x509.Certificate) (*ocsp.Response, error) {
+	opts := &ocsp.RequestOptions{Hash: crypto.SHA256}
 	buffer, err := ocsp.CreateRequest(peerCertificate, issuerCert, opts)
 	if err != nil {
-		return errors.Join(errCreateOCSPReq, err)
+		return nil, errors.Join(errCreateOCSPReq, err)
+	}
+	var nonce []byte
+	if c.OCSPNonce || c.OCSPNonceRequired {
+		if buffer, nonce, err = addNonce(buffer); err != nil {
+			return nil, errors.Join(errCreateOCSPReq, err)
+		}
+	}
+
+	responders, err := c.responders(peerCertificate)
+	if err != nil {
+		return nil, err
 	}
+	var errs []error
+	for _, responder := range responders {
+		ocspResponse, err := c.postRequest(ctx, responder, buffer, peerCertificate, issuerCert)
+		if err == nil {
+			err = checkNonce(ocspResponse, nonce, c.OCSPNonceRequired)
+		}
+		if err == nil && c.OCSPVerifyResponder {
+			err = checkResponder(ocspResponse, issuerCert)
+		}
+		if err == nil {
+			return ocspResponse, nil
+		}
+		errs = append(errs, fmt.Errorf("OCSP responder %s: %w", responder, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
 
-	ocspURL := ""
-	ocspURLHost := ""
-	if c.OCSPResponderURL.String() == "" {
-		if len(peerCertificate.OCSPServer) < 1 {
-			return fmt.Errorf("%w common name %s and serial number %x", errNoOCSPURL, peerCertificate.Subject.CommonName, peerCertificate.SerialNumber)
+// responders returns the OCSP responder URLs to try in order: the configured
+// OCSPResponderURL override, or the responders listed in the AIA of the certificate.
+func (c *Config) responders(peerCertificate *x509.Certificate) ([]string, error) {
+	var responders []string
+	for _, u := range c.OCSPResponderURL {
+		if u.String() != "" {
+			responders = append(responders, u.String())
 		}
-		ocspURL = peerCertificate.OCSPServer[0]
-		ocspParsedURL, err := url.Parse(peerCertificate.OCSPServer[0])
-		if err != nil {
-			return errors.Join(errParseOCSPUrl, err)
+	}
+	if len(responders) > 0 {
+		return responders, nil
+	}
+	if len(peerCertificate.OCSPServer) < 1 {
+		return nil, fmt.Errorf("%w common name %s and serial number %x", errNoOCSPURL, peerCertificate.Subject.CommonName, peerCertificate.SerialNumber)
+	}
+	for _, responder := range peerCertificate.OCSPServer {
+		if _, err := url.Parse(responder); err != nil {
+			return nil, errors.Join(errParseOCSPUrl, err)
 		}
-		ocspURLHost = ocspParsedURL.Host
-	} else {
-		ocspURLHost = c.OCSPResponderURL.Host
-		ocspURL = c.OCSPResponderURL.String()
 	}
+	return peerCertificate.OCSPServer, nil
+}
 
-	httpRequest, err := http.NewRequest(http.MethodPost, ocspURL, bytes.NewBuffer(buffer))
+// postRequest sends the OCSP request to a single responder, bounded by OCSPResponderTimeout.
+func (c *Config) postRequest(ctx context.Context, responder string, request []byte, peerCertificate, issuerCert *x509.Certificate) (*ocsp.Response, error) {
+	if c.OCSPResponderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.OCSPResponderTimeout)
+		defer cancel()
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewBuffer(request))
 	if err != nil {
-		return errors.Join(errCreateOCSPHTTPReq, err)
+		return nil, errors.Join(errCreateOCSPHTTPReq, err)
 	}
 	httpRequest.Header.Add("Content-Type", "application/ocsp-request")
 	httpRequest.Header.Add("Accept", "application/ocsp-response")
-	httpRequest.Header.Add("host", ocspURLHost)
 
-	httpClient := &http.Client{}
-	httpResponse, err := httpClient.Do(httpRequest)
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
 	if err != nil {
-		return errors.Join(errOCSPReq, err)
+		return nil, errors.Join(errOCSPReq, err)
 	}
 	defer httpResponse.Body.Close()
 	output, err := io.ReadAll(httpResponse.Body)
 	if err != nil {
-		return errors.Join(errOCSPReadResp, err)
+		return nil, errors.Join(errOCSPReadResp, err)
 	}
 	ocspResponse, err := ocsp.ParseResponseForCert(output, peerCertificate, issuerCert)
 	if err != nil {
-		return errors.Join(errParseOCSPRespForCert, err)
-	}
-	switch ocspResponse.Status {
-	case ocsp.Good:
-		return nil
-	case ocsp.Revoked:
-		return fmt.Errorf("%w command name %s and serial number %x revoked at %v", errCertRevoked, peerCertificate.Subject.CommonName, peerCertificate.SerialNumber, ocspResponse.RevokedAt)
-	case ocsp.ServerFailed:
-		return errOCSPServerFailed
-	case ocsp.Unknown:
-		fallthrough
-	default:
-		return errOCSPUnknown
+		return nil, errors.Join(errParseOCSPRespForCert, err)
 	}
+	return ocspResponse, nil
 }
 
 func retrieveIssuerCert(issuerSubject pkix.Name, certs []*x509.Certificate) *x509.Certificate {
@@ -189,8 +265,12 @@ func retrieveIssuerCert(issuerSubject pkix.Name, certs []*x509.Certificate) *x50
 	return nil
 }
 
-func retrieveIssuingCertificate(issuingCertificateURL string) (*x509.Certificate, error) {
-	resp, err := http.Get(issuingCertificateURL)
+func retrieveIssuingCertificate(ctx context.Context, issuingCertificateURL string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuingCertificateURL, http.NoBody)
+	if err != nil {
+		return nil, errors.Join(errRetrieveIssuerCrt, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, errors.Join(errRetrieveIssuerCrt, err)
 	}
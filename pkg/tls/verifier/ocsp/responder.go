@@ -0,0 +1,47 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package ocsp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	errResponderEKU     = errors.New("delegated OCSP responder certificate lacks the OCSP signing extended key usage")
+	errResponderExpired = errors.New("delegated OCSP responder certificate is not valid at the time the response was produced")
+)
+
+// checkResponder verifies the certificate of a delegated OCSP responder as
+// required by RFC 6960 4.2.2.2: it must carry id-kp-OCSPSigning and be valid
+// when the response was produced. Its issuance by the CA is already verified
+// when the response is parsed. Responses signed by the CA itself need no check.
+func checkResponder(resp *ocsp.Response, issuer *x509.Certificate) error {
+	responder := resp.Certificate
+	if responder == nil || bytes.Equal(responder.Raw, issuer.Raw) {
+		return nil
+	}
+	hasEKU := false
+	for _, eku := range responder.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			hasEKU = true
+			break
+		}
+	}
+	if !hasEKU {
+		return errResponderEKU
+	}
+	producedAt := resp.ProducedAt
+	if producedAt.IsZero() {
+		producedAt = time.Now()
+	}
+	if producedAt.Before(responder.NotBefore) || producedAt.After(responder.NotAfter) {
+		return errResponderExpired
+	}
+	return nil
+}
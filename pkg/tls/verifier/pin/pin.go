@@ -0,0 +1,141 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package pin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/tls/verifier"
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	errNoPinFile  = errors.New("CERT_PIN_FILE is required for certificate pinning")
+	errInvalidPin = errors.New("invalid certificate pin")
+	errClientCrt  = errors.New("client certificate not received")
+	errNotPinned  = errors.New("client certificate is not pinned")
+)
+
+// Config represents certificate pinning verifier configuration. PinFile lists
+// the accepted client certificates, one per line, either as the hex SHA-256
+// fingerprint of the certificate, optionally prefixed with "cert:", or as the
+// hex SHA-256 hash of its public key prefixed with "spki:". Colons between hex
+// bytes and lines starting with # are ignored. PinFile is checked for changes
+// at most once per PinReloadInterval.
+type Config struct {
+	PinFile           string        `env:"CERT_PIN_FILE"            envDefault:""`
+	PinReloadInterval time.Duration `env:"CERT_PIN_RELOAD_INTERVAL" envDefault:"10s"`
+
+	mu      sync.RWMutex
+	certs   map[[sha256.Size]byte]struct{}
+	spkis   map[[sha256.Size]byte]struct{}
+	modTime time.Time
+	checked time.Time
+}
+
+var _ verifier.Verifier = (*Config)(nil)
+
+func New(opts env.Options) (*Config, error) {
+	var c Config
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return nil, err
+	}
+	if c.PinFile == "" {
+		return nil, errNoPinFile
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errClientCrt
+	}
+	c.reload()
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.certs[sha256.Sum256(cert.Raw)]; ok {
+		return nil
+	}
+	if _, ok := c.spkis[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errNotPinned, cert.Subject)
+}
+
+// reload loads the pin file again if it changed since it was last loaded.
+// The previous pins are kept if the file can't be loaded.
+func (c *Config) reload() {
+	c.mu.RLock()
+	due := time.Since(c.checked) >= c.PinReloadInterval
+	c.mu.RUnlock()
+	if !due {
+		return
+	}
+	if err := c.load(); err != nil {
+		slog.Warn("Failed to reload certificate pins", slog.String("file", c.PinFile), slog.Any("error", err))
+	}
+}
+
+func (c *Config) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	info, err := os.Stat(c.PinFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(c.modTime) && c.certs != nil {
+		return nil
+	}
+	b, err := os.ReadFile(c.PinFile)
+	if err != nil {
+		return err
+	}
+	certs, spkis, err := parsePins(b)
+	if err != nil {
+		return err
+	}
+	c.certs, c.spkis, c.modTime = certs, spkis, info.ModTime()
+	return nil
+}
+
+func parsePins(b []byte) (certs, spkis map[[sha256.Size]byte]struct{}, err error) {
+	certs, spkis = make(map[[sha256.Size]byte]struct{}), make(map[[sha256.Size]byte]struct{})
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		pin := strings.TrimSpace(s.Text())
+		if pin == "" || strings.HasPrefix(pin, "#") {
+			continue
+		}
+		pins := certs
+		if v, ok := strings.CutPrefix(pin, "spki:"); ok {
+			pin, pins = v, spkis
+		}
+		pin = strings.TrimPrefix(pin, "cert:")
+		h, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(h) != sha256.Size {
+			return nil, nil, fmt.Errorf("%w on line %d", errInvalidPin, line)
+		}
+		pins[[sha256.Size]byte(h)] = struct{}{}
+	}
+	return certs, spkis, s.Err()
+}
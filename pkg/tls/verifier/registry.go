@@ -0,0 +1,40 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Factory creates a verifier configured from the environment of a listener.
+type Factory func(opts env.Options) (Verifier, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a custom verifier available under the given name, which can
+// then be listed in CERT_VERIFICATION_METHODS alongside the built-in methods.
+// Names are case insensitive. Register panics if the name is registered twice.
+func Register(name string, f Factory) {
+	name = strings.ToLower(name)
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("verifier: Register called twice for " + name)
+	}
+	factories[name] = f
+}
+
+// Lookup returns the factory of the verifier registered under the given name.
+func Lookup(name string) (Factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	f, ok := factories[strings.ToLower(name)]
+	return f, ok
+}
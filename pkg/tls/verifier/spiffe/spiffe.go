@@ -0,0 +1,107 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package spiffe
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/absmach/mproxy/pkg/tls/verifier"
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	errNoTrustDomain   = errors.New("SPIFFE_TRUST_DOMAIN is required for SPIFFE verification")
+	errInvalidPattern  = errors.New("invalid SPIFFE ID pattern")
+	errClientCrt       = errors.New("client certificate not received")
+	errParseCert       = errors.New("failed to parse Certificate")
+	errNotSVID         = errors.New("client certificate is not an X.509 SVID")
+	errSVIDIsCA        = errors.New("X.509 SVID must not be a CA certificate")
+	errTrustDomain     = errors.New("SPIFFE ID does not belong to the trust domain")
+	errSPIFFEIDAllowed = errors.New("SPIFFE ID is not allowed")
+)
+
+// Config represents SPIFFE X.509 SVID verifier configuration.
+type Config struct {
+	TrustDomain string `env:"SPIFFE_TRUST_DOMAIN" envDefault:""`
+	// AllowedIDs are SPIFFE IDs, or path.Match patterns such as
+	// spiffe://example.org/ns/*/sa/mqtt, accepted in addition to the trust
+	// domain check. If empty, any SPIFFE ID of the trust domain is accepted.
+	AllowedIDs []string `env:"SPIFFE_ALLOWED_IDS" envDefault:""`
+}
+
+var _ verifier.Verifier = (*Config)(nil)
+
+func New(opts env.Options) (*Config, error) {
+	var c Config
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return nil, err
+	}
+	if c.TrustDomain == "" {
+		return nil, errNoTrustDomain
+	}
+	for _, pattern := range c.AllowedIDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%w %q: %w", errInvalidPattern, pattern, err)
+		}
+	}
+	return &c, nil
+}
+
+func (c *Config) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	switch {
+	case len(verifiedChains) > 0 && len(verifiedChains[0]) > 0:
+		return c.VerifySVID(verifiedChains[0][0])
+	case len(rawCerts) > 0:
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.Join(errParseCert, err)
+		}
+		return c.VerifySVID(cert)
+	default:
+		return errClientCrt
+	}
+}
+
+// VerifySVID checks that the leaf certificate is an X.509 SVID of the trust
+// domain whose SPIFFE ID is allowed.
+func (c *Config) VerifySVID(cert *x509.Certificate) error {
+	id, err := ID(cert)
+	if err != nil {
+		return err
+	}
+	if cert.IsCA {
+		return errSVIDIsCA
+	}
+	if !strings.EqualFold(id.Host, c.TrustDomain) {
+		return fmt.Errorf("%w %s: %s", errTrustDomain, c.TrustDomain, id)
+	}
+	if len(c.AllowedIDs) == 0 {
+		return nil
+	}
+	for _, pattern := range c.AllowedIDs {
+		if ok, _ := path.Match(pattern, id.String()); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errSPIFFEIDAllowed, id)
+}
+
+// ID returns the SPIFFE ID of an X.509 SVID, which must hold exactly one URI
+// SAN with the spiffe scheme, a trust domain and no query, fragment, user
+// info or port.
+func ID(cert *x509.Certificate) (*url.URL, error) {
+	if len(cert.URIs) != 1 {
+		return nil, errNotSVID
+	}
+	id := cert.URIs[0]
+	if id.Scheme != "spiffe" || id.Host == "" || id.Port() != "" || id.User != nil || id.RawQuery != "" || id.Fragment != "" {
+		return nil, errNotSVID
+	}
+	return id, nil
+}
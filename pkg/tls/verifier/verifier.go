@@ -3,7 +3,13 @@
 
 package verifier
 
-import "crypto/x509"
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// ErrCertRevoked is wrapped by the errors of verifiers which found the certificate revoked.
+var ErrCertRevoked = errors.New("certificate revoked")
 
 type Verifier interface {
 	// VerifyPeerCertificate is used to verify certificates in TLS config.
@@ -12,13 +18,74 @@ type Verifier interface {
 
 type Validator func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 
+// VerifyPeerCertificate calls the validator, so that validators can be combined like verifiers.
+func (v Validator) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return v(rawCerts, verifiedChains)
+}
+
+// Policy defines how the results of several verifiers are combined.
+type Policy int
+
+const (
+	// RequireAll accepts a certificate only if every verifier accepts it.
+	RequireAll Policy = iota
+	// RequireAny accepts a certificate if at least one verifier accepts it
+	// and none of them reports it as revoked.
+	RequireAny
+	// Fallback consults the verifiers in order and the first one which
+	// accepts the certificate or reports it as revoked decides. The next
+	// verifier is only consulted when the previous one fails otherwise, such
+	// as when its responder or distribution point is unavailable.
+	Fallback
+)
+
 func NewValidator(verifiers []Verifier) Validator {
-	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-		for _, vm := range verifiers {
-			if err := vm.VerifyPeerCertificate(rawCerts, verifiedChains); err != nil {
-				return err
+	return NewPolicyValidator(verifiers, RequireAll)
+}
+
+// NewPolicyValidator returns a validator combining the verifiers according to the policy.
+func NewPolicyValidator(verifiers []Verifier, policy Policy) Validator {
+	switch policy {
+	case RequireAny:
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			var errs []error
+			accepted := false
+			for _, vm := range verifiers {
+				err := vm.VerifyPeerCertificate(rawCerts, verifiedChains)
+				switch {
+				case err == nil:
+					accepted = true
+				case errors.Is(err, ErrCertRevoked):
+					return err
+				default:
+					errs = append(errs, err)
+				}
+			}
+			if accepted {
+				return nil
+			}
+			return errors.Join(errs...)
+		}
+	case Fallback:
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			var errs []error
+			for _, vm := range verifiers {
+				err := vm.VerifyPeerCertificate(rawCerts, verifiedChains)
+				if err == nil || errors.Is(err, ErrCertRevoked) {
+					return err
+				}
+				errs = append(errs, err)
+			}
+			return errors.Join(errs...)
+		}
+	default:
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, vm := range verifiers {
+				if err := vm.VerifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+					return err
+				}
 			}
+			return nil
 		}
-		return nil
 	}
 }
@@ -0,0 +1,227 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstream dials the brokers proxied by the MQTT proxies.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Strategies selecting the order in which the targets are dialed.
+const (
+	// Failover dials the target first and the fallbacks in order.
+	Failover = "failover"
+	// RoundRobin starts each dial at the target following the previous one.
+	RoundRobin = "round-robin"
+	// LeastConnections starts with the target with the fewest connections.
+	LeastConnections = "least-connections"
+	// Random starts at a random target.
+	Random = "random"
+	// ConsistentHash starts at the target selected by the key of the context,
+	// so the same key always lands on the same target while it is reachable.
+	// Dials without key start at a random target.
+	ConsistentHash = "consistent-hash"
+)
+
+var (
+	errNoTarget = errors.New("no target is reachable")
+	errStrategy = errors.New("unknown target strategy")
+)
+
+// Config holds the options used to dial the target and its fallbacks.
+type Config struct {
+	Fallbacks  []string      `env:"TARGET_FALLBACKS"   envDefault:""`
+	Strategy   string        `env:"TARGET_STRATEGY"    envDefault:"failover"`
+	Backoff    time.Duration `env:"TARGET_BACKOFF"     envDefault:"1s"`
+	MaxBackoff time.Duration `env:"TARGET_MAX_BACKOFF" envDefault:"30s"`
+	Retries    int           `env:"TARGET_RETRIES"     envDefault:"3"`
+	Reconnect  bool          `env:"TARGET_RECONNECT"   envDefault:"false"`
+}
+
+// NewConfig parses the upstream options from the environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	switch c.Strategy {
+	case Failover, RoundRobin, LeastConnections, Random, ConsistentHash:
+	default:
+		return Config{}, errStrategy
+	}
+	return c, nil
+}
+
+type keyContextKey struct{}
+
+// WithKey returns a context carrying the key selecting the target with the
+// ConsistentHash strategy, such as the client identifier.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, key)
+}
+
+// SplitScheme returns the address of an MQTT target given as host:port or as
+// a URL such as mqtts://host:port, and whether its scheme requires TLS: mqtts,
+// ssl and tls do, while mqtt and tcp don't.
+func SplitScheme(target string) (string, bool) {
+	scheme, address, ok := strings.Cut(target, "://")
+	if !ok {
+		return target, false
+	}
+	switch strings.ToLower(scheme) {
+	case "mqtts", "ssl", "tls":
+		return address, true
+	}
+	return address, false
+}
+
+// DialFunc connects to a target address.
+type DialFunc func(ctx context.Context, target string) (net.Conn, error)
+
+// Dialer dials the target and its fallbacks, in the order selected by the
+// strategy, failing over to the next one when a target is unreachable.
+type Dialer struct {
+	targets []string
+	cfg     Config
+
+	mu sync.Mutex
+	// next is the target starting the next round robin dial.
+	next int
+	// conns holds the number of open connections by target.
+	conns []int
+}
+
+// NewDialer returns a dialer of the target and the fallbacks of cfg.
+func NewDialer(target string, cfg Config) *Dialer {
+	return &Dialer{
+		targets: append([]string{target}, cfg.Fallbacks...),
+		cfg:     cfg,
+		conns:   make([]int, len(cfg.Fallbacks)+1),
+	}
+}
+
+// Dial connects to the first reachable target using dial. When no target is
+// reachable, the targets are dialed again after the backoff, which doubles
+// after each round up to the maximum backoff, for up to Retries rounds.
+func (d *Dialer) Dial(ctx context.Context, dial DialFunc) (net.Conn, error) {
+	backoff := d.cfg.Backoff
+	for round := 0; ; round++ {
+		var errs []error
+		for _, i := range d.order(ctx) {
+			conn, err := dial(ctx, d.targets[i])
+			if err == nil {
+				return d.track(i, conn), nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", d.targets[i], err))
+		}
+		if round >= d.cfg.Retries {
+			return nil, errors.Join(append([]error{errNoTarget}, errs...)...)
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > d.cfg.MaxBackoff {
+			backoff = d.cfg.MaxBackoff
+		}
+	}
+}
+
+// order returns the indexes of the targets in the order they are dialed.
+func (d *Dialer) order(ctx context.Context) []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.targets)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	switch d.cfg.Strategy {
+	case RoundRobin:
+		rotate(order, d.next)
+		d.next = (d.next + 1) % n
+	case Random:
+		rotate(order, rand.Intn(n))
+	case ConsistentHash:
+		key, _ := ctx.Value(keyContextKey{}).(string)
+		if key == "" {
+			rotate(order, rand.Intn(n))
+			break
+		}
+		// Rendezvous hashing: the targets are ordered by the hash of the key
+		// and the target, so the key only moves when its target is removed.
+		k := hash(key)
+		scores := make([]uint64, n)
+		for i, target := range d.targets {
+			scores[i] = mix(k ^ hash(target))
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return scores[order[i]] > scores[order[j]]
+		})
+	case LeastConnections:
+		sort.SliceStable(order, func(i, j int) bool {
+			return d.conns[order[i]] < d.conns[order[j]]
+		})
+	}
+	return order
+}
+
+// track counts the connection to the target until it is closed.
+func (d *Dialer) track(i int, conn net.Conn) net.Conn {
+	d.mu.Lock()
+	d.conns[i]++
+	d.mu.Unlock()
+	return &trackedConn{Conn: conn, release: func() {
+		d.mu.Lock()
+		d.conns[i]--
+		d.mu.Unlock()
+	}}
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix is the finalizer of MurmurHash3, which spreads the bits of the
+// combined hashes, since FNV hashes of similar strings are close.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// rotate moves the first k elements to the end.
+func rotate(s []int, k int) {
+	copy(s, append(s[k:], s[:k]...))
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
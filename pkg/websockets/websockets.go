@@ -51,7 +51,7 @@ func (p *Proxy) Handler(w http.ResponseWriter, r *http.Request) {
 	defer targetConn.Close()
 
 	topic := r.URL.Path
-	s := session.Session{Password: []byte(token)}
+	s := session.Session{Password: []byte(token), Header: r.Header.Clone(), Cookies: r.Cookies(), Query: r.URL.Query()}
 	ctx := session.NewContext(context.Background(), &s)
 	if err := p.event.AuthConnect(ctx); err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)